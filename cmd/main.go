@@ -24,12 +24,17 @@ import (
 	"os"
 	"time"
 
+	v1 "k8s.io/api/core/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 	"github.com/kubernetes-csi/csi-lib-utils/leaderelection"
@@ -39,6 +44,7 @@ import (
 	ddpscheme "github.com/mayadata-io/storage-provisioner/client/generated/clientset/versioned/scheme"
 	ddpinformers "github.com/mayadata-io/storage-provisioner/client/generated/informer/externalversions"
 	"github.com/mayadata-io/storage-provisioner/storage"
+	"github.com/mayadata-io/storage-provisioner/webhook"
 )
 
 const (
@@ -89,6 +95,22 @@ var (
 		`Namespace where the leader election resource lives. 
 		Defaults to this pod namespace if not set.`,
 	)
+
+	webhookAddress = flag.String(
+		"webhook-address", "",
+		`Address to serve the validating & defaulting webhooks of storage e.g. :9443.
+		Webhook is not served if not set.`,
+	)
+
+	webhookTLSCertFile = flag.String(
+		"webhook-tls-cert-file", "",
+		"File containing the TLS certificate of the webhook server.",
+	)
+
+	webhookTLSKeyFile = flag.String(
+		"webhook-tls-key-file", "",
+		"File containing the TLS private key of the webhook server.",
+	)
 )
 
 type leaderElection interface {
@@ -120,6 +142,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *webhookAddress != "" && (*webhookTLSCertFile == "" || *webhookTLSKeyFile == "") {
+		klog.Error("options -webhook-tls-cert-file & -webhook-tls-key-file are required with -webhook-address")
+		os.Exit(1)
+	}
+
 	utilruntime.Must(ddpscheme.AddToScheme(scheme.Scheme))
 
 	clientset, err := kubernetes.NewForConfig(config)
@@ -134,39 +161,100 @@ func main() {
 		os.Exit(1)
 	}
 
-	factory := informers.NewSharedInformerFactory(clientset, *resync)
-	ddpFactory := ddpinformers.NewSharedInformerFactory(ddpClientset, *resync)
+	// volume snapshots are accessed via dynamic client
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		klog.Error(err.Error())
+		os.Exit(1)
+	}
 
-	storageQ := workqueue.NewNamedRateLimitingQueue(
-		workqueue.NewItemExponentialFailureRateLimiter(*retryIntervalStart, *retryIntervalMax),
-		"ddp-storage-q",
+	// events are recorded against storage & its owned resources
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(klog.Infof)
+	eventBroadcaster.StartRecordingToSink(
+		&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")},
 	)
-	pvcQ := workqueue.NewNamedRateLimitingQueue(
-		workqueue.NewItemExponentialFailureRateLimiter(*retryIntervalStart, *retryIntervalMax),
-		"ddp-pvc-q",
+	recorder := eventBroadcaster.NewRecorder(
+		scheme.Scheme, v1.EventSource{Component: controllerName},
 	)
 
+	factory := informers.NewSharedInformerFactory(clientset, *resync)
+	ddpFactory := ddpinformers.NewSharedInformerFactory(ddpClientset, *resync)
+
+	newRateLimiter := func() workqueue.RateLimiter {
+		return workqueue.NewItemExponentialFailureRateLimiter(
+			*retryIntervalStart, *retryIntervalMax,
+		)
+	}
+	storageQ := workqueue.NewNamedRateLimitingQueue(newRateLimiter(), "ddp-storage-q")
+	pvcQ := workqueue.NewNamedRateLimitingQueue(newRateLimiter(), "ddp-pvc-q")
+	storageSetQ := workqueue.NewNamedRateLimitingQueue(newRateLimiter(), "ddp-storageset-q")
+
 	// new instance of storage reconciler
-	storageReconciler := &storage.Reconciler{
-		Clientset: clientset,
-		PVCLister: factory.Core().V1().PersistentVolumeClaims().Lister(),
+	storageReconciler := &storage.StorageReconciler{
+		Clientset:    clientset,
+		DDPClientset: ddpClientset,
+		PVCLister:    factory.Core().V1().PersistentVolumeClaims().Lister(),
+		PVLister:     factory.Core().V1().PersistentVolumes().Lister(),
+		NodeLister:   factory.Core().V1().Nodes().Lister(),
+		VALister:     factory.Storage().V1beta1().VolumeAttachments().Lister(),
+
+		StorageClassLister: factory.Storage().V1().StorageClasses().Lister(),
+		CSIDriverLister:    factory.Storage().V1beta1().CSIDrivers().Lister(),
+		CSINodeLister:      factory.Storage().V1beta1().CSINodes().Lister(),
+
+		DynamicClient: dynamicClient,
+		StorageLister: ddpFactory.Dao().V1alpha1().Storages().Lister(),
+
+		Recorder: recorder,
 	}
 
 	// new instance of storage reconciler
 	pvcReconciler := &storage.PVCReconciler{
-		Clientset: clientset,
-		VALister:  factory.Storage().V1beta1().VolumeAttachments().Lister(),
+		Clientset:     clientset,
+		VALister:      factory.Storage().V1beta1().VolumeAttachments().Lister(),
+		StorageLister: ddpFactory.Dao().V1alpha1().Storages().Lister(),
+
+		CSIDriverLister: factory.Storage().V1beta1().CSIDrivers().Lister(),
+		PVLister:        factory.Core().V1().PersistentVolumes().Lister(),
+		NodeLister:      factory.Core().V1().Nodes().Lister(),
+		CSINodeLister:   factory.Storage().V1beta1().CSINodes().Lister(),
+
+		Recorder: recorder,
 	}
 
+	// new instance of storage set reconciler
+	storageSetReconciler := &storage.StorageSetReconciler{
+		DDPClientset:  ddpClientset,
+		StorageLister: ddpFactory.Dao().V1alpha1().Storages().Lister(),
+
+		Recorder: recorder,
+	}
+
+	// reconcilers are invoked in the order of their registration
+	registry := storage.NewRegistry()
+	registry.MustRegister(
+		storage.StorageGVK, "storage",
+		storage.StorageReconcilerFunc(storageReconciler.Reconcile),
+	)
+	registry.MustRegister(
+		storage.PVCGVK, "pvc",
+		storage.PVCReconcilerFunc(pvcReconciler.Reconcile),
+	)
+	registry.MustRegister(
+		storage.StorageSetGVK, "storageset",
+		storage.StorageSetReconcilerFunc(storageSetReconciler.Reconcile),
+	)
+
 	// new instance of storage controller
 	ctrl := &storage.Controller{
-		Name:                controllerName,
-		InformerFactory:     factory,
-		DDPInformerFactory:  ddpFactory,
-		StorageQueue:        storageQ,
-		PVCQueue:            pvcQ,
-		StorageReconcilerFn: storageReconciler.Reconcile,
-		PVCReconcilerFn:     pvcReconciler.Reconcile,
+		Name:               controllerName,
+		InformerFactory:    factory,
+		DDPInformerFactory: ddpFactory,
+		Registry:           registry,
+		StorageQueue:       storageQ,
+		PVCQueue:           pvcQ,
+		StorageSetQueue:    storageSetQ,
 	}
 
 	// initialize the controller before running
@@ -176,6 +264,33 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *webhookAddress != "" {
+		server := &webhook.Server{
+			Addr:     *webhookAddress,
+			CertFile: *webhookTLSCertFile,
+			KeyFile:  *webhookTLSKeyFile,
+			Validator: &webhook.StorageValidator{
+				StorageClassLister: factory.Storage().V1().StorageClasses().Lister(),
+				NodeLister:         factory.Core().V1().Nodes().Lister(),
+			},
+			Defaulter: &webhook.StorageDefaulter{
+				StorageClassLister: factory.Storage().V1().StorageClasses().Lister(),
+			},
+			Converter: &webhook.StorageConverter{},
+		}
+
+		// webhook is served by every replica irrespective of leader
+		// election; informers are started only once by the factory
+		go func() {
+			factory.Start(wait.NeverStop)
+			factory.WaitForCacheSync(wait.NeverStop)
+
+			if err := server.Run(wait.NeverStop); err != nil {
+				klog.Fatalf("Webhook failed: %v", err)
+			}
+		}()
+	}
+
 	// define the controller run func, It is a wrapper over original
 	// controller run function with context management
 	ctrlRun := func(ctx context.Context) {
@@ -185,6 +300,10 @@ func main() {
 		factory.Start(stopCh)
 		ddpFactory.Start(stopCh)
 
+		// listers used by reconcilers need to be synced before use
+		factory.WaitForCacheSync(stopCh)
+		ddpFactory.WaitForCacheSync(stopCh)
+
 		// run the storage controller
 		ctrl.Run(int(*workerThreads), stopCh)
 	}
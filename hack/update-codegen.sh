@@ -29,5 +29,5 @@ CODEGEN_PKG=${CODEGEN_PKG:-$(cd "${SCRIPT_ROOT}"; ls -d -1 ./vendor/k8s.io/code-
 bash "${CODEGEN_PKG}"/generate-groups.sh "deepcopy,client,informer,lister" \
   github.com/mayadata-io/storage-provisioner/client/generated \
   github.com/mayadata-io/storage-provisioner/pkg/apis \
-  ddp:v1alpha1 \
+  dao:v1alpha1,v1beta1 \
   --go-header-file "${SCRIPT_ROOT}"/hack/custom-boilerplate.go.txt
\ No newline at end of file
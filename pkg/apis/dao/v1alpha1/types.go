@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -40,6 +41,130 @@ type StorageSpec struct {
 	//
 	// This is optional
 	NodeName *string `json:"nodeName,omitempty"`
+
+	// Labels of the node that should attach the storage. Controller
+	// selects a ready & schedulable node matching these labels as
+	// well as the topology constraints of the storageclass or volume.
+	// This can not be set along with NodeName or NodeNames.
+	//
+	// This is optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Affinity of the node that should attach the storage. This is
+	// used along with NodeSelector to select the node.
+	//
+	// This is optional
+	NodeAffinity *v1.NodeSelector `json:"nodeAffinity,omitempty"`
+
+	// Names of the nodes that should attach the storage. More than
+	// one node can be set only if access modes allow the storage to
+	// be shared. This can not be set along with NodeName.
+	//
+	// This is optional
+	NodeNames []string `json:"nodeNames,omitempty"`
+
+	// Access modes of the storage. ReadWriteOnce is used if not set.
+	//
+	// NOTE:
+	//	Changes to access modes are not reflected once the storage
+	// is provisioned.
+	//
+	// This is optional
+	AccessModes []v1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
+
+	// Name of the storageclass that provisions the storage
+	//
+	// This is optional. Annotation
+	// storageprovisioner.dao.mayadata.io/storageclass-name is used
+	// if this is not set.
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// Name of the CSI attacher that attaches the storage to the node
+	//
+	// This is optional. Annotation
+	// storageprovisioner.dao.mayadata.io/csi-attacher-name is used
+	// if this is not set. Attacher is derived from the CSI driver of
+	// the volume or from the storageclass provisioner if neither is
+	// set.
+	Attacher *string `json:"attacher,omitempty"`
+
+	// Template used to create the PVC of this storage. Fields owned
+	// by the controller e.g. capacity, storageclass & access modes
+	// are set from the storage spec & are not part of this template.
+	//
+	// This is optional
+	PVCTemplate *PVCTemplate `json:"pvcTemplate,omitempty"`
+
+	// Source of the data to populate the storage with. This is
+	// used only when the PVC gets created & can not be set along
+	// with the data source of the PVC template.
+	//
+	// This is optional
+	Source *StorageSource `json:"source,omitempty"`
+}
+
+// StorageSource is the data source of a storage. Exactly one of its
+// members must be set.
+type StorageSource struct {
+	// VolumeSnapshot in the namespace of this storage to restore
+	// the data from. Snapshot must be ready to use.
+	//
+	// +optional
+	VolumeSnapshot *v1.LocalObjectReference `json:"volumeSnapshot,omitempty"`
+
+	// Storage in the namespace of this storage to clone the data
+	// from. Source storage must be provisioned by the same
+	// storageclass.
+	//
+	// +optional
+	Storage *v1.LocalObjectReference `json:"storage,omitempty"`
+}
+
+// PVCTemplate describes the PVC that gets created for a storage
+type PVCTemplate struct {
+	// Labels & annotations of the PVC. These are synced to the PVC
+	// when changed.
+	//
+	// +optional
+	Metadata PVCTemplateMeta `json:"metadata,omitempty"`
+
+	// Spec of the PVC. These are set only when the PVC gets created.
+	//
+	// +optional
+	Spec PVCTemplateSpec `json:"spec,omitempty"`
+}
+
+// PVCTemplateMeta is the metadata of the PVC that can be set by
+// the user
+type PVCTemplateMeta struct {
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations with storageprovisioner.dao.mayadata.io domain are
+	// not allowed since these are owned by the controller.
+	//
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// PVCTemplateSpec is the subset of PersistentVolumeClaimSpec that
+// can be set by the user
+type PVCTemplateSpec struct {
+	// A label query over volumes to consider for binding.
+	//
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// Defines what type of volume is required by the claim e.g.
+	// Block or Filesystem
+	//
+	// +optional
+	VolumeMode *v1.PersistentVolumeMode `json:"volumeMode,omitempty"`
+
+	// Data source to populate the volume from e.g. a snapshot
+	//
+	// +optional
+	DataSource *v1.TypedLocalObjectReference `json:"dataSource,omitempty"`
 }
 
 // StoragePhase is a label for the condition of a storage at
@@ -55,11 +180,80 @@ const (
 	// StorageAttached means the storage has been attached to a node.
 	StorageAttached StoragePhase = "Attached"
 
+	// StorageDetached means the storage is not attached to any node
+	// since no node is selected. Data of the storage is retained.
+	StorageDetached StoragePhase = "Detached"
+
 	// StorageFailed indicates some failures with the controller, or
 	// resources that are required to have this storage attached.
 	StorageFailed StoragePhase = "Failed"
+
+	// StorageTerminating means the storage is being deleted & its
+	// resources are getting torn down in order.
+	StorageTerminating StoragePhase = "Terminating"
+)
+
+// MigrationStep is a step of moving the storage from one node
+// to another
+type MigrationStep string
+
+// These are the valid steps of a migration.
+const (
+	// MigrationNodeUpdated means the target node has been propagated
+	// to the resources of the storage.
+	MigrationNodeUpdated MigrationStep = "NodeUpdated"
+
+	// MigrationDetaching means the storage is being detached from
+	// the source node.
+	MigrationDetaching MigrationStep = "Detaching"
+
+	// MigrationAttaching means the storage has been detached from the
+	// source node & is being attached to the target node.
+	MigrationAttaching MigrationStep = "Attaching"
 )
 
+// StorageMigration represents the move of a storage from one node
+// to another
+type StorageMigration struct {
+	// Name of the node the storage is being detached from
+	SourceNode string `json:"sourceNode,omitempty" protobuf:"bytes,1,opt,name=sourceNode"`
+
+	// Name of the node the storage is being attached to
+	TargetNode string `json:"targetNode,omitempty" protobuf:"bytes,2,opt,name=targetNode"`
+
+	// Current step of the migration
+	Step MigrationStep `json:"step" protobuf:"bytes,3,opt,name=step,casttype=MigrationStep"`
+
+	// RFC 3339 date and time at which the migration started.
+	StartTime *metav1.Time `json:"startTime,omitempty" protobuf:"bytes,4,opt,name=startTime"`
+}
+
+// StorageAttachment represents the attach state of the storage
+// against a node
+type StorageAttachment struct {
+	// Name of the node
+	NodeName string `json:"nodeName" protobuf:"bytes,1,opt,name=nodeName"`
+
+	// Name of the VolumeAttachment that attaches the storage to
+	// this node
+	//
+	// +optional
+	VolumeAttachmentName string `json:"volumeAttachmentName,omitempty" protobuf:"bytes,2,opt,name=volumeAttachmentName"`
+
+	// Attached is true if the storage is attached to this node
+	Attached bool `json:"attached" protobuf:"varint,3,opt,name=attached"`
+
+	// Unique, one-word, CamelCase reason for the attach state.
+	//
+	// +optional
+	Reason string `json:"reason,omitempty" protobuf:"bytes,4,opt,name=reason"`
+
+	// Human-readable message indicating details about the attach state.
+	//
+	// +optional
+	Message string `json:"message,omitempty" protobuf:"bytes,5,opt,name=message"`
+}
+
 // StorageConditionType is a valid value for StorageCondition.Type
 type StorageConditionType string
 
@@ -73,6 +267,10 @@ const (
 	// is bound against its associated PV
 	PVCBound StorageConditionType = "PVCBound"
 
+	// AttacherResolved represents the status if the CSI attacher of
+	// this storage is resolved & matches the driver of its volume
+	AttacherResolved StorageConditionType = "AttacherResolved"
+
 	// NodeSelected represents status if any node was selected to attach
 	// this storage
 	NodeSelected StorageConditionType = "NodeSelected"
@@ -80,9 +278,26 @@ const (
 	// NodeAvailable represents the status if the selected node is available
 	NodeAvailable StorageConditionType = "NodeAvailable"
 
+	// VolumeAttached represents the attach state of the storage as
+	// reported by the attacher
+	VolumeAttached StorageConditionType = "VolumeAttached"
+
 	// VolumeResize represents the status when this storage is undergoing
-	// a resize operation
+	// a resize operation. It is false with a reason if the resize can
+	// not proceed e.g. when the storage is shrunk.
 	VolumeResize StorageConditionType = "VolumeResize"
+
+	// VolumeRestored represents the status of populating the storage
+	// from its source i.e. a volume snapshot or another storage
+	VolumeRestored StorageConditionType = "VolumeRestored"
+
+	// DeletionHeld represents the status if deletion of any resource
+	// owned by this storage is held by the storage controller
+	DeletionHeld StorageConditionType = "DeletionHeld"
+
+	// Ready is an aggregate of all other conditions. It is true only
+	// when the storage is attached & can be consumed.
+	Ready StorageConditionType = "Ready"
 )
 
 // ConditionStatus is a typed value to represent various condition statuses
@@ -158,6 +373,33 @@ type StorageStatus struct {
 
 	// RFC 3339 date and time at which the object was acknowledged by its controller.
 	StartTime *metav1.Time `json:"startTime,omitempty" protobuf:"bytes,7,opt,name=startTime"`
+
+	// Actual capacity of the storage as reported by its PVC. This
+	// differs from the capacity in spec while the storage is being
+	// resized.
+	//
+	// +optional
+	Capacity *resource.Quantity `json:"capacity,omitempty" protobuf:"bytes,11,opt,name=capacity"`
+
+	// Name of the node selected by the controller based on the node
+	// selector & node affinity of the storage. Storage sticks to this
+	// node as long as it exists & matches.
+	//
+	// +optional
+	SelectedNode string `json:"selectedNode,omitempty" protobuf:"bytes,10,opt,name=selectedNode"`
+
+	// Migration is set while the storage is being moved from one node
+	// to another. Source node is retained here once the storage gets
+	// detached from it.
+	//
+	// +optional
+	Migration *StorageMigration `json:"migration,omitempty" protobuf:"bytes,8,opt,name=migration"`
+
+	// Attach state of the storage per node. This includes the nodes
+	// that the storage is being detached from.
+	//
+	// +optional
+	Attachments []StorageAttachment `json:"attachments,omitempty" protobuf:"bytes,9,rep,name=attachments"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -167,3 +409,139 @@ type StorageList struct {
 	metav1.ListMeta `json:"metadata"`
 	Items           []Storage `json:"items"`
 }
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type StorageSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+
+	Spec   StorageSetSpec   `json:"spec"`
+	Status StorageSetStatus `json:"status,omitempty"`
+}
+
+// StorageSetSpec is the desired state of a storage set. Storages of
+// a set are named with the name prefix followed by their ordinal i.e.
+// <namePrefix>-0, <namePrefix>-1, & so on.
+type StorageSetSpec struct {
+	// Number of storages of this set. Storages with the highest
+	// ordinals are removed on scale down.
+	//
+	// This is optional. 1 is used if not set.
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Prefix of the names of the storages
+	//
+	// This is optional. Name of the set is used if not set.
+	NamePrefix string `json:"namePrefix,omitempty"`
+
+	// Template used to create the storages of this set
+	//
+	// NOTE:
+	//	Changes to the template are not reflected in the storages
+	// that are already created.
+	Template StorageTemplate `json:"template"`
+
+	// What happens to the storages removed on scale down
+	//
+	// This is optional. Delete is used if not set.
+	RetentionPolicy StorageSetRetentionPolicy `json:"retentionPolicy,omitempty"`
+}
+
+// StorageTemplate describes the storage that gets created for each
+// ordinal of a storage set
+type StorageTemplate struct {
+	// Labels & annotations of the storage
+	//
+	// +optional
+	Metadata StorageTemplateMeta `json:"metadata,omitempty"`
+
+	// Spec of the storage
+	Spec StorageSpec `json:"spec"`
+}
+
+// StorageTemplateMeta is the metadata of the storage that can be set
+// by the user
+type StorageTemplateMeta struct {
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// StorageSetRetentionPolicy tells what happens to a storage that is
+// removed from its set
+type StorageSetRetentionPolicy string
+
+// These are the valid retention policies of storage set.
+const (
+	// StorageSetRetentionDelete means the storages removed on scale
+	// down are deleted along with their volumes.
+	StorageSetRetentionDelete StorageSetRetentionPolicy = "Delete"
+
+	// StorageSetRetentionRetain means the storages removed on scale
+	// down are released by the set but are not deleted. A retained
+	// storage is adopted back when the set is scaled up to include
+	// its ordinal.
+	StorageSetRetentionRetain StorageSetRetentionPolicy = "Retain"
+)
+
+// StorageSetStatus represents information about the status of the
+// storage set. Only the storages having an ordinal less than the
+// desired replicas are counted.
+type StorageSetStatus struct {
+	// The generation observed by the storage set controller
+	//
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty" protobuf:"varint,1,opt,name=observedGeneration"`
+
+	// Number of storages created by this set
+	Replicas int32 `json:"replicas" protobuf:"varint,2,opt,name=replicas"`
+
+	// Number of storages that are pending
+	//
+	// +optional
+	PendingReplicas int32 `json:"pendingReplicas,omitempty" protobuf:"varint,3,opt,name=pendingReplicas"`
+
+	// Number of storages that are attached
+	//
+	// +optional
+	AttachedReplicas int32 `json:"attachedReplicas,omitempty" protobuf:"varint,4,opt,name=attachedReplicas"`
+
+	// Number of storages that have failed
+	//
+	// +optional
+	FailedReplicas int32 `json:"failedReplicas,omitempty" protobuf:"varint,5,opt,name=failedReplicas"`
+
+	// Number of storages that are detached
+	//
+	// +optional
+	DetachedReplicas int32 `json:"detachedReplicas,omitempty" protobuf:"varint,8,opt,name=detachedReplicas"`
+
+	// Number of storages that are being deleted
+	//
+	// +optional
+	TerminatingReplicas int32 `json:"terminatingReplicas,omitempty" protobuf:"varint,9,opt,name=terminatingReplicas"`
+
+	// A brief CamelCase message indicating details about why the
+	// storage set can not have all its storages e.g. NameConflict
+	//
+	// +optional
+	Reason string `json:"reason,omitempty" protobuf:"bytes,6,opt,name=reason"`
+
+	// A human readable message indicating details about the above
+	// reason
+	//
+	// +optional
+	Message string `json:"message,omitempty" protobuf:"bytes,7,opt,name=message"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type StorageSetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []StorageSet `json:"items"`
+}
@@ -0,0 +1,356 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+const (
+	// storageclassProviderKey & storageCSIAttacherKey are the
+	// v1alpha1 annotations that were used before the storageclass &
+	// attacher became part of its spec. These are converted to the
+	// respective v1beta1 spec fields.
+	storageclassProviderKey string = "storageprovisioner.dao.mayadata.io/storageclass-name"
+	storageCSIAttacherKey   string = "storageprovisioner.dao.mayadata.io/csi-attacher-name"
+
+	// v1alpha1SpecKey holds the v1alpha1 spec fields of a storage
+	// that can not be represented in v1beta1. It is set only against
+	// a v1beta1 storage & is removed when the storage is converted
+	// back to v1alpha1.
+	v1alpha1SpecKey string = "storageprovisioner.dao.mayadata.io/v1alpha1-spec"
+)
+
+// fieldOrigin tells how a v1alpha1 string pointer field was set
+// when it is converted to a v1beta1 string field
+type fieldOrigin string
+
+const (
+	// fieldFromAnnotation means the field was not set in spec but
+	// in its legacy annotation
+	fieldFromAnnotation fieldOrigin = "Annotation"
+
+	// fieldSetEmpty means the field was set to an empty string in
+	// spec. This differs from not setting the field at all.
+	fieldSetEmpty fieldOrigin = "Empty"
+)
+
+// v1alpha1Spec records the v1alpha1 spec fields of a storage that
+// are lost when converted to v1beta1. This lets a storage get back
+// the same v1alpha1 spec unless it was changed in v1beta1.
+type v1alpha1Spec struct {
+	StorageClassName fieldOrigin `json:"storageClassName,omitempty"`
+	Attacher         fieldOrigin `json:"attacher,omitempty"`
+
+	// NodeName is set if the v1alpha1 spec has the node name
+	NodeName *string `json:"nodeName,omitempty"`
+
+	// NodeNames is true if the v1alpha1 spec has the node names
+	// along with the node name
+	NodeNames bool `json:"nodeNames,omitempty"`
+}
+
+// ConvertFromV1alpha1 returns the v1beta1 storage of the given
+// v1alpha1 storage. Storageclass & attacher set via the legacy
+// annotations are moved to spec while the node name is moved to the
+// node names of the placement.
+func ConvertFromV1alpha1(in *v1alpha1.Storage) (out *Storage, err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(
+				err, "Convert storage %s/%s to %s failed",
+				in.Namespace, in.Name, SchemeGroupVersion,
+			)
+		}
+	}()
+
+	in = in.DeepCopy()
+	out = &Storage{
+		TypeMeta:   in.TypeMeta,
+		ObjectMeta: in.ObjectMeta,
+		Status:     convertStatusFromV1alpha1(in.Status),
+	}
+	out.APIVersion = SchemeGroupVersion.String()
+
+	var lost v1alpha1Spec
+	out.Spec.StorageClassName, lost.StorageClassName =
+		convertStrFromV1alpha1(in.Spec.StorageClassName, out.Annotations, storageclassProviderKey)
+	out.Spec.Attacher, lost.Attacher =
+		convertStrFromV1alpha1(in.Spec.Attacher, out.Annotations, storageCSIAttacherKey)
+
+	out.Spec.Placement = StoragePlacement{
+		NodeNames:    in.Spec.NodeNames,
+		NodeSelector: in.Spec.NodeSelector,
+		NodeAffinity: in.Spec.NodeAffinity,
+	}
+	if in.Spec.NodeName != nil {
+		lost.NodeName = in.Spec.NodeName
+		lost.NodeNames = len(in.Spec.NodeNames) != 0
+		if !lost.NodeNames && *in.Spec.NodeName != "" {
+			out.Spec.Placement.NodeNames = []string{*in.Spec.NodeName}
+		}
+	}
+
+	out.Spec.Capacity = in.Spec.Capacity
+	out.Spec.AccessModes = in.Spec.AccessModes
+	if in.Spec.PVCTemplate != nil {
+		out.Spec.PVCTemplate = &PVCTemplate{
+			Metadata: PVCTemplateMeta{
+				Labels:      in.Spec.PVCTemplate.Metadata.Labels,
+				Annotations: in.Spec.PVCTemplate.Metadata.Annotations,
+			},
+			Spec: PVCTemplateSpec{
+				Selector:   in.Spec.PVCTemplate.Spec.Selector,
+				VolumeMode: in.Spec.PVCTemplate.Spec.VolumeMode,
+				DataSource: in.Spec.PVCTemplate.Spec.DataSource,
+			},
+		}
+	}
+	if in.Spec.Source != nil {
+		out.Spec.Source = &StorageSource{
+			VolumeSnapshot: in.Spec.Source.VolumeSnapshot,
+			Storage:        in.Spec.Source.Storage,
+		}
+	}
+
+	delete(out.Annotations, v1alpha1SpecKey)
+	if lost != (v1alpha1Spec{}) {
+		raw, err := json.Marshal(lost)
+		if err != nil {
+			return nil, err
+		}
+		if out.Annotations == nil {
+			out.Annotations = map[string]string{}
+		}
+		out.Annotations[v1alpha1SpecKey] = string(raw)
+	}
+	if len(out.Annotations) == 0 {
+		out.Annotations = nil
+	}
+	return out, nil
+}
+
+// ConvertToV1alpha1 returns the v1alpha1 storage of the given v1beta1
+// storage. Fields recorded during the conversion from v1alpha1 are
+// restored as long as they are consistent with the v1beta1 spec.
+func ConvertToV1alpha1(in *Storage) (out *v1alpha1.Storage, err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(
+				err, "Convert storage %s/%s to %s failed",
+				in.Namespace, in.Name, v1alpha1.SchemeGroupVersion,
+			)
+		}
+	}()
+
+	in = in.DeepCopy()
+	out = &v1alpha1.Storage{
+		TypeMeta:   in.TypeMeta,
+		ObjectMeta: in.ObjectMeta,
+		Status:     convertStatusToV1alpha1(in.Status),
+	}
+	out.APIVersion = v1alpha1.SchemeGroupVersion.String()
+
+	var lost v1alpha1Spec
+	if raw, found := out.Annotations[v1alpha1SpecKey]; found {
+		if err := json.Unmarshal([]byte(raw), &lost); err != nil {
+			return nil, errors.Wrapf(err, "Invalid annotation %s", v1alpha1SpecKey)
+		}
+		delete(out.Annotations, v1alpha1SpecKey)
+	}
+
+	out.Spec.StorageClassName = convertStrToV1alpha1(
+		in.Spec.StorageClassName, lost.StorageClassName, out, storageclassProviderKey,
+	)
+	out.Spec.Attacher = convertStrToV1alpha1(
+		in.Spec.Attacher, lost.Attacher, out, storageCSIAttacherKey,
+	)
+
+	out.Spec.NodeNames = in.Spec.Placement.NodeNames
+	out.Spec.NodeSelector = in.Spec.Placement.NodeSelector
+	out.Spec.NodeAffinity = in.Spec.Placement.NodeAffinity
+	if lost.NodeName != nil {
+		if lost.NodeNames {
+			out.Spec.NodeName = lost.NodeName
+		} else if len(out.Spec.NodeNames) == 1 {
+			// node name is preferred over node names having a
+			// single node since v1alpha1 had it this way
+			out.Spec.NodeName = &out.Spec.NodeNames[0]
+			out.Spec.NodeNames = nil
+		} else if len(out.Spec.NodeNames) == 0 && *lost.NodeName == "" {
+			out.Spec.NodeName = lost.NodeName
+		}
+	}
+
+	out.Spec.Capacity = in.Spec.Capacity
+	out.Spec.AccessModes = in.Spec.AccessModes
+	if in.Spec.PVCTemplate != nil {
+		out.Spec.PVCTemplate = &v1alpha1.PVCTemplate{
+			Metadata: v1alpha1.PVCTemplateMeta{
+				Labels:      in.Spec.PVCTemplate.Metadata.Labels,
+				Annotations: in.Spec.PVCTemplate.Metadata.Annotations,
+			},
+			Spec: v1alpha1.PVCTemplateSpec{
+				Selector:   in.Spec.PVCTemplate.Spec.Selector,
+				VolumeMode: in.Spec.PVCTemplate.Spec.VolumeMode,
+				DataSource: in.Spec.PVCTemplate.Spec.DataSource,
+			},
+		}
+	}
+	if in.Spec.Source != nil {
+		out.Spec.Source = &v1alpha1.StorageSource{
+			VolumeSnapshot: in.Spec.Source.VolumeSnapshot,
+			Storage:        in.Spec.Source.Storage,
+		}
+	}
+
+	if len(out.Annotations) == 0 {
+		out.Annotations = nil
+	}
+	return out, nil
+}
+
+// convertStrFromV1alpha1 returns the v1beta1 value of the given
+// v1alpha1 field & how the field was set. Value is taken from the
+// given annotation if the field is not set. This annotation is
+// removed from the given annotations since it is moved to spec.
+func convertStrFromV1alpha1(
+	field *string, annotations map[string]string, key string,
+) (string, fieldOrigin) {
+
+	if field != nil {
+		if *field == "" {
+			return "", fieldSetEmpty
+		}
+		return *field, ""
+	}
+	val, found := annotations[key]
+	if !found {
+		return "", ""
+	}
+	delete(annotations, key)
+	return val, fieldFromAnnotation
+}
+
+// convertStrToV1alpha1 returns the v1alpha1 field of the given
+// v1beta1 value based on how the field was set in v1alpha1. Value is
+// set against the given annotation if it was originally set there.
+func convertStrToV1alpha1(
+	val string, origin fieldOrigin, stor *v1alpha1.Storage, key string,
+) *string {
+
+	if origin == fieldFromAnnotation {
+		// annotation is restored even if its value is empty
+		if stor.Annotations == nil {
+			stor.Annotations = map[string]string{}
+		}
+		if _, found := stor.Annotations[key]; !found {
+			stor.Annotations[key] = val
+			return nil
+		}
+	}
+	if val == "" && origin != fieldSetEmpty {
+		return nil
+	}
+	return &val
+}
+
+// convertStatusFromV1alpha1 returns the v1beta1 status of the given
+// v1alpha1 status. Both the versions have the same status.
+func convertStatusFromV1alpha1(in v1alpha1.StorageStatus) StorageStatus {
+	out := StorageStatus{
+		Phase:        StoragePhase(in.Phase),
+		Message:      in.Message,
+		Reason:       in.Reason,
+		StartTime:    in.StartTime,
+		Capacity:     in.Capacity,
+		SelectedNode: in.SelectedNode,
+	}
+	for _, cond := range in.Conditions {
+		out.Conditions = append(out.Conditions, StorageCondition{
+			Type:               StorageConditionType(cond.Type),
+			Status:             ConditionStatus(cond.Status),
+			LastObservedTime:   cond.LastObservedTime,
+			LastTransitionTime: cond.LastTransitionTime,
+			Reason:             cond.Reason,
+			Message:            cond.Message,
+		})
+	}
+	if in.Migration != nil {
+		out.Migration = &StorageMigration{
+			SourceNode: in.Migration.SourceNode,
+			TargetNode: in.Migration.TargetNode,
+			Step:       MigrationStep(in.Migration.Step),
+			StartTime:  in.Migration.StartTime,
+		}
+	}
+	for _, attachment := range in.Attachments {
+		out.Attachments = append(out.Attachments, StorageAttachment{
+			NodeName:             attachment.NodeName,
+			VolumeAttachmentName: attachment.VolumeAttachmentName,
+			Attached:             attachment.Attached,
+			Reason:               attachment.Reason,
+			Message:              attachment.Message,
+		})
+	}
+	return out
+}
+
+// convertStatusToV1alpha1 returns the v1alpha1 status of the given
+// v1beta1 status
+func convertStatusToV1alpha1(in StorageStatus) v1alpha1.StorageStatus {
+	out := v1alpha1.StorageStatus{
+		Phase:        v1alpha1.StoragePhase(in.Phase),
+		Message:      in.Message,
+		Reason:       in.Reason,
+		StartTime:    in.StartTime,
+		Capacity:     in.Capacity,
+		SelectedNode: in.SelectedNode,
+	}
+	for _, cond := range in.Conditions {
+		out.Conditions = append(out.Conditions, v1alpha1.StorageCondition{
+			Type:               v1alpha1.StorageConditionType(cond.Type),
+			Status:             v1alpha1.ConditionStatus(cond.Status),
+			LastObservedTime:   cond.LastObservedTime,
+			LastTransitionTime: cond.LastTransitionTime,
+			Reason:             cond.Reason,
+			Message:            cond.Message,
+		})
+	}
+	if in.Migration != nil {
+		out.Migration = &v1alpha1.StorageMigration{
+			SourceNode: in.Migration.SourceNode,
+			TargetNode: in.Migration.TargetNode,
+			Step:       v1alpha1.MigrationStep(in.Migration.Step),
+			StartTime:  in.Migration.StartTime,
+		}
+	}
+	for _, attachment := range in.Attachments {
+		out.Attachments = append(out.Attachments, v1alpha1.StorageAttachment{
+			NodeName:             attachment.NodeName,
+			VolumeAttachmentName: attachment.VolumeAttachmentName,
+			Attached:             attachment.Attached,
+			Reason:               attachment.Reason,
+			Message:              attachment.Message,
+		})
+	}
+	return out
+}
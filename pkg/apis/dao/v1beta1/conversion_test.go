@@ -0,0 +1,400 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"testing"
+	"time"
+
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/diff"
+
+	"github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func newV1alpha1Storage(
+	annotations map[string]string, spec v1alpha1.StorageSpec,
+) *v1alpha1.Storage {
+	spec.Capacity = resource.MustParse("4Gi")
+	return &v1alpha1.Storage{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+			Kind:       "Storage",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "stor",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Spec: spec,
+	}
+}
+
+func newV1beta1Storage(annotations map[string]string, spec StorageSpec) *Storage {
+	spec.Capacity = resource.MustParse("4Gi")
+	return &Storage{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: SchemeGroupVersion.String(),
+			Kind:       "Storage",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "stor",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Spec: spec,
+	}
+}
+
+func newV1alpha1Status() v1alpha1.StorageStatus {
+	now := metav1.NewTime(time.Date(2019, 9, 1, 10, 0, 0, 0, time.UTC))
+	capacity := resource.MustParse("4Gi")
+	return v1alpha1.StorageStatus{
+		Phase:        v1alpha1.StorageAttached,
+		Message:      "Attached to node n1",
+		Reason:       "Attached",
+		StartTime:    &now,
+		Capacity:     &capacity,
+		SelectedNode: "n1",
+		Conditions: []v1alpha1.StorageCondition{{
+			Type:               v1alpha1.VolumeRestored,
+			Status:             v1alpha1.ConditionTrue,
+			LastObservedTime:   now,
+			LastTransitionTime: now,
+			Reason:             "Restored",
+			Message:            "Restored from snapshot snap",
+		}},
+		Migration: &v1alpha1.StorageMigration{
+			SourceNode: "n1",
+			TargetNode: "n2",
+			Step:       v1alpha1.MigrationDetaching,
+			StartTime:  &now,
+		},
+		Attachments: []v1alpha1.StorageAttachment{{
+			NodeName:             "n1",
+			VolumeAttachmentName: "csi-abc",
+			Attached:             true,
+		}, {
+			NodeName: "n2",
+			Reason:   "AttachLimitReached",
+			Message:  "Node n2 has reached its attach limit",
+		}},
+	}
+}
+
+func newV1beta1Status() StorageStatus {
+	now := metav1.NewTime(time.Date(2019, 9, 1, 10, 0, 0, 0, time.UTC))
+	capacity := resource.MustParse("4Gi")
+	return StorageStatus{
+		Phase:        StorageAttached,
+		Message:      "Attached to node n1",
+		Reason:       "Attached",
+		StartTime:    &now,
+		Capacity:     &capacity,
+		SelectedNode: "n1",
+		Conditions: []StorageCondition{{
+			Type:               VolumeRestored,
+			Status:             ConditionTrue,
+			LastObservedTime:   now,
+			LastTransitionTime: now,
+			Reason:             "Restored",
+			Message:            "Restored from snapshot snap",
+		}},
+		Migration: &StorageMigration{
+			SourceNode: "n1",
+			TargetNode: "n2",
+			Step:       MigrationDetaching,
+			StartTime:  &now,
+		},
+		Attachments: []StorageAttachment{{
+			NodeName:             "n1",
+			VolumeAttachmentName: "csi-abc",
+			Attached:             true,
+		}, {
+			NodeName: "n2",
+			Reason:   "AttachLimitReached",
+			Message:  "Node n2 has reached its attach limit",
+		}},
+	}
+}
+
+func TestConvertFromV1alpha1RoundTrip(t *testing.T) {
+	var tests = map[string]struct {
+		alpha *v1alpha1.Storage
+		beta  *Storage
+	}{
+		"annotations only": {
+			alpha: newV1alpha1Storage(map[string]string{
+				storageclassProviderKey: "csi-gce-pd",
+				storageCSIAttacherKey:   "pd.csi.storage.gke.io",
+			}, v1alpha1.StorageSpec{}),
+			beta: newV1beta1Storage(map[string]string{
+				v1alpha1SpecKey: `{"storageClassName":"Annotation","attacher":"Annotation"}`,
+			}, StorageSpec{
+				StorageClassName: "csi-gce-pd",
+				Attacher:         "pd.csi.storage.gke.io",
+			}),
+		},
+		"annotations with empty values": {
+			alpha: newV1alpha1Storage(map[string]string{
+				storageclassProviderKey: "",
+				storageCSIAttacherKey:   "",
+			}, v1alpha1.StorageSpec{}),
+			beta: newV1beta1Storage(map[string]string{
+				v1alpha1SpecKey: `{"storageClassName":"Annotation","attacher":"Annotation"}`,
+			}, StorageSpec{}),
+		},
+		"spec only": {
+			alpha: newV1alpha1Storage(nil, v1alpha1.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+				Attacher:         strPtr("pd.csi.storage.gke.io"),
+			}),
+			beta: newV1beta1Storage(nil, StorageSpec{
+				StorageClassName: "csi-gce-pd",
+				Attacher:         "pd.csi.storage.gke.io",
+			}),
+		},
+		"spec with empty values": {
+			alpha: newV1alpha1Storage(nil, v1alpha1.StorageSpec{
+				StorageClassName: strPtr(""),
+				Attacher:         strPtr(""),
+			}),
+			beta: newV1beta1Storage(map[string]string{
+				v1alpha1SpecKey: `{"storageClassName":"Empty","attacher":"Empty"}`,
+			}, StorageSpec{}),
+		},
+		"both spec & annotations": {
+			alpha: newV1alpha1Storage(map[string]string{
+				storageclassProviderKey: "standard",
+				storageCSIAttacherKey:   "",
+			}, v1alpha1.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+				Attacher:         strPtr("pd.csi.storage.gke.io"),
+			}),
+			beta: newV1beta1Storage(map[string]string{
+				storageclassProviderKey: "standard",
+				storageCSIAttacherKey:   "",
+			}, StorageSpec{
+				StorageClassName: "csi-gce-pd",
+				Attacher:         "pd.csi.storage.gke.io",
+			}),
+		},
+		"node name": {
+			alpha: newV1alpha1Storage(nil, v1alpha1.StorageSpec{
+				NodeName: strPtr("n1"),
+			}),
+			beta: newV1beta1Storage(map[string]string{
+				v1alpha1SpecKey: `{"nodeName":"n1"}`,
+			}, StorageSpec{
+				Placement: StoragePlacement{NodeNames: []string{"n1"}},
+			}),
+		},
+		"empty node name": {
+			alpha: newV1alpha1Storage(nil, v1alpha1.StorageSpec{
+				NodeName: strPtr(""),
+			}),
+			beta: newV1beta1Storage(map[string]string{
+				v1alpha1SpecKey: `{"nodeName":""}`,
+			}, StorageSpec{}),
+		},
+		"node names": {
+			alpha: newV1alpha1Storage(nil, v1alpha1.StorageSpec{
+				NodeNames: []string{"n1"},
+			}),
+			beta: newV1beta1Storage(nil, StorageSpec{
+				Placement: StoragePlacement{NodeNames: []string{"n1"}},
+			}),
+		},
+		"node name & node names": {
+			alpha: newV1alpha1Storage(nil, v1alpha1.StorageSpec{
+				NodeName:  strPtr("n1"),
+				NodeNames: []string{"n2", "n3"},
+			}),
+			beta: newV1beta1Storage(map[string]string{
+				v1alpha1SpecKey: `{"nodeName":"n1","nodeNames":true}`,
+			}, StorageSpec{
+				Placement: StoragePlacement{NodeNames: []string{"n2", "n3"}},
+			}),
+		},
+		"status": {
+			alpha: func() *v1alpha1.Storage {
+				stor := newV1alpha1Storage(nil, v1alpha1.StorageSpec{})
+				stor.Status = newV1alpha1Status()
+				return stor
+			}(),
+			beta: func() *Storage {
+				stor := newV1beta1Storage(nil, StorageSpec{})
+				stor.Status = newV1beta1Status()
+				return stor
+			}(),
+		},
+	}
+	for name, mock := range tests {
+		name, mock := name, mock
+		t.Run(name, func(t *testing.T) {
+			beta, err := ConvertFromV1alpha1(mock.alpha)
+			if err != nil {
+				t.Fatalf("Expected no error got %v", err)
+			}
+			if !apiequality.Semantic.DeepEqual(beta, mock.beta) {
+				t.Fatalf("Invalid v1beta1 storage: %s", diff.ObjectReflectDiff(mock.beta, beta))
+			}
+			alpha, err := ConvertToV1alpha1(beta)
+			if err != nil {
+				t.Fatalf("Expected no error got %v", err)
+			}
+			if !apiequality.Semantic.DeepEqual(alpha, mock.alpha) {
+				t.Fatalf("Lossy round trip: %s", diff.ObjectReflectDiff(mock.alpha, alpha))
+			}
+		})
+	}
+}
+
+func TestConvertToV1alpha1RoundTrip(t *testing.T) {
+	var tests = map[string]struct {
+		beta  *Storage
+		alpha *v1alpha1.Storage
+	}{
+		"spec only": {
+			beta: newV1beta1Storage(nil, StorageSpec{
+				StorageClassName: "csi-gce-pd",
+				Attacher:         "pd.csi.storage.gke.io",
+				Placement:        StoragePlacement{NodeNames: []string{"n1", "n2"}},
+			}),
+			alpha: newV1alpha1Storage(nil, v1alpha1.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+				Attacher:         strPtr("pd.csi.storage.gke.io"),
+				NodeNames:        []string{"n1", "n2"},
+			}),
+		},
+		"empty spec": {
+			beta:  newV1beta1Storage(nil, StorageSpec{}),
+			alpha: newV1alpha1Storage(nil, v1alpha1.StorageSpec{}),
+		},
+		"single node name": {
+			beta: newV1beta1Storage(nil, StorageSpec{
+				Placement: StoragePlacement{NodeNames: []string{"n1"}},
+			}),
+			alpha: newV1alpha1Storage(nil, v1alpha1.StorageSpec{
+				NodeNames: []string{"n1"},
+			}),
+		},
+		"carried annotations": {
+			beta: newV1beta1Storage(map[string]string{
+				v1alpha1SpecKey: `{"storageClassName":"Annotation","attacher":"Annotation"}`,
+			}, StorageSpec{
+				StorageClassName: "csi-gce-pd",
+				Attacher:         "pd.csi.storage.gke.io",
+			}),
+			alpha: newV1alpha1Storage(map[string]string{
+				storageclassProviderKey: "csi-gce-pd",
+				storageCSIAttacherKey:   "pd.csi.storage.gke.io",
+			}, v1alpha1.StorageSpec{}),
+		},
+		"carried annotations with empty values": {
+			beta: newV1beta1Storage(map[string]string{
+				v1alpha1SpecKey: `{"storageClassName":"Annotation","attacher":"Annotation"}`,
+			}, StorageSpec{}),
+			alpha: newV1alpha1Storage(map[string]string{
+				storageclassProviderKey: "",
+				storageCSIAttacherKey:   "",
+			}, v1alpha1.StorageSpec{}),
+		},
+		"carried empty spec": {
+			beta: newV1beta1Storage(map[string]string{
+				v1alpha1SpecKey: `{"storageClassName":"Empty","attacher":"Empty"}`,
+			}, StorageSpec{}),
+			alpha: newV1alpha1Storage(nil, v1alpha1.StorageSpec{
+				StorageClassName: strPtr(""),
+				Attacher:         strPtr(""),
+			}),
+		},
+		"carried node name": {
+			beta: newV1beta1Storage(map[string]string{
+				v1alpha1SpecKey: `{"nodeName":"n1"}`,
+			}, StorageSpec{
+				Placement: StoragePlacement{NodeNames: []string{"n1"}},
+			}),
+			alpha: newV1alpha1Storage(nil, v1alpha1.StorageSpec{
+				NodeName: strPtr("n1"),
+			}),
+		},
+		"carried empty node name": {
+			beta: newV1beta1Storage(map[string]string{
+				v1alpha1SpecKey: `{"nodeName":""}`,
+			}, StorageSpec{}),
+			alpha: newV1alpha1Storage(nil, v1alpha1.StorageSpec{
+				NodeName: strPtr(""),
+			}),
+		},
+		"carried node name & node names": {
+			beta: newV1beta1Storage(map[string]string{
+				v1alpha1SpecKey: `{"nodeName":"n1","nodeNames":true}`,
+			}, StorageSpec{
+				Placement: StoragePlacement{NodeNames: []string{"n2", "n3"}},
+			}),
+			alpha: newV1alpha1Storage(nil, v1alpha1.StorageSpec{
+				NodeName:  strPtr("n1"),
+				NodeNames: []string{"n2", "n3"},
+			}),
+		},
+		"status": {
+			beta: func() *Storage {
+				stor := newV1beta1Storage(nil, StorageSpec{})
+				stor.Status = newV1beta1Status()
+				return stor
+			}(),
+			alpha: func() *v1alpha1.Storage {
+				stor := newV1alpha1Storage(nil, v1alpha1.StorageSpec{})
+				stor.Status = newV1alpha1Status()
+				return stor
+			}(),
+		},
+	}
+	for name, mock := range tests {
+		name, mock := name, mock
+		t.Run(name, func(t *testing.T) {
+			alpha, err := ConvertToV1alpha1(mock.beta)
+			if err != nil {
+				t.Fatalf("Expected no error got %v", err)
+			}
+			if !apiequality.Semantic.DeepEqual(alpha, mock.alpha) {
+				t.Fatalf("Invalid v1alpha1 storage: %s", diff.ObjectReflectDiff(mock.alpha, alpha))
+			}
+			beta, err := ConvertFromV1alpha1(alpha)
+			if err != nil {
+				t.Fatalf("Expected no error got %v", err)
+			}
+			if !apiequality.Semantic.DeepEqual(beta, mock.beta) {
+				t.Fatalf("Lossy round trip: %s", diff.ObjectReflectDiff(mock.beta, beta))
+			}
+		})
+	}
+}
+
+func TestConvertToV1alpha1InvalidAnnotation(t *testing.T) {
+	stor := newV1beta1Storage(map[string]string{v1alpha1SpecKey: "{"}, StorageSpec{})
+	if _, err := ConvertToV1alpha1(stor); err == nil {
+		t.Fatalf("Expected error got none")
+	}
+}
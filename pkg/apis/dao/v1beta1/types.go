@@ -0,0 +1,409 @@
+/*
+Copyright 2019 The MayaData Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type Storage struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+
+	Spec   StorageSpec   `json:"spec"`
+	Status StorageStatus `json:"status,omitempty"`
+}
+
+type StorageSpec struct {
+	// Capacity of the storage
+	Capacity resource.Quantity `json:"capacity"`
+
+	// Name of the storageclass that provisions the storage
+	StorageClassName string `json:"storageClassName"`
+
+	// Name of the CSI attacher that attaches the storage to the node
+	//
+	// This is optional. Attacher is derived from the CSI driver of
+	// the volume or from the storageclass provisioner if not set.
+	Attacher string `json:"attacher,omitempty"`
+
+	// Nodes that should attach the storage
+	//
+	// This is optional. Storage is not attached if not set.
+	Placement StoragePlacement `json:"placement,omitempty"`
+
+	// Access modes of the storage. ReadWriteOnce is used if not set.
+	//
+	// NOTE:
+	//	Changes to access modes are not reflected once the storage
+	// is provisioned.
+	//
+	// This is optional
+	AccessModes []v1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
+
+	// Template used to create the PVC of this storage. Fields owned
+	// by the controller e.g. capacity, storageclass & access modes
+	// are set from the storage spec & are not part of this template.
+	//
+	// This is optional
+	PVCTemplate *PVCTemplate `json:"pvcTemplate,omitempty"`
+
+	// Source of the data to populate the storage with. This is
+	// used only when the PVC gets created & can not be set along
+	// with the data source of the PVC template.
+	//
+	// This is optional
+	Source *StorageSource `json:"source,omitempty"`
+}
+
+// StoragePlacement describes the nodes that attach a storage. Nodes
+// are either set by name or selected by the controller based on the
+// node selector & node affinity.
+type StoragePlacement struct {
+	// Names of the nodes that should attach the storage. More than
+	// one node can be set only if access modes allow the storage to
+	// be shared.
+	//
+	// +optional
+	NodeNames []string `json:"nodeNames,omitempty"`
+
+	// Labels of the node that should attach the storage. Controller
+	// selects a ready & schedulable node matching these labels as
+	// well as the topology constraints of the storageclass or volume.
+	// This can not be set along with NodeNames.
+	//
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Affinity of the node that should attach the storage. This is
+	// used along with NodeSelector to select the node.
+	//
+	// +optional
+	NodeAffinity *v1.NodeSelector `json:"nodeAffinity,omitempty"`
+}
+
+// StorageSource is the data source of a storage. Exactly one of its
+// members must be set.
+type StorageSource struct {
+	// VolumeSnapshot in the namespace of this storage to restore
+	// the data from. Snapshot must be ready to use.
+	//
+	// +optional
+	VolumeSnapshot *v1.LocalObjectReference `json:"volumeSnapshot,omitempty"`
+
+	// Storage in the namespace of this storage to clone the data
+	// from. Source storage must be provisioned by the same
+	// storageclass.
+	//
+	// +optional
+	Storage *v1.LocalObjectReference `json:"storage,omitempty"`
+}
+
+// PVCTemplate describes the PVC that gets created for a storage
+type PVCTemplate struct {
+	// Labels & annotations of the PVC. These are synced to the PVC
+	// when changed.
+	//
+	// +optional
+	Metadata PVCTemplateMeta `json:"metadata,omitempty"`
+
+	// Spec of the PVC. These are set only when the PVC gets created.
+	//
+	// +optional
+	Spec PVCTemplateSpec `json:"spec,omitempty"`
+}
+
+// PVCTemplateMeta is the metadata of the PVC that can be set by
+// the user
+type PVCTemplateMeta struct {
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations with storageprovisioner.dao.mayadata.io domain are
+	// not allowed since these are owned by the controller.
+	//
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// PVCTemplateSpec is the subset of PersistentVolumeClaimSpec that
+// can be set by the user
+type PVCTemplateSpec struct {
+	// A label query over volumes to consider for binding.
+	//
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// Defines what type of volume is required by the claim e.g.
+	// Block or Filesystem
+	//
+	// +optional
+	VolumeMode *v1.PersistentVolumeMode `json:"volumeMode,omitempty"`
+
+	// Data source to populate the volume from e.g. a snapshot
+	//
+	// +optional
+	DataSource *v1.TypedLocalObjectReference `json:"dataSource,omitempty"`
+}
+
+// StoragePhase is a label for the condition of a storage at
+// the current time.
+type StoragePhase string
+
+// These are the valid statuses of storage.
+const (
+	// StoragePending means the storage has been accepted by the system,
+	// but one or more of the required resources has not been created.
+	StoragePending StoragePhase = "Pending"
+
+	// StorageAttached means the storage has been attached to a node.
+	StorageAttached StoragePhase = "Attached"
+
+	// StorageDetached means the storage is not attached to any node
+	// since no node is selected. Data of the storage is retained.
+	StorageDetached StoragePhase = "Detached"
+
+	// StorageFailed indicates some failures with the controller, or
+	// resources that are required to have this storage attached.
+	StorageFailed StoragePhase = "Failed"
+
+	// StorageTerminating means the storage is being deleted & its
+	// resources are getting torn down in order.
+	StorageTerminating StoragePhase = "Terminating"
+)
+
+// MigrationStep is a step of moving the storage from one node
+// to another
+type MigrationStep string
+
+// These are the valid steps of a migration.
+const (
+	// MigrationNodeUpdated means the target node has been propagated
+	// to the resources of the storage.
+	MigrationNodeUpdated MigrationStep = "NodeUpdated"
+
+	// MigrationDetaching means the storage is being detached from
+	// the source node.
+	MigrationDetaching MigrationStep = "Detaching"
+
+	// MigrationAttaching means the storage has been detached from the
+	// source node & is being attached to the target node.
+	MigrationAttaching MigrationStep = "Attaching"
+)
+
+// StorageMigration represents the move of a storage from one node
+// to another
+type StorageMigration struct {
+	// Name of the node the storage is being detached from
+	SourceNode string `json:"sourceNode,omitempty" protobuf:"bytes,1,opt,name=sourceNode"`
+
+	// Name of the node the storage is being attached to
+	TargetNode string `json:"targetNode,omitempty" protobuf:"bytes,2,opt,name=targetNode"`
+
+	// Current step of the migration
+	Step MigrationStep `json:"step" protobuf:"bytes,3,opt,name=step,casttype=MigrationStep"`
+
+	// RFC 3339 date and time at which the migration started.
+	StartTime *metav1.Time `json:"startTime,omitempty" protobuf:"bytes,4,opt,name=startTime"`
+}
+
+// StorageAttachment represents the attach state of the storage
+// against a node
+type StorageAttachment struct {
+	// Name of the node
+	NodeName string `json:"nodeName" protobuf:"bytes,1,opt,name=nodeName"`
+
+	// Name of the VolumeAttachment that attaches the storage to
+	// this node
+	//
+	// +optional
+	VolumeAttachmentName string `json:"volumeAttachmentName,omitempty" protobuf:"bytes,2,opt,name=volumeAttachmentName"`
+
+	// Attached is true if the storage is attached to this node
+	Attached bool `json:"attached" protobuf:"varint,3,opt,name=attached"`
+
+	// Unique, one-word, CamelCase reason for the attach state.
+	//
+	// +optional
+	Reason string `json:"reason,omitempty" protobuf:"bytes,4,opt,name=reason"`
+
+	// Human-readable message indicating details about the attach state.
+	//
+	// +optional
+	Message string `json:"message,omitempty" protobuf:"bytes,5,opt,name=message"`
+}
+
+// StorageConditionType is a valid value for StorageCondition.Type
+type StorageConditionType string
+
+// These are valid conditions of storage.
+const (
+	// ResourcesCreated indicates whether all resources of the storage
+	// are created.
+	ResourcesCreated StorageConditionType = "ResourcesCreated"
+
+	// PVCBound means the PVC associated with this storage
+	// is bound against its associated PV
+	PVCBound StorageConditionType = "PVCBound"
+
+	// AttacherResolved represents the status if the CSI attacher of
+	// this storage is resolved & matches the driver of its volume
+	AttacherResolved StorageConditionType = "AttacherResolved"
+
+	// NodeSelected represents status if any node was selected to attach
+	// this storage
+	NodeSelected StorageConditionType = "NodeSelected"
+
+	// NodeAvailable represents the status if the selected node is available
+	NodeAvailable StorageConditionType = "NodeAvailable"
+
+	// VolumeAttached represents the attach state of the storage as
+	// reported by the attacher
+	VolumeAttached StorageConditionType = "VolumeAttached"
+
+	// VolumeResize represents the status when this storage is undergoing
+	// a resize operation. It is false with a reason if the resize can
+	// not proceed e.g. when the storage is shrunk.
+	VolumeResize StorageConditionType = "VolumeResize"
+
+	// VolumeRestored represents the status of populating the storage
+	// from its source i.e. a volume snapshot or another storage
+	VolumeRestored StorageConditionType = "VolumeRestored"
+
+	// DeletionHeld represents the status if deletion of any resource
+	// owned by this storage is held by the storage controller
+	DeletionHeld StorageConditionType = "DeletionHeld"
+
+	// Ready is an aggregate of all other conditions. It is true only
+	// when the storage is attached & can be consumed.
+	Ready StorageConditionType = "Ready"
+)
+
+// ConditionStatus is a typed value to represent various condition statuses
+type ConditionStatus string
+
+// These are valid condition statuses.
+const (
+	// "ConditionTrue" means the storage is in the StorageConditionType
+	ConditionTrue ConditionStatus = "True"
+
+	// "ConditionFalse" means a storage is not in the StorageConditionType
+	ConditionFalse ConditionStatus = "False"
+
+	// "ConditionUnknown" means controller can't decide if storage
+	// is in the StorageConditionType or not.
+	ConditionUnknown ConditionStatus = "Unknown"
+)
+
+// StorageCondition contains details for the current condition of this storage.
+type StorageCondition struct {
+	// Type is the type of the condition.
+	Type StorageConditionType `json:"type" protobuf:"bytes,1,opt,name=type,casttype=StorageConditionType"`
+
+	// Status is the status of the condition.
+	// Can be True, False, Unknown.
+	Status ConditionStatus `json:"status" protobuf:"bytes,2,opt,name=status,casttype=ConditionStatus"`
+
+	// Last time we probed the condition.
+	// +optional
+	LastObservedTime metav1.Time `json:"lastObservedTime,omitempty" protobuf:"bytes,3,opt,name=lastObservedTime"`
+
+	// Last time the condition transitioned from one status to another.
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty" protobuf:"bytes,4,opt,name=lastTransitionTime"`
+
+	// Unique, one-word, CamelCase reason for the condition's last transition.
+	// +optional
+	Reason string `json:"reason,omitempty" protobuf:"bytes,5,opt,name=reason"`
+
+	// Human-readable message indicating details about last transition.
+	// +optional
+	Message string `json:"message,omitempty" protobuf:"bytes,6,opt,name=message"`
+}
+
+// StorageStatus represents information about the status of the storage.
+type StorageStatus struct {
+	// The phase of a storage is a high-level summary of where the storage
+	// is in its lifecycle.
+	//
+	// The conditions array, the reason and message fields, contain more
+	// detail about the storage's status.
+	Phase StoragePhase `json:"phase,omitempty" protobuf:"bytes,1,opt,name=phase,casttype=StoragePhase"`
+
+	// Current service state of storage.
+	//
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	Conditions []StorageCondition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,2,rep,name=conditions"`
+
+	// A human readable message indicating details about why the storage
+	// is in this condition.
+	//
+	// +optional
+	Message string `json:"message,omitempty" protobuf:"bytes,3,opt,name=message"`
+
+	// A brief CamelCase message indicating details about why the storage
+	// is in this state.
+	//
+	// e.g. 'Evicted'
+	// +optional
+	Reason string `json:"reason,omitempty" protobuf:"bytes,4,opt,name=reason"`
+
+	// RFC 3339 date and time at which the object was acknowledged by its controller.
+	StartTime *metav1.Time `json:"startTime,omitempty" protobuf:"bytes,7,opt,name=startTime"`
+
+	// Actual capacity of the storage as reported by its PVC. This
+	// differs from the capacity in spec while the storage is being
+	// resized.
+	//
+	// +optional
+	Capacity *resource.Quantity `json:"capacity,omitempty" protobuf:"bytes,11,opt,name=capacity"`
+
+	// Name of the node selected by the controller based on the node
+	// selector & node affinity of the storage. Storage sticks to this
+	// node as long as it exists & matches.
+	//
+	// +optional
+	SelectedNode string `json:"selectedNode,omitempty" protobuf:"bytes,10,opt,name=selectedNode"`
+
+	// Migration is set while the storage is being moved from one node
+	// to another. Source node is retained here once the storage gets
+	// detached from it.
+	//
+	// +optional
+	Migration *StorageMigration `json:"migration,omitempty" protobuf:"bytes,8,opt,name=migration"`
+
+	// Attach state of the storage per node. This includes the nodes
+	// that the storage is being detached from.
+	//
+	// +optional
+	Attachments []StorageAttachment `json:"attachments,omitempty" protobuf:"bytes,9,rep,name=attachments"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type StorageList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []Storage `json:"items"`
+}
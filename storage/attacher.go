@@ -0,0 +1,138 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// resolveAttacher returns the name of the CSI attacher that should
+// attach this storage. Attacher is resolved in following order:
+//
+//	1/ spec.attacher or its annotation is used as an override
+//	2/ CSI driver of the bound PV
+//	3/ provisioner of the storageclass
+//
+// An in-tree provisioner of the storageclass is not a CSI driver & is
+// not used as the attacher.
+// An override that does not match the CSI driver of the bound PV is
+// not used. In this case an empty attacher name is returned. The
+// returned condition reports the outcome of this resolution.
+func (s *storageSync) resolveAttacher(
+	pv *v1.PersistentVolume,
+) (name string, cond ddp.StorageCondition, err error) {
+
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Resolve attacher failed", s)
+		}
+	}()
+
+	override, overridden := findAttacherFromStorage(s.storage)
+
+	var source string
+	if pv != nil && pv.Spec.CSI != nil {
+		name = pv.Spec.CSI.Driver
+		source = fmt.Sprintf("PV %s", pv.Name)
+
+		if overridden && override != name {
+			return "", newStorageCondition(
+				ddp.AttacherResolved, ddp.ConditionFalse, "AttacherMismatch",
+				fmt.Sprintf(
+					"Attacher %s does not match driver %s of PV %s",
+					override, name, pv.Name,
+				),
+			), nil
+		}
+	} else if !overridden {
+		sc, err := s.StorageClassLister.Get(s.providerName)
+		if apierrs.IsNotFound(err) {
+			return "", newStorageCondition(
+				ddp.AttacherResolved, ddp.ConditionFalse, "StorageClassNotFound",
+				fmt.Sprintf("Storageclass %s does not exist", s.providerName),
+			), nil
+		}
+		if err != nil {
+			return "", ddp.StorageCondition{}, err
+		}
+		if strings.HasPrefix(sc.Provisioner, inTreeProvisionerPrefix) {
+			return "", newStorageCondition(
+				ddp.AttacherResolved, ddp.ConditionFalse, "InTreeProvisioner",
+				fmt.Sprintf(
+					"Provisioner %s of storageclass %s is not a CSI driver",
+					sc.Provisioner, sc.Name,
+				),
+			), nil
+		}
+		name = sc.Provisioner
+		source = fmt.Sprintf("storageclass %s", sc.Name)
+	}
+
+	if overridden {
+		name = override
+		source = "storage spec"
+	}
+
+	_, err = s.CSIDriverLister.Get(name)
+	if apierrs.IsNotFound(err) {
+		// CSIDriver objects are optional
+		return name, newStorageCondition(
+			ddp.AttacherResolved, ddp.ConditionTrue, "CSIDriverNotRegistered",
+			fmt.Sprintf(
+				"Attacher %s is resolved from %s: CSIDriver %s does not exist",
+				name, source, name,
+			),
+		), nil
+	}
+	if err != nil {
+		return "", ddp.StorageCondition{}, err
+	}
+
+	return name, newStorageCondition(
+		ddp.AttacherResolved, ddp.ConditionTrue, "Resolved",
+		fmt.Sprintf("Attacher %s is resolved from %s", name, source),
+	), nil
+}
+
+// isAttachRequired returns true if the given CSI attacher requires
+// a VolumeAttachment to attach its volumes. Attach is assumed to be
+// required if the attacher has no CSIDriver object.
+func isAttachRequired(
+	lister storagelisters.CSIDriverLister, attacherName string,
+) (bool, error) {
+
+	driver, err := lister.Get(attacherName)
+	if apierrs.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "Get CSIDriver %s failed", attacherName)
+	}
+	if driver.Spec.AttachRequired == nil {
+		// defaults to true
+		return true, nil
+	}
+	return *driver.Spec.AttachRequired, nil
+}
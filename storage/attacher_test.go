@@ -0,0 +1,173 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// newCSIPV returns a PV provisioned by the given CSI driver
+func newCSIPV(name, driver string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driver},
+			},
+		},
+	}
+}
+
+func TestStorageSyncResolveAttacher(t *testing.T) {
+	tests := map[string]struct {
+		attacher     *string
+		providerName string
+		pv           *v1.PersistentVolume
+		name         string
+		status       ddp.ConditionStatus
+		reason       string
+	}{
+		"from pv driver": {
+			providerName: "csi-sc",
+			pv:           newCSIPV("pv", "pv.example.com"),
+			name:         "pv.example.com",
+			status:       ddp.ConditionTrue,
+			reason:       "Resolved",
+		},
+		"from storageclass provisioner": {
+			providerName: "csi-sc",
+			name:         "csi.example.com",
+			status:       ddp.ConditionTrue,
+			reason:       "Resolved",
+		},
+		"in-tree storageclass provisioner": {
+			providerName: "in-tree-sc",
+			status:       ddp.ConditionFalse,
+			reason:       "InTreeProvisioner",
+		},
+		"storageclass not found": {
+			providerName: "other-sc",
+			status:       ddp.ConditionFalse,
+			reason:       "StorageClassNotFound",
+		},
+		"override without pv": {
+			attacher:     strPtr("override.example.com"),
+			providerName: "other-sc",
+			name:         "override.example.com",
+			status:       ddp.ConditionTrue,
+			reason:       "CSIDriverNotRegistered",
+		},
+		"override matches pv driver": {
+			attacher:     strPtr("pv.example.com"),
+			providerName: "csi-sc",
+			pv:           newCSIPV("pv", "pv.example.com"),
+			name:         "pv.example.com",
+			status:       ddp.ConditionTrue,
+			reason:       "Resolved",
+		},
+		"override does not match pv driver": {
+			attacher:     strPtr("override.example.com"),
+			providerName: "csi-sc",
+			pv:           newCSIPV("pv", "pv.example.com"),
+			status:       ddp.ConditionFalse,
+			reason:       "AttacherMismatch",
+		},
+	}
+	for name, mock := range tests {
+		stor := newTestStorage("stor", "node-1")
+		stor.Spec.Attacher = mock.attacher
+
+		s := &storageSync{
+			StorageReconciler: &StorageReconciler{
+				StorageClassLister: storagev1listers.NewStorageClassLister(newIndexer(t,
+					&storagev1.StorageClass{
+						ObjectMeta:  metav1.ObjectMeta{Name: "csi-sc"},
+						Provisioner: "csi.example.com",
+					},
+					&storagev1.StorageClass{
+						ObjectMeta:  metav1.ObjectMeta{Name: "in-tree-sc"},
+						Provisioner: "kubernetes.io/gce-pd",
+					},
+				)),
+				CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t,
+					&storage.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: "csi.example.com"}},
+					&storage.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: "pv.example.com"}},
+				)),
+			},
+			storage:      stor,
+			providerName: mock.providerName,
+		}
+
+		attacherName, cond, err := s.resolveAttacher(mock.pv)
+		if err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+		if attacherName != mock.name {
+			t.Fatalf("%s: Expected attacher %q got %q", name, mock.name, attacherName)
+		}
+		if cond.Status != mock.status || cond.Reason != mock.reason {
+			t.Fatalf(
+				"%s: Expected %s: %s got %s: %s",
+				name, mock.status, mock.reason, cond.Status, cond.Reason,
+			)
+		}
+	}
+}
+
+func TestIsAttachRequired(t *testing.T) {
+	lister := storagelisters.NewCSIDriverLister(newIndexer(t,
+		&storage.CSIDriver{
+			ObjectMeta: metav1.ObjectMeta{Name: "default.example.com"},
+		},
+		&storage.CSIDriver{
+			ObjectMeta: metav1.ObjectMeta{Name: "nfs.example.com"},
+			Spec:       storage.CSIDriverSpec{AttachRequired: boolPtr(false)},
+		},
+		&storage.CSIDriver{
+			ObjectMeta: metav1.ObjectMeta{Name: "block.example.com"},
+			Spec:       storage.CSIDriverSpec{AttachRequired: boolPtr(true)},
+		},
+	))
+
+	tests := map[string]struct {
+		attacherName string
+		isRequired   bool
+	}{
+		"no csidriver":            {attacherName: "csi.example.com", isRequired: true},
+		"attach required not set": {attacherName: "default.example.com", isRequired: true},
+		"attach not required":     {attacherName: "nfs.example.com", isRequired: false},
+		"attach required":         {attacherName: "block.example.com", isRequired: true},
+	}
+	for name, mock := range tests {
+		required, err := isAttachRequired(lister, mock.attacherName)
+		if err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+		if required != mock.isRequired {
+			t.Fatalf("%s: Expected attach required %t got %t", name, mock.isRequired, required)
+		}
+	}
+}
@@ -17,8 +17,18 @@ limitations under the License.
 package storage
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
 
 	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
 )
@@ -44,6 +54,68 @@ const (
 
 	// storageUIDKey holds the name of the storage UID
 	storageUIDKey string = StorageProvisionerAnnotationNamespace + "/storage-uid"
+
+	// pvcNamespaceKey holds the namespace of the PVC that is attached
+	// via the VolumeAttachment
+	pvcNamespaceKey string = StorageProvisionerAnnotationNamespace + "/pvc-namespace"
+
+	// pvcNameKey holds the name of the PVC that is attached via the
+	// VolumeAttachment
+	pvcNameKey string = StorageProvisionerAnnotationNamespace + "/pvc-name"
+
+	// defaultsAppliedKey holds the defaults applied to a storage by
+	// the defaulting webhook. Storage controller reports these as an
+	// event & removes this annotation.
+	defaultsAppliedKey string = StorageProvisionerAnnotationNamespace + "/defaults-applied"
+
+	// storageSetKey is the label set against the storages of a
+	// storage set. It holds the name of the set & lets a retained
+	// storage get adopted back by its set.
+	storageSetKey string = StorageProvisionerAnnotationNamespace + "/storageset"
+
+	// retainedByKey is set against a storage retained by a storage
+	// set. It holds the UID of the set & lets only this set adopt the
+	// storage back; not another set of the same name.
+	retainedByKey string = StorageProvisionerAnnotationNamespace + "/retained-by"
+
+	// managedByKey & storageclassKey are the standard labels set
+	// against every storage
+	managedByKey    string = "app.kubernetes.io/managed-by"
+	storageclassKey string = StorageProvisionerAnnotationNamespace + "/storageclass"
+
+	// managedByValue is the value of managedByKey label
+	managedByValue string = "storage-provisioner"
+
+	// isDefaultStorageClassKey & betaIsDefaultStorageClassKey mark a
+	// storageclass as the default of the cluster
+	isDefaultStorageClassKey     string = "storageclass.kubernetes.io/is-default-class"
+	betaIsDefaultStorageClassKey string = "storageclass.beta.kubernetes.io/is-default-class"
+
+	// inTreeProvisionerPrefix is the prefix of the provisioners that
+	// are not CSI drivers & hence can not be used as an attacher
+	inTreeProvisionerPrefix string = "kubernetes.io/"
+
+	// selectedNodeKey is set against a PVC of a WaitForFirstConsumer
+	// storageclass. It lets the provisioner provision the volume as
+	// per the topology of this node. This is normally set by the
+	// scheduler when a pod consumes the PVC.
+	selectedNodeKey string = "volume.kubernetes.io/selected-node"
+
+	// storageTeardownFinalizer is set against the storage. It lets
+	// storage controller delete the owned resources in order before
+	// the storage is removed.
+	storageTeardownFinalizer string = StorageProvisionerAnnotationNamespace + "/storage-teardown"
+
+	// storageProtectionFinalizer is set against the PVC created by
+	// storage controller. It holds the PVC deletion till the owner
+	// storage is deleted.
+	storageProtectionFinalizer string = StorageProvisionerAnnotationNamespace + "/storage-protection"
+
+	// pvcProtectionFinalizer is set against the VolumeAttachment
+	// created by storage controller. It keeps a deleted VolumeAttachment
+	// till the controller observes the deletion. Attacher detaches the
+	// volume irrespective of this finalizer.
+	pvcProtectionFinalizer string = StorageProvisionerAnnotationNamespace + "/pvc-protection"
 )
 
 // boolPtr returns a pointer to a bool
@@ -69,14 +141,130 @@ func findValueFromDict(dict map[string]string, key string) (string, bool) {
 }
 
 // findProviderFromStorage finds the storage provider name from
-// storage API
+// storage API. Spec takes precedence over the annotation.
 func findProviderFromStorage(storage *ddp.Storage) (string, bool) {
+	if storage.Spec.StorageClassName != nil {
+		return *storage.Spec.StorageClassName, true
+	}
 	anns := storage.GetAnnotations()
 	return findValueFromDict(anns, storageclassProviderKey)
 }
 
-// findAttacherFromStorage finds the attacher name from Storage API
+// FindProviderFromStorage returns the name of the storageclass of
+// the given storage. It returns empty string if not set.
+func FindProviderFromStorage(storage *ddp.Storage) string {
+	provider, _ := findProviderFromStorage(storage)
+	return provider
+}
+
+// DefaultStorage applies the defaults to the given storage. It
+// returns the description of the defaults applied to the spec.
+// Following defaults are applied:
+//
+//	1/ storageclass is set to the default storageclass of the cluster
+//	2/ attacher is set to the CSI provisioner of the storageclass
+//	3/ standard labels are set
+//
+// NOTE:
+//	This is used by both the defaulting webhook & storage controller
+// so that a storage gets the same defaults irrespective of the
+// webhook being deployed
+func DefaultStorage(
+	stor *ddp.Storage, lister storagev1listers.StorageClassLister,
+) (defaults []string, err error) {
+
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(
+				err, "Default storage %s/%s failed", stor.Namespace, stor.Name,
+			)
+		}
+	}()
+
+	provider, providerFound := findProviderFromStorage(stor)
+	if !providerFound {
+		sc, err := findDefaultStorageClass(lister)
+		if err != nil {
+			return nil, err
+		}
+		if sc != nil {
+			provider = sc.Name
+			stor.Spec.StorageClassName = strPtr(provider)
+			defaults = append(defaults, fmt.Sprintf(
+				"spec.storageClassName is set to default storageclass %s", provider,
+			))
+		}
+	}
+
+	if _, found := findAttacherFromStorage(stor); !found && provider != "" {
+		sc, err := lister.Get(provider)
+		if err != nil && !apierrs.IsNotFound(err) {
+			return nil, err
+		}
+		if sc != nil && !strings.HasPrefix(sc.Provisioner, inTreeProvisionerPrefix) {
+			stor.Spec.Attacher = strPtr(sc.Provisioner)
+			defaults = append(defaults, fmt.Sprintf(
+				"spec.attacher is set to provisioner %s of storageclass %s",
+				sc.Provisioner, provider,
+			))
+		}
+	}
+
+	if stor.Labels == nil {
+		stor.Labels = map[string]string{}
+	}
+	stor.Labels[managedByKey] = managedByValue
+	if provider != "" && len(validation.IsValidLabelValue(provider)) == 0 {
+		stor.Labels[storageclassKey] = provider
+	}
+	return defaults, nil
+}
+
+// SetDefaultsApplied records the given defaults against the given
+// storage as an annotation
+func SetDefaultsApplied(stor *ddp.Storage, defaults []string) {
+	if len(defaults) == 0 {
+		return
+	}
+	if stor.Annotations == nil {
+		stor.Annotations = map[string]string{}
+	}
+	stor.Annotations[defaultsAppliedKey] = strings.Join(defaults, "; ")
+}
+
+// findDefaultStorageClass returns the storageclass marked as the
+// default of the cluster. It returns nil if there is no default or
+// there are more than one defaults.
+func findDefaultStorageClass(
+	lister storagev1listers.StorageClassLister,
+) (*storagev1.StorageClass, error) {
+
+	scs, err := lister.List(labels.Everything())
+	if err != nil {
+		return nil, errors.Wrapf(err, "List storageclasses failed")
+	}
+
+	var defaults []*storagev1.StorageClass
+	for _, sc := range scs {
+		anns := sc.GetAnnotations()
+		if anns[isDefaultStorageClassKey] == "true" ||
+			anns[betaIsDefaultStorageClassKey] == "true" {
+			defaults = append(defaults, sc)
+		}
+	}
+	if len(defaults) != 1 {
+		// default is ambiguous if more than one is found
+		return nil, nil
+	}
+	return defaults[0], nil
+}
+
+// findAttacherFromStorage finds the attacher name from Storage API.
+// Spec takes precedence over the annotation.
 func findAttacherFromStorage(storage *ddp.Storage) (string, bool) {
+	if storage.Spec.Attacher != nil {
+		return *storage.Spec.Attacher, true
+	}
 	anns := storage.GetAnnotations()
 	return findValueFromDict(anns, storageCSIAttacherKey)
 }
@@ -87,11 +275,89 @@ func findAttacherFromPVC(pvc *v1.PersistentVolumeClaim) (string, bool) {
 	return findValueFromDict(anns, storageCSIAttacherKey)
 }
 
-// findNodeNameFromPVC finds the node name from
-// PVC API
-func findNodeNameFromPVC(pvc *v1.PersistentVolumeClaim) (string, bool) {
+// findNodeNamesFromPVC finds the node names from PVC API. Node names
+// are set as a comma separated list.
+func findNodeNamesFromPVC(pvc *v1.PersistentVolumeClaim) []string {
 	anns := pvc.GetAnnotations()
-	return findValueFromDict(anns, nodeNameKey)
+	val, _ := findValueFromDict(anns, nodeNameKey)
+	return splitNodeNames(val)
+}
+
+// joinNodeNames returns the given node names as a comma separated
+// list
+func joinNodeNames(nodeNames []string) string {
+	return strings.Join(nodeNames, ",")
+}
+
+// splitNodeNames returns the node names from the given comma
+// separated list
+func splitNodeNames(val string) []string {
+	var nodeNames []string
+	for _, name := range strings.Split(val, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			nodeNames = append(nodeNames, name)
+		}
+	}
+	return nodeNames
+}
+
+// ContainsString returns true if the given string is present in
+// the given list
+func ContainsString(list []string, given string) bool {
+	for _, s := range list {
+		if s == given {
+			return true
+		}
+	}
+	return false
+}
+
+// getAccessModes returns the access modes of the given storage.
+// It defaults to ReadWriteOnce.
+//
+// NOTE:
+//	These are set against the PVC & hence the provisioned PV. CSI
+// attacher publishes a ReadOnlyMany volume in read only mode.
+func getAccessModes(stor *ddp.Storage) []v1.PersistentVolumeAccessMode {
+	if len(stor.Spec.AccessModes) == 0 {
+		return []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}
+	}
+	return stor.Spec.AccessModes
+}
+
+// isMultiNodeAccess returns true if the given access modes allow
+// the volume to be attached to more than one node
+func isMultiNodeAccess(modes []v1.PersistentVolumeAccessMode) bool {
+	for _, mode := range modes {
+		if mode == v1.ReadWriteMany || mode == v1.ReadOnlyMany {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFinalizer returns true if the given finalizer is present in
+// the given object
+func hasFinalizer(obj metav1.Object, finalizer string) bool {
+	for _, f := range obj.GetFinalizers() {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// removeFinalizer returns the given finalizers without the one
+// that needs to be removed
+func removeFinalizer(finalizers []string, finalizer string) []string {
+	var result []string
+	for _, f := range finalizers {
+		if f == finalizer {
+			continue
+		}
+		result = append(result, f)
+	}
+	return result
 }
 
 // containsOwner returns true if the given owner is present in the
@@ -135,3 +401,43 @@ func isStorageKindOwnerOfPVC(pvc *v1.PersistentVolumeClaim) bool {
 	}
 	return false
 }
+
+// getStorageOwnerOfPVC returns the storage owner reference of the
+// given PVC if available
+func getStorageOwnerOfPVC(pvc *v1.PersistentVolumeClaim) *metav1.OwnerReference {
+	owners := pvc.GetOwnerReferences()
+
+	for i, o := range owners {
+		if o.Kind == "Storage" &&
+			o.APIVersion == ddp.SchemeGroupVersion.String() &&
+			o.Controller != nil && *o.Controller {
+			return &owners[i]
+		}
+	}
+	return nil
+}
+
+// findPVCFromVA finds the namespace & name of the PVC that is
+// attached via the given VolumeAttachment
+func findPVCFromVA(va *storage.VolumeAttachment) (namespace, name string, found bool) {
+	anns := va.GetAnnotations()
+	namespace, nsFound := findValueFromDict(anns, pvcNamespaceKey)
+	name, nameFound := findValueFromDict(anns, pvcNameKey)
+	if nsFound && nameFound {
+		return namespace, name, true
+	}
+
+	// VolumeAttachments created by older versions have PVC as owner
+	// & are named as <pvc namespace>-<pvc name>
+	for _, o := range va.GetOwnerReferences() {
+		if o.Kind != "PersistentVolumeClaim" ||
+			o.APIVersion != v1.SchemeGroupVersion.String() {
+			continue
+		}
+		if !strings.HasSuffix(va.Name, "-"+o.Name) {
+			continue
+		}
+		return strings.TrimSuffix(va.Name, "-"+o.Name), o.Name, true
+	}
+	return "", "", false
+}
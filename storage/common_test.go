@@ -0,0 +1,243 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+func TestFindPVCFromVA(t *testing.T) {
+	tests := map[string]struct {
+		va        *storage.VolumeAttachment
+		namespace string
+		name      string
+		isFound   bool
+	}{
+		"annotated va": {
+			va: &storage.VolumeAttachment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "ns-1-pvc-1",
+					Annotations: map[string]string{
+						pvcNamespaceKey: "ns-1",
+						pvcNameKey:      "pvc-1",
+					},
+				},
+			},
+			namespace: "ns-1",
+			name:      "pvc-1",
+			isFound:   true,
+		},
+		"va created by older version": {
+			va: &storage.VolumeAttachment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "my-ns-pvc-1",
+					OwnerReferences: []metav1.OwnerReference{
+						{APIVersion: "v1", Kind: "PersistentVolumeClaim", Name: "pvc-1"},
+					},
+				},
+			},
+			namespace: "my-ns",
+			name:      "pvc-1",
+			isFound:   true,
+		},
+		"va not created by storage controller": {
+			va: &storage.VolumeAttachment{
+				ObjectMeta: metav1.ObjectMeta{Name: "csi-1234"},
+			},
+		},
+	}
+	for name, mock := range tests {
+		namespace, pvcName, found := findPVCFromVA(mock.va)
+		if found != mock.isFound {
+			t.Fatalf("%s: Expected found %t got %t", name, mock.isFound, found)
+		}
+		if namespace != mock.namespace || pvcName != mock.name {
+			t.Fatalf(
+				"%s: Expected PVC %s/%s got %s/%s",
+				name, mock.namespace, mock.name, namespace, pvcName,
+			)
+		}
+	}
+}
+
+func TestSplitNodeNames(t *testing.T) {
+	tests := map[string]struct {
+		val       string
+		nodeNames []string
+	}{
+		"empty":         {},
+		"single node":   {val: "node-1", nodeNames: []string{"node-1"}},
+		"multiple node": {val: "node-1,node-2", nodeNames: []string{"node-1", "node-2"}},
+		"extra spaces":  {val: " node-1 , ,node-2", nodeNames: []string{"node-1", "node-2"}},
+	}
+	for name, mock := range tests {
+		got := splitNodeNames(mock.val)
+		if !reflect.DeepEqual(got, mock.nodeNames) {
+			t.Fatalf("%s: Expected %v got %v", name, mock.nodeNames, got)
+		}
+	}
+}
+
+func TestJoinNodeNames(t *testing.T) {
+	val := joinNodeNames([]string{"node-1", "node-2"})
+	if val != "node-1,node-2" {
+		t.Fatalf("Expected node-1,node-2 got %s", val)
+	}
+}
+
+func TestIsMultiNodeAccess(t *testing.T) {
+	tests := map[string]struct {
+		modes   []v1.PersistentVolumeAccessMode
+		isMulti bool
+	}{
+		"none": {},
+		"read write once": {
+			modes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		},
+		"read write many": {
+			modes:   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadWriteMany},
+			isMulti: true,
+		},
+		"read only many": {
+			modes:   []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany},
+			isMulti: true,
+		},
+	}
+	for name, mock := range tests {
+		if got := isMultiNodeAccess(mock.modes); got != mock.isMulti {
+			t.Fatalf("%s: Expected multi node %t got %t", name, mock.isMulti, got)
+		}
+	}
+}
+
+func TestDefaultStorage(t *testing.T) {
+	newSC := func(name, provisioner string, isDefault bool) *storagev1.StorageClass {
+		sc := &storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: name},
+			Provisioner: provisioner,
+		}
+		if isDefault {
+			sc.Annotations = map[string]string{isDefaultStorageClassKey: "true"}
+		}
+		return sc
+	}
+
+	tests := map[string]struct {
+		scs              []interface{}
+		storageClassName *string
+		attacher         *string
+		expectedSC       *string
+		expectedAttacher *string
+		defaults         int
+	}{
+		"default storageclass & attacher": {
+			scs:              []interface{}{newSC("csi-sc", "csi.example.com", true)},
+			expectedSC:       strPtr("csi-sc"),
+			expectedAttacher: strPtr("csi.example.com"),
+			defaults:         2,
+		},
+		"default attacher of given storageclass": {
+			scs:              []interface{}{newSC("csi-sc", "csi.example.com", false)},
+			storageClassName: strPtr("csi-sc"),
+			expectedSC:       strPtr("csi-sc"),
+			expectedAttacher: strPtr("csi.example.com"),
+			defaults:         1,
+		},
+		"given attacher": {
+			scs:              []interface{}{newSC("csi-sc", "csi.example.com", false)},
+			storageClassName: strPtr("csi-sc"),
+			attacher:         strPtr("other.example.com"),
+			expectedSC:       strPtr("csi-sc"),
+			expectedAttacher: strPtr("other.example.com"),
+		},
+		"in-tree storageclass": {
+			scs:        []interface{}{newSC("standard", "kubernetes.io/gce-pd", true)},
+			expectedSC: strPtr("standard"),
+			defaults:   1,
+		},
+		"storageclass not found": {
+			storageClassName: strPtr("csi-sc"),
+			expectedSC:       strPtr("csi-sc"),
+		},
+		"ambiguous default storageclass": {
+			scs: []interface{}{
+				newSC("csi-sc", "csi.example.com", true),
+				newSC("standard", "kubernetes.io/gce-pd", true),
+			},
+		},
+	}
+	for name, mock := range tests {
+		stor := &ddp.Storage{
+			ObjectMeta: metav1.ObjectMeta{Name: "stor", Namespace: "default"},
+			Spec: ddp.StorageSpec{
+				StorageClassName: mock.storageClassName,
+				Attacher:         mock.attacher,
+			},
+		}
+		lister := storagev1listers.NewStorageClassLister(newIndexer(t, mock.scs...))
+
+		defaults, err := DefaultStorage(stor, lister)
+		if err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+		if len(defaults) != mock.defaults {
+			t.Fatalf("%s: Expected %d defaults got %v", name, mock.defaults, defaults)
+		}
+		if !reflect.DeepEqual(stor.Spec.StorageClassName, mock.expectedSC) {
+			t.Fatalf(
+				"%s: Expected storageclass %v got %v",
+				name, mock.expectedSC, stor.Spec.StorageClassName,
+			)
+		}
+		if !reflect.DeepEqual(stor.Spec.Attacher, mock.expectedAttacher) {
+			t.Fatalf(
+				"%s: Expected attacher %v got %v",
+				name, mock.expectedAttacher, stor.Spec.Attacher,
+			)
+		}
+
+		expectedLabels := map[string]string{managedByKey: managedByValue}
+		if mock.expectedSC != nil {
+			expectedLabels[storageclassKey] = *mock.expectedSC
+		}
+		if !reflect.DeepEqual(stor.Labels, expectedLabels) {
+			t.Fatalf("%s: Expected labels %v got %v", name, expectedLabels, stor.Labels)
+		}
+	}
+}
+
+func TestSetDefaultsApplied(t *testing.T) {
+	stor := &ddp.Storage{}
+	SetDefaultsApplied(stor, nil)
+	if stor.Annotations != nil {
+		t.Fatalf("Expected no annotations got %v", stor.Annotations)
+	}
+
+	SetDefaultsApplied(stor, []string{"first", "second"})
+	if got := stor.Annotations[defaultsAppliedKey]; got != "first; second" {
+		t.Fatalf("Expected %q got %q", "first; second", got)
+	}
+}
@@ -18,12 +18,18 @@ package storage
 
 import (
 	"strings"
+	"time"
 
 	"k8s.io/klog"
 
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	corelisters "k8s.io/client-go/listers/core/v1"
@@ -38,8 +44,30 @@ import (
 const (
 	// default controller name
 	defaultCtrlName string = "StorageController"
+
+	// waitInterval is the duration after which a reconcile key is
+	// requeued when the reconciler is waiting on some other controller
+	// e.g. waiting for a PVC to get bound
+	waitInterval time.Duration = 5 * time.Second
 )
 
+// Result is the outcome of a reconcile invocation
+type Result struct {
+	// Requeue tells the controller to requeue the reconcile key
+	// with rate limiting
+	Requeue bool
+
+	// RequeueAfter if greater than 0, tells the controller to requeue
+	// the reconcile key after this duration. This implies Requeue but
+	// is not treated as a failure.
+	RequeueAfter time.Duration
+}
+
+// waitResult returns a result that requeues after waitInterval
+func waitResult() Result {
+	return Result{RequeueAfter: waitInterval}
+}
+
 // storageQueueKey returns a key in string format corresponding to the
 // given storage. This string form is suitable to be used as a key.
 func storageQueueKey(s *ddp.Storage) string {
@@ -56,6 +84,13 @@ func parseQueueKey(key string) (namespace, name string) {
 	return splits[0], splits[1]
 }
 
+// storageSetQueueKey returns a key in string format corresponding to
+// the given storage set. This string form is suitable to be used as a
+// key.
+func storageSetQueueKey(s *ddp.StorageSet) string {
+	return s.Namespace + ":" + s.Name
+}
+
 // pvcQueueKey returns a key in string format corresponding to the
 // given PVC. This string form is suitable to be used as a key.
 func pvcQueueKey(p *v1.PersistentVolumeClaim) string {
@@ -71,18 +106,28 @@ type Controller struct {
 	InformerFactory    informers.SharedInformerFactory
 	DDPInformerFactory ddpinformers.SharedInformerFactory
 
-	// core reconciliation logic
-	StorageReconcilerFn func(*ddp.Storage) error
-	PVCReconcilerFn     func(*v1.PersistentVolumeClaim) error
+	// Registry holds the core reconciliation logic. Reconcilers
+	// must be registered before invoking Init.
+	Registry *Registry
 
 	// Queues to queue reconcile keys before invoking reconciliation
 	StorageQueue workqueue.RateLimitingInterface
 	PVCQueue     workqueue.RateLimitingInterface
 
+	// StorageSetQueue queues the storage set keys
+	//
+	// This is optional. It is required only if a storage set
+	// reconciler is registered.
+	StorageSetQueue workqueue.RateLimitingInterface
+
 	storageLister       ddplisters.StorageLister
 	storageListerSynced cache.InformerSynced
+	storageSetLister    ddplisters.StorageSetLister
+	storageSetSynced    cache.InformerSynced
 	pvcLister           corelisters.PersistentVolumeClaimLister
 	pvcListerSynced     cache.InformerSynced
+	vaListerSynced      cache.InformerSynced
+	nodeListerSynced    cache.InformerSynced
 }
 
 // String implements Stringer interface
@@ -106,11 +151,21 @@ func (ctrl *Controller) Init() error {
 	if ctrl.DDPInformerFactory == nil {
 		return errors.Errorf("%s: Init failed: Nil ddp informer factory", ctrl)
 	}
-	if ctrl.StorageReconcilerFn == nil {
-		return errors.Errorf("%s: Init failed: Nil storage reconciler", ctrl)
+	if ctrl.Registry == nil {
+		return errors.Errorf("%s: Init failed: Nil registry", ctrl)
 	}
-	if ctrl.PVCReconcilerFn == nil {
-		return errors.Errorf("%s: Init failed: Nil pvc reconciler", ctrl)
+	for _, gvk := range ctrl.Registry.Kinds() {
+		if gvk != StorageGVK && gvk != PVCGVK && gvk != StorageSetGVK {
+			return errors.Errorf(
+				"%s: Init failed: Unsupported reconciler kind %s", ctrl, gvk,
+			)
+		}
+	}
+	if len(ctrl.Registry.Registrations(StorageGVK)) == 0 {
+		return errors.Errorf("%s: Init failed: No storage reconciler", ctrl)
+	}
+	if len(ctrl.Registry.Registrations(PVCGVK)) == 0 {
+		return errors.Errorf("%s: Init failed: No pvc reconciler", ctrl)
 	}
 	if ctrl.StorageQueue == nil {
 		return errors.Errorf("%s: Init failed: Nil storage queue", ctrl)
@@ -118,13 +173,20 @@ func (ctrl *Controller) Init() error {
 	if ctrl.PVCQueue == nil {
 		return errors.Errorf("%s: Init failed: Nil pvc queue", ctrl)
 	}
+	storageSetEnabled := len(ctrl.Registry.Registrations(StorageSetGVK)) != 0
+	if storageSetEnabled && ctrl.StorageSetQueue == nil {
+		return errors.Errorf("%s: Init failed: Nil storage set queue", ctrl)
+	}
 
 	storageInformer := ctrl.DDPInformerFactory.Dao().V1alpha1().Storages()
 	pvcInformer := ctrl.InformerFactory.Core().V1().PersistentVolumeClaims()
+	vaInformer := ctrl.InformerFactory.Storage().V1beta1().VolumeAttachments()
+	nodeInformer := ctrl.InformerFactory.Core().V1().Nodes()
 
 	storageInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    ctrl.storageAdded,
 		UpdateFunc: ctrl.storageUpdated,
+		DeleteFunc: ctrl.storageDeleted,
 	})
 	ctrl.storageLister = storageInformer.Lister()
 	ctrl.storageListerSynced = storageInformer.Informer().HasSynced
@@ -132,10 +194,35 @@ func (ctrl *Controller) Init() error {
 	pvcInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    ctrl.pvcAdded,
 		UpdateFunc: ctrl.pvcUpdated,
+		DeleteFunc: ctrl.pvcDeleted,
 	})
 	ctrl.pvcLister = pvcInformer.Lister()
 	ctrl.pvcListerSynced = pvcInformer.Informer().HasSynced
 
+	vaInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    ctrl.vaAdded,
+		UpdateFunc: ctrl.vaUpdated,
+		DeleteFunc: ctrl.vaDeleted,
+	})
+	ctrl.vaListerSynced = vaInformer.Informer().HasSynced
+
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    ctrl.nodeAdded,
+		UpdateFunc: ctrl.nodeUpdated,
+		DeleteFunc: ctrl.nodeDeleted,
+	})
+	ctrl.nodeListerSynced = nodeInformer.Informer().HasSynced
+
+	if storageSetEnabled {
+		storageSetInformer := ctrl.DDPInformerFactory.Dao().V1alpha1().StorageSets()
+		storageSetInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    ctrl.storageSetAdded,
+			UpdateFunc: ctrl.storageSetUpdated,
+		})
+		ctrl.storageSetLister = storageSetInformer.Lister()
+		ctrl.storageSetSynced = storageSetInformer.Informer().HasSynced
+	}
+
 	return nil
 }
 
@@ -144,11 +231,23 @@ func (ctrl *Controller) Run(workers int, stopCh <-chan struct{}) {
 	// shutdown the queues
 	defer ctrl.StorageQueue.ShutDown()
 	defer ctrl.PVCQueue.ShutDown()
+	if ctrl.StorageSetQueue != nil {
+		defer ctrl.StorageSetQueue.ShutDown()
+	}
 
 	klog.Infof("Starting %s", ctrl)
 	defer klog.Infof("Shutting down %s", ctrl)
 
-	if !cache.WaitForCacheSync(stopCh, ctrl.storageListerSynced, ctrl.pvcListerSynced) {
+	synced := []cache.InformerSynced{
+		ctrl.storageListerSynced,
+		ctrl.pvcListerSynced,
+		ctrl.vaListerSynced,
+		ctrl.nodeListerSynced,
+	}
+	if ctrl.storageSetLister != nil {
+		synced = append(synced, ctrl.storageSetSynced)
+	}
+	if !cache.WaitForCacheSync(stopCh, synced...) {
 		klog.Errorf("%s: Cannot sync caches", ctrl)
 		return
 	}
@@ -157,6 +256,9 @@ func (ctrl *Controller) Run(workers int, stopCh <-chan struct{}) {
 		// run all reconcile funcs in a continuous loop
 		go wait.Until(ctrl.syncStorage, 0, stopCh)
 		go wait.Until(ctrl.syncPVC, 0, stopCh)
+		if ctrl.storageSetLister != nil {
+			go wait.Until(ctrl.syncStorageSet, 0, stopCh)
+		}
 	}
 
 	// block till stop is invoked
@@ -167,17 +269,79 @@ func (ctrl *Controller) Run(workers int, stopCh <-chan struct{}) {
 func (ctrl *Controller) storageAdded(obj interface{}) {
 	stor := obj.(*ddp.Storage)
 	ctrl.StorageQueue.Add(storageQueueKey(stor))
+	ctrl.enqueueStorageSetOfStorage(stor)
 }
 
 // storageAdded reacts to a storage update
 func (ctrl *Controller) storageUpdated(old, new interface{}) {
 	ctrl.storageAdded(new)
+
+	// storage set reacts to the storage getting released or adopted
+	oldStor := old.(*ddp.Storage)
+	if owner := metav1.GetControllerOf(oldStor); owner != nil &&
+		!isControlledBy(new.(*ddp.Storage), owner) {
+		ctrl.enqueueStorageSetOfStorage(oldStor)
+	}
+}
+
+// storageDeleted reacts to a storage deletion
+func (ctrl *Controller) storageDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	stor, ok := obj.(*ddp.Storage)
+	if !ok {
+		klog.Errorf("%s: Ignoring storage deletion: Invalid object %T", ctrl, obj)
+		return
+	}
+
+	// only the owner storage set needs to react to storage deletion
+	ctrl.enqueueStorageSetOfStorage(stor)
+}
+
+// enqueueStorageSetOfStorage enqueues the storage set that is the
+// controller of the given storage
+func (ctrl *Controller) enqueueStorageSetOfStorage(stor *ddp.Storage) {
+	if ctrl.storageSetLister == nil {
+		// storage sets are not reconciled
+		return
+	}
+	owner := metav1.GetControllerOf(stor)
+	if owner == nil ||
+		owner.Kind != StorageSetGVK.Kind ||
+		owner.APIVersion != StorageSetGVK.GroupVersion().String() {
+		return
+	}
+	ctrl.StorageSetQueue.Add(stor.Namespace + ":" + owner.Name)
+}
+
+// isControlledBy returns true if the given owner is the controller of
+// the given storage
+func isControlledBy(stor *ddp.Storage, owner *metav1.OwnerReference) bool {
+	controller := metav1.GetControllerOf(stor)
+	return controller != nil && controller.UID == owner.UID
+}
+
+// storageSetAdded reacts to a storage set creation
+func (ctrl *Controller) storageSetAdded(obj interface{}) {
+	set := obj.(*ddp.StorageSet)
+	ctrl.StorageSetQueue.Add(storageSetQueueKey(set))
+}
+
+// storageSetUpdated reacts to a storage set update
+func (ctrl *Controller) storageSetUpdated(old, new interface{}) {
+	ctrl.storageSetAdded(new)
 }
 
 // pvcAdded reacts to a PVC creation
 func (ctrl *Controller) pvcAdded(obj interface{}) {
 	pvc := obj.(*v1.PersistentVolumeClaim)
 
+	// owner storage reacts to PVC binding, resize, deletion, etc.
+	if key, found := ctrl.findStorageKeyFromPVC(pvc); found {
+		ctrl.StorageQueue.Add(key)
+	}
+
 	if !isStorageKindOwnerOfPVC(pvc) {
 		// this PVC does not belong to storage API
 		klog.V(3).Infof(
@@ -195,6 +359,155 @@ func (ctrl *Controller) pvcUpdated(old, new interface{}) {
 	ctrl.pvcAdded(new)
 }
 
+// pvcDeleted reacts to a PVC deletion
+func (ctrl *Controller) pvcDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pvc, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		klog.Errorf("%s: Ignoring PVC deletion: Invalid object %T", ctrl, obj)
+		return
+	}
+
+	// only the owner storage needs to react to PVC deletion
+	if key, found := ctrl.findStorageKeyFromPVC(pvc); found {
+		ctrl.StorageQueue.Add(key)
+	}
+}
+
+// findStorageKeyFromPVC returns the queue key of the storage that
+// owns the given PVC. Storage is found via the controller owner
+// reference & falls back to the storage UID annotation.
+func (ctrl *Controller) findStorageKeyFromPVC(
+	pvc *v1.PersistentVolumeClaim,
+) (string, bool) {
+
+	if owner := getStorageOwnerOfPVC(pvc); owner != nil {
+		return pvc.Namespace + ":" + owner.Name, true
+	}
+
+	uid, found := findValueFromDict(pvc.GetAnnotations(), storageUIDKey)
+	if !found || uid == "" {
+		return "", false
+	}
+
+	// PVC & storage must have same namespace
+	stors, err := ctrl.storageLister.Storages(pvc.Namespace).List(labels.Everything())
+	if err != nil {
+		klog.Errorf(
+			"%s: Find storage of PVC %s/%s failed: %v",
+			ctrl, pvc.Namespace, pvc.Name, err,
+		)
+		return "", false
+	}
+	for _, stor := range stors {
+		if string(stor.UID) == uid {
+			return storageQueueKey(stor), true
+		}
+	}
+	return "", false
+}
+
+// vaAdded reacts to a VolumeAttachment creation
+func (ctrl *Controller) vaAdded(obj interface{}) {
+	va := obj.(*storage.VolumeAttachment)
+
+	ns, name, found := findPVCFromVA(va)
+	if !found {
+		// this VolumeAttachment was not created by storage controller
+		return
+	}
+
+	// PVC reconciler manages the VolumeAttachment
+	ctrl.PVCQueue.Add(ns + ":" + name)
+
+	pvc, err := ctrl.pvcLister.PersistentVolumeClaims(ns).Get(name)
+	if err != nil {
+		klog.V(4).Infof(
+			"%s: Ignoring VA %s: Get PVC %s/%s: %v", ctrl, va.Name, ns, name, err,
+		)
+		return
+	}
+
+	// storage reconciler reflects the attach state
+	if key, found := ctrl.findStorageKeyFromPVC(pvc); found {
+		ctrl.StorageQueue.Add(key)
+	}
+}
+
+// vaUpdated reacts to a VolumeAttachment update
+func (ctrl *Controller) vaUpdated(old, new interface{}) {
+	ctrl.vaAdded(new)
+}
+
+// vaDeleted reacts to a VolumeAttachment deletion
+func (ctrl *Controller) vaDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if _, ok := obj.(*storage.VolumeAttachment); !ok {
+		klog.Errorf("%s: Ignoring VA deletion: Invalid object %T", ctrl, obj)
+		return
+	}
+	ctrl.vaAdded(obj)
+}
+
+// nodeAdded reacts to a node creation
+func (ctrl *Controller) nodeAdded(obj interface{}) {
+	node := obj.(*v1.Node)
+	ctrl.enqueueStoragesForNode(node)
+}
+
+// nodeUpdated reacts to a node update. Only the changes that affect
+// node selection are considered.
+func (ctrl *Controller) nodeUpdated(old, new interface{}) {
+	oldNode := old.(*v1.Node)
+	newNode := new.(*v1.Node)
+
+	if labels.Equals(oldNode.Labels, newNode.Labels) &&
+		oldNode.Spec.Unschedulable == newNode.Spec.Unschedulable &&
+		isNodeReady(oldNode) == isNodeReady(newNode) {
+		return
+	}
+	ctrl.enqueueStoragesForNode(newNode)
+}
+
+// nodeDeleted reacts to a node deletion
+func (ctrl *Controller) nodeDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		klog.Errorf("%s: Ignoring node deletion: Invalid object %T", ctrl, obj)
+		return
+	}
+	ctrl.enqueueStoragesForNode(node)
+}
+
+// enqueueStoragesForNode enqueues the storages whose node is selected
+// by the controller & are either waiting for a node or have selected
+// the given node
+func (ctrl *Controller) enqueueStoragesForNode(node *v1.Node) {
+	stors, err := ctrl.storageLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf(
+			"%s: Find storages of node %s failed: %v", ctrl, node.Name, err,
+		)
+		return
+	}
+
+	for _, stor := range stors {
+		if !isNodeSelectionRequired(stor) {
+			continue
+		}
+		if stor.Status.SelectedNode == "" || stor.Status.SelectedNode == node.Name {
+			ctrl.StorageQueue.Add(storageQueueKey(stor))
+		}
+	}
+}
+
 // syncStorage starts reconciliation of storage as per the needs of
 // storage controller
 func (ctrl *Controller) syncStorage() {
@@ -206,42 +519,65 @@ func (ctrl *Controller) syncStorage() {
 	defer ctrl.StorageQueue.Done(key)
 
 	storName := key.(string)
-	var err error
-	handleErr := func() {
-		if err != nil {
-			if apierrs.IsNotFound(err) {
-				// Storage was deleted in the meantime, ignore.
-				klog.V(3).Infof(
-					"%s: Sync ignored: Storage %q does not exist", ctrl, storName,
-				)
-				return
-			}
-			klog.Errorf(
-				"%s: Sync failed: Will re-queue storage %q: %v", ctrl, storName, err,
-			)
-			ctrl.StorageQueue.AddRateLimited(key)
-			return
-		}
-	}
-	defer handleErr()
-
 	klog.V(4).Infof("%s: Sync started: Storage %q", ctrl, storName)
 	ns, name := parseQueueKey(storName)
 
 	// get storage to process further
 	stor, err := ctrl.storageLister.Storages(ns).Get(name)
 	if err != nil {
+		if apierrs.IsNotFound(err) {
+			// Storage was deleted in the meantime, ignore.
+			klog.V(3).Infof(
+				"%s: Sync ignored: Storage %q does not exist", ctrl, storName,
+			)
+			ctrl.StorageQueue.Forget(key)
+			return
+		}
+		klog.Errorf(
+			"%s: Sync failed: Will re-queue storage %q: %v", ctrl, storName, err,
+		)
+		ctrl.StorageQueue.AddRateLimited(key)
 		return
 	}
 
-	err = ctrl.StorageReconcilerFn(stor)
+	ctrl.reconcile(ctrl.StorageQueue, StorageGVK, key, stor)
+	klog.V(4).Infof("%s: Sync completed: Storage %q", ctrl, storName)
+}
+
+// syncStorageSet starts reconciliation of storage set as per the needs
+// of storage controller
+func (ctrl *Controller) syncStorageSet() {
+	key, quit := ctrl.StorageSetQueue.Get()
+	if quit {
+		// nothing to do
+		return
+	}
+	defer ctrl.StorageSetQueue.Done(key)
+
+	setName := key.(string)
+	klog.V(4).Infof("%s: Sync started: Storage set %q", ctrl, setName)
+	ns, name := parseQueueKey(setName)
+
+	// get storage set to process further
+	set, err := ctrl.storageSetLister.StorageSets(ns).Get(name)
 	if err != nil {
+		if apierrs.IsNotFound(err) {
+			// Storage set was deleted in the meantime, ignore.
+			klog.V(3).Infof(
+				"%s: Sync ignored: Storage set %q does not exist", ctrl, setName,
+			)
+			ctrl.StorageSetQueue.Forget(key)
+			return
+		}
+		klog.Errorf(
+			"%s: Sync failed: Will re-queue storage set %q: %v", ctrl, setName, err,
+		)
+		ctrl.StorageSetQueue.AddRateLimited(key)
 		return
 	}
 
-	// The operation has finished successfully, reset exponential backoff
-	ctrl.StorageQueue.Forget(key)
-	klog.V(4).Infof("%s: Sync completed: Storage %q", ctrl, storName)
+	ctrl.reconcile(ctrl.StorageSetQueue, StorageSetGVK, key, set)
+	klog.V(4).Infof("%s: Sync completed: Storage set %q", ctrl, setName)
 }
 
 // syncPVC starts reconciliation of PVC as per the needs of storage
@@ -255,39 +591,85 @@ func (ctrl *Controller) syncPVC() {
 	defer ctrl.PVCQueue.Done(key)
 
 	pvcName := key.(string)
-	var err error
-	handleErr := func() {
-		if err != nil {
-			if apierrs.IsNotFound(err) {
-				// PV was deleted in the meantime, ignore.
-				klog.V(3).Infof(
-					"%s: Sync ignored: PVC %q does not exist", ctrl, pvcName,
-				)
-				return
-			}
-			klog.Errorf(
-				"%s: Sync failed: Will re-queue PVC %q: %v", ctrl, pvcName, err,
-			)
-			ctrl.PVCQueue.AddRateLimited(key)
-		}
-	}
-	defer handleErr()
-
 	klog.V(4).Infof("%s: Sync started: PVC %q", ctrl, pvcName)
 	ns, name := parseQueueKey(pvcName)
 
 	// get PVC to process
 	pvc, err := ctrl.pvcLister.PersistentVolumeClaims(ns).Get(name)
 	if err != nil {
+		if apierrs.IsNotFound(err) {
+			// PVC was deleted in the meantime, ignore.
+			klog.V(3).Infof(
+				"%s: Sync ignored: PVC %q does not exist", ctrl, pvcName,
+			)
+			ctrl.PVCQueue.Forget(key)
+			return
+		}
+		klog.Errorf(
+			"%s: Sync failed: Will re-queue PVC %q: %v", ctrl, pvcName, err,
+		)
+		ctrl.PVCQueue.AddRateLimited(key)
 		return
 	}
 
-	err = ctrl.PVCReconcilerFn(pvc)
-	if err != nil {
-		return
+	ctrl.reconcile(ctrl.PVCQueue, PVCGVK, key, pvc)
+	klog.V(4).Infof("%s: Sync completed: PVC %q", ctrl, pvcName)
+}
+
+// reconcile invokes all the reconcilers registered against the given
+// kind in the order of their registration. Error or requeue of each
+// reconciler is handled on its own i.e. a failing reconciler does not
+// stop the reconcilers registered after it.
+//
+// NOTE:
+//	Back off is tracked per key by the queue's rate limiter. The key
+// backs off if any of the reconcilers failed or asked for a requeue
+// & is forgotten only when none of them did. A wait asked by any of
+// the reconcilers is honoured in addition to the back off.
+func (ctrl *Controller) reconcile(
+	queue workqueue.RateLimitingInterface,
+	gvk schema.GroupVersionKind,
+	key interface{},
+	obj runtime.Object,
+) {
+
+	var (
+		backoff      bool
+		requeueAfter time.Duration
+	)
+
+	for _, reg := range ctrl.Registry.Registrations(gvk) {
+		// each reconciler gets its own copy to work with
+		result, err := reg.Reconciler.Reconcile(obj.DeepCopyObject())
+
+		switch {
+		case err != nil:
+			klog.Errorf(
+				"%s: %s: Reconcile failed: Will re-queue %q: %v",
+				ctrl, reg.Name, key, err,
+			)
+			backoff = true
+		case result.RequeueAfter > 0:
+			klog.V(4).Infof(
+				"%s: %s: Will re-queue %q after %s",
+				ctrl, reg.Name, key, result.RequeueAfter,
+			)
+			if requeueAfter == 0 || result.RequeueAfter < requeueAfter {
+				requeueAfter = result.RequeueAfter
+			}
+		case result.Requeue:
+			klog.V(4).Infof("%s: %s: Will re-queue %q", ctrl, reg.Name, key)
+			backoff = true
+		}
 	}
 
-	// The operation has finished successfully, reset exponential backoff
-	ctrl.PVCQueue.Forget(key)
-	klog.V(4).Infof("%s: Sync completed: PVC %q", ctrl, pvcName)
+	if backoff {
+		queue.AddRateLimited(key)
+	} else {
+		// none failed, reset exponential backoff
+		queue.Forget(key)
+	}
+	if requeueAfter > 0 {
+		queue.AddAfter(key, requeueAfter)
+	}
 }
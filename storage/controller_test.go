@@ -0,0 +1,442 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	ddplisters "github.com/mayadata-io/storage-provisioner/client/generated/lister/dao/v1alpha1"
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+func TestControllerReconcile(t *testing.T) {
+	var invoked []string
+	newRegistration := func(name string, result Result, err error) Registration {
+		return Registration{
+			Name: name,
+			Reconciler: StorageReconcilerFunc(func(*ddp.Storage) (Result, error) {
+				invoked = append(invoked, name)
+				return result, err
+			}),
+		}
+	}
+
+	tests := map[string]struct {
+		registrations []Registration
+		isBackoff     bool
+		requeueAfter  time.Duration
+	}{
+		"all done": {
+			registrations: []Registration{
+				newRegistration("first", Result{}, nil),
+				newRegistration("second", Result{}, nil),
+			},
+		},
+		"failure does not stop the next reconciler": {
+			registrations: []Registration{
+				newRegistration("first", Result{}, errors.New("failed")),
+				newRegistration("second", Result{}, nil),
+			},
+			isBackoff: true,
+		},
+		"requeue backs off": {
+			registrations: []Registration{
+				newRegistration("first", Result{Requeue: true}, nil),
+				newRegistration("second", Result{}, nil),
+			},
+			isBackoff: true,
+		},
+		"smallest wait wins": {
+			registrations: []Registration{
+				newRegistration("first", waitResult(), nil),
+				newRegistration("second", Result{RequeueAfter: time.Second}, nil),
+			},
+			requeueAfter: time.Second,
+		},
+		"wait does not reset back off of a failure": {
+			registrations: []Registration{
+				newRegistration("first", Result{}, errors.New("failed")),
+				newRegistration("second", Result{RequeueAfter: time.Second}, nil),
+			},
+			isBackoff:    true,
+			requeueAfter: time.Second,
+		},
+	}
+	for name, mock := range tests {
+		invoked = nil
+		registry := NewRegistry()
+		for _, reg := range mock.registrations {
+			registry.MustRegister(StorageGVK, reg.Name, reg.Reconciler)
+		}
+		queue := &fakeQueue{
+			RateLimitingInterface: workqueue.NewRateLimitingQueue(
+				workqueue.DefaultControllerRateLimiter(),
+			),
+		}
+		ctrl := &Controller{Name: "test", Registry: registry}
+
+		ctrl.reconcile(queue, StorageGVK, "default/stor", &ddp.Storage{})
+		queue.ShutDown()
+
+		if len(invoked) != len(mock.registrations) {
+			t.Fatalf(
+				"%s: Expected %d reconcilers to be invoked got %v",
+				name, len(mock.registrations), invoked,
+			)
+		}
+		for i, reg := range mock.registrations {
+			if invoked[i] != reg.Name {
+				t.Fatalf("%s: Expected %s at %d got %s", name, reg.Name, i, invoked[i])
+			}
+		}
+		if queue.isRateLimited != mock.isBackoff {
+			t.Fatalf(
+				"%s: Expected back off %t got %t",
+				name, mock.isBackoff, queue.isRateLimited,
+			)
+		}
+		if queue.isForgotten == mock.isBackoff {
+			t.Fatalf(
+				"%s: Expected forget %t got %t",
+				name, !mock.isBackoff, queue.isForgotten,
+			)
+		}
+		if queue.after != mock.requeueAfter {
+			t.Fatalf(
+				"%s: Expected requeue after %s got %s",
+				name, mock.requeueAfter, queue.after,
+			)
+		}
+	}
+}
+
+func TestControllerReconcileBackoffPerKey(t *testing.T) {
+	var err error
+	registry := NewRegistry()
+	registry.MustRegister(
+		StorageGVK, "first", StorageReconcilerFunc(func(*ddp.Storage) (Result, error) {
+			return Result{}, err
+		}),
+	)
+	registry.MustRegister(
+		StorageGVK, "second", StorageReconcilerFunc(func(*ddp.Storage) (Result, error) {
+			return waitResult(), nil
+		}),
+	)
+	queue := workqueue.NewRateLimitingQueue(
+		workqueue.NewItemExponentialFailureRateLimiter(time.Hour, time.Hour),
+	)
+	defer queue.ShutDown()
+	ctrl := &Controller{Name: "test", Registry: registry}
+
+	err = errors.New("failed")
+	for i := 1; i <= 2; i++ {
+		ctrl.reconcile(queue, StorageGVK, "default/stor", &ddp.Storage{})
+		if queue.NumRequeues("default/stor") != i {
+			t.Fatalf(
+				"Expected %d requeues got %d", i, queue.NumRequeues("default/stor"),
+			)
+		}
+	}
+	if queue.NumRequeues("default/other") != 0 {
+		t.Fatalf(
+			"Expected no requeues of other key got %d",
+			queue.NumRequeues("default/other"),
+		)
+	}
+
+	err = nil
+	ctrl.reconcile(queue, StorageGVK, "default/stor", &ddp.Storage{})
+	if queue.NumRequeues("default/stor") != 0 {
+		t.Fatalf(
+			"Expected back off to be reset got %d requeues",
+			queue.NumRequeues("default/stor"),
+		)
+	}
+}
+
+// fakeQueue records the back off & delayed addition of a key
+type fakeQueue struct {
+	workqueue.RateLimitingInterface
+
+	isRateLimited bool
+	isForgotten   bool
+	after         time.Duration
+}
+
+func (q *fakeQueue) AddRateLimited(item interface{}) {
+	q.isRateLimited = true
+}
+
+func (q *fakeQueue) Forget(item interface{}) {
+	q.isForgotten = true
+}
+
+func (q *fakeQueue) AddAfter(item interface{}, after time.Duration) {
+	q.after = after
+}
+
+func TestStorageReconcilerFuncInvalidObject(t *testing.T) {
+	fn := StorageReconcilerFunc(func(*ddp.Storage) (Result, error) {
+		return Result{}, nil
+	})
+
+	var obj runtime.Object = &runtime.Unknown{}
+	if _, err := fn.Reconcile(obj); err == nil {
+		t.Fatalf("Expected error got none")
+	}
+}
+
+func TestControllerVADeleted(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+	pvc := newAttachablePVC(stor, "node-1")
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: vaNameForPVC(pvc, "node-1"),
+			Annotations: map[string]string{
+				pvcNamespaceKey: pvc.Namespace,
+				pvcNameKey:      pvc.Name,
+			},
+		},
+	}
+
+	ctrl := &Controller{
+		Name:         "test",
+		StorageQueue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		PVCQueue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		pvcLister:    corelisters.NewPersistentVolumeClaimLister(newIndexer(t, pvc)),
+	}
+	defer ctrl.StorageQueue.ShutDown()
+	defer ctrl.PVCQueue.ShutDown()
+
+	// deletion may be observed as a tombstone
+	ctrl.vaDeleted(cache.DeletedFinalStateUnknown{Key: va.Name, Obj: va})
+
+	if key, _ := ctrl.PVCQueue.Get(); key != pvcQueueKey(pvc) {
+		t.Fatalf("Expected PVC %s to be queued got %v", pvc.Name, key)
+	}
+	if key, _ := ctrl.StorageQueue.Get(); key != storageQueueKey(stor) {
+		t.Fatalf("Expected storage %s to be queued got %v", stor.Name, key)
+	}
+}
+
+func TestControllerPVCDeleted(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+
+	// owner reference is removed from this PVC
+	orphan := newAttachablePVC(stor, "node-1")
+	orphan.OwnerReferences = nil
+	orphan.Annotations[storageUIDKey] = string(stor.UID)
+
+	unowned := newAttachablePVC(stor, "node-1")
+	unowned.OwnerReferences = nil
+
+	tests := map[string]struct {
+		pvc      *v1.PersistentVolumeClaim
+		isQueued bool
+	}{
+		"owned pvc": {
+			pvc:      newAttachablePVC(stor, "node-1"),
+			isQueued: true,
+		},
+		"pvc with storage uid": {
+			pvc:      orphan,
+			isQueued: true,
+		},
+		"pvc not owned by storage": {
+			pvc: unowned,
+		},
+	}
+	for name, mock := range tests {
+		ctrl := &Controller{
+			Name:          "test",
+			StorageQueue:  workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+			storageLister: ddplisters.NewStorageLister(newIndexer(t, stor)),
+		}
+
+		ctrl.pvcDeleted(cache.DeletedFinalStateUnknown{Key: mock.pvc.Name, Obj: mock.pvc})
+
+		if !mock.isQueued {
+			if ctrl.StorageQueue.Len() != 0 {
+				t.Fatalf("%s: Expected no storage to be queued", name)
+			}
+			continue
+		}
+		if key, _ := ctrl.StorageQueue.Get(); key != storageQueueKey(stor) {
+			t.Fatalf("%s: Expected storage %s to be queued got %v", name, stor.Name, key)
+		}
+		ctrl.StorageQueue.ShutDown()
+	}
+}
+
+func TestControllerNodeUpdated(t *testing.T) {
+	// storage waiting for a node to get selected
+	waiting := newTestStorage("waiting", "")
+	waiting.Spec.NodeName = nil
+	waiting.Spec.NodeSelector = map[string]string{"zone": "zone-a"}
+
+	// storage that has selected node-2
+	selected := waiting.DeepCopy()
+	selected.Name = "selected"
+	selected.Status.SelectedNode = "node-2"
+
+	// storage with an explicit node
+	explicit := newTestStorage("explicit", "node-1")
+
+	ready := newTestNode("node-1", v1.ConditionTrue)
+	notReady := newTestNode("node-1", v1.ConditionFalse)
+	relabelled := ready.DeepCopy()
+	relabelled.Labels = map[string]string{"zone": "zone-a"}
+
+	tests := map[string]struct {
+		old, new *v1.Node
+		queued   []string
+	}{
+		"no change": {
+			old: ready,
+			new: ready.DeepCopy(),
+		},
+		"node became ready": {
+			old:    notReady,
+			new:    ready,
+			queued: []string{storageQueueKey(waiting)},
+		},
+		"node labels changed": {
+			old:    ready,
+			new:    relabelled,
+			queued: []string{storageQueueKey(waiting)},
+		},
+	}
+	for name, mock := range tests {
+		ctrl := &Controller{
+			Name:         "test",
+			StorageQueue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+			storageLister: ddplisters.NewStorageLister(
+				newIndexer(t, waiting, selected, explicit),
+			),
+		}
+
+		ctrl.nodeUpdated(mock.old, mock.new)
+
+		if ctrl.StorageQueue.Len() != len(mock.queued) {
+			t.Fatalf("%s: Expected %v to be queued got %d", name, mock.queued, ctrl.StorageQueue.Len())
+		}
+		for _, expected := range mock.queued {
+			if key, _ := ctrl.StorageQueue.Get(); key != expected {
+				t.Fatalf("%s: Expected storage %s to be queued got %v", name, expected, key)
+			}
+		}
+		ctrl.StorageQueue.ShutDown()
+	}
+}
+
+func TestControllerNodeDeleted(t *testing.T) {
+	stor := newTestStorage("stor", "")
+	stor.Spec.NodeName = nil
+	stor.Spec.NodeSelector = map[string]string{"zone": "zone-a"}
+	stor.Status.SelectedNode = "node-1"
+
+	ctrl := &Controller{
+		Name:          "test",
+		StorageQueue:  workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		storageLister: ddplisters.NewStorageLister(newIndexer(t, stor)),
+	}
+	defer ctrl.StorageQueue.ShutDown()
+
+	// storage selects another node once its node is deleted
+	node := newTestNode("node-1", v1.ConditionTrue)
+	ctrl.nodeDeleted(cache.DeletedFinalStateUnknown{Key: node.Name, Obj: node})
+
+	if key, _ := ctrl.StorageQueue.Get(); key != storageQueueKey(stor) {
+		t.Fatalf("Expected storage %s to be queued got %v", stor.Name, key)
+	}
+}
+
+func TestStorageSetReconcilerFuncInvalidObject(t *testing.T) {
+	fn := StorageSetReconcilerFunc(func(*ddp.StorageSet) (Result, error) {
+		return Result{}, nil
+	})
+
+	var obj runtime.Object = &runtime.Unknown{}
+	if _, err := fn.Reconcile(obj); err == nil {
+		t.Fatalf("Expected error got none")
+	}
+}
+
+func TestControllerStorageEventsQueueStorageSet(t *testing.T) {
+	set := newTestStorageSet(1, ddp.StorageSetRetentionRetain)
+	owned := newSetStorage(set, 0, ddp.StorageAttached)
+	released := owned.DeepCopy()
+	released.OwnerReferences = nil
+
+	tests := map[string]struct {
+		event  func(ctrl *Controller)
+		queued bool
+	}{
+		"storage added": {
+			event:  func(ctrl *Controller) { ctrl.storageAdded(owned) },
+			queued: true,
+		},
+		"storage released": {
+			event:  func(ctrl *Controller) { ctrl.storageUpdated(owned, released) },
+			queued: true,
+		},
+		"storage deleted": {
+			event: func(ctrl *Controller) {
+				ctrl.storageDeleted(cache.DeletedFinalStateUnknown{Key: owned.Name, Obj: owned})
+			},
+			queued: true,
+		},
+		"storage without set": {
+			event: func(ctrl *Controller) { ctrl.storageAdded(released) },
+		},
+	}
+	for name, mock := range tests {
+		ctrl := &Controller{
+			Name:             "test",
+			StorageQueue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+			StorageSetQueue:  workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+			storageSetLister: ddplisters.NewStorageSetLister(newIndexer(t, set)),
+		}
+
+		mock.event(ctrl)
+
+		if mock.queued != (ctrl.StorageSetQueue.Len() == 1) {
+			t.Fatalf(
+				"%s: Expected queued %t got %d queued",
+				name, mock.queued, ctrl.StorageSetQueue.Len(),
+			)
+		}
+		if mock.queued {
+			if key, _ := ctrl.StorageSetQueue.Get(); key != storageSetQueueKey(set) {
+				t.Fatalf("%s: Expected storage set %s to be queued got %v", name, set.Name, key)
+			}
+		}
+		ctrl.StorageQueue.ShutDown()
+		ctrl.StorageSetQueue.ShutDown()
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+// Reasons used by the events emitted by storage controller
+const (
+	// EventPVCCreated is emitted when a PVC is created for a storage
+	EventPVCCreated string = "PVCCreated"
+
+	// EventPVCResized is emitted when PVC capacity is updated as per
+	// the storage capacity
+	EventPVCResized string = "PVCResized"
+
+	// EventResizeRejected is emitted when the PVC can not be resized
+	// to the storage capacity e.g. when the storage is shrunk
+	EventResizeRejected string = "ResizeRejected"
+
+	// EventPVCDeleted is emitted when a PVC is deleted as part of
+	// storage teardown
+	EventPVCDeleted string = "PVCDeleted"
+
+	// EventVolumeAttachmentCreated is emitted when a VolumeAttachment
+	// is created for a PVC
+	EventVolumeAttachmentCreated string = "VolumeAttachmentCreated"
+
+	// EventVolumeAttachmentDeleted is emitted when a VolumeAttachment
+	// is deleted as part of storage teardown
+	EventVolumeAttachmentDeleted string = "VolumeAttachmentDeleted"
+
+	// EventReattaching is emitted when the storage is being detached
+	// from its current node to get attached to a new node
+	EventReattaching string = "Reattaching"
+
+	// EventDetaching is emitted when the storage is being detached
+	// since no node is selected
+	EventDetaching string = "Detaching"
+
+	// EventNodeSelected is emitted when a node is selected based on
+	// the node selector & node affinity of the storage
+	EventNodeSelected string = "NodeSelected"
+
+	// EventNodeChanged is emitted when the node of the storage is
+	// propagated to its PVC
+	EventNodeChanged string = "NodeChanged"
+
+	// EventMigrated is emitted when the storage is attached to its new
+	// node after getting detached from the previous node
+	EventMigrated string = "Migrated"
+
+	// EventSpecMigrated is emitted when the deprecated annotations of
+	// the storage are moved to its spec
+	EventSpecMigrated string = "SpecMigrated"
+
+	// EventDefaulted is emitted when defaults are applied to the spec
+	// of the storage e.g. the default storageclass
+	EventDefaulted string = "Defaulted"
+
+	// EventInvalidSpec is emitted when the storage spec is not valid
+	EventInvalidSpec string = "InvalidSpec"
+
+	// EventTopologyMismatch is emitted when the storage can not be
+	// attached to a node due to the node affinity of its volume
+	EventTopologyMismatch string = "TopologyMismatch"
+
+	// EventAttachLimitReached is emitted when the storage can not be
+	// attached to a node since the node has reached the attach limit
+	// of the driver
+	EventAttachLimitReached string = "AttachLimitReached"
+
+	// EventStorageCreated is emitted when a storage is created for an
+	// ordinal of a storage set
+	EventStorageCreated string = "StorageCreated"
+
+	// EventStorageAdopted is emitted when a storage retained on an
+	// earlier scale down is adopted back by its storage set
+	EventStorageAdopted string = "StorageAdopted"
+
+	// EventStorageRetained is emitted when a storage is released by
+	// its storage set on scale down without being deleted
+	EventStorageRetained string = "StorageRetained"
+
+	// EventStorageDeleted is emitted when a storage is deleted on
+	// scale down of its storage set
+	EventStorageDeleted string = "StorageDeleted"
+
+	// EventNameConflict is emitted when the name of a storage of a
+	// storage set is taken by a storage that is not part of the set
+	EventNameConflict string = "NameConflict"
+
+	// EventCreateFailed is emitted when a resource could not be created
+	EventCreateFailed string = "CreateFailed"
+
+	// EventUpdateFailed is emitted when a resource could not be updated
+	EventUpdateFailed string = "UpdateFailed"
+
+	// EventDeleteFailed is emitted when a resource could not be deleted
+	EventDeleteFailed string = "DeleteFailed"
+)
+
+// getStorageReferenceFromPVC returns the reference of the storage that
+// owns the given PVC. It returns nil if PVC is not owned by any
+// storage.
+func getStorageReferenceFromPVC(pvc *v1.PersistentVolumeClaim) *v1.ObjectReference {
+	owner := getStorageOwnerOfPVC(pvc)
+	if owner == nil {
+		return nil
+	}
+
+	return &v1.ObjectReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Namespace:  pvc.Namespace,
+		Name:       owner.Name,
+		UID:        owner.UID,
+	}
+}
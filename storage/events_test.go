@@ -0,0 +1,138 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	"k8s.io/client-go/tools/record"
+
+	ddplisters "github.com/mayadata-io/storage-provisioner/client/generated/lister/dao/v1alpha1"
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// drainEvents returns the events recorded so far
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// expectEvents fails unless each of the given prefixes matches
+// an event recorded so far
+func expectEvents(t *testing.T, recorder *record.FakeRecorder, prefixes ...string) {
+	t.Helper()
+
+	events := drainEvents(recorder)
+	for _, prefix := range prefixes {
+		found := false
+		for _, event := range events {
+			if strings.HasPrefix(event, prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("Expected event %q got %v", prefix, events)
+		}
+	}
+}
+
+func TestStorageReconcilerInvalidSpecEvent(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+	stor.Spec.StorageClassName = nil
+
+	ddpStorages := &fakeStorages{updated: map[string]*ddp.Storage{}}
+	recorder := record.NewFakeRecorder(10)
+	r := &StorageReconciler{
+		Clientset:          fake.NewSimpleClientset(),
+		DDPClientset:       &fakeDDPClientset{storages: ddpStorages},
+		PVCLister:          corelisters.NewPersistentVolumeClaimLister(newIndexer(t)),
+		PVLister:           corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister:         corelisters.NewNodeLister(newIndexer(t)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:           recorder,
+	}
+
+	// storage is not retried till its spec is fixed
+	if _, err := r.Reconcile(stor); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	expectEvents(t, recorder, "Warning "+EventInvalidSpec)
+
+	updated := ddpStorages.updated[stor.Namespace+"/"+stor.Name]
+	if updated.Status.Phase != ddp.StorageFailed || updated.Status.Reason != EventInvalidSpec {
+		t.Fatalf(
+			"Expected Failed: %s got %s: %s",
+			EventInvalidSpec, updated.Status.Phase, updated.Status.Reason,
+		)
+	}
+}
+
+func TestPVCReconcilerEventsAgainstOwner(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+	pvc := newAttachablePVC(stor, "node-1")
+
+	recorder := record.NewFakeRecorder(10)
+	r := &PVCReconciler{
+		Clientset:       fake.NewSimpleClientset(),
+		VALister:        storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageLister:   ddplisters.NewStorageLister(newIndexer(t, stor)),
+		PVLister:        newTestPVLister(t, stor),
+		NodeLister:      corelisters.NewNodeLister(newIndexer(t)),
+		CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:        recorder,
+	}
+
+	if _, err := r.Reconcile(pvc); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	// one event against the PVC & another against its storage
+	events := drainEvents(recorder)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events got %v", events)
+	}
+	if !strings.HasPrefix(events[0], "Normal "+EventVolumeAttachmentCreated) {
+		t.Fatalf("Expected event %s got %s", EventVolumeAttachmentCreated, events[0])
+	}
+	prefix := "Normal " + EventVolumeAttachmentCreated + " PVC " + pvc.Name + ": "
+	if !strings.HasPrefix(events[1], prefix) {
+		t.Fatalf("Expected event %q got %s", prefix, events[1])
+	}
+
+	_, err := r.Clientset.StorageV1beta1().VolumeAttachments().
+		Get(vaNameForPVC(pvc, "node-1"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected VA got %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	storage "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+)
+
+// attachUsage is the number of volumes of a CSI driver that are
+// attached to a node against the limit set by the driver
+type attachUsage struct {
+	nodeName string
+	driver   string
+
+	// number of VolumeAttachments of this driver against this node
+	count int
+
+	// max number of volumes that can be attached; this is valid only
+	// if limited is true
+	limit   int32
+	limited bool
+}
+
+// isFull returns true if no more volumes can be attached
+func (u attachUsage) isFull() bool {
+	return u.limited && int32(u.count) >= u.limit
+}
+
+// String implements Stringer interface
+func (u attachUsage) String() string {
+	if !u.limited {
+		return fmt.Sprintf(
+			"Node %s has %d volumes of driver %s attached", u.nodeName, u.count, u.driver,
+		)
+	}
+	return fmt.Sprintf(
+		"Node %s has %d of %d volumes of driver %s attached",
+		u.nodeName, u.count, u.limit, u.driver,
+	)
+}
+
+// getAttachLimit returns the max number of volumes of the given driver
+// that can be attached to the given node. This limit is reported by
+// the driver in CSINode. False is returned if there is no limit.
+func getAttachLimit(
+	lister storagelisters.CSINodeLister, nodeName, driver string,
+) (int32, bool, error) {
+
+	// CSINode has the same name as its node
+	csiNode, err := lister.Get(nodeName)
+	if apierrs.IsNotFound(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "Get CSINode %s failed", nodeName)
+	}
+
+	for _, d := range csiNode.Spec.Drivers {
+		if d.Name != driver {
+			continue
+		}
+		if d.Allocatable == nil || d.Allocatable.Count == nil {
+			return 0, false, nil
+		}
+		return *d.Allocatable.Count, true, nil
+	}
+	return 0, false, nil
+}
+
+// countAttachments returns the number of the given VolumeAttachments
+// that attach volumes of the given driver to the given node
+func countAttachments(
+	vas []*storage.VolumeAttachment, nodeName, driver string,
+) int {
+
+	var count int
+	for _, va := range vas {
+		if va.Spec.NodeName == nodeName && va.Spec.Attacher == driver {
+			count++
+		}
+	}
+	return count
+}
+
+// getAttachUsage returns the number of volumes of the given driver
+// attached to the given node against its limit
+func getAttachUsage(
+	csiNodeLister storagelisters.CSINodeLister,
+	vaLister storagelisters.VolumeAttachmentLister,
+	nodeName, driver string,
+) (attachUsage, error) {
+
+	usage := attachUsage{nodeName: nodeName, driver: driver}
+
+	var err error
+	usage.limit, usage.limited, err = getAttachLimit(csiNodeLister, nodeName, driver)
+	if err != nil {
+		return attachUsage{}, err
+	}
+
+	vas, err := vaLister.List(labels.Everything())
+	if err != nil {
+		return attachUsage{}, errors.Wrapf(err, "List VAs failed")
+	}
+	usage.count = countAttachments(vas, nodeName, driver)
+	return usage, nil
+}
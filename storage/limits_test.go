@@ -0,0 +1,135 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"testing"
+
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+)
+
+// newTestCSINode returns a CSINode that reports the given attach
+// limit for csi.example.com driver
+func newTestCSINode(nodeName string, limit int32) *storage.CSINode {
+	return &storage.CSINode{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeName},
+		Spec: storage.CSINodeSpec{
+			Drivers: []storage.CSINodeDriver{
+				{
+					Name:        "csi.example.com",
+					NodeID:      nodeName,
+					Allocatable: &storage.VolumeNodeResources{Count: &limit},
+				},
+			},
+		},
+	}
+}
+
+func TestGetAttachLimit(t *testing.T) {
+	unlimited := &storage.CSINode{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-2"},
+		Spec: storage.CSINodeSpec{
+			Drivers: []storage.CSINodeDriver{
+				{Name: "csi.example.com", NodeID: "node-2"},
+			},
+		},
+	}
+	lister := storagelisters.NewCSINodeLister(newIndexer(t,
+		newTestCSINode("node-1", 2), unlimited,
+	))
+
+	tests := map[string]struct {
+		nodeName  string
+		driver    string
+		limit     int32
+		isLimited bool
+	}{
+		"limit reported": {
+			nodeName:  "node-1",
+			driver:    "csi.example.com",
+			limit:     2,
+			isLimited: true,
+		},
+		"limit not reported": {
+			nodeName: "node-2",
+			driver:   "csi.example.com",
+		},
+		"driver not registered": {
+			nodeName: "node-1",
+			driver:   "other.example.com",
+		},
+		"csinode not found": {
+			nodeName: "node-3",
+			driver:   "csi.example.com",
+		},
+	}
+	for name, mock := range tests {
+		limit, limited, err := getAttachLimit(lister, mock.nodeName, mock.driver)
+		if err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+		if limited != mock.isLimited || limit != mock.limit {
+			t.Fatalf(
+				"%s: Expected limit %d, %t got %d, %t",
+				name, mock.limit, mock.isLimited, limit, limited,
+			)
+		}
+	}
+}
+
+func TestGetAttachUsage(t *testing.T) {
+	newVA := func(name, nodeName, driver string) *storage.VolumeAttachment {
+		return &storage.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       storage.VolumeAttachmentSpec{NodeName: nodeName, Attacher: driver},
+		}
+	}
+	csiNodeLister := storagelisters.NewCSINodeLister(newIndexer(t,
+		newTestCSINode("node-1", 2),
+	))
+	vaLister := storagelisters.NewVolumeAttachmentLister(newIndexer(t,
+		newVA("va-1", "node-1", "csi.example.com"),
+		newVA("va-2", "node-1", "other.example.com"),
+		newVA("va-3", "node-2", "csi.example.com"),
+	))
+
+	usage, err := getAttachUsage(csiNodeLister, vaLister, "node-1", "csi.example.com")
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if usage.count != 1 || usage.isFull() {
+		t.Fatalf("Expected 1 of 2 slots to be used got %s", usage)
+	}
+	expected := "Node node-1 has 1 of 2 volumes of driver csi.example.com attached"
+	if usage.String() != expected {
+		t.Fatalf("Expected %q got %q", expected, usage.String())
+	}
+
+	vaLister = storagelisters.NewVolumeAttachmentLister(newIndexer(t,
+		newVA("va-1", "node-1", "csi.example.com"),
+		newVA("va-2", "node-1", "csi.example.com"),
+	))
+	usage, err = getAttachUsage(csiNodeLister, vaLister, "node-1", "csi.example.com")
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if !usage.isFull() {
+		t.Fatalf("Expected node to be full got %s", usage)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// addPVCProtection sets the storage protection finalizer against the
+// given PVC if not set previously
+func addPVCProtection(
+	clientset kubernetes.Interface, pvc *v1.PersistentVolumeClaim,
+) error {
+
+	if hasFinalizer(pvc, storageProtectionFinalizer) {
+		return nil
+	}
+
+	copy := pvc.DeepCopy()
+	copy.Finalizers = append(copy.Finalizers, storageProtectionFinalizer)
+
+	_, err := clientset.CoreV1().PersistentVolumeClaims(copy.Namespace).Update(copy)
+	return errors.Wrapf(err, "Add finalizer failed: PVC %s/%s", pvc.Namespace, pvc.Name)
+}
+
+// addVAProtection sets the pvc protection finalizer against the
+// given VolumeAttachment if not set previously
+func addVAProtection(
+	clientset kubernetes.Interface, va *storage.VolumeAttachment,
+) error {
+
+	if hasFinalizer(va, pvcProtectionFinalizer) {
+		return nil
+	}
+
+	copy := va.DeepCopy()
+	copy.Finalizers = append(copy.Finalizers, pvcProtectionFinalizer)
+
+	_, err := clientset.StorageV1beta1().VolumeAttachments().Update(copy)
+	return errors.Wrapf(err, "Add finalizer failed: VA %s", va.Name)
+}
+
+// deletePVC removes the storage protection finalizer from the given
+// PVC & deletes it.
+//
+// NOTE:
+//	This must be invoked only when the owner storage is being deleted
+func deletePVC(
+	clientset kubernetes.Interface, pvc *v1.PersistentVolumeClaim,
+) error {
+
+	if hasFinalizer(pvc, storageProtectionFinalizer) {
+		copy := pvc.DeepCopy()
+		copy.Finalizers = removeFinalizer(copy.Finalizers, storageProtectionFinalizer)
+
+		_, err := clientset.CoreV1().PersistentVolumeClaims(copy.Namespace).Update(copy)
+		if err != nil {
+			return errors.Wrapf(
+				err, "Remove finalizer failed: PVC %s/%s", pvc.Namespace, pvc.Name,
+			)
+		}
+	}
+
+	if pvc.DeletionTimestamp != nil {
+		return nil
+	}
+
+	err := clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace).
+		Delete(pvc.Name, &metav1.DeleteOptions{})
+	if err != nil && !apierrs.IsNotFound(err) {
+		return errors.Wrapf(err, "Delete failed: PVC %s/%s", pvc.Namespace, pvc.Name)
+	}
+	return nil
+}
+
+// deleteVA removes the pvc protection finalizer from the given
+// VolumeAttachment & deletes it. VolumeAttachment continues to exist
+// till the attacher confirms the detach.
+//
+// NOTE:
+//	This must be invoked only when storage controller wants the
+// volume to be detached
+func deleteVA(clientset kubernetes.Interface, va *storage.VolumeAttachment) error {
+	if hasFinalizer(va, pvcProtectionFinalizer) {
+		copy := va.DeepCopy()
+		copy.Finalizers = removeFinalizer(copy.Finalizers, pvcProtectionFinalizer)
+
+		_, err := clientset.StorageV1beta1().VolumeAttachments().Update(copy)
+		if err != nil {
+			return errors.Wrapf(err, "Remove finalizer failed: VA %s", va.Name)
+		}
+	}
+
+	if va.DeletionTimestamp != nil {
+		return nil
+	}
+
+	err := clientset.StorageV1beta1().VolumeAttachments().
+		Delete(va.Name, &metav1.DeleteOptions{})
+	if err != nil && !apierrs.IsNotFound(err) {
+		return errors.Wrapf(err, "Delete failed: VA %s", va.Name)
+	}
+	return nil
+}
+
+// isDeletionHeld returns true if the given object is being deleted
+// but its deletion is held by the given finalizer
+func isDeletionHeld(obj metav1.Object, finalizer string) bool {
+	return obj.GetDeletionTimestamp() != nil && hasFinalizer(obj, finalizer)
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	"k8s.io/client-go/tools/record"
+
+	ddplisters "github.com/mayadata-io/storage-provisioner/client/generated/lister/dao/v1alpha1"
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+func TestDeleteVA(t *testing.T) {
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "va",
+			Finalizers: []string{pvcProtectionFinalizer, "external-attacher"},
+		},
+	}
+	clientset := fake.NewSimpleClientset(va)
+
+	if err := deleteVA(clientset, va); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	actions := clientset.Actions()
+	if len(actions) != 2 {
+		t.Fatalf("Expected update & delete got %d actions", len(actions))
+	}
+	if !actions[0].Matches("update", "volumeattachments") {
+		t.Fatalf("Expected finalizer to be removed first got %v", actions[0])
+	}
+	if !actions[1].Matches("delete", "volumeattachments") {
+		t.Fatalf("Expected VA to be deleted got %v", actions[1])
+	}
+	_, err := clientset.StorageV1beta1().VolumeAttachments().Get(va.Name, metav1.GetOptions{})
+	if !apierrs.IsNotFound(err) {
+		t.Fatalf("Expected VA to be deleted got %v", err)
+	}
+}
+
+func TestDeletePVCBeingDeleted(t *testing.T) {
+	now := metav1.Now()
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "pvc",
+			Namespace:         "default",
+			DeletionTimestamp: &now,
+			Finalizers:        []string{storageProtectionFinalizer},
+		},
+	}
+	clientset := fake.NewSimpleClientset(pvc)
+
+	if err := deletePVC(clientset, pvc); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	// deletion was already initiated; only the finalizer is removed
+	actions := clientset.Actions()
+	if len(actions) != 1 || !actions[0].Matches("update", "persistentvolumeclaims") {
+		t.Fatalf("Expected a single update got %v", actions)
+	}
+	got, err := clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace).
+		Get(pvc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected PVC got %v", err)
+	}
+	if hasFinalizer(got, storageProtectionFinalizer) {
+		t.Fatalf("Expected finalizer to be removed got %v", got.Finalizers)
+	}
+}
+
+func TestPVCReconcilerAddsVAProtection(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+	pvc := newAttachablePVC(stor, "node-1")
+
+	// VolumeAttachment created by an older version
+	va := newTestVA(pvc, "node-1")
+	va.Finalizers = nil
+	clientset := fake.NewSimpleClientset(va)
+	r := &PVCReconciler{
+		Clientset:       clientset,
+		VALister:        storagelisters.NewVolumeAttachmentLister(newIndexer(t, va)),
+		StorageLister:   ddplisters.NewStorageLister(newIndexer(t, stor)),
+		PVLister:        newTestPVLister(t, stor),
+		NodeLister:      corelisters.NewNodeLister(newIndexer(t)),
+		CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:        record.NewFakeRecorder(10),
+	}
+
+	if _, err := r.Reconcile(pvc); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	got, err := clientset.StorageV1beta1().VolumeAttachments().Get(va.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected VA got %v", err)
+	}
+	if !hasFinalizer(got, pvcProtectionFinalizer) {
+		t.Fatalf("Expected finalizer %s got %v", pvcProtectionFinalizer, got.Finalizers)
+	}
+}
+
+func TestStorageStatusBuilderDeletionHeld(t *testing.T) {
+	now := metav1.Now()
+	pvc := newTestPVC(v1.ClaimBound)
+	pvc.DeletionTimestamp = &now
+	pvc.Finalizers = []string{storageProtectionFinalizer}
+
+	b := &storageStatusBuilder{
+		status:           &ddp.StorageStatus{},
+		pvc:              pvc,
+		attacherResolved: attacherResolved,
+		attacherName:     "csi.example.com",
+		attachRequired:   true,
+	}
+	b.build()
+
+	cond := getStorageCondition(b.status, ddp.DeletionHeld)
+	if cond.Status != ddp.ConditionTrue || cond.Reason != "PVCDeletionHeld" {
+		t.Fatalf("Expected PVCDeletionHeld got %s: %s", cond.Status, cond.Reason)
+	}
+}
+
+func TestStorageStatusBuilderDeletedVAIsNotHeld(t *testing.T) {
+	now := metav1.Now()
+	pvc := newTestPVC(v1.ClaimBound)
+	va := newTestVA(pvc, "node-1")
+	va.DeletionTimestamp = &now
+
+	b := &storageStatusBuilder{
+		status:           &ddp.StorageStatus{},
+		pvc:              pvc,
+		pv:               &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv"}},
+		vas:              []*storage.VolumeAttachment{va},
+		nodeNames:        []string{"node-1"},
+		nodes:            map[string]*v1.Node{"node-1": newTestNode("node-1", v1.ConditionTrue)},
+		attacherResolved: attacherResolved,
+		attacherName:     "csi.example.com",
+		attachRequired:   true,
+	}
+	b.build()
+
+	// attacher detaches the volume irrespective of the finalizer
+	cond := getStorageCondition(b.status, ddp.DeletionHeld)
+	if cond.Status != ddp.ConditionFalse || cond.Reason != "NoDeletionHeld" {
+		t.Fatalf("Expected NoDeletionHeld got %s: %s", cond.Status, cond.Reason)
+	}
+	if len(b.status.Attachments) != 1 || b.status.Attachments[0].Reason != "Detaching" {
+		t.Fatalf("Expected attachment to be detaching got %+v", b.status.Attachments)
+	}
+}
+
+func TestPVCReconcilerReattachDeletedVA(t *testing.T) {
+	now := metav1.Now()
+	stor := newTestStorage("stor", "node-1")
+	pvc := newAttachablePVC(stor, "node-1")
+
+	// VolumeAttachment deleted by others while its PVC still exists
+	va := newTestVA(pvc, "node-1")
+	va.DeletionTimestamp = &now
+	va.Finalizers = append(va.Finalizers, "external-attacher")
+
+	clientset := fake.NewSimpleClientset(va)
+	vaIndexer := newIndexer(t, va)
+	recorder := record.NewFakeRecorder(10)
+	r := &PVCReconciler{
+		Clientset:       clientset,
+		VALister:        storagelisters.NewVolumeAttachmentLister(vaIndexer),
+		StorageLister:   ddplisters.NewStorageLister(newIndexer(t, stor)),
+		PVLister:        newTestPVLister(t, stor),
+		NodeLister:      corelisters.NewNodeLister(newIndexer(t)),
+		CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:        recorder,
+	}
+
+	result, err := r.Reconcile(pvc)
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if result.RequeueAfter != waitInterval {
+		t.Fatalf("Expected requeue after %s got %+v", waitInterval, result)
+	}
+
+	// deletion is not held since the attacher detaches anyway
+	got, err := clientset.StorageV1beta1().VolumeAttachments().Get(va.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected VA got %v", err)
+	}
+	if hasFinalizer(got, pvcProtectionFinalizer) {
+		t.Fatalf("Expected finalizer %s to be removed got %v", pvcProtectionFinalizer, got.Finalizers)
+	}
+	select {
+	case event := <-recorder.Events:
+		if event != v1.EventTypeNormal+" "+EventReattaching+" "+
+			"VolumeAttachment "+va.Name+" was deleted: Reattaching to node node-1 once it is detached" {
+			t.Fatalf("Expected event %s got %q", EventReattaching, event)
+		}
+	default:
+		t.Fatalf("Expected event %s got none", EventReattaching)
+	}
+
+	// attacher has confirmed the detach
+	if err := vaIndexer.Delete(va); err != nil {
+		t.Fatalf("Delete VA from indexer failed: %v", err)
+	}
+	if err := clientset.Tracker().Delete(
+		storage.SchemeGroupVersion.WithResource("volumeattachments"), "", va.Name,
+	); err != nil {
+		t.Fatalf("Delete VA from tracker failed: %v", err)
+	}
+
+	if _, err := r.Reconcile(pvc); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	got, err = clientset.StorageV1beta1().VolumeAttachments().Get(va.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected VA to be created again got %v", err)
+	}
+	if got.DeletionTimestamp != nil || got.Spec.NodeName != "node-1" {
+		t.Fatalf("Expected VA attaching to node-1 got %+v", got)
+	}
+	if !hasFinalizer(got, pvcProtectionFinalizer) {
+		t.Fatalf("Expected finalizer %s got %v", pvcProtectionFinalizer, got.Finalizers)
+	}
+}
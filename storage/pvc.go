@@ -18,25 +18,98 @@ package storage
 
 import (
 	"fmt"
+	"hash/fnv"
 
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1beta1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	"k8s.io/client-go/tools/record"
 	ref "k8s.io/client-go/tools/reference"
 	"k8s.io/klog"
+
+	ddplisters "github.com/mayadata-io/storage-provisioner/client/generated/lister/dao/v1alpha1"
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
 )
 
+// vaNameForPVC returns the name of the VolumeAttachment that
+// attaches the given PVC to the given node.
+//
+// NOTE:
+//	VolumeAttachment is a cluster scoped resource. Hence PVC
+// namespace & name are used to name the VolumeAttachment. A hash of
+// the node name keeps the names unique when the PVC is attached to
+// more than one node.
+func vaNameForPVC(pvc *v1.PersistentVolumeClaim, nodeName string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(nodeName))
+	return fmt.Sprintf("%s-%s-%08x", pvc.Namespace, pvc.Name, hash.Sum32())
+}
+
+// listVAsForPVC returns the VolumeAttachments that attach the given
+// PVC
+func listVAsForPVC(
+	lister storagelisters.VolumeAttachmentLister, pvc *v1.PersistentVolumeClaim,
+) ([]*storage.VolumeAttachment, error) {
+
+	list, err := lister.List(labels.Everything())
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "List VAs for PVC %s/%s failed", pvc.Namespace, pvc.Name,
+		)
+	}
+
+	var vas []*storage.VolumeAttachment
+	for _, va := range list {
+		namespace, name, found := findPVCFromVA(va)
+		if found && namespace == pvc.Namespace && name == pvc.Name {
+			vas = append(vas, va)
+		}
+	}
+	return vas, nil
+}
+
+// findVAForNode returns the VolumeAttachment that attaches to the
+// given node
+func findVAForNode(
+	vas []*storage.VolumeAttachment, nodeName string,
+) *storage.VolumeAttachment {
+
+	for _, va := range vas {
+		if va.Spec.NodeName == nodeName {
+			return va
+		}
+	}
+	return nil
+}
+
 // PVCReconciler manages reconciling PVC API
 // in kubernetes cluster
 type PVCReconciler struct {
 	// instances to invoke various Kubernetes APIs
-	Clientset kubernetes.Interface
-	VALister  storagelisters.VolumeAttachmentLister
+	Clientset       kubernetes.Interface
+	VALister        storagelisters.VolumeAttachmentLister
+	StorageLister   ddplisters.StorageLister
+	CSIDriverLister storagelisters.CSIDriverLister
+	PVLister        corelisters.PersistentVolumeLister
+	NodeLister      corelisters.NodeLister
+	CSINodeLister   storagelisters.CSINodeLister
+
+	// Recorder emits events against the PVC & its owner storage
+	Recorder record.EventRecorder
+}
+
+// pvcSync holds the state of reconciling a single PVC. This is not
+// kept in the reconciler since the same reconciler is invoked by
+// concurrent workers.
+type pvcSync struct {
+	*PVCReconciler
 
 	// pvc object that will be reconciled
 	pvc *v1.PersistentVolumeClaim
@@ -45,19 +118,16 @@ type PVCReconciler struct {
 	// extra info like APIVersion and Kind
 	pvcRef *v1.ObjectReference
 
-	// node where the storage should get attached
-	nodeName string
+	// nodes where the storage should get attached
+	nodeNames []string
 
 	// name of the attacher that should attach the volume
 	attacherName string
 }
 
 // String implements stringer interface
-func (r *PVCReconciler) String() string {
-	if r.pvc == nil {
-		return "PVCReconciler"
-	}
-	return fmt.Sprintf("PVCReconciler %s/%s", r.pvc.Namespace, r.pvc.Name)
+func (s *pvcSync) String() string {
+	return fmt.Sprintf("PVCReconciler %s/%s", s.pvc.Namespace, s.pvc.Name)
 }
 
 // Reconcile accepts PVC as the desired state and starts executing
@@ -65,139 +135,441 @@ func (r *PVCReconciler) String() string {
 //
 // NOTE:
 //	Reconcile logic needs to be idempotent
-func (r *PVCReconciler) Reconcile(pvc *v1.PersistentVolumeClaim) error {
-	r.pvc = pvc
+func (r *PVCReconciler) Reconcile(
+	pvc *v1.PersistentVolumeClaim,
+) (result Result, err error) {
+
+	s := &pvcSync{
+		PVCReconciler: r,
+		pvc:           pvc,
+	}
 
 	if pvc.Spec.VolumeName == "" {
-		// nothing to do since PVC is not yet bound to any PV
+		// nothing to do since PVC is not yet bound to any PV; PVC
+		// gets requeued by its update event once it is bound
 		klog.V(3).Infof(
-			"%s: Reconcile ignored: Volume not bound", r,
+			"%s: Reconcile ignored: Volume not bound", s,
 		)
-		return nil
+		return Result{}, nil
 	}
 
-	var err error
 	defer func() {
 		if err != nil {
-			errors.Wrapf(err, "%s: Reconcile failed", r)
+			err = errors.Wrapf(err, "%s: Reconcile failed", s)
 		}
 	}()
 
-	r.pvcRef, err = ref.GetReference(scheme.Scheme, r.pvc)
+	// PVC & its VolumeAttachment are torn down by storage reconciler
+	// when the storage is deleted
+	deleting, err := s.isTeardownInProgress()
 	if err != nil {
-		return err
+		return Result{}, err
+	}
+	if deleting {
+		klog.V(3).Infof(
+			"%s: Reconcile ignored: Teardown in progress", s,
+		)
+		return Result{}, nil
 	}
 
-	// find if VolumeAttachment is created in previous reconcile attempt
-	va, err := r.findVA()
+	s.pvcRef, err = ref.GetReference(scheme.Scheme, s.pvc)
 	if err != nil {
-		return err
+		return Result{}, err
 	}
 
-	// create VolumeAttachment if not found
-	if va == nil {
-		return r.createVA()
+	s.nodeNames = findNodeNamesFromPVC(s.pvc)
+
+	// find VolumeAttachments created in previous reconcile attempts
+	vas, err := listVAsForPVC(s.VALister, s.pvc)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// Moving the storage to another node is carried out in
+	// following steps:
+	//
+	//	1/ storage reconciler sets the new node against the PVC
+	//	2/ VolumeAttachment of the old node is deleted
+	//	3/ attacher confirms the detach & VolumeAttachment is gone
+	//	4/ VolumeAttachment is created for the new node
+	//
+	// Storage that can be shared across nodes is attached to new
+	// nodes without waiting for the detach from old nodes.
+	//
+	// Each step is derived from the observed state. Hence a restart
+	// of this controller resumes from where it left off.
+	detaching, err := s.detachVAs(vas)
+	if err != nil {
+		return Result{}, err
+	}
+	if detaching && !isMultiNodeAccess(s.pvc.Spec.AccessModes) {
+		// poll till the attacher confirms the detach
+		return waitResult(), nil
+	}
+
+	attaching, err := s.attachVAs(vas)
+	if err != nil {
+		return Result{}, err
+	}
+	if detaching || attaching {
+		// poll till the VolumeAttachments are gone
+		return waitResult(), nil
+	}
+	return Result{}, nil
+}
+
+// eventf emits an event against this PVC as well as its owner
+// storage
+func (s *pvcSync) eventf(
+	eventtype, reason, messageFmt string, args ...interface{},
+) {
+	s.Recorder.Eventf(s.pvc, eventtype, reason, messageFmt, args...)
+
+	if storRef := getStorageReferenceFromPVC(s.pvc); storRef != nil {
+		s.Recorder.Eventf(
+			storRef, eventtype, reason, "PVC "+s.pvc.Name+": "+messageFmt, args...,
+		)
 	}
+}
 
-	// update VolumeAttachment if desired state was changed
-	update, err := r.updateVA(va)
-	if !update {
-		klog.V(3).Infof("%s: No change to desired state", r)
+// isTeardownInProgress returns true if either this PVC or its
+// owner storage is being deleted
+func (s *pvcSync) isTeardownInProgress() (bool, error) {
+	if s.pvc.DeletionTimestamp != nil {
+		return true, nil
+	}
+
+	stor, err := s.findOwnerStorage()
+	if err != nil {
+		return false, err
+	}
+	return stor != nil && stor.DeletionTimestamp != nil, nil
+}
+
+// findOwnerStorage returns the storage that owns this PVC. It
+// returns nil if the owner storage is not found.
+func (s *pvcSync) findOwnerStorage() (*ddp.Storage, error) {
+	owner := getStorageOwnerOfPVC(s.pvc)
+	if owner == nil {
+		return nil, nil
+	}
+
+	stor, err := s.StorageLister.Storages(s.pvc.Namespace).Get(owner.Name)
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "%s: Find owner storage failed", s)
 	}
-	return err
+	if stor.UID != owner.UID {
+		// owner was deleted & a new storage with same name is created
+		return nil, nil
+	}
+	return stor, nil
+}
+
+// isVADetaching returns true if the given VolumeAttachment is being
+// deleted on behalf of storage controller
+func isVADetaching(va *storage.VolumeAttachment) bool {
+	return va.DeletionTimestamp != nil && !hasFinalizer(va, pvcProtectionFinalizer)
 }
 
-// findVA will list & find the correct VolumeAttachment if available
-func (r *PVCReconciler) findVA() (*storage.VolumeAttachment, error) {
-	var err error
+// detachVAs deletes the given VolumeAttachments that attach to the
+// nodes that are no longer selected. It returns true if any of these
+// VolumeAttachments still exist i.e. detach is not yet confirmed by
+// the attacher.
+func (s *pvcSync) detachVAs(
+	vas []*storage.VolumeAttachment,
+) (detaching bool, err error) {
+
 	defer func() {
 		if err != nil {
-			err = errors.Wrapf(err, "%s: Find VA failed", r)
+			err = errors.Wrapf(err, "%s: Detach failed", s)
 		}
 	}()
 
-	// VolumeAttachment & PVC Name are same in case in this provisioner
-	va, err := r.VALister.Get(r.pvc.Name)
-	if err != nil && !apierrs.IsNotFound(err) {
-		// do not ignore error other than notfound error
-		return nil, err
-	}
+	for _, va := range vas {
+		if ContainsString(s.nodeNames, va.Spec.NodeName) {
+			continue
+		}
+		detaching = true
+
+		if isVADetaching(va) {
+			klog.V(3).Infof(
+				"%s: Waiting for VA %s to detach from node %s",
+				s, va.Name, va.Spec.NodeName,
+			)
+			continue
+		}
 
-	return va, nil
+		err = deleteVA(s.Clientset, va)
+		if err != nil {
+			s.eventf(
+				v1.EventTypeWarning, EventDeleteFailed,
+				"Failed to delete VolumeAttachment %s: %v", va.Name, err,
+			)
+			return true, err
+		}
+
+		switch {
+		case len(s.nodeNames) == 0:
+			s.eventf(
+				v1.EventTypeNormal, EventDetaching,
+				"Detaching from node %s since no node is selected",
+				va.Spec.NodeName,
+			)
+		case len(s.nodeNames) == 1 && !isMultiNodeAccess(s.pvc.Spec.AccessModes):
+			s.eventf(
+				v1.EventTypeNormal, EventReattaching,
+				"Detaching from node %s to attach to node %s",
+				va.Spec.NodeName, s.nodeNames[0],
+			)
+		default:
+			s.eventf(
+				v1.EventTypeNormal, EventDetaching,
+				"Detaching from node %s since it is not selected",
+				va.Spec.NodeName,
+			)
+		}
+	}
+	return detaching, nil
 }
 
-// updateVA updates the given VolumeAttachment in case of any change
-// in the desired state
-func (r *PVCReconciler) updateVA(va *storage.VolumeAttachment) (bool, error) {
-	var err error
+// attachVAs creates VolumeAttachments for the selected nodes that
+// do not have one. It returns true if a VolumeAttachment of any
+// selected node needs to be created later. This happens when the
+// existing VolumeAttachment is being deleted or when the node has
+// reached its attach limit.
+func (s *pvcSync) attachVAs(
+	vas []*storage.VolumeAttachment,
+) (attaching bool, err error) {
+
 	defer func() {
 		if err != nil {
-			err = errors.Wrapf(err, "%s: Update VA failed", r)
+			err = errors.Wrapf(err, "%s: Attach failed", s)
 		}
 	}()
 
-	nodeName, found := findNodeNameFromPVC(r.pvc)
-	if !found || nodeName == "" {
-		// nothing to verify & evaluate further
+	if len(s.nodeNames) == 0 {
+		// storage stays detached till a node is selected
+		klog.V(3).Infof("%s: Attach skipped: No node is selected", s)
 		return false, nil
 	}
 
-	if nodeName == va.Spec.NodeName {
-		// no change
+	s.attacherName, _ = findAttacherFromPVC(s.pvc)
+	if s.attacherName == "" {
+		// storage reconciler reports why the attacher is not resolved
+		klog.V(3).Infof("%s: Attach skipped: Attacher is not resolved", s)
 		return false, nil
 	}
 
-	// we shall delete the VolumeAttachment & expect a new one
-	// to get created as part of next reconcile invocation
-	err = r.Clientset.StorageV1beta1().VolumeAttachments().
-		Delete(va.Name, &metav1.DeleteOptions{})
-	return true, err
+	attachRequired, err := isAttachRequired(s.CSIDriverLister, s.attacherName)
+	if err != nil {
+		return false, err
+	}
+	if !attachRequired {
+		// volume is usable once the PVC is bound
+		klog.V(3).Infof(
+			"%s: Attach skipped: Attacher %s does not require attach",
+			s, s.attacherName,
+		)
+		return false, nil
+	}
+
+	pv, err := s.PVLister.Get(s.pvc.Spec.VolumeName)
+	if apierrs.IsNotFound(err) {
+		// storage reconciler reports the missing volume
+		klog.V(3).Infof(
+			"%s: Attach skipped: PV %s not found", s, s.pvc.Spec.VolumeName,
+		)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, nodeName := range s.nodeNames {
+		va := findVAForNode(vas, nodeName)
+		switch {
+		case va == nil:
+			matches, err := s.matchesTopology(pv, nodeName)
+			if err != nil {
+				return false, err
+			}
+			if !matches {
+				// storage reconciler reports the mismatch
+				continue
+			}
+			usage, err := getAttachUsage(
+				s.CSINodeLister, s.VALister, nodeName, s.attacherName,
+			)
+			if err != nil {
+				return false, err
+			}
+			if usage.isFull() {
+				// VolumeAttachment is created once a slot is free
+				reported, err := s.isAttachLimitReported(nodeName)
+				if err != nil {
+					return false, err
+				}
+				if !reported {
+					s.eventf(
+						v1.EventTypeWarning, EventAttachLimitReached,
+						"Attach to node %s is queued: %s", nodeName, usage,
+					)
+				}
+				attaching = true
+				continue
+			}
+			err = s.createVA(nodeName)
+			if err != nil {
+				return false, err
+			}
+		case isVADetaching(va):
+			// VolumeAttachment is created once this one is gone
+			klog.V(3).Infof(
+				"%s: Waiting for VA %s to detach from node %s",
+				s, va.Name, va.Spec.NodeName,
+			)
+			attaching = true
+		case va.Spec.Attacher != s.attacherName:
+			// attacher of a VolumeAttachment can not be changed; a new
+			// VolumeAttachment gets created once this one is gone
+			err = deleteVA(s.Clientset, va)
+			if err != nil {
+				s.eventf(
+					v1.EventTypeWarning, EventDeleteFailed,
+					"Failed to delete VolumeAttachment %s: %v", va.Name, err,
+				)
+				return false, err
+			}
+			s.eventf(
+				v1.EventTypeNormal, EventReattaching,
+				"Detaching from node %s to attach via %s instead of %s",
+				va.Spec.NodeName, s.attacherName, va.Spec.Attacher,
+			)
+			attaching = true
+		case va.DeletionTimestamp != nil:
+			// VolumeAttachment was deleted by others; attacher detaches
+			// the volume & a new VolumeAttachment gets created once this
+			// one is gone
+			err = deleteVA(s.Clientset, va)
+			if err != nil {
+				s.eventf(
+					v1.EventTypeWarning, EventDeleteFailed,
+					"Failed to delete VolumeAttachment %s: %v", va.Name, err,
+				)
+				return false, err
+			}
+			s.eventf(
+				v1.EventTypeNormal, EventReattaching,
+				"VolumeAttachment %s was deleted: Reattaching to node %s once it is detached",
+				va.Name, va.Spec.NodeName,
+			)
+			attaching = true
+		default:
+			// VolumeAttachments created by older versions may not
+			// have the finalizer
+			err = addVAProtection(s.Clientset, va)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return attaching, nil
 }
 
-func (r *PVCReconciler) createVA() error {
-	var (
-		found bool
-		err   error
-	)
-	defer func() {
-		if err != nil {
-			err = errors.Wrapf(err, "%s: Create VA failed", r)
+// isAttachLimitReported returns true if the owner storage already
+// reports that the attach to the given node is queued due to the
+// attach limit. This avoids repeating the event on every reconcile
+// while the node stays full.
+func (s *pvcSync) isAttachLimitReported(nodeName string) (bool, error) {
+	stor, err := s.findOwnerStorage()
+	if err != nil || stor == nil {
+		return false, err
+	}
+	for _, attachment := range stor.Status.Attachments {
+		if attachment.NodeName == nodeName {
+			return attachment.Reason == "AttachLimitReached", nil
 		}
-	}()
+	}
+	return false, nil
+}
 
-	r.nodeName, found = findNodeNameFromPVC(r.pvc)
-	if !found {
-		return errors.Errorf(
-			"%s: Create VA failed: Node name not found", r,
-		)
+// matchesTopology returns true if the given node matches the node
+// affinity of the given PV. Volume can not be attached to a node that
+// does not match.
+func (s *pvcSync) matchesTopology(
+	pv *v1.PersistentVolume, nodeName string,
+) (bool, error) {
+
+	affinity := getPVNodeAffinity(pv)
+	if affinity == nil {
+		return true, nil
+	}
+
+	node, err := s.NodeLister.Get(nodeName)
+	if apierrs.IsNotFound(err) {
+		// storage reconciler reports the missing node
+		klog.V(3).Infof("%s: Attach skipped: Node %s not found", s, nodeName)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
 	}
 
-	r.attacherName, found = findAttacherFromPVC(r.pvc)
-	if !found {
-		return errors.Errorf(
-			"%s: Create VA failed: Attacher name not found", r,
+	matches, err := matchesNodeSelector(node, affinity)
+	if err != nil {
+		return false, errors.Wrapf(err, "Match node affinity of PV %s failed", pv.Name)
+	}
+	if !matches {
+		s.eventf(
+			v1.EventTypeWarning, EventTopologyMismatch,
+			"Node %s does not match the node affinity of PV %s", nodeName, pv.Name,
 		)
 	}
+	return matches, nil
+}
 
-	va := r.newVA()
+func (s *pvcSync) createVA(nodeName string) error {
+	va := s.newVA(nodeName)
 
-	_, err =
-		r.Clientset.StorageV1beta1().VolumeAttachments().Create(va)
-	return err
+	_, err :=
+		s.Clientset.StorageV1beta1().VolumeAttachments().Create(va)
+	if err != nil {
+		s.eventf(
+			v1.EventTypeWarning, EventCreateFailed,
+			"Failed to create VolumeAttachment %s: %v", va.Name, err,
+		)
+		return errors.Wrapf(err, "%s: Create VA %s failed", s, va.Name)
+	}
+
+	s.eventf(
+		v1.EventTypeNormal, EventVolumeAttachmentCreated,
+		"Created VolumeAttachment %s to attach to node %s via %s",
+		va.Name, nodeName, s.attacherName,
+	)
+	return nil
 }
 
-func (r *PVCReconciler) newVA() *storage.VolumeAttachment {
+func (s *pvcSync) newVA(nodeName string) *storage.VolumeAttachment {
 
 	return &storage.VolumeAttachment{
 		ObjectMeta: metav1.ObjectMeta{
-			// use PVC namespace & name as the name for VolumeAttachment
-			Name: r.pvcRef.Namespace + "-" + r.pvcRef.Name,
+			Name: vaNameForPVC(s.pvc, nodeName),
+			Annotations: map[string]string{
+				pvcNamespaceKey: s.pvc.Namespace,
+				pvcNameKey:      s.pvc.Name,
+			},
+			Finalizers: []string{
+				pvcProtectionFinalizer,
+			},
 			OwnerReferences: []metav1.OwnerReference{
 				metav1.OwnerReference{
-					APIVersion:         r.pvcRef.APIVersion,
-					Kind:               r.pvcRef.Kind,
-					Name:               r.pvcRef.Name,
-					UID:                r.pvcRef.UID,
+					APIVersion:         s.pvcRef.APIVersion,
+					Kind:               s.pvcRef.Kind,
+					Name:               s.pvcRef.Name,
+					UID:                s.pvcRef.UID,
 					Controller:         boolPtr(true),
 					BlockOwnerDeletion: boolPtr(true),
 				},
@@ -205,10 +577,10 @@ func (r *PVCReconciler) newVA() *storage.VolumeAttachment {
 		},
 		Spec: storage.VolumeAttachmentSpec{
 			Source: storage.VolumeAttachmentSource{
-				PersistentVolumeName: strPtr(r.pvc.Spec.VolumeName),
+				PersistentVolumeName: strPtr(s.pvc.Spec.VolumeName),
 			},
-			NodeName: r.nodeName,
-			Attacher: r.attacherName,
+			NodeName: nodeName,
+			Attacher: s.attacherName,
 		},
 	}
 }
@@ -0,0 +1,644 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	"k8s.io/client-go/tools/record"
+
+	ddplisters "github.com/mayadata-io/storage-provisioner/client/generated/lister/dao/v1alpha1"
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// newAttachablePVC returns a bound PVC of the given storage that
+// is annotated with the node & attacher
+func newAttachablePVC(stor *ddp.Storage, nodeName string) *v1.PersistentVolumeClaim {
+	pvc := newOwnedPVC(stor)
+	pvc.Annotations = map[string]string{
+		nodeNameKey:           nodeName,
+		storageCSIAttacherKey: "csi.example.com",
+	}
+	return pvc
+}
+
+// newTestPVLister returns a lister of the PVs bound to the PVCs of
+// the given storages
+func newTestPVLister(t *testing.T, stors ...interface{}) corelisters.PersistentVolumeLister {
+	var pvs []interface{}
+	for _, stor := range stors {
+		pvs = append(pvs, newCSIPV("pv-"+stor.(*ddp.Storage).Name, "csi.example.com"))
+	}
+	return corelisters.NewPersistentVolumeLister(newIndexer(t, pvs...))
+}
+
+// newTestVA returns a VolumeAttachment that attaches the given PVC
+// to the given node
+func newTestVA(pvc *v1.PersistentVolumeClaim, nodeName string) *storage.VolumeAttachment {
+	return &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: vaNameForPVC(pvc, nodeName),
+			Annotations: map[string]string{
+				pvcNamespaceKey: pvc.Namespace,
+				pvcNameKey:      pvc.Name,
+			},
+			Finalizers: []string{pvcProtectionFinalizer},
+		},
+		Spec: storage.VolumeAttachmentSpec{NodeName: nodeName, Attacher: "csi.example.com"},
+	}
+}
+
+func TestPVCReconcilerReconcile(t *testing.T) {
+	now := metav1.Now()
+	stor := newTestStorage("stor", "node-1")
+	deleting := newTestStorage("deleting", "node-1")
+	deleting.DeletionTimestamp = &now
+
+	unbound := newAttachablePVC(stor, "node-1")
+	unbound.Spec.VolumeName = ""
+	terminating := newAttachablePVC(stor, "node-1")
+	terminating.DeletionTimestamp = &now
+	detached := newAttachablePVC(stor, "")
+
+	tests := map[string]struct {
+		stor     *ddp.Storage
+		pvc      *v1.PersistentVolumeClaim
+		isCreate bool
+	}{
+		"bound pvc": {
+			stor:     stor,
+			pvc:      newAttachablePVC(stor, "node-1"),
+			isCreate: true,
+		},
+		"pvc not bound": {
+			stor: stor,
+			pvc:  unbound,
+		},
+		"pvc is being deleted": {
+			stor: stor,
+			pvc:  terminating,
+		},
+		"no node selected": {
+			stor: stor,
+			pvc:  detached,
+		},
+		"owner storage is being deleted": {
+			stor: deleting,
+			pvc:  newAttachablePVC(deleting, "node-1"),
+		},
+	}
+	for name, mock := range tests {
+		name, mock := name, mock
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			r := &PVCReconciler{
+				Clientset:       clientset,
+				VALister:        storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+				StorageLister:   ddplisters.NewStorageLister(newIndexer(t, mock.stor)),
+				PVLister:        newTestPVLister(t, mock.stor),
+				NodeLister:      corelisters.NewNodeLister(newIndexer(t)),
+				CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+				CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+				Recorder:        record.NewFakeRecorder(10),
+			}
+
+			if _, err := r.Reconcile(mock.pvc); err != nil {
+				t.Fatalf("Expected no error got %v", err)
+			}
+
+			vas, err := clientset.StorageV1beta1().VolumeAttachments().List(metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("Expected no error got %v", err)
+			}
+			if mock.isCreate && len(vas.Items) != 1 {
+				t.Fatalf("Expected VA to be created got %d VAs", len(vas.Items))
+			}
+			if !mock.isCreate && len(vas.Items) != 0 {
+				t.Fatalf("Expected no VA got %d VAs", len(vas.Items))
+			}
+			if !mock.isCreate {
+				return
+			}
+			if va := vas.Items[0]; va.Spec.NodeName != "node-1" {
+				t.Fatalf("Expected node node-1 got %s", va.Spec.NodeName)
+			}
+			if va := vas.Items[0]; !hasFinalizer(&va, pvcProtectionFinalizer) {
+				t.Fatalf("Expected finalizer %s got %v", pvcProtectionFinalizer, va.Finalizers)
+			}
+		})
+	}
+}
+
+func TestPVCReconcilerReattach(t *testing.T) {
+	stor := newTestStorage("stor", "node-2")
+	pvc := newAttachablePVC(stor, "node-2")
+	va := newTestVA(pvc, "node-1")
+
+	clientset := fake.NewSimpleClientset(va)
+	recorder := record.NewFakeRecorder(10)
+	r := &PVCReconciler{
+		Clientset:       clientset,
+		VALister:        storagelisters.NewVolumeAttachmentLister(newIndexer(t, va)),
+		StorageLister:   ddplisters.NewStorageLister(newIndexer(t, stor)),
+		PVLister:        newTestPVLister(t, stor),
+		NodeLister:      corelisters.NewNodeLister(newIndexer(t)),
+		CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:        recorder,
+	}
+
+	result, err := r.Reconcile(pvc)
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if result.RequeueAfter != waitInterval {
+		t.Fatalf("Expected requeue after %s got %+v", waitInterval, result)
+	}
+
+	// VolumeAttachment of the old node is deleted & a new one is
+	// expected to be created in a later reconcile
+	_, err = clientset.StorageV1beta1().VolumeAttachments().Get(va.Name, metav1.GetOptions{})
+	if !apierrs.IsNotFound(err) {
+		t.Fatalf("Expected VA to be deleted got %v", err)
+	}
+	expectEvents(t, recorder, "Normal "+EventReattaching)
+}
+
+func TestPVCReconcilerConcurrentReconcile(t *testing.T) {
+	var pvcs []*v1.PersistentVolumeClaim
+	var stors []interface{}
+	for i := 0; i < workers; i++ {
+		stor := newTestStorage(fmt.Sprintf("stor-%d", i), fmt.Sprintf("node-%d", i))
+		stors = append(stors, stor)
+		pvcs = append(pvcs, newAttachablePVC(stor, *stor.Spec.NodeName))
+	}
+
+	clientset := fake.NewSimpleClientset()
+	r := &PVCReconciler{
+		Clientset:       clientset,
+		VALister:        storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageLister:   ddplisters.NewStorageLister(newIndexer(t, stors...)),
+		PVLister:        newTestPVLister(t, stors...),
+		NodeLister:      corelisters.NewNodeLister(newIndexer(t)),
+		CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:        record.NewFakeRecorder(10 * workers),
+	}
+
+	// same reconciler is invoked by concurrent workers
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, len(pvcs))
+	for i, pvc := range pvcs {
+		wg.Add(1)
+		go func(i int, pvc *v1.PersistentVolumeClaim) {
+			defer wg.Done()
+			<-start
+			_, errs[i] = r.Reconcile(pvc)
+		}(i, pvc)
+	}
+	close(start)
+	wg.Wait()
+
+	for i, pvc := range pvcs {
+		if errs[i] != nil {
+			t.Fatalf("%s: Expected no error got %v", pvc.Name, errs[i])
+		}
+
+		nodeName := fmt.Sprintf("node-%d", i)
+		va, err := clientset.StorageV1beta1().VolumeAttachments().
+			Get(vaNameForPVC(pvc, nodeName), metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: Expected VA got %v", pvc.Name, err)
+		}
+		if va.Spec.NodeName != nodeName {
+			t.Fatalf("%s: Expected node %s got %s", pvc.Name, nodeName, va.Spec.NodeName)
+		}
+		if pv := va.Spec.Source.PersistentVolumeName; pv == nil || *pv != pvc.Spec.VolumeName {
+			t.Fatalf("%s: Expected PV %s got %v", pvc.Name, pvc.Spec.VolumeName, pv)
+		}
+		if owner := va.OwnerReferences[0]; owner.Name != pvc.Name {
+			t.Fatalf("%s: Expected owner %s got %s", pvc.Name, pvc.Name, owner.Name)
+		}
+	}
+}
+
+func TestPVCReconcilerDetachThenAttach(t *testing.T) {
+	now := metav1.Now()
+	stor := newTestStorage("stor", "node-2")
+	pvc := newAttachablePVC(stor, "node-2")
+
+	// VolumeAttachment of the old node was deleted in an earlier
+	// reconcile & is waiting for the attacher to confirm the detach
+	va := newTestVA(pvc, "node-1")
+	va.DeletionTimestamp = &now
+	va.Finalizers = []string{"external-attacher"}
+
+	clientset := fake.NewSimpleClientset(va)
+	vaIndexer := newIndexer(t, va)
+	r := &PVCReconciler{
+		Clientset:       clientset,
+		VALister:        storagelisters.NewVolumeAttachmentLister(vaIndexer),
+		StorageLister:   ddplisters.NewStorageLister(newIndexer(t, stor)),
+		PVLister:        newTestPVLister(t, stor),
+		NodeLister:      corelisters.NewNodeLister(newIndexer(t)),
+		CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:        record.NewFakeRecorder(10),
+	}
+
+	result, err := r.Reconcile(pvc)
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if result.RequeueAfter != waitInterval {
+		t.Fatalf("Expected requeue after %s got %+v", waitInterval, result)
+	}
+	if actions := clientset.Actions(); len(actions) != 0 {
+		t.Fatalf("Expected no change till detach is confirmed got %v", actions)
+	}
+
+	// attacher has confirmed the detach
+	if err := vaIndexer.Delete(va); err != nil {
+		t.Fatalf("Delete VA from indexer failed: %v", err)
+	}
+	if err := clientset.Tracker().Delete(
+		storage.SchemeGroupVersion.WithResource("volumeattachments"), "", va.Name,
+	); err != nil {
+		t.Fatalf("Delete VA from tracker failed: %v", err)
+	}
+
+	if _, err := r.Reconcile(pvc); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	got, err := clientset.StorageV1beta1().VolumeAttachments().
+		Get(vaNameForPVC(pvc, "node-2"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected VA got %v", err)
+	}
+	if got.Spec.NodeName != "node-2" {
+		t.Fatalf("Expected node node-2 got %s", got.Spec.NodeName)
+	}
+}
+
+func TestPVCReconcilerDetach(t *testing.T) {
+	stor := newTestStorage("stor", "")
+	pvc := newAttachablePVC(stor, "")
+	va := newTestVA(pvc, "node-1")
+
+	clientset := fake.NewSimpleClientset(va)
+	recorder := record.NewFakeRecorder(10)
+	r := &PVCReconciler{
+		Clientset:       clientset,
+		VALister:        storagelisters.NewVolumeAttachmentLister(newIndexer(t, va)),
+		StorageLister:   ddplisters.NewStorageLister(newIndexer(t, stor)),
+		PVLister:        newTestPVLister(t, stor),
+		NodeLister:      corelisters.NewNodeLister(newIndexer(t)),
+		CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:        recorder,
+	}
+
+	result, err := r.Reconcile(pvc)
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if result.RequeueAfter != waitInterval {
+		t.Fatalf("Expected requeue after %s got %+v", waitInterval, result)
+	}
+	_, err = clientset.StorageV1beta1().VolumeAttachments().Get(va.Name, metav1.GetOptions{})
+	if !apierrs.IsNotFound(err) {
+		t.Fatalf("Expected VA to be deleted got %v", err)
+	}
+	expectEvents(t, recorder, "Normal "+EventDetaching)
+}
+
+func TestPVCReconcilerAttacherChange(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+	pvc := newAttachablePVC(stor, "node-1")
+
+	// VolumeAttachment was created before the attacher got resolved
+	// to csi.example.com
+	va := newTestVA(pvc, "node-1")
+	va.Spec.Attacher = "old.example.com"
+
+	clientset := fake.NewSimpleClientset(va)
+	vaIndexer := newIndexer(t, va)
+	recorder := record.NewFakeRecorder(10)
+	r := &PVCReconciler{
+		Clientset:       clientset,
+		VALister:        storagelisters.NewVolumeAttachmentLister(vaIndexer),
+		StorageLister:   ddplisters.NewStorageLister(newIndexer(t, stor)),
+		PVLister:        newTestPVLister(t, stor),
+		NodeLister:      corelisters.NewNodeLister(newIndexer(t)),
+		CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:        recorder,
+	}
+
+	result, err := r.Reconcile(pvc)
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if result.RequeueAfter != waitInterval {
+		t.Fatalf("Expected requeue after %s got %+v", waitInterval, result)
+	}
+	_, err = clientset.StorageV1beta1().VolumeAttachments().Get(va.Name, metav1.GetOptions{})
+	if !apierrs.IsNotFound(err) {
+		t.Fatalf("Expected VA to be deleted got %v", err)
+	}
+	expectEvents(t, recorder, "Normal "+EventReattaching)
+
+	// VolumeAttachment of the new attacher is created once the old
+	// one is gone
+	if err := vaIndexer.Delete(va); err != nil {
+		t.Fatalf("Delete VA from indexer failed: %v", err)
+	}
+	if _, err := r.Reconcile(pvc); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	got, err := clientset.StorageV1beta1().VolumeAttachments().Get(va.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected VA got %v", err)
+	}
+	if got.Spec.Attacher != "csi.example.com" {
+		t.Fatalf("Expected attacher csi.example.com got %s", got.Spec.Attacher)
+	}
+}
+
+func TestPVCReconcilerAttachNotRequired(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+	pvc := newAttachablePVC(stor, "node-1")
+
+	clientset := fake.NewSimpleClientset()
+	r := &PVCReconciler{
+		Clientset:     clientset,
+		VALister:      storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageLister: ddplisters.NewStorageLister(newIndexer(t, stor)),
+		PVLister:      newTestPVLister(t, stor),
+		NodeLister:    corelisters.NewNodeLister(newIndexer(t)),
+		CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t,
+			&storage.CSIDriver{
+				ObjectMeta: metav1.ObjectMeta{Name: "csi.example.com"},
+				Spec:       storage.CSIDriverSpec{AttachRequired: boolPtr(false)},
+			},
+		)),
+		CSINodeLister: storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:      record.NewFakeRecorder(10),
+	}
+
+	if _, err := r.Reconcile(pvc); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if actions := clientset.Actions(); len(actions) != 0 {
+		t.Fatalf("Expected no VA to be created got %v", actions)
+	}
+}
+
+func TestPVCReconcilerAttachMultipleNodes(t *testing.T) {
+	stor := newTestStorage("stor", "")
+	pvc := newAttachablePVC(stor, "node-1,node-2")
+	pvc.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteMany}
+	va := newTestVA(pvc, "node-1")
+
+	clientset := fake.NewSimpleClientset(va)
+	r := &PVCReconciler{
+		Clientset:       clientset,
+		VALister:        storagelisters.NewVolumeAttachmentLister(newIndexer(t, va)),
+		StorageLister:   ddplisters.NewStorageLister(newIndexer(t, stor)),
+		PVLister:        newTestPVLister(t, stor),
+		NodeLister:      corelisters.NewNodeLister(newIndexer(t)),
+		CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:        record.NewFakeRecorder(10),
+	}
+
+	result, err := r.Reconcile(pvc)
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if result.RequeueAfter != 0 {
+		t.Fatalf("Expected no requeue got %+v", result)
+	}
+
+	// VolumeAttachment of node-1 is retained & one more is
+	// created for node-2
+	vas, err := clientset.StorageV1beta1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if len(vas.Items) != 2 {
+		t.Fatalf("Expected 2 VAs got %d", len(vas.Items))
+	}
+	got, err := clientset.StorageV1beta1().VolumeAttachments().
+		Get(vaNameForPVC(pvc, "node-2"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected VA got %v", err)
+	}
+	if got.Spec.NodeName != "node-2" {
+		t.Fatalf("Expected node node-2 got %s", got.Spec.NodeName)
+	}
+}
+
+func TestPVCReconcilerMoveSharedStorage(t *testing.T) {
+	now := metav1.Now()
+	stor := newTestStorage("stor", "node-2")
+	pvc := newAttachablePVC(stor, "node-2")
+	pvc.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany}
+
+	// shared storage is attached to the new node without waiting for
+	// the detach from the old node
+	va := newTestVA(pvc, "node-1")
+	va.DeletionTimestamp = &now
+	va.Finalizers = []string{"external-attacher"}
+
+	clientset := fake.NewSimpleClientset(va)
+	r := &PVCReconciler{
+		Clientset:       clientset,
+		VALister:        storagelisters.NewVolumeAttachmentLister(newIndexer(t, va)),
+		StorageLister:   ddplisters.NewStorageLister(newIndexer(t, stor)),
+		PVLister:        newTestPVLister(t, stor),
+		NodeLister:      corelisters.NewNodeLister(newIndexer(t)),
+		CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:        record.NewFakeRecorder(10),
+	}
+
+	result, err := r.Reconcile(pvc)
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if result.RequeueAfter != waitInterval {
+		t.Fatalf("Expected requeue after %s got %+v", waitInterval, result)
+	}
+	got, err := clientset.StorageV1beta1().VolumeAttachments().
+		Get(vaNameForPVC(pvc, "node-2"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected VA got %v", err)
+	}
+	if got.Spec.NodeName != "node-2" {
+		t.Fatalf("Expected node node-2 got %s", got.Spec.NodeName)
+	}
+}
+
+func TestPVCReconcilerTopologyMismatch(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+	pvc := newAttachablePVC(stor, "node-1")
+	pv := newCSIPV(pvc.Spec.VolumeName, "csi.example.com")
+	pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+		Required: newZoneSelector("zone-a"),
+	}
+
+	tests := map[string]struct {
+		node     *v1.Node
+		isCreate bool
+	}{
+		"node matches pv affinity": {
+			node:     newZonalNode("node-1", "zone-a"),
+			isCreate: true,
+		},
+		"node does not match pv affinity": {
+			node: newZonalNode("node-1", "zone-b"),
+		},
+	}
+	for name, mock := range tests {
+		clientset := fake.NewSimpleClientset()
+		recorder := record.NewFakeRecorder(10)
+		r := &PVCReconciler{
+			Clientset:       clientset,
+			VALister:        storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+			StorageLister:   ddplisters.NewStorageLister(newIndexer(t, stor)),
+			CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+			PVLister:        corelisters.NewPersistentVolumeLister(newIndexer(t, pv)),
+			NodeLister:      corelisters.NewNodeLister(newIndexer(t, mock.node)),
+			CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+			Recorder:        recorder,
+		}
+
+		if _, err := r.Reconcile(pvc); err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+		_, err := clientset.StorageV1beta1().VolumeAttachments().
+			Get(vaNameForPVC(pvc, "node-1"), metav1.GetOptions{})
+		if mock.isCreate && err != nil {
+			t.Fatalf("%s: Expected VA got %v", name, err)
+		}
+		if !mock.isCreate && !apierrs.IsNotFound(err) {
+			t.Fatalf("%s: Expected no VA got %v", name, err)
+		}
+		if !mock.isCreate {
+			expectEvents(t, recorder, "Warning "+EventTopologyMismatch)
+		}
+	}
+}
+
+func TestPVCReconcilerPVNotFound(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+	pvc := newAttachablePVC(stor, "node-1")
+
+	clientset := fake.NewSimpleClientset()
+	r := &PVCReconciler{
+		Clientset:       clientset,
+		VALister:        storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageLister:   ddplisters.NewStorageLister(newIndexer(t, stor)),
+		CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+		PVLister:        corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister:      corelisters.NewNodeLister(newIndexer(t)),
+		CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:        record.NewFakeRecorder(10),
+	}
+
+	// storage reconciler reports the missing volume
+	if _, err := r.Reconcile(pvc); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if actions := clientset.Actions(); len(actions) != 0 {
+		t.Fatalf("Expected no VA to be created got %v", actions)
+	}
+}
+
+func TestPVCReconcilerAttachLimit(t *testing.T) {
+	// node-1 is full with the volume of another storage
+	other := newTestVA(newAttachablePVC(newTestStorage("other", "node-1"), "node-1"), "node-1")
+
+	reported := newTestStorage("stor", "node-1")
+	reported.Status.Attachments = []ddp.StorageAttachment{
+		{NodeName: "node-1", Reason: "AttachLimitReached"},
+	}
+
+	tests := map[string]struct {
+		stor    *ddp.Storage
+		isEvent bool
+	}{
+		"attach is queued": {
+			stor:    newTestStorage("stor", "node-1"),
+			isEvent: true,
+		},
+		"queued attach is already reported": {
+			stor: reported,
+		},
+	}
+	for name, mock := range tests {
+		pvc := newAttachablePVC(mock.stor, "node-1")
+
+		clientset := fake.NewSimpleClientset(other)
+		recorder := record.NewFakeRecorder(10)
+		r := &PVCReconciler{
+			Clientset:       clientset,
+			VALister:        storagelisters.NewVolumeAttachmentLister(newIndexer(t, other)),
+			StorageLister:   ddplisters.NewStorageLister(newIndexer(t, mock.stor)),
+			CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+			PVLister:        newTestPVLister(t, mock.stor),
+			NodeLister:      corelisters.NewNodeLister(newIndexer(t)),
+			CSINodeLister: storagelisters.NewCSINodeLister(newIndexer(t,
+				newTestCSINode("node-1", 1),
+			)),
+			Recorder: recorder,
+		}
+
+		result, err := r.Reconcile(pvc)
+		if err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+		if result.RequeueAfter != waitInterval {
+			t.Fatalf("%s: Expected requeue after %s got %+v", name, waitInterval, result)
+		}
+		_, err = clientset.StorageV1beta1().VolumeAttachments().
+			Get(vaNameForPVC(pvc, "node-1"), metav1.GetOptions{})
+		if !apierrs.IsNotFound(err) {
+			t.Fatalf("%s: Expected no VA got %v", name, err)
+		}
+
+		events := drainEvents(recorder)
+		if mock.isEvent && (len(events) == 0 || !strings.HasPrefix(events[0], "Warning "+EventAttachLimitReached)) {
+			t.Fatalf("%s: Expected event %s got %v", name, EventAttachLimitReached, events)
+		}
+		if !mock.isEvent && len(events) != 0 {
+			t.Fatalf("%s: Expected no event got %v", name, events)
+		}
+	}
+}
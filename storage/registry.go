@@ -0,0 +1,177 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+var (
+	// StorageGVK is the apiVersion & kind of storage
+	StorageGVK = ddp.SchemeGroupVersion.WithKind("Storage")
+
+	// StorageSetGVK is the apiVersion & kind of storage set
+	StorageSetGVK = ddp.SchemeGroupVersion.WithKind("StorageSet")
+
+	// PVCGVK is the apiVersion & kind of PVC
+	PVCGVK = v1.SchemeGroupVersion.WithKind("PersistentVolumeClaim")
+)
+
+// Reconciler reconciles a single concern of a watched resource.
+// Multiple reconcilers can be registered against the same
+// apiVersion & kind.
+//
+// NOTE:
+//	Reconcile logic needs to be idempotent. The given object is a
+// copy & hence can be modified by the reconciler.
+type Reconciler interface {
+	Reconcile(obj runtime.Object) (Result, error)
+}
+
+// StorageReconcilerFunc adapts a storage reconcile function to
+// Reconciler interface
+type StorageReconcilerFunc func(*ddp.Storage) (Result, error)
+
+// Reconcile implements Reconciler interface
+func (fn StorageReconcilerFunc) Reconcile(obj runtime.Object) (Result, error) {
+	stor, ok := obj.(*ddp.Storage)
+	if !ok {
+		return Result{}, errors.Errorf("Invalid object: Want storage: Got %T", obj)
+	}
+	return fn(stor)
+}
+
+// StorageSetReconcilerFunc adapts a storage set reconcile function
+// to Reconciler interface
+type StorageSetReconcilerFunc func(*ddp.StorageSet) (Result, error)
+
+// Reconcile implements Reconciler interface
+func (fn StorageSetReconcilerFunc) Reconcile(obj runtime.Object) (Result, error) {
+	set, ok := obj.(*ddp.StorageSet)
+	if !ok {
+		return Result{}, errors.Errorf("Invalid object: Want storage set: Got %T", obj)
+	}
+	return fn(set)
+}
+
+// PVCReconcilerFunc adapts a PVC reconcile function to Reconciler
+// interface
+type PVCReconcilerFunc func(*v1.PersistentVolumeClaim) (Result, error)
+
+// Reconcile implements Reconciler interface
+func (fn PVCReconcilerFunc) Reconcile(obj runtime.Object) (Result, error) {
+	pvc, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		return Result{}, errors.Errorf("Invalid object: Want PVC: Got %T", obj)
+	}
+	return fn(pvc)
+}
+
+// Registration is a reconciler registered against an apiVersion
+// & kind
+type Registration struct {
+	// Name of the reconciler. This is unique for an apiVersion & kind.
+	Name string
+
+	Reconciler Reconciler
+}
+
+// Registry holds the reconcilers registered against various
+// apiVersion & kind
+type Registry struct {
+	mutex         sync.RWMutex
+	registrations map[schema.GroupVersionKind][]Registration
+}
+
+// NewRegistry returns a new instance of empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		registrations: map[schema.GroupVersionKind][]Registration{},
+	}
+}
+
+// Register adds the given reconciler against the given apiVersion &
+// kind. Reconcilers of an apiVersion & kind are invoked in the order
+// of their registration.
+func (r *Registry) Register(
+	gvk schema.GroupVersionKind, name string, reconciler Reconciler,
+) error {
+
+	if name == "" {
+		return errors.Errorf("Register failed: %s: Missing reconciler name", gvk)
+	}
+	if reconciler == nil {
+		return errors.Errorf("Register failed: %s: %s: Nil reconciler", gvk, name)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, reg := range r.registrations[gvk] {
+		if reg.Name == name {
+			return errors.Errorf(
+				"Register failed: %s: %s: Duplicate reconciler", gvk, name,
+			)
+		}
+	}
+
+	r.registrations[gvk] = append(
+		r.registrations[gvk], Registration{Name: name, Reconciler: reconciler},
+	)
+	return nil
+}
+
+// MustRegister adds the given reconciler against the given
+// apiVersion & kind. It panics if registration fails.
+func (r *Registry) MustRegister(
+	gvk schema.GroupVersionKind, name string, reconciler Reconciler,
+) {
+	if err := r.Register(gvk, name, reconciler); err != nil {
+		panic(err)
+	}
+}
+
+// Registrations returns the reconcilers registered against the
+// given apiVersion & kind in the order of their registration
+func (r *Registry) Registrations(gvk schema.GroupVersionKind) []Registration {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	regs := make([]Registration, len(r.registrations[gvk]))
+	copy(regs, r.registrations[gvk])
+	return regs
+}
+
+// Kinds returns all the apiVersion & kinds that have at least one
+// reconciler registered
+func (r *Registry) Kinds() []schema.GroupVersionKind {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var gvks []schema.GroupVersionKind
+	for gvk := range r.registrations {
+		gvks = append(gvks, gvk)
+	}
+	return gvks
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"testing"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+func TestRegistryRegister(t *testing.T) {
+	noop := StorageReconcilerFunc(func(*ddp.Storage) (Result, error) {
+		return Result{}, nil
+	})
+
+	registry := NewRegistry()
+	registry.MustRegister(StorageGVK, "first", noop)
+	registry.MustRegister(StorageGVK, "second", noop)
+	// same name can be used against a different kind
+	registry.MustRegister(PVCGVK, "first", PVCReconcilerFunc(nil))
+
+	tests := map[string]struct {
+		name       string
+		reconciler Reconciler
+	}{
+		"missing name": {
+			reconciler: noop,
+		},
+		"nil reconciler": {
+			name: "third",
+		},
+		"duplicate name": {
+			name:       "first",
+			reconciler: noop,
+		},
+	}
+	for name, mock := range tests {
+		if err := registry.Register(StorageGVK, mock.name, mock.reconciler); err == nil {
+			t.Fatalf("%s: Expected error got none", name)
+		}
+	}
+
+	regs := registry.Registrations(StorageGVK)
+	if len(regs) != 2 || regs[0].Name != "first" || regs[1].Name != "second" {
+		t.Fatalf("Expected reconcilers in the order of registration got %v", regs)
+	}
+
+	// registrations returned to the caller are a copy
+	regs[0].Name = "changed"
+	if got := registry.Registrations(StorageGVK)[0].Name; got != "first" {
+		t.Fatalf("Expected first got %s", got)
+	}
+
+	if kinds := registry.Kinds(); len(kinds) != 2 {
+		t.Fatalf("Expected 2 kinds got %v", kinds)
+	}
+}
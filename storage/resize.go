@@ -0,0 +1,148 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// resizePVC expands the PVC to the capacity of the storage. A resize
+// that can not proceed is returned as a VolumeResize condition instead
+// of an error since retrying it is of no use till the storage or its
+// storageclass is changed.
+//
+// NOTE:
+//	Resize is attempted only after the PVC is bound since the request
+// of an unbound PVC can not be changed
+func (s *storageSync) resizePVC(
+	pvc *v1.PersistentVolumeClaim,
+) (updated *v1.PersistentVolumeClaim, rejected ddp.StorageCondition, err error) {
+
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Resize PVC failed", s)
+		}
+	}()
+
+	if pvc.Status.Phase != v1.ClaimBound {
+		return pvc, ddp.StorageCondition{}, nil
+	}
+
+	requested := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	desired := s.storage.Spec.Capacity
+	switch desired.Cmp(requested) {
+	case 0:
+		// no resize
+		return pvc, ddp.StorageCondition{}, nil
+	case -1:
+		return pvc, s.newShrinkCondition(pvc), nil
+	}
+
+	sc, err := s.StorageClassLister.Get(s.providerName)
+	if apierrs.IsNotFound(err) {
+		return pvc, newStorageCondition(
+			ddp.VolumeResize, ddp.ConditionFalse, "StorageClassNotFound",
+			fmt.Sprintf(
+				"Storageclass %s does not exist: Can not resize to %s",
+				s.providerName, desired.String(),
+			),
+		), nil
+	}
+	if err != nil {
+		return nil, ddp.StorageCondition{}, err
+	}
+	if sc.AllowVolumeExpansion == nil || !*sc.AllowVolumeExpansion {
+		return pvc, newStorageCondition(
+			ddp.VolumeResize, ddp.ConditionFalse, "ExpansionNotAllowed",
+			fmt.Sprintf(
+				"Storageclass %s does not allow volume expansion: Can not resize to %s",
+				sc.Name, desired.String(),
+			),
+		), nil
+	}
+
+	copy := pvc.DeepCopy()
+	copy.Spec.Resources.Requests[v1.ResourceStorage] = desired
+
+	// PVC & storage must have same namespace
+	updated, err =
+		s.Clientset.CoreV1().PersistentVolumeClaims(s.storage.Namespace).Update(copy)
+	if err != nil {
+		s.Recorder.Eventf(
+			s.storage, v1.EventTypeWarning, EventUpdateFailed,
+			"Failed to resize PVC %s to %s: %v", pvc.Name, desired.String(), err,
+		)
+		if apierrs.IsInvalid(err) || apierrs.IsForbidden(err) {
+			// e.g. resource quota is exceeded; this is not retried
+			// till the storage is changed
+			return pvc, newStorageCondition(
+				ddp.VolumeResize, ddp.ConditionFalse, "ResizeFailed",
+				fmt.Sprintf(
+					"Failed to resize PVC %s to %s: %v", pvc.Name, desired.String(), err,
+				),
+			), nil
+		}
+		return nil, ddp.StorageCondition{}, err
+	}
+
+	s.Recorder.Eventf(
+		s.storage, v1.EventTypeNormal, EventPVCResized,
+		"Resized PVC %s from %s to %s",
+		pvc.Name, requested.String(), desired.String(),
+	)
+	s.Recorder.Eventf(
+		pvc, v1.EventTypeNormal, EventPVCResized,
+		"Resized from %s to %s as per storage %s",
+		requested.String(), desired.String(), s.storage.Name,
+	)
+	return updated, ddp.StorageCondition{}, nil
+}
+
+// newShrinkCondition returns the condition that rejects the capacity
+// of the storage since it is less than the request of its PVC
+func (s *storageSync) newShrinkCondition(
+	pvc *v1.PersistentVolumeClaim,
+) ddp.StorageCondition {
+
+	requested := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	actual := pvc.Status.Capacity[v1.ResourceStorage]
+	desired := s.storage.Spec.Capacity
+
+	if actual.Cmp(requested) < 0 && desired.Cmp(actual) >= 0 {
+		// expansion is in progress or has failed
+		return newStorageCondition(
+			ddp.VolumeResize, ddp.ConditionFalse, "ResizeNotCancellable",
+			fmt.Sprintf(
+				"Resize of PVC %s from %s to %s can not be cancelled: Set capacity to %s",
+				pvc.Name, actual.String(), requested.String(), requested.String(),
+			),
+		)
+	}
+	return newStorageCondition(
+		ddp.VolumeResize, ddp.ConditionFalse, "ShrinkNotSupported",
+		fmt.Sprintf(
+			"Capacity %s is less than the capacity %s of PVC %s: Storage can not be shrunk",
+			desired.String(), requested.String(), pvc.Name,
+		),
+	)
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+// newBoundPVC returns a bound PVC of the given request & actual
+// capacity
+func newBoundPVC(requested, actual string) *v1.PersistentVolumeClaim {
+	pvc := newTestPVC(v1.ClaimBound)
+	pvc.Name = "stor"
+	pvc.Spec.Resources.Requests = v1.ResourceList{
+		v1.ResourceStorage: resource.MustParse(requested),
+	}
+	pvc.Status.Capacity = v1.ResourceList{
+		v1.ResourceStorage: resource.MustParse(actual),
+	}
+	return pvc
+}
+
+func TestStorageSyncResizePVC(t *testing.T) {
+	tests := map[string]struct {
+		pvc       *v1.PersistentVolumeClaim
+		capacity  string
+		scName    string
+		updateErr error
+		isUpdated bool
+		reason    string
+		isErr     bool
+	}{
+		"pvc not bound": {
+			pvc:      newTestPVC(v1.ClaimPending),
+			capacity: "8Gi",
+			scName:   "expandable-sc",
+		},
+		"same capacity": {
+			pvc:      newBoundPVC("4Gi", "4Gi"),
+			capacity: "4Gi",
+			scName:   "expandable-sc",
+		},
+		"shrink": {
+			pvc:      newBoundPVC("4Gi", "4Gi"),
+			capacity: "2Gi",
+			scName:   "expandable-sc",
+			reason:   "ShrinkNotSupported",
+		},
+		"cancel resize in progress": {
+			pvc:      newBoundPVC("8Gi", "4Gi"),
+			capacity: "4Gi",
+			scName:   "expandable-sc",
+			reason:   "ResizeNotCancellable",
+		},
+		"storageclass not found": {
+			pvc:      newBoundPVC("4Gi", "4Gi"),
+			capacity: "8Gi",
+			scName:   "missing-sc",
+			reason:   "StorageClassNotFound",
+		},
+		"expansion not allowed": {
+			pvc:      newBoundPVC("4Gi", "4Gi"),
+			capacity: "8Gi",
+			scName:   "csi-sc",
+			reason:   "ExpansionNotAllowed",
+		},
+		"update forbidden": {
+			pvc:      newBoundPVC("4Gi", "4Gi"),
+			capacity: "8Gi",
+			scName:   "expandable-sc",
+			updateErr: apierrs.NewForbidden(
+				schema.GroupResource{Resource: "persistentvolumeclaims"},
+				"stor", nil,
+			),
+			reason: "ResizeFailed",
+		},
+		"update failed": {
+			pvc:       newBoundPVC("4Gi", "4Gi"),
+			capacity:  "8Gi",
+			scName:    "expandable-sc",
+			updateErr: apierrs.NewServiceUnavailable("try again"),
+			isErr:     true,
+		},
+		"resized": {
+			pvc:       newBoundPVC("4Gi", "4Gi"),
+			capacity:  "8Gi",
+			scName:    "expandable-sc",
+			isUpdated: true,
+		},
+	}
+	for name, mock := range tests {
+		stor := newTestStorage("stor", "node-1")
+		stor.Spec.Capacity = resource.MustParse(mock.capacity)
+
+		clientset := fake.NewSimpleClientset(mock.pvc)
+		if mock.updateErr != nil {
+			updateErr := mock.updateErr
+			clientset.PrependReactor("update", "persistentvolumeclaims",
+				func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, updateErr
+				},
+			)
+		}
+		recorder := record.NewFakeRecorder(10)
+		s := &storageSync{
+			StorageReconciler: &StorageReconciler{
+				Clientset: clientset,
+				StorageClassLister: storagev1listers.NewStorageClassLister(newIndexer(t,
+					&storagev1.StorageClass{
+						ObjectMeta: metav1.ObjectMeta{Name: "csi-sc"},
+					},
+					&storagev1.StorageClass{
+						ObjectMeta:           metav1.ObjectMeta{Name: "expandable-sc"},
+						AllowVolumeExpansion: boolPtr(true),
+					},
+				)),
+				Recorder: recorder,
+			},
+			storage:      stor,
+			providerName: mock.scName,
+		}
+
+		_, rejected, err := s.resizePVC(mock.pvc)
+		if mock.isErr {
+			if err == nil {
+				t.Fatalf("%s: Expected error got none", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+		if rejected.Reason != mock.reason {
+			t.Fatalf("%s: Expected reason %q got %q", name, mock.reason, rejected.Reason)
+		}
+
+		pvc, err := clientset.CoreV1().PersistentVolumeClaims(stor.Namespace).
+			Get(mock.pvc.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: Get PVC failed: %v", name, err)
+		}
+		requested := mock.pvc.Spec.Resources.Requests[v1.ResourceStorage]
+		actual := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+		if got := actual.Cmp(requested) != 0; got != mock.isUpdated {
+			t.Fatalf(
+				"%s: Expected resized %t got %t: request %s",
+				name, mock.isUpdated, got, actual.String(),
+			)
+		}
+		if mock.isUpdated {
+			select {
+			case event := <-recorder.Events:
+				if !strings.Contains(event, EventPVCResized) {
+					t.Fatalf("%s: Expected event %s got %q", name, EventPVCResized, event)
+				}
+			default:
+				t.Fatalf("%s: Expected event %s got none", name, EventPVCResized)
+			}
+		}
+	}
+}
@@ -0,0 +1,342 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// nodeNameField is the only field supported by node selector terms
+const nodeNameField = "metadata.name"
+
+// isNodeSelectionRequired returns true if the node of the given
+// storage should be selected by the controller
+func isNodeSelectionRequired(stor *ddp.Storage) bool {
+	if stor.Spec.NodeName != nil || len(stor.Spec.NodeNames) != 0 {
+		return false
+	}
+	return len(stor.Spec.NodeSelector) != 0 || stor.Spec.NodeAffinity != nil
+}
+
+// selectNode returns the node that matches the node selector & node
+// affinity of the storage as well as the topology constraints of its
+// volume. A new node is selected only if it is ready & schedulable.
+// Previously selected node is retained as long as it exists & matches.
+// The returned condition reports the outcome of this selection.
+func (s *storageSync) selectNode(
+	pv *v1.PersistentVolume,
+) (nodeName string, cond ddp.StorageCondition, err error) {
+
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Select node failed", s)
+		}
+	}()
+
+	topology, err := s.getTopology(pv)
+	if err != nil {
+		return "", ddp.StorageCondition{}, err
+	}
+
+	nodes, err := s.NodeLister.List(labels.Everything())
+	if err != nil {
+		return "", ddp.StorageCondition{}, err
+	}
+
+	var candidates []*v1.Node
+	for _, node := range nodes {
+		matches, err := s.matchesNode(node, topology)
+		if err != nil {
+			return "", ddp.StorageCondition{}, err
+		}
+		if !matches {
+			continue
+		}
+		if node.Name == s.storage.Status.SelectedNode {
+			// selection is sticky
+			return node.Name, newStorageCondition(
+				ddp.NodeSelected, ddp.ConditionTrue, "NodeSelected",
+				fmt.Sprintf("Node %s is selected to attach the storage", node.Name),
+			), nil
+		}
+		if isNodeReady(node) && !node.Spec.Unschedulable {
+			candidates = append(candidates, node)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", newStorageCondition(
+			ddp.NodeSelected, ddp.ConditionFalse, "NoMatchingNode",
+			fmt.Sprintf(
+				"None of the %d nodes is ready, schedulable & matches the node selector, node affinity & volume topology",
+				len(nodes),
+			),
+		), nil
+	}
+
+	full, err := s.getFullNodes(candidates)
+	if err != nil {
+		return "", ddp.StorageCondition{}, err
+	}
+
+	// prefer nodes with free attach slots & a stable choice across
+	// reconciles
+	sort.Slice(candidates, func(i, j int) bool {
+		if full[candidates[i].Name] != full[candidates[j].Name] {
+			return !full[candidates[i].Name]
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates[0].Name, newStorageCondition(
+		ddp.NodeSelected, ddp.ConditionTrue, "NodeSelected",
+		fmt.Sprintf("Node %s is selected to attach the storage", candidates[0].Name),
+	), nil
+}
+
+// getFullNodes returns the names of the given nodes that have reached
+// the attach limit of the attacher of this storage
+func (s *storageSync) getFullNodes(nodes []*v1.Node) (map[string]bool, error) {
+	full := map[string]bool{}
+	if !s.attachRequired || s.attacherName == "" {
+		return full, nil
+	}
+
+	vas, err := s.VALister.List(labels.Everything())
+	if err != nil {
+		return nil, errors.Wrapf(err, "List VAs failed")
+	}
+
+	for _, node := range nodes {
+		limit, limited, err := getAttachLimit(s.CSINodeLister, node.Name, s.attacherName)
+		if err != nil {
+			return nil, err
+		}
+		usage := attachUsage{
+			count:   countAttachments(vas, node.Name, s.attacherName),
+			limit:   limit,
+			limited: limited,
+		}
+		full[node.Name] = usage.isFull()
+	}
+	return full, nil
+}
+
+// matchesNode returns true if the given node matches the node selector
+// & node affinity of the storage as well as the given topology
+func (s *storageSync) matchesNode(
+	node *v1.Node, topology *v1.NodeSelector,
+) (bool, error) {
+
+	selector := labels.SelectorFromSet(s.storage.Spec.NodeSelector)
+	if !selector.Matches(labels.Set(node.Labels)) {
+		return false, nil
+	}
+
+	for _, ns := range []*v1.NodeSelector{s.storage.Spec.NodeAffinity, topology} {
+		matches, err := matchesNodeSelector(node, ns)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// getTopology returns the topology constraint of the storage. Node
+// affinity of the bound PV is used if available. Allowed topologies
+// of the storageclass are used otherwise. A nil constraint is
+// returned if there are no constraints.
+func (s *storageSync) getTopology(pv *v1.PersistentVolume) (*v1.NodeSelector, error) {
+	if pv != nil {
+		return getPVNodeAffinity(pv), nil
+	}
+
+	sc, err := s.StorageClassLister.Get(s.providerName)
+	if apierrs.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return topologyToNodeSelector(sc.AllowedTopologies), nil
+}
+
+// getPVNodeAffinity returns the required node affinity of the given
+// PV. It returns nil if the PV can be accessed from any node.
+func getPVNodeAffinity(pv *v1.PersistentVolume) *v1.NodeSelector {
+	if pv == nil || pv.Spec.NodeAffinity == nil {
+		return nil
+	}
+	return pv.Spec.NodeAffinity.Required
+}
+
+// findCompatibleNode returns the name of a ready & schedulable node
+// that matches the node affinity of the given PV. It returns empty
+// string if no such node is found.
+func findCompatibleNode(nodes []*v1.Node, pv *v1.PersistentVolume) string {
+	var names []string
+	for _, node := range nodes {
+		if !isNodeReady(node) || node.Spec.Unschedulable {
+			continue
+		}
+		matches, err := matchesNodeSelector(node, getPVNodeAffinity(pv))
+		if err == nil && matches {
+			names = append(names, node.Name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return names[0]
+}
+
+// topologyToNodeSelector converts the given allowed topologies of a
+// storageclass to a node selector. A nil selector is returned if
+// there are no topologies.
+func topologyToNodeSelector(terms []v1.TopologySelectorTerm) *v1.NodeSelector {
+	if len(terms) == 0 {
+		return nil
+	}
+
+	selector := &v1.NodeSelector{}
+	for _, term := range terms {
+		var nsTerm v1.NodeSelectorTerm
+		for _, expr := range term.MatchLabelExpressions {
+			nsTerm.MatchExpressions = append(nsTerm.MatchExpressions, v1.NodeSelectorRequirement{
+				Key:      expr.Key,
+				Operator: v1.NodeSelectorOpIn,
+				Values:   expr.Values,
+			})
+		}
+		selector.NodeSelectorTerms = append(selector.NodeSelectorTerms, nsTerm)
+	}
+	return selector
+}
+
+// matchesNodeSelector returns true if the given node matches any of
+// the terms of the given node selector. A nil selector matches all
+// the nodes.
+func matchesNodeSelector(node *v1.Node, selector *v1.NodeSelector) (bool, error) {
+	if selector == nil {
+		return true, nil
+	}
+
+	for _, term := range selector.NodeSelectorTerms {
+		matches, err := matchesNodeSelectorTerm(node, term)
+		if err != nil {
+			return false, err
+		}
+		if matches {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchesNodeSelectorTerm returns true if the given node matches all
+// the requirements of the given term. An empty term matches no node.
+func matchesNodeSelectorTerm(node *v1.Node, term v1.NodeSelectorTerm) (bool, error) {
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return false, nil
+	}
+
+	for _, expr := range term.MatchExpressions {
+		matches, err := matchesNodeSelectorRequirement(labels.Set(node.Labels), expr)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	for _, expr := range term.MatchFields {
+		if expr.Key != nodeNameField {
+			return false, errors.Errorf(
+				"Unsupported field %q: Want %q", expr.Key, nodeNameField,
+			)
+		}
+		matches, err := matchesNodeNameRequirement(node.Name, expr)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchesNodeNameRequirement returns true if the given node name
+// matches the given field requirement.
+//
+// NOTE:
+//	Node name is compared as is since it is not a label value & may
+// be longer than what a label requirement accepts.
+func matchesNodeNameRequirement(
+	nodeName string, expr v1.NodeSelectorRequirement,
+) (bool, error) {
+
+	switch expr.Operator {
+	case v1.NodeSelectorOpIn:
+		return ContainsString(expr.Values, nodeName), nil
+	case v1.NodeSelectorOpNotIn:
+		return !ContainsString(expr.Values, nodeName), nil
+	default:
+		return false, errors.Errorf(
+			"Unsupported operator %q of field %q", expr.Operator, expr.Key,
+		)
+	}
+}
+
+// matchesNodeSelectorRequirement returns true if the given set of
+// labels matches the given requirement
+func matchesNodeSelectorRequirement(
+	set labels.Set, expr v1.NodeSelectorRequirement,
+) (bool, error) {
+
+	req, err := newNodeSelectorRequirement(expr)
+	if err != nil {
+		return false, err
+	}
+	return req.Matches(set), nil
+}
+
+// newNodeSelectorRequirement converts the given node selector
+// requirement to a label requirement
+func newNodeSelectorRequirement(expr v1.NodeSelectorRequirement) (*labels.Requirement, error) {
+	var op selection.Operator
+	switch expr.Operator {
+	case v1.NodeSelectorOpIn:
+		op = selection.In
+	case v1.NodeSelectorOpNotIn:
+		op = selection.NotIn
+	case v1.NodeSelectorOpExists:
+		op = selection.Exists
+	case v1.NodeSelectorOpDoesNotExist:
+		op = selection.DoesNotExist
+	case v1.NodeSelectorOpGt:
+		op = selection.GreaterThan
+	case v1.NodeSelectorOpLt:
+		op = selection.LessThan
+	default:
+		return nil, errors.Errorf("Unsupported operator %q", expr.Operator)
+	}
+	return labels.NewRequirement(expr.Key, op, expr.Values)
+}
@@ -0,0 +1,425 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// newZonalNode returns a ready node with the given zone label
+func newZonalNode(name, zone string) *v1.Node {
+	node := newTestNode(name, v1.ConditionTrue)
+	node.Labels = map[string]string{
+		"kubernetes.io/hostname": name,
+		"zone":                   zone,
+	}
+	return node
+}
+
+// newZoneSelector returns a node selector that matches the nodes of
+// the given zones
+func newZoneSelector(zones ...string) *v1.NodeSelector {
+	return &v1.NodeSelector{
+		NodeSelectorTerms: []v1.NodeSelectorTerm{
+			{
+				MatchExpressions: []v1.NodeSelectorRequirement{
+					{Key: "zone", Operator: v1.NodeSelectorOpIn, Values: zones},
+				},
+			},
+		},
+	}
+}
+
+func TestMatchesNodeSelector(t *testing.T) {
+	node := newZonalNode("node-1", "zone-a")
+
+	tests := map[string]struct {
+		selector *v1.NodeSelector
+		isMatch  bool
+		isErr    bool
+	}{
+		"nil selector": {
+			isMatch: true,
+		},
+		"matching expression": {
+			selector: newZoneSelector("zone-a", "zone-b"),
+			isMatch:  true,
+		},
+		"non matching expression": {
+			selector: newZoneSelector("zone-b"),
+		},
+		"any term matches": {
+			selector: &v1.NodeSelector{
+				NodeSelectorTerms: append(
+					newZoneSelector("zone-b").NodeSelectorTerms,
+					newZoneSelector("zone-a").NodeSelectorTerms...,
+				),
+			},
+			isMatch: true,
+		},
+		"empty term": {
+			selector: &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{{}}},
+		},
+		"matching field": {
+			selector: &v1.NodeSelector{
+				NodeSelectorTerms: []v1.NodeSelectorTerm{
+					{
+						MatchFields: []v1.NodeSelectorRequirement{
+							{Key: nodeNameField, Operator: v1.NodeSelectorOpIn, Values: []string{"node-1"}},
+						},
+					},
+				},
+			},
+			isMatch: true,
+		},
+		"unsupported field": {
+			selector: &v1.NodeSelector{
+				NodeSelectorTerms: []v1.NodeSelectorTerm{
+					{
+						MatchFields: []v1.NodeSelectorRequirement{
+							{Key: "spec.podCIDR", Operator: v1.NodeSelectorOpExists},
+						},
+					},
+				},
+			},
+			isErr: true,
+		},
+		"unsupported operator": {
+			selector: &v1.NodeSelector{
+				NodeSelectorTerms: []v1.NodeSelectorTerm{
+					{
+						MatchExpressions: []v1.NodeSelectorRequirement{
+							{Key: "zone", Operator: "Near", Values: []string{"zone-a"}},
+						},
+					},
+				},
+			},
+			isErr: true,
+		},
+	}
+	for name, mock := range tests {
+		matches, err := matchesNodeSelector(node, mock.selector)
+		if mock.isErr && err == nil {
+			t.Fatalf("%s: Expected error got none", name)
+		}
+		if !mock.isErr && err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+		if matches != mock.isMatch {
+			t.Fatalf("%s: Expected match %t got %t", name, mock.isMatch, matches)
+		}
+	}
+}
+
+func TestMatchesNodeSelectorNodeName(t *testing.T) {
+	// node names are DNS subdomains & may be longer than a label value
+	longName := "node-" + strings.Repeat("a", 70)
+	node := newZonalNode(longName, "zone-a")
+
+	newNodeNameSelector := func(
+		op v1.NodeSelectorOperator, values ...string,
+	) *v1.NodeSelector {
+		return &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{
+				{
+					MatchFields: []v1.NodeSelectorRequirement{
+						{Key: nodeNameField, Operator: op, Values: values},
+					},
+				},
+			},
+		}
+	}
+
+	tests := map[string]struct {
+		selector *v1.NodeSelector
+		isMatch  bool
+		isErr    bool
+	}{
+		"in": {
+			selector: newNodeNameSelector(v1.NodeSelectorOpIn, "node-0", longName),
+			isMatch:  true,
+		},
+		"in does not match": {
+			selector: newNodeNameSelector(v1.NodeSelectorOpIn, "node-0"),
+		},
+		"not in excludes": {
+			selector: newNodeNameSelector(v1.NodeSelectorOpNotIn, longName),
+		},
+		"not in includes": {
+			selector: newNodeNameSelector(v1.NodeSelectorOpNotIn, "node-0"),
+			isMatch:  true,
+		},
+		"unsupported operator": {
+			selector: newNodeNameSelector(v1.NodeSelectorOpExists),
+			isErr:    true,
+		},
+	}
+	for name, mock := range tests {
+		matches, err := matchesNodeSelector(node, mock.selector)
+		if mock.isErr && err == nil {
+			t.Fatalf("%s: Expected error got none", name)
+		}
+		if !mock.isErr && err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+		if matches != mock.isMatch {
+			t.Fatalf("%s: Expected match %t got %t", name, mock.isMatch, matches)
+		}
+	}
+}
+
+func TestTopologyToNodeSelector(t *testing.T) {
+	if selector := topologyToNodeSelector(nil); selector != nil {
+		t.Fatalf("Expected nil selector got %+v", selector)
+	}
+
+	selector := topologyToNodeSelector([]v1.TopologySelectorTerm{
+		{
+			MatchLabelExpressions: []v1.TopologySelectorLabelRequirement{
+				{Key: "zone", Values: []string{"zone-b"}},
+			},
+		},
+	})
+	for nodeName, expected := range map[string]bool{"node-a": false, "node-b": true} {
+		node := newZonalNode(nodeName, "zone-"+nodeName[len(nodeName)-1:])
+		matches, err := matchesNodeSelector(node, selector)
+		if err != nil {
+			t.Fatalf("%s: Expected no error got %v", nodeName, err)
+		}
+		if matches != expected {
+			t.Fatalf("%s: Expected match %t got %t", nodeName, expected, matches)
+		}
+	}
+}
+
+func TestStorageSyncSelectNode(t *testing.T) {
+	notReady := newZonalNode("node-0", "zone-a")
+	notReady.Status.Conditions[0].Status = v1.ConditionFalse
+	cordoned := newZonalNode("node-1", "zone-a")
+	cordoned.Spec.Unschedulable = true
+
+	nodes := []interface{}{
+		notReady,
+		cordoned,
+		newZonalNode("node-2", "zone-a"),
+		newZonalNode("node-3", "zone-b"),
+		newZonalNode("node-4", "zone-c"),
+	}
+
+	zonalPV := newCSIPV("pv", "csi.example.com")
+	zonalPV.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+		Required: newZoneSelector("zone-c"),
+	}
+
+	tests := map[string]struct {
+		nodeSelector map[string]string
+		nodeAffinity *v1.NodeSelector
+		providerName string
+		pv           *v1.PersistentVolume
+		selectedNode string
+		nodeName     string
+		reason       string
+	}{
+		"first ready & schedulable node": {
+			nodeSelector: map[string]string{"zone": "zone-a"},
+			nodeName:     "node-2",
+			reason:       "NodeSelected",
+		},
+		"node affinity": {
+			nodeAffinity: newZoneSelector("zone-b", "zone-c"),
+			nodeName:     "node-3",
+			reason:       "NodeSelected",
+		},
+		"storageclass topology": {
+			nodeSelector: map[string]string{"kubernetes.io/hostname": "node-3"},
+			providerName: "zonal-sc",
+			reason:       "NoMatchingNode",
+		},
+		"pv node affinity": {
+			nodeAffinity: newZoneSelector("zone-b", "zone-c"),
+			pv:           zonalPV,
+			nodeName:     "node-4",
+			reason:       "NodeSelected",
+		},
+		"selection is sticky": {
+			nodeAffinity: newZoneSelector("zone-b", "zone-c"),
+			selectedNode: "node-4",
+			nodeName:     "node-4",
+			reason:       "NodeSelected",
+		},
+		"sticky node even if cordoned": {
+			nodeSelector: map[string]string{"zone": "zone-a"},
+			selectedNode: "node-1",
+			nodeName:     "node-1",
+			reason:       "NodeSelected",
+		},
+		"selected node no longer matches": {
+			nodeSelector: map[string]string{"zone": "zone-b"},
+			selectedNode: "node-2",
+			nodeName:     "node-3",
+			reason:       "NodeSelected",
+		},
+		"no matching node": {
+			nodeSelector: map[string]string{"zone": "zone-d"},
+			reason:       "NoMatchingNode",
+		},
+	}
+	for name, mock := range tests {
+		stor := newTestStorage("stor", "")
+		stor.Spec.NodeName = nil
+		stor.Spec.NodeSelector = mock.nodeSelector
+		stor.Spec.NodeAffinity = mock.nodeAffinity
+		stor.Status.SelectedNode = mock.selectedNode
+		if mock.providerName == "" {
+			mock.providerName = "csi-sc"
+		}
+
+		s := &storageSync{
+			StorageReconciler: &StorageReconciler{
+				NodeLister: corelisters.NewNodeLister(newIndexer(t, nodes...)),
+				StorageClassLister: storagev1listers.NewStorageClassLister(newIndexer(t,
+					&storagev1.StorageClass{
+						ObjectMeta:  metav1.ObjectMeta{Name: "csi-sc"},
+						Provisioner: "csi.example.com",
+					},
+					&storagev1.StorageClass{
+						ObjectMeta:  metav1.ObjectMeta{Name: "zonal-sc"},
+						Provisioner: "csi.example.com",
+						AllowedTopologies: []v1.TopologySelectorTerm{
+							{
+								MatchLabelExpressions: []v1.TopologySelectorLabelRequirement{
+									{Key: "zone", Values: []string{"zone-a"}},
+								},
+							},
+						},
+					},
+				)),
+			},
+			storage:      stor,
+			providerName: mock.providerName,
+		}
+
+		nodeName, cond, err := s.selectNode(mock.pv)
+		if err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+		if nodeName != mock.nodeName {
+			t.Fatalf("%s: Expected node %q got %q", name, mock.nodeName, nodeName)
+		}
+		if cond.Type != ddp.NodeSelected || cond.Reason != mock.reason {
+			t.Fatalf("%s: Expected %s: %s got %s: %s", name, ddp.NodeSelected, mock.reason, cond.Type, cond.Reason)
+		}
+	}
+}
+
+func TestIsNodeSelectionRequired(t *testing.T) {
+	tests := map[string]struct {
+		spec       ddp.StorageSpec
+		isRequired bool
+	}{
+		"node name": {
+			spec: ddp.StorageSpec{NodeName: strPtr("node-1")},
+		},
+		"node selector": {
+			spec:       ddp.StorageSpec{NodeSelector: map[string]string{"zone": "zone-a"}},
+			isRequired: true,
+		},
+		"node affinity": {
+			spec:       ddp.StorageSpec{NodeAffinity: newZoneSelector("zone-a")},
+			isRequired: true,
+		},
+		"no node": {},
+	}
+	for name, mock := range tests {
+		got := isNodeSelectionRequired(&ddp.Storage{Spec: mock.spec})
+		if got != mock.isRequired {
+			t.Fatalf("%s: Expected required %t got %t", name, mock.isRequired, got)
+		}
+	}
+}
+
+func TestFindCompatibleNode(t *testing.T) {
+	pv := newCSIPV("pv", "csi.example.com")
+	pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+		Required: newZoneSelector("zone-b"),
+	}
+	cordoned := newZonalNode("node-2", "zone-b")
+	cordoned.Spec.Unschedulable = true
+
+	nodes := []*v1.Node{
+		newZonalNode("node-4", "zone-b"),
+		newZonalNode("node-1", "zone-a"),
+		cordoned,
+		newZonalNode("node-3", "zone-b"),
+	}
+	if nodeName := findCompatibleNode(nodes, pv); nodeName != "node-3" {
+		t.Fatalf("Expected node node-3 got %q", nodeName)
+	}
+	if nodeName := findCompatibleNode(nodes[1:3], pv); nodeName != "" {
+		t.Fatalf("Expected no node got %q", nodeName)
+	}
+}
+
+func TestStorageSyncSelectNodeWithFreeSlots(t *testing.T) {
+	stor := newTestStorage("stor", "")
+	stor.Spec.NodeName = nil
+	stor.Spec.NodeSelector = map[string]string{"zone": "zone-a"}
+
+	// node-1 is full with the volume of another storage
+	other := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "other"},
+		Spec:       storage.VolumeAttachmentSpec{NodeName: "node-1", Attacher: "csi.example.com"},
+	}
+
+	s := &storageSync{
+		StorageReconciler: &StorageReconciler{
+			NodeLister: corelisters.NewNodeLister(newIndexer(t,
+				newZonalNode("node-1", "zone-a"),
+				newZonalNode("node-2", "zone-a"),
+			)),
+			VALister: storagelisters.NewVolumeAttachmentLister(newIndexer(t, other)),
+			CSINodeLister: storagelisters.NewCSINodeLister(newIndexer(t,
+				newTestCSINode("node-1", 1),
+				newTestCSINode("node-2", 1),
+			)),
+			StorageClassLister: newTestStorageClassLister(t),
+		},
+		storage:        stor,
+		providerName:   "csi-sc",
+		attacherName:   "csi.example.com",
+		attachRequired: true,
+	}
+
+	nodeName, _, err := s.selectNode(nil)
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if nodeName != "node-2" {
+		t.Fatalf("Expected node node-2 got %q", nodeName)
+	}
+}
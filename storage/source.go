@@ -0,0 +1,203 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+	ref "k8s.io/client-go/tools/reference"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+const (
+	// API group & kind of volume snapshots that are set as the data
+	// source of a PVC
+	snapshotAPIGroup = "snapshot.storage.k8s.io"
+	snapshotKind     = "VolumeSnapshot"
+
+	// kind of PVC that is set as the data source of a cloned PVC
+	pvcKind = "PersistentVolumeClaim"
+)
+
+// volumeSnapshotGVR is used to get volume snapshots via the dynamic
+// client since snapshot API is not part of the core clientset
+var volumeSnapshotGVR = schema.GroupVersionResource{
+	Group:    snapshotAPIGroup,
+	Version:  "v1beta1",
+	Resource: "volumesnapshots",
+}
+
+// resolveSource returns the data source of the PVC of this storage.
+// A condition is returned instead if the source can not be used yet
+// to populate the PVC. Both are empty if the storage has no source.
+func (s *storageSync) resolveSource() (
+	*v1.TypedLocalObjectReference, ddp.StorageCondition, error,
+) {
+
+	src := s.storage.Spec.Source
+	switch {
+	case src == nil:
+		return nil, ddp.StorageCondition{}, nil
+	case src.VolumeSnapshot != nil:
+		return s.resolveSnapshotSource(src.VolumeSnapshot.Name)
+	case src.Storage != nil:
+		return s.resolveStorageSource(src.Storage.Name)
+	default:
+		// this is verified during validation
+		return nil, ddp.StorageCondition{}, nil
+	}
+}
+
+// resolveSnapshotSource verifies if the given volume snapshot is ready
+// to use & is not larger than the capacity of this storage
+func (s *storageSync) resolveSnapshotSource(name string) (
+	*v1.TypedLocalObjectReference, ddp.StorageCondition, error,
+) {
+
+	// snapshot & storage must have same namespace
+	snap, err := s.DynamicClient.Resource(volumeSnapshotGVR).
+		Namespace(s.storage.Namespace).Get(name, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		return nil, newStorageCondition(
+			ddp.VolumeRestored, ddp.ConditionFalse, "SourceNotFound",
+			fmt.Sprintf("VolumeSnapshot %s does not exist", name),
+		), nil
+	}
+	if err != nil {
+		return nil, ddp.StorageCondition{},
+			errors.Wrapf(err, "%s: Get VolumeSnapshot %s failed", s, name)
+	}
+
+	if message, found, _ := unstructured.NestedString(
+		snap.Object, "status", "error", "message",
+	); found && message != "" {
+		return nil, newStorageCondition(
+			ddp.VolumeRestored, ddp.ConditionFalse, "SnapshotError",
+			fmt.Sprintf("VolumeSnapshot %s failed: %s", name, message),
+		), nil
+	}
+
+	ready, _, _ := unstructured.NestedBool(snap.Object, "status", "readyToUse")
+	if !ready {
+		return nil, newStorageCondition(
+			ddp.VolumeRestored, ddp.ConditionFalse, "SourceNotReady",
+			fmt.Sprintf("VolumeSnapshot %s is not ready to use", name),
+		), nil
+	}
+
+	size, found, _ := unstructured.NestedString(snap.Object, "status", "restoreSize")
+	if found && size != "" {
+		restoreSize, err := resource.ParseQuantity(size)
+		if err != nil {
+			return nil, ddp.StorageCondition{}, errors.Wrapf(
+				err, "%s: Invalid restore size %q of VolumeSnapshot %s", s, size, name,
+			)
+		}
+		if s.storage.Spec.Capacity.Cmp(restoreSize) < 0 {
+			return nil, newStorageCondition(
+				ddp.VolumeRestored, ddp.ConditionFalse, "InsufficientCapacity",
+				fmt.Sprintf(
+					"Capacity %s is less than the restore size %s of VolumeSnapshot %s",
+					s.storage.Spec.Capacity.String(), restoreSize.String(), name,
+				),
+			), nil
+		}
+	}
+
+	return &v1.TypedLocalObjectReference{
+		APIGroup: strPtr(snapshotAPIGroup),
+		Kind:     snapshotKind,
+		Name:     name,
+	}, ddp.StorageCondition{}, nil
+}
+
+// resolveStorageSource verifies if the PVC of the given storage can be
+// cloned into the PVC of this storage. Source PVC must be bound, must
+// belong to the same storageclass & must not be larger than the
+// capacity of this storage.
+func (s *storageSync) resolveStorageSource(name string) (
+	*v1.TypedLocalObjectReference, ddp.StorageCondition, error,
+) {
+
+	// source & this storage must have same namespace
+	src, err := s.StorageLister.Storages(s.storage.Namespace).Get(name)
+	if apierrs.IsNotFound(err) {
+		return nil, newStorageCondition(
+			ddp.VolumeRestored, ddp.ConditionFalse, "SourceNotFound",
+			fmt.Sprintf("Storage %s does not exist", name),
+		), nil
+	}
+	if err != nil {
+		return nil, ddp.StorageCondition{},
+			errors.Wrapf(err, "%s: Get storage %s failed", s, name)
+	}
+	if src.DeletionTimestamp != nil {
+		return nil, newStorageCondition(
+			ddp.VolumeRestored, ddp.ConditionFalse, "SourceNotReady",
+			fmt.Sprintf("Storage %s is being deleted", name),
+		), nil
+	}
+
+	srcRef, err := ref.GetReference(scheme.Scheme, src)
+	if err != nil {
+		return nil, ddp.StorageCondition{}, err
+	}
+	srcPVC, err := s.findPVCOf(srcRef)
+	if err != nil {
+		return nil, ddp.StorageCondition{}, err
+	}
+	if srcPVC == nil || srcPVC.Status.Phase != v1.ClaimBound {
+		return nil, newStorageCondition(
+			ddp.VolumeRestored, ddp.ConditionFalse, "SourceNotReady",
+			fmt.Sprintf("PVC of storage %s is not bound", name),
+		), nil
+	}
+
+	if srcPVC.Spec.StorageClassName == nil || *srcPVC.Spec.StorageClassName != s.providerName {
+		return nil, newStorageCondition(
+			ddp.VolumeRestored, ddp.ConditionFalse, "StorageClassMismatch",
+			fmt.Sprintf(
+				"Storage %s is not provisioned by storageclass %s", name, s.providerName,
+			),
+		), nil
+	}
+
+	srcCapacity := srcPVC.Status.Capacity[v1.ResourceStorage]
+	if s.storage.Spec.Capacity.Cmp(srcCapacity) < 0 {
+		return nil, newStorageCondition(
+			ddp.VolumeRestored, ddp.ConditionFalse, "InsufficientCapacity",
+			fmt.Sprintf(
+				"Capacity %s is less than the capacity %s of storage %s",
+				s.storage.Spec.Capacity.String(), srcCapacity.String(), name,
+			),
+		), nil
+	}
+
+	return &v1.TypedLocalObjectReference{
+		Kind: pvcKind,
+		Name: srcPVC.Name,
+	}, ddp.StorageCondition{}, nil
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	ddplisters "github.com/mayadata-io/storage-provisioner/client/generated/lister/dao/v1alpha1"
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// newTestSnapshot returns a volume snapshot with the given status
+func newTestSnapshot(name string, status map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": snapshotAPIGroup + "/v1beta1",
+			"kind":       snapshotKind,
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": "default",
+			},
+			"status": status,
+		},
+	}
+}
+
+func TestStorageSyncResolveSnapshotSource(t *testing.T) {
+	tests := map[string]struct {
+		snapshotName string
+		isSource     bool
+		reason       string
+	}{
+		"snapshot not found": {
+			snapshotName: "missing",
+			reason:       "SourceNotFound",
+		},
+		"snapshot failed": {
+			snapshotName: "failed",
+			reason:       "SnapshotError",
+		},
+		"snapshot not ready": {
+			snapshotName: "pending",
+			reason:       "SourceNotReady",
+		},
+		"snapshot larger than storage": {
+			snapshotName: "large",
+			reason:       "InsufficientCapacity",
+		},
+		"snapshot ready": {
+			snapshotName: "ready",
+			isSource:     true,
+		},
+	}
+	for name, mock := range tests {
+		stor := newTestStorage("stor", "node-1")
+		stor.Spec.Source = &ddp.StorageSource{
+			VolumeSnapshot: &v1.LocalObjectReference{Name: mock.snapshotName},
+		}
+
+		s := &storageSync{
+			StorageReconciler: &StorageReconciler{
+				DynamicClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+					newTestSnapshot("failed", map[string]interface{}{
+						"error": map[string]interface{}{"message": "timed out"},
+					}),
+					newTestSnapshot("pending", map[string]interface{}{
+						"readyToUse": false,
+					}),
+					newTestSnapshot("large", map[string]interface{}{
+						"readyToUse":  true,
+						"restoreSize": "8Gi",
+					}),
+					newTestSnapshot("ready", map[string]interface{}{
+						"readyToUse":  true,
+						"restoreSize": "2Gi",
+					}),
+				),
+			},
+			storage: stor,
+		}
+
+		src, cond, err := s.resolveSource()
+		if err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+		if cond.Reason != mock.reason {
+			t.Fatalf("%s: Expected reason %q got %q", name, mock.reason, cond.Reason)
+		}
+		if !mock.isSource {
+			if src != nil {
+				t.Fatalf("%s: Expected no source got %+v", name, src)
+			}
+			continue
+		}
+		if src == nil || src.Kind != snapshotKind || src.Name != mock.snapshotName {
+			t.Fatalf("%s: Expected snapshot %s got %+v", name, mock.snapshotName, src)
+		}
+		if src.APIGroup == nil || *src.APIGroup != snapshotAPIGroup {
+			t.Fatalf("%s: Expected API group %s got %v", name, snapshotAPIGroup, src.APIGroup)
+		}
+	}
+}
+
+func TestStorageSyncResolveStorageSource(t *testing.T) {
+	now := metav1.Now()
+	deleting := newTestStorage("deleting", "")
+	deleting.DeletionTimestamp = &now
+
+	newBoundPVC := func(stor *ddp.Storage, sc, capacity string) *v1.PersistentVolumeClaim {
+		pvc := newOwnedPVC(stor)
+		pvc.Spec.StorageClassName = strPtr(sc)
+		pvc.Status.Phase = v1.ClaimBound
+		pvc.Status.Capacity = v1.ResourceList{
+			v1.ResourceStorage: resource.MustParse(capacity),
+		}
+		return pvc
+	}
+
+	unbound := newTestStorage("unbound", "")
+	unboundPVC := newOwnedPVC(unbound)
+	otherSC := newTestStorage("other-sc", "")
+	large := newTestStorage("large", "")
+	ready := newTestStorage("ready", "")
+
+	tests := map[string]struct {
+		sourceName string
+		isSource   bool
+		reason     string
+	}{
+		"storage not found": {
+			sourceName: "missing",
+			reason:     "SourceNotFound",
+		},
+		"storage is being deleted": {
+			sourceName: "deleting",
+			reason:     "SourceNotReady",
+		},
+		"pvc not bound": {
+			sourceName: "unbound",
+			reason:     "SourceNotReady",
+		},
+		"different storageclass": {
+			sourceName: "other-sc",
+			reason:     "StorageClassMismatch",
+		},
+		"storage larger than this storage": {
+			sourceName: "large",
+			reason:     "InsufficientCapacity",
+		},
+		"storage ready": {
+			sourceName: "ready",
+			isSource:   true,
+		},
+	}
+	for name, mock := range tests {
+		stor := newTestStorage("stor", "node-1")
+		stor.Spec.Source = &ddp.StorageSource{
+			Storage: &v1.LocalObjectReference{Name: mock.sourceName},
+		}
+
+		s := &storageSync{
+			StorageReconciler: &StorageReconciler{
+				StorageLister: ddplisters.NewStorageLister(newIndexer(t,
+					deleting, unbound, otherSC, large, ready,
+				)),
+				PVCLister: corelisters.NewPersistentVolumeClaimLister(newIndexer(t,
+					unboundPVC,
+					newBoundPVC(otherSC, "other-sc", "1Gi"),
+					newBoundPVC(large, "csi-sc", "8Gi"),
+					newBoundPVC(ready, "csi-sc", "2Gi"),
+				)),
+			},
+			storage:      stor,
+			providerName: "csi-sc",
+		}
+
+		src, cond, err := s.resolveSource()
+		if err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+		if cond.Reason != mock.reason {
+			t.Fatalf("%s: Expected reason %q got %q", name, mock.reason, cond.Reason)
+		}
+		if !mock.isSource {
+			if src != nil {
+				t.Fatalf("%s: Expected no source got %+v", name, src)
+			}
+			continue
+		}
+		if src == nil || src.Kind != pvcKind || src.Name != mock.sourceName {
+			t.Fatalf("%s: Expected PVC %s got %+v", name, mock.sourceName, src)
+		}
+	}
+}
@@ -0,0 +1,937 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// storageConditionOrder is the order in which conditions are
+// listed in storage status
+var storageConditionOrder = []ddp.StorageConditionType{
+	ddp.ResourcesCreated,
+	ddp.PVCBound,
+	ddp.VolumeRestored,
+	ddp.AttacherResolved,
+	ddp.NodeSelected,
+	ddp.NodeAvailable,
+	ddp.VolumeAttached,
+	ddp.VolumeResize,
+	ddp.DeletionHeld,
+	ddp.Ready,
+}
+
+// getStorageCondition returns the condition of the given type if
+// available in the given status
+func getStorageCondition(
+	status *ddp.StorageStatus, condType ddp.StorageConditionType,
+) *ddp.StorageCondition {
+
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == condType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setStorageCondition adds the given condition to the given status
+// or replaces the existing condition of the same type.
+//
+// NOTE:
+//	Timestamps are updated only if the condition has changed. This
+// avoids a status update & hence a re-queue for every reconcile.
+func setStorageCondition(status *ddp.StorageStatus, cond ddp.StorageCondition) {
+	now := metav1.Now()
+
+	existing := getStorageCondition(status, cond.Type)
+	if existing == nil {
+		cond.LastObservedTime = now
+		cond.LastTransitionTime = now
+		status.Conditions = append(status.Conditions, cond)
+		return
+	}
+
+	if existing.Status == cond.Status &&
+		existing.Reason == cond.Reason &&
+		existing.Message == cond.Message {
+		// no change
+		return
+	}
+
+	cond.LastObservedTime = now
+	cond.LastTransitionTime = existing.LastTransitionTime
+	if existing.Status != cond.Status {
+		cond.LastTransitionTime = now
+	}
+	*existing = cond
+}
+
+// isStorageConditionSet returns true if the given status has a
+// condition with the same type, status & reason as the given condition
+func isStorageConditionSet(
+	status *ddp.StorageStatus, cond ddp.StorageCondition,
+) bool {
+
+	existing := getStorageCondition(status, cond.Type)
+	return existing != nil &&
+		existing.Status == cond.Status &&
+		existing.Reason == cond.Reason
+}
+
+// removeStorageCondition removes the condition of the given type
+// from the given status if available
+func removeStorageCondition(
+	status *ddp.StorageStatus, condType ddp.StorageConditionType,
+) {
+
+	var conds []ddp.StorageCondition
+	for _, cond := range status.Conditions {
+		if cond.Type != condType {
+			conds = append(conds, cond)
+		}
+	}
+	status.Conditions = conds
+}
+
+// newStorageCondition returns a new instance of storage condition
+func newStorageCondition(
+	condType ddp.StorageConditionType,
+	status ddp.ConditionStatus,
+	reason, message string,
+) ddp.StorageCondition {
+
+	return ddp.StorageCondition{
+		Type:    condType,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	}
+}
+
+// storageStatusBuilder computes the status of a storage based on
+// the observed state of the resources owned by this storage
+type storageStatusBuilder struct {
+	status *ddp.StorageStatus
+
+	pvc       *v1.PersistentVolumeClaim
+	pv        *v1.PersistentVolume
+	vas       []*storage.VolumeAttachment
+	nodes     map[string]*v1.Node
+	nodeNames []string
+
+	// all the nodes of the cluster; these are set only if the PV
+	// has a node affinity & are used to suggest a compatible node
+	allNodes []*v1.Node
+
+	// attach usage of the selected nodes that do not have a
+	// VolumeAttachment for this storage
+	attachUsages map[string]attachUsage
+
+	// outcome of selecting the node; not set if the nodes are set
+	// explicitly
+	nodeSelected ddp.StorageCondition
+
+	// outcome of resolving the attacher
+	attacherResolved ddp.StorageCondition
+
+	// reason why the data source can not be used yet; not set if
+	// there is no data source or it was used to create the PVC
+	sourceResolved ddp.StorageCondition
+
+	// reason why the PVC can not be resized; not set if the resize
+	// was propagated to the PVC or is not required
+	resizeRejected ddp.StorageCondition
+
+	// name of the attacher & whether it needs a VolumeAttachment
+	attacherName   string
+	attachRequired bool
+}
+
+// build computes all the conditions & then derives the phase,
+// reason & message from these conditions
+func (b *storageStatusBuilder) build() {
+	if b.status.StartTime == nil {
+		now := metav1.Now()
+		b.status.StartTime = &now
+	}
+
+	b.setPVCBound()
+	b.setVolumeRestored()
+	setStorageCondition(b.status, b.attacherResolved)
+	b.setNodeSelected()
+	b.setNodeAvailable()
+	b.setResourcesCreated()
+	b.setAttachments()
+	b.setVolumeAttached()
+	b.setVolumeResize()
+	b.setDeletionHeld()
+	b.setMigration()
+	b.setPhase()
+	b.setReady()
+}
+
+func (b *storageStatusBuilder) setPVCBound() {
+	switch {
+	case b.pvc == nil:
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.PVCBound, ddp.ConditionFalse, "PVCNotFound",
+			"PVC is not created",
+		))
+	case b.pvc.Status.Phase == v1.ClaimLost:
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.PVCBound, ddp.ConditionFalse, "ClaimLost",
+			fmt.Sprintf("PVC %s lost its PV %s", b.pvc.Name, b.pvc.Spec.VolumeName),
+		))
+	case b.pvc.Status.Phase == v1.ClaimBound && b.pv != nil:
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.PVCBound, ddp.ConditionTrue, "Bound",
+			fmt.Sprintf("PVC %s is bound to PV %s", b.pvc.Name, b.pv.Name),
+		))
+	default:
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.PVCBound, ddp.ConditionFalse, "WaitingForBinding",
+			fmt.Sprintf("PVC %s is %s", b.pvc.Name, b.pvc.Status.Phase),
+		))
+	}
+}
+
+// setVolumeRestored reflects the progress of populating the PVC from
+// its data source. Volume is restored once the PVC gets bound.
+func (b *storageStatusBuilder) setVolumeRestored() {
+	switch {
+	case b.pvc == nil && b.sourceResolved.Type != "":
+		setStorageCondition(b.status, b.sourceResolved)
+	case b.pvc == nil || b.pvc.Spec.DataSource == nil:
+		// there is nothing to restore from
+		removeStorageCondition(b.status, ddp.VolumeRestored)
+	case b.pvc.Status.Phase == v1.ClaimBound:
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.VolumeRestored, ddp.ConditionTrue, "Restored",
+			fmt.Sprintf(
+				"PVC %s is restored from %s %s",
+				b.pvc.Name, b.pvc.Spec.DataSource.Kind, b.pvc.Spec.DataSource.Name,
+			),
+		))
+	default:
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.VolumeRestored, ddp.ConditionFalse, "Restoring",
+			fmt.Sprintf(
+				"Restoring PVC %s from %s %s",
+				b.pvc.Name, b.pvc.Spec.DataSource.Kind, b.pvc.Spec.DataSource.Name,
+			),
+		))
+	}
+}
+
+func (b *storageStatusBuilder) setNodeSelected() {
+	b.status.SelectedNode = ""
+	if b.nodeSelected.Type != "" {
+		// node was selected by the controller
+		if len(b.nodeNames) == 1 {
+			b.status.SelectedNode = b.nodeNames[0]
+		}
+		setStorageCondition(b.status, b.nodeSelected)
+		return
+	}
+
+	switch len(b.nodeNames) {
+	case 0:
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.NodeSelected, ddp.ConditionFalse, "NodeNameNotSet",
+			"No node is selected to attach the storage",
+		))
+	case 1:
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.NodeSelected, ddp.ConditionTrue, "NodeNameSet",
+			fmt.Sprintf("Node %s is selected to attach the storage", b.nodeNames[0]),
+		))
+	default:
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.NodeSelected, ddp.ConditionTrue, "NodeNameSet",
+			fmt.Sprintf(
+				"Nodes %s are selected to attach the storage",
+				strings.Join(b.nodeNames, ", "),
+			),
+		))
+	}
+}
+
+func (b *storageStatusBuilder) setNodeAvailable() {
+	if len(b.nodeNames) == 0 {
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.NodeAvailable, ddp.ConditionUnknown, "NodeNotSelected",
+			"No node is selected to attach the storage",
+		))
+		return
+	}
+
+	for _, nodeName := range b.nodeNames {
+		node := b.nodes[nodeName]
+		if node == nil {
+			setStorageCondition(b.status, newStorageCondition(
+				ddp.NodeAvailable, ddp.ConditionFalse, "NodeNotFound",
+				fmt.Sprintf("Node %s does not exist", nodeName),
+			))
+			return
+		}
+		if !isNodeReady(node) {
+			setStorageCondition(b.status, newStorageCondition(
+				ddp.NodeAvailable, ddp.ConditionFalse, "NodeNotReady",
+				fmt.Sprintf("Node %s is not ready", nodeName),
+			))
+			return
+		}
+		if message := b.getTopologyMismatch(node); message != "" {
+			setStorageCondition(b.status, newStorageCondition(
+				ddp.NodeAvailable, ddp.ConditionFalse, "TopologyMismatch", message,
+			))
+			return
+		}
+	}
+
+	message := fmt.Sprintf("Node %s is ready", b.nodeNames[0])
+	if len(b.nodeNames) > 1 {
+		message = fmt.Sprintf("Nodes %s are ready", strings.Join(b.nodeNames, ", "))
+	}
+	setStorageCondition(b.status, newStorageCondition(
+		ddp.NodeAvailable, ddp.ConditionTrue, "NodeReady", message,
+	))
+}
+
+// getTopologyMismatch returns the reason why the volume can not be
+// attached to the given node due to the node affinity of its PV. It
+// returns empty string if there is no mismatch.
+func (b *storageStatusBuilder) getTopologyMismatch(node *v1.Node) string {
+	matches, err := matchesNodeSelector(node, getPVNodeAffinity(b.pv))
+	if err != nil {
+		return fmt.Sprintf(
+			"Node affinity of PV %s can not be evaluated: %v", b.pv.Name, err,
+		)
+	}
+	if matches {
+		return ""
+	}
+
+	message := fmt.Sprintf(
+		"Node %s does not match the node affinity of PV %s", node.Name, b.pv.Name,
+	)
+	if compatible := findCompatibleNode(b.allNodes, b.pv); compatible != "" {
+		message = fmt.Sprintf("%s: Node %s is compatible", message, compatible)
+	}
+	return message
+}
+
+func (b *storageStatusBuilder) setResourcesCreated() {
+	if b.pvc == nil {
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.ResourcesCreated, ddp.ConditionFalse, "PVCNotCreated",
+			"PVC is not created",
+		))
+		return
+	}
+
+	for _, nodeName := range b.nodeNames {
+		if usage, found := b.attachUsages[nodeName]; found && usage.isFull() {
+			setStorageCondition(b.status, newStorageCondition(
+				ddp.ResourcesCreated, ddp.ConditionFalse, "AttachLimitReached",
+				fmt.Sprintf(
+					"VolumeAttachment for PVC %s on node %s is queued: %s",
+					b.pvc.Name, nodeName, usage,
+				),
+			))
+			return
+		}
+		if b.attachRequired && findVAForNode(b.vas, nodeName) == nil {
+			setStorageCondition(b.status, newStorageCondition(
+				ddp.ResourcesCreated, ddp.ConditionFalse, "VolumeAttachmentNotCreated",
+				fmt.Sprintf(
+					"VolumeAttachment for PVC %s on node %s is not created",
+					b.pvc.Name, nodeName,
+				),
+			))
+			return
+		}
+	}
+
+	setStorageCondition(b.status, newStorageCondition(
+		ddp.ResourcesCreated, ddp.ConditionTrue, "ResourcesCreated",
+		"All resources are created",
+	))
+}
+
+// setAttachments reflects the attach state of the storage against
+// each node. Nodes that the storage is being detached from are
+// listed first.
+func (b *storageStatusBuilder) setAttachments() {
+	var attachments []ddp.StorageAttachment
+	for _, va := range b.vas {
+		if !ContainsString(b.nodeNames, va.Spec.NodeName) {
+			attachments = append(
+				attachments, b.newStorageAttachment(va.Spec.NodeName, va, false),
+			)
+		}
+	}
+	for _, nodeName := range b.nodeNames {
+		attachments = append(
+			attachments,
+			b.newStorageAttachment(nodeName, findVAForNode(b.vas, nodeName), true),
+		)
+	}
+	b.status.Attachments = attachments
+}
+
+// newStorageAttachment returns the attach state of the storage against
+// the given node based on the given VolumeAttachment. Selected is true
+// if the storage should be attached to this node.
+func (b *storageStatusBuilder) newStorageAttachment(
+	nodeName string, va *storage.VolumeAttachment, selected bool,
+) ddp.StorageAttachment {
+
+	attachment := ddp.StorageAttachment{NodeName: nodeName}
+	if va != nil {
+		attachment.VolumeAttachmentName = va.Name
+		attachment.Attached = va.Status.Attached
+	}
+
+	switch {
+	case va == nil && !b.attachRequired && b.pv != nil:
+		attachment.Attached = true
+		attachment.Reason = "AttachNotRequired"
+		attachment.Message = fmt.Sprintf(
+			"Attacher %s does not require attach: PV %s is bound",
+			b.attacherName, b.pv.Name,
+		)
+	case va == nil && !b.attachRequired:
+		attachment.Reason = "WaitingForBinding"
+		attachment.Message = "Attach is not required: Waiting for PVC to get bound"
+	case va == nil && b.attachUsages[nodeName].isFull():
+		attachment.Reason = "AttachLimitReached"
+		attachment.Message = fmt.Sprintf(
+			"Attach is queued: %s", b.attachUsages[nodeName],
+		)
+	case va == nil:
+		attachment.Reason = "VolumeAttachmentNotFound"
+		attachment.Message = "VolumeAttachment is not created"
+	case va.DeletionTimestamp != nil && va.Status.DetachError != nil:
+		attachment.Reason = "DetachError"
+		attachment.Message = fmt.Sprintf(
+			"Failed to detach from node %s: %s",
+			nodeName, va.Status.DetachError.Message,
+		)
+	case va.DeletionTimestamp != nil:
+		attachment.Reason = "Detaching"
+		attachment.Message = fmt.Sprintf("Detaching from node %s", nodeName)
+	case !selected && va.Status.Attached:
+		attachment.Reason = "AttachedToOtherNode"
+		attachment.Message = fmt.Sprintf(
+			"Attached to node %s which is not selected", nodeName,
+		)
+	case !selected:
+		attachment.Reason = "NodeNotSelected"
+		attachment.Message = fmt.Sprintf(
+			"Waiting for detach from node %s which is not selected", nodeName,
+		)
+	case va.Status.Attached:
+		attachment.Reason = "Attached"
+		attachment.Message = fmt.Sprintf("Attached to node %s", nodeName)
+	case va.Status.AttachError != nil:
+		attachment.Reason = "AttachError"
+		attachment.Message = fmt.Sprintf(
+			"Failed to attach to node %s: %s",
+			nodeName, va.Status.AttachError.Message,
+		)
+	default:
+		attachment.Reason = "WaitingForAttach"
+		attachment.Message = fmt.Sprintf(
+			"Waiting for attacher %s to attach to node %s",
+			va.Spec.Attacher, nodeName,
+		)
+	}
+	return attachment
+}
+
+// setVolumeAttached aggregates the attach state of the storage
+// against all the nodes
+func (b *storageStatusBuilder) setVolumeAttached() {
+	if len(b.nodeNames) == 0 && len(b.vas) == 0 {
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.VolumeAttached, ddp.ConditionFalse, "Detached",
+			"Storage is not attached to any node",
+		))
+		return
+	}
+
+	for _, attachment := range b.status.Attachments {
+		if !attachment.Attached || !ContainsString(b.nodeNames, attachment.NodeName) {
+			setStorageCondition(b.status, newStorageCondition(
+				ddp.VolumeAttached, ddp.ConditionFalse,
+				attachment.Reason, attachment.Message,
+			))
+			return
+		}
+	}
+
+	if len(b.status.Attachments) == 1 {
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.VolumeAttached, ddp.ConditionTrue,
+			b.status.Attachments[0].Reason, b.status.Attachments[0].Message,
+		))
+		return
+	}
+	setStorageCondition(b.status, newStorageCondition(
+		ddp.VolumeAttached, ddp.ConditionTrue, "Attached",
+		fmt.Sprintf("Attached to nodes %s", strings.Join(b.nodeNames, ", ")),
+	))
+}
+
+// setVolumeResize reflects the progress of expanding the PVC as per
+// the resize conditions of the PVC. Actual capacity of the PVC is
+// reported once it is bound.
+func (b *storageStatusBuilder) setVolumeResize() {
+	if b.pvc == nil || b.pvc.Status.Phase != v1.ClaimBound {
+		b.status.Capacity = nil
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.VolumeResize, ddp.ConditionFalse, "NotBound",
+			"Storage can not be resized till its PVC is bound",
+		))
+		return
+	}
+
+	requested := b.pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	actual := b.pvc.Status.Capacity[v1.ResourceStorage]
+	b.status.Capacity = &actual
+
+	if b.resizeRejected.Type != "" {
+		setStorageCondition(b.status, b.resizeRejected)
+		return
+	}
+
+	if cond := getPVCCondition(
+		b.pvc, v1.PersistentVolumeClaimFileSystemResizePending,
+	); cond != nil && cond.Status == v1.ConditionTrue {
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.VolumeResize, ddp.ConditionTrue, "FileSystemResizePending",
+			fmt.Sprintf(
+				"Volume is resized to %s: Waiting for the file system to get resized on the node",
+				requested.String(),
+			),
+		))
+		return
+	}
+
+	if actual.Cmp(requested) < 0 {
+		message := fmt.Sprintf(
+			"Resizing from %s to %s", actual.String(), requested.String(),
+		)
+		if cond := getPVCCondition(
+			b.pvc, v1.PersistentVolumeClaimResizing,
+		); cond != nil && cond.Message != "" {
+			message = fmt.Sprintf("%s: %s", message, cond.Message)
+		}
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.VolumeResize, ddp.ConditionTrue, "Resizing", message,
+		))
+		return
+	}
+	setStorageCondition(b.status, newStorageCondition(
+		ddp.VolumeResize, ddp.ConditionFalse, "NoResizeInProgress",
+		fmt.Sprintf("Capacity is %s", actual.String()),
+	))
+}
+
+// getPVCCondition returns the condition of the given type if
+// available in the given PVC
+func getPVCCondition(
+	pvc *v1.PersistentVolumeClaim,
+	condType v1.PersistentVolumeClaimConditionType,
+) *v1.PersistentVolumeClaimCondition {
+
+	for i := range pvc.Status.Conditions {
+		if pvc.Status.Conditions[i].Type == condType {
+			return &pvc.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setDeletionHeld reports the deletion of the PVC that was not
+// initiated by storage controller & hence is held by its protection
+// finalizer. Deleted VolumeAttachments are reported as detaching since
+// their deletion can not be held.
+func (b *storageStatusBuilder) setDeletionHeld() {
+	if b.pvc != nil && isDeletionHeld(b.pvc, storageProtectionFinalizer) {
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.DeletionHeld, ddp.ConditionTrue, "PVCDeletionHeld",
+			fmt.Sprintf(
+				"PVC %s deletion is held till the storage is deleted", b.pvc.Name,
+			),
+		))
+		return
+	}
+	setStorageCondition(b.status, newStorageCondition(
+		ddp.DeletionHeld, ddp.ConditionFalse, "NoDeletionHeld",
+		"No deletion is held",
+	))
+}
+
+// setMigration records the progress of moving this storage from one
+// node to another. Steps are derived from the observed state of the
+// VolumeAttachment. Source node is carried over from the previous
+// status once its VolumeAttachment is gone.
+func (b *storageStatusBuilder) setMigration() {
+	prev := b.status.Migration
+
+	if len(b.nodeNames) != 1 {
+		// there is no single target node to move to
+		b.status.Migration = nil
+		return
+	}
+	target := b.nodeNames[0]
+
+	var sourceVA *storage.VolumeAttachment
+	for _, va := range b.vas {
+		if va.Spec.NodeName != target {
+			sourceVA = va
+			break
+		}
+	}
+
+	var source string
+	var step ddp.MigrationStep
+	switch {
+	case sourceVA != nil:
+		source = sourceVA.Spec.NodeName
+		step = ddp.MigrationNodeUpdated
+		if sourceVA.DeletionTimestamp != nil {
+			step = ddp.MigrationDetaching
+		}
+	case prev == nil:
+		// storage is not being moved
+		return
+	case b.isAttached(target):
+		// attached to the target node
+		b.status.Migration = nil
+		return
+	default:
+		source = prev.SourceNode
+		step = ddp.MigrationAttaching
+	}
+
+	startTime := metav1.Now()
+	if prev != nil && prev.SourceNode == source && prev.TargetNode == target {
+		if prev.Step == step {
+			// no change
+			return
+		}
+		if prev.StartTime != nil {
+			startTime = *prev.StartTime
+		}
+	}
+	b.status.Migration = &ddp.StorageMigration{
+		SourceNode: source,
+		TargetNode: target,
+		Step:       step,
+		StartTime:  &startTime,
+	}
+}
+
+// isAttached returns true if the storage is attached to the given
+// node
+func (b *storageStatusBuilder) isAttached(nodeName string) bool {
+	for _, attachment := range b.status.Attachments {
+		if attachment.NodeName == nodeName {
+			return attachment.Attached
+		}
+	}
+	return false
+}
+
+// setPhase derives the phase of the storage from the conditions
+// computed earlier
+func (b *storageStatusBuilder) setPhase() {
+	failed := b.failedCondition()
+
+	attached := getStorageCondition(b.status, ddp.VolumeAttached)
+	bound := getStorageCondition(b.status, ddp.PVCBound)
+	switch {
+	case failed != nil:
+		b.status.Phase = ddp.StorageFailed
+		b.status.Reason = failed.Reason
+		b.status.Message = failed.Message
+	case len(b.nodeNames) == 0 && len(b.vas) == 0 && bound.Status == ddp.ConditionTrue:
+		// no node is selected & the attacher has confirmed the detach
+		b.status.Phase = ddp.StorageDetached
+		b.status.Reason = attached.Reason
+		b.status.Message = attached.Message
+	case len(b.nodeNames) == 0 && len(b.vas) != 0:
+		// storage is getting detached
+		b.status.Phase = ddp.StoragePending
+		b.status.Reason = attached.Reason
+		b.status.Message = attached.Message
+	case attached.Status == ddp.ConditionTrue:
+		// attacher has reported success
+		b.status.Phase = ddp.StorageAttached
+		b.status.Reason = attached.Reason
+		b.status.Message = attached.Message
+	default:
+		b.status.Phase = ddp.StoragePending
+		b.status.Reason, b.status.Message = b.pendingReason()
+	}
+}
+
+// failedCondition returns the first condition that can not be
+// resolved by retrying the reconcile, nil otherwise
+func (b *storageStatusBuilder) failedCondition() *ddp.StorageCondition {
+	bound := getStorageCondition(b.status, ddp.PVCBound)
+	restored := getStorageCondition(b.status, ddp.VolumeRestored)
+	attacher := getStorageCondition(b.status, ddp.AttacherResolved)
+	available := getStorageCondition(b.status, ddp.NodeAvailable)
+	attached := getStorageCondition(b.status, ddp.VolumeAttached)
+
+	switch {
+	case bound.Reason == "ClaimLost":
+		return bound
+	case restored != nil &&
+		(restored.Reason == "InsufficientCapacity" || restored.Reason == "StorageClassMismatch"):
+		return restored
+	case attacher.Reason == "AttacherMismatch":
+		return attacher
+	case available.Reason == "NodeNotFound" || available.Reason == "TopologyMismatch":
+		return available
+	case attached.Reason == "AttachError":
+		return attached
+	default:
+		return nil
+	}
+}
+
+// pendingReason returns the reason & message of the first condition
+// that prevents this storage from getting attached
+func (b *storageStatusBuilder) pendingReason() (string, string) {
+	for _, condType := range []ddp.StorageConditionType{
+		ddp.VolumeRestored,
+		ddp.PVCBound,
+		ddp.AttacherResolved,
+		ddp.NodeSelected,
+		ddp.NodeAvailable,
+		ddp.ResourcesCreated,
+		ddp.VolumeAttached,
+	} {
+		cond := getStorageCondition(b.status, condType)
+		if cond != nil && cond.Status != ddp.ConditionTrue {
+			return cond.Reason, cond.Message
+		}
+	}
+	return "WaitingForAttach", "Waiting for the attacher to attach the storage"
+}
+
+// setReady sets the aggregate Ready condition based on the phase
+func (b *storageStatusBuilder) setReady() {
+	if b.status.Phase == ddp.StorageAttached {
+		setStorageCondition(b.status, newStorageCondition(
+			ddp.Ready, ddp.ConditionTrue, b.status.Reason, b.status.Message,
+		))
+		return
+	}
+	setStorageCondition(b.status, newStorageCondition(
+		ddp.Ready, ddp.ConditionFalse, b.status.Reason, b.status.Message,
+	))
+}
+
+// sortStorageConditions orders the conditions as per
+// storageConditionOrder. Unknown condition types are placed at the end.
+func sortStorageConditions(status *ddp.StorageStatus) {
+	sorted := make([]ddp.StorageCondition, 0, len(status.Conditions))
+	for _, condType := range storageConditionOrder {
+		if cond := getStorageCondition(status, condType); cond != nil {
+			sorted = append(sorted, *cond)
+		}
+	}
+	for _, cond := range status.Conditions {
+		if !isStorageConditionTypeOrdered(cond.Type) {
+			sorted = append(sorted, cond)
+		}
+	}
+	status.Conditions = sorted
+}
+
+// isStorageConditionTypeOrdered returns true if the given condition
+// type is present in storageConditionOrder
+func isStorageConditionTypeOrdered(condType ddp.StorageConditionType) bool {
+	for _, t := range storageConditionOrder {
+		if t == condType {
+			return true
+		}
+	}
+	return false
+}
+
+// isNodeReady returns true if the given node has its Ready condition
+// set to true
+func isNodeReady(node *v1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == v1.NodeReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// updateStatus computes the status of the storage from the given PVC,
+// its bound PV & VolumeAttachment. Status is updated only if there
+// was a change.
+func (s *storageSync) updateStatus(
+	pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume,
+) (err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Update status failed", s)
+		}
+	}()
+
+	builder := &storageStatusBuilder{
+		status:           s.storage.Status.DeepCopy(),
+		pvc:              pvc,
+		pv:               pv,
+		nodes:            map[string]*v1.Node{},
+		nodeNames:        s.nodeNames,
+		nodeSelected:     s.nodeSelected,
+		attacherResolved: s.attacherResolved,
+		sourceResolved:   s.sourceResolved,
+		resizeRejected:   s.resizeRejected,
+		attacherName:     s.attacherName,
+		attachRequired:   s.attachRequired,
+	}
+
+	if pvc != nil {
+		builder.vas, err = listVAsForPVC(s.VALister, pvc)
+		if err != nil {
+			return err
+		}
+	}
+
+	if getPVNodeAffinity(pv) != nil {
+		builder.allNodes, err = s.NodeLister.List(labels.Everything())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, nodeName := range s.nodeNames {
+		node, err := s.NodeLister.Get(nodeName)
+		if err != nil && !apierrs.IsNotFound(err) {
+			return err
+		}
+		if node != nil {
+			builder.nodes[nodeName] = node
+		}
+	}
+
+	builder.attachUsages = map[string]attachUsage{}
+	for _, nodeName := range s.nodeNames {
+		if !s.attachRequired || s.attacherName == "" ||
+			findVAForNode(builder.vas, nodeName) != nil {
+			continue
+		}
+		builder.attachUsages[nodeName], err = getAttachUsage(
+			s.CSINodeLister, s.VALister, nodeName, s.attacherName,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	prev := s.storage.Status.Migration
+	builder.build()
+
+	err = s.writeStatus(builder.status)
+	if err != nil {
+		return err
+	}
+
+	if prev != nil && builder.status.Migration == nil &&
+		len(s.nodeNames) == 1 && s.nodeNames[0] == prev.TargetNode {
+		s.Recorder.Eventf(
+			s.storage, v1.EventTypeNormal, EventMigrated,
+			"Moved from node %s to node %s", prev.SourceNode, prev.TargetNode,
+		)
+	}
+	return nil
+}
+
+// setFailedStatus marks the storage as failed with the given reason
+// & message. This is used when the storage can not be reconciled.
+func (s *storageSync) setFailedStatus(reason, message string) (err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Update status failed", s)
+		}
+	}()
+
+	status := s.storage.Status.DeepCopy()
+	if status.StartTime == nil {
+		now := metav1.Now()
+		status.StartTime = &now
+	}
+
+	status.Phase = ddp.StorageFailed
+	status.Reason = reason
+	status.Message = message
+	setStorageCondition(status, newStorageCondition(
+		ddp.Ready, ddp.ConditionFalse, reason, message,
+	))
+
+	return s.writeStatus(status)
+}
+
+// writeStatus updates the storage with the given status via status
+// sub resource. Update is skipped if there is no change in status.
+func (s *storageSync) writeStatus(status *ddp.StorageStatus) error {
+	sortStorageConditions(status)
+
+	if apiequality.Semantic.DeepEqual(&s.storage.Status, status) {
+		klog.V(4).Infof("%s: No change to status", s)
+		return nil
+	}
+
+	copy := s.storage.DeepCopy()
+	copy.Status = *status
+
+	updated, err :=
+		s.DDPClientset.DaoV1alpha1().Storages(copy.Namespace).UpdateStatus(copy)
+	if err != nil {
+		return err
+	}
+	klog.V(3).Infof(
+		"%s: Status updated: Phase %s: Reason %s", s, status.Phase, status.Reason,
+	)
+	s.storage = updated
+	return nil
+}
@@ -0,0 +1,560 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+func newTestPVC(phase v1.PersistentVolumeClaimPhase) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc", Namespace: "default"},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv"},
+		Status:     v1.PersistentVolumeClaimStatus{Phase: phase},
+	}
+}
+
+func newTestNode(name string, ready v1.ConditionStatus) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{
+				{Type: v1.NodeReady, Status: ready},
+			},
+		},
+	}
+}
+
+// attacherResolved is the outcome of resolving the attacher of the
+// test storages
+var attacherResolved = newStorageCondition(
+	ddp.AttacherResolved, ddp.ConditionTrue, "Resolved",
+	"Attacher csi.example.com is resolved from storage spec",
+)
+
+func TestStorageStatusBuilderPhase(t *testing.T) {
+	now := metav1.Now()
+	pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv"}}
+	restoring := newTestPVC(v1.ClaimPending)
+	restoring.Spec.DataSource = &v1.TypedLocalObjectReference{
+		APIGroup: strPtr(snapshotAPIGroup),
+		Kind:     snapshotKind,
+		Name:     "snap",
+	}
+	zonalPV := newCSIPV("pv", "csi.example.com")
+	zonalPV.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+		Required: newZoneSelector("zone-a"),
+	}
+
+	tests := map[string]struct {
+		builder *storageStatusBuilder
+		phase   ddp.StoragePhase
+		reason  string
+	}{
+		"pvc not created": {
+			builder: &storageStatusBuilder{},
+			phase:   ddp.StoragePending,
+			reason:  "PVCNotFound",
+		},
+		"pvc lost its pv": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimLost),
+				nodeNames: []string{"node-1"},
+				nodes:     map[string]*v1.Node{"node-1": newTestNode("node-1", v1.ConditionTrue)},
+			},
+			phase:  ddp.StorageFailed,
+			reason: "ClaimLost",
+		},
+		"source not ready": {
+			builder: &storageStatusBuilder{
+				sourceResolved: newStorageCondition(
+					ddp.VolumeRestored, ddp.ConditionFalse, "SourceNotReady",
+					"VolumeSnapshot snap is not ready to use",
+				),
+			},
+			phase:  ddp.StoragePending,
+			reason: "SourceNotReady",
+		},
+		"source larger than storage": {
+			builder: &storageStatusBuilder{
+				sourceResolved: newStorageCondition(
+					ddp.VolumeRestored, ddp.ConditionFalse, "InsufficientCapacity",
+					"Capacity 1Gi is less than the restore size 2Gi of VolumeSnapshot snap",
+				),
+			},
+			phase:  ddp.StorageFailed,
+			reason: "InsufficientCapacity",
+		},
+		"restoring": {
+			builder: &storageStatusBuilder{
+				pvc:       restoring,
+				nodeNames: []string{"node-1"},
+				nodes:     map[string]*v1.Node{"node-1": newTestNode("node-1", v1.ConditionTrue)},
+			},
+			phase:  ddp.StoragePending,
+			reason: "Restoring",
+		},
+		"node does not exist": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimBound),
+				pv:        pv,
+				nodeNames: []string{"node-1"},
+			},
+			phase:  ddp.StorageFailed,
+			reason: "NodeNotFound",
+		},
+		"node not ready": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimBound),
+				pv:        pv,
+				nodeNames: []string{"node-1"},
+				nodes:     map[string]*v1.Node{"node-1": newTestNode("node-1", v1.ConditionFalse)},
+			},
+			phase:  ddp.StoragePending,
+			reason: "NodeNotReady",
+		},
+		"node does not match pv affinity": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimBound),
+				pv:        zonalPV,
+				nodeNames: []string{"node-1"},
+				nodes:     map[string]*v1.Node{"node-1": newZonalNode("node-1", "zone-b")},
+			},
+			phase:  ddp.StorageFailed,
+			reason: "TopologyMismatch",
+		},
+		"node matches pv affinity": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimBound),
+				pv:        zonalPV,
+				nodeNames: []string{"node-1"},
+				nodes:     map[string]*v1.Node{"node-1": newZonalNode("node-1", "zone-a")},
+			},
+			phase:  ddp.StoragePending,
+			reason: "VolumeAttachmentNotCreated",
+		},
+		"va not created": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimBound),
+				pv:        pv,
+				nodeNames: []string{"node-1"},
+				nodes:     map[string]*v1.Node{"node-1": newTestNode("node-1", v1.ConditionTrue)},
+			},
+			phase:  ddp.StoragePending,
+			reason: "VolumeAttachmentNotCreated",
+		},
+		"attach limit reached": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimBound),
+				pv:        pv,
+				nodeNames: []string{"node-1"},
+				nodes:     map[string]*v1.Node{"node-1": newTestNode("node-1", v1.ConditionTrue)},
+				attachUsages: map[string]attachUsage{
+					"node-1": {nodeName: "node-1", driver: "csi.example.com", count: 1, limit: 1, limited: true},
+				},
+			},
+			phase:  ddp.StoragePending,
+			reason: "AttachLimitReached",
+		},
+		"va attached": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimBound),
+				pv:        pv,
+				nodeNames: []string{"node-1"},
+				nodes:     map[string]*v1.Node{"node-1": newTestNode("node-1", v1.ConditionTrue)},
+				vas: []*storage.VolumeAttachment{{
+					Spec:   storage.VolumeAttachmentSpec{NodeName: "node-1"},
+					Status: storage.VolumeAttachmentStatus{Attached: true},
+				}},
+			},
+			phase:  ddp.StorageAttached,
+			reason: "Attached",
+		},
+		"va attach error": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimBound),
+				pv:        pv,
+				nodeNames: []string{"node-1"},
+				nodes:     map[string]*v1.Node{"node-1": newTestNode("node-1", v1.ConditionTrue)},
+				vas: []*storage.VolumeAttachment{{
+					Spec: storage.VolumeAttachmentSpec{NodeName: "node-1"},
+					Status: storage.VolumeAttachmentStatus{
+						AttachError: &storage.VolumeError{Message: "timed out"},
+					},
+				}},
+			},
+			phase:  ddp.StorageFailed,
+			reason: "AttachError",
+		},
+		"va of other node not detached": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimBound),
+				pv:        pv,
+				nodeNames: []string{"node-2"},
+				nodes:     map[string]*v1.Node{"node-2": newTestNode("node-2", v1.ConditionTrue)},
+				vas: []*storage.VolumeAttachment{{
+					Spec:   storage.VolumeAttachmentSpec{NodeName: "node-1"},
+					Status: storage.VolumeAttachmentStatus{Attached: true},
+				}},
+			},
+			phase:  ddp.StoragePending,
+			reason: "VolumeAttachmentNotCreated",
+		},
+		"attached to multiple nodes": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimBound),
+				pv:        pv,
+				nodeNames: []string{"node-1", "node-2"},
+				nodes: map[string]*v1.Node{
+					"node-1": newTestNode("node-1", v1.ConditionTrue),
+					"node-2": newTestNode("node-2", v1.ConditionTrue),
+				},
+				vas: []*storage.VolumeAttachment{
+					{
+						Spec:   storage.VolumeAttachmentSpec{NodeName: "node-1"},
+						Status: storage.VolumeAttachmentStatus{Attached: true},
+					},
+					{
+						Spec:   storage.VolumeAttachmentSpec{NodeName: "node-2"},
+						Status: storage.VolumeAttachmentStatus{Attached: true},
+					},
+				},
+			},
+			phase:  ddp.StorageAttached,
+			reason: "Attached",
+		},
+		"attached to one of multiple nodes": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimBound),
+				pv:        pv,
+				nodeNames: []string{"node-1", "node-2"},
+				nodes: map[string]*v1.Node{
+					"node-1": newTestNode("node-1", v1.ConditionTrue),
+					"node-2": newTestNode("node-2", v1.ConditionTrue),
+				},
+				vas: []*storage.VolumeAttachment{
+					{
+						Spec:   storage.VolumeAttachmentSpec{NodeName: "node-1"},
+						Status: storage.VolumeAttachmentStatus{Attached: true},
+					},
+					{
+						Spec: storage.VolumeAttachmentSpec{NodeName: "node-2"},
+					},
+				},
+			},
+			phase:  ddp.StoragePending,
+			reason: "WaitingForAttach",
+		},
+		"one of multiple nodes does not exist": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimBound),
+				pv:        pv,
+				nodeNames: []string{"node-1", "node-2"},
+				nodes: map[string]*v1.Node{
+					"node-1": newTestNode("node-1", v1.ConditionTrue),
+				},
+			},
+			phase:  ddp.StorageFailed,
+			reason: "NodeNotFound",
+		},
+		"waiting for attacher": {
+			builder: &storageStatusBuilder{
+				pvc:       newTestPVC(v1.ClaimBound),
+				pv:        pv,
+				nodeNames: []string{"node-1"},
+				nodes:     map[string]*v1.Node{"node-1": newTestNode("node-1", v1.ConditionTrue)},
+				vas: []*storage.VolumeAttachment{{
+					Spec: storage.VolumeAttachmentSpec{NodeName: "node-1"},
+				}},
+			},
+			phase:  ddp.StoragePending,
+			reason: "WaitingForAttach",
+		},
+		"no node selected": {
+			builder: &storageStatusBuilder{
+				pvc: newTestPVC(v1.ClaimBound),
+				pv:  pv,
+			},
+			phase:  ddp.StorageDetached,
+			reason: "Detached",
+		},
+		"detaching since no node is selected": {
+			builder: &storageStatusBuilder{
+				pvc: newTestPVC(v1.ClaimBound),
+				pv:  pv,
+				vas: []*storage.VolumeAttachment{{
+					ObjectMeta: metav1.ObjectMeta{DeletionTimestamp: &now},
+					Spec:       storage.VolumeAttachmentSpec{NodeName: "node-1"},
+					Status:     storage.VolumeAttachmentStatus{Attached: true},
+				}},
+			},
+			phase:  ddp.StoragePending,
+			reason: "Detaching",
+		},
+		"attach not required": {
+			builder: &storageStatusBuilder{
+				pvc:          newTestPVC(v1.ClaimBound),
+				pv:           pv,
+				nodeNames:    []string{"node-1"},
+				nodes:        map[string]*v1.Node{"node-1": newTestNode("node-1", v1.ConditionTrue)},
+				attacherName: "nfs.example.com",
+			},
+			phase:  ddp.StorageAttached,
+			reason: "AttachNotRequired",
+		},
+	}
+	for name, mock := range tests {
+		name, mock := name, mock
+		t.Run(name, func(t *testing.T) {
+			mock.builder.status = &ddp.StorageStatus{}
+			if mock.builder.attacherResolved.Type == "" {
+				mock.builder.attacherResolved = attacherResolved
+			}
+			if mock.builder.attacherName == "" {
+				mock.builder.attacherName = "csi.example.com"
+				mock.builder.attachRequired = true
+			}
+			mock.builder.build()
+
+			if mock.builder.status.Phase != mock.phase {
+				t.Fatalf("Expected phase %s got %s", mock.phase, mock.builder.status.Phase)
+			}
+			if mock.builder.status.Reason != mock.reason {
+				t.Fatalf("Expected reason %s got %s", mock.reason, mock.builder.status.Reason)
+			}
+			ready := getStorageCondition(mock.builder.status, ddp.Ready)
+			if ready.Reason != mock.reason {
+				t.Fatalf("Expected ready reason %s got %s", mock.reason, ready.Reason)
+			}
+		})
+	}
+}
+
+func TestSetStorageConditionKeepsTimestamps(t *testing.T) {
+	status := &ddp.StorageStatus{}
+	setStorageCondition(status, newStorageCondition(
+		ddp.PVCBound, ddp.ConditionFalse, "WaitingForBinding", "PVC pvc is Pending",
+	))
+	past := metav1.NewTime(status.Conditions[0].LastTransitionTime.Add(-time.Minute))
+	status.Conditions[0].LastObservedTime = past
+	status.Conditions[0].LastTransitionTime = past
+
+	setStorageCondition(status, newStorageCondition(
+		ddp.PVCBound, ddp.ConditionFalse, "WaitingForBinding", "PVC pvc is Pending",
+	))
+	if cond := status.Conditions[0]; !cond.LastObservedTime.Equal(&past) {
+		t.Fatalf("Expected observed time %v got %v", past, cond.LastObservedTime)
+	}
+
+	setStorageCondition(status, newStorageCondition(
+		ddp.PVCBound, ddp.ConditionTrue, "Bound", "PVC pvc is bound to PV pv",
+	))
+	if len(status.Conditions) != 1 {
+		t.Fatalf("Expected 1 condition got %d", len(status.Conditions))
+	}
+	if cond := status.Conditions[0]; cond.LastTransitionTime.Equal(&past) {
+		t.Fatalf("Expected transition time to change got %v", cond.LastTransitionTime)
+	}
+}
+
+func TestStorageStatusBuilderMigration(t *testing.T) {
+	now := metav1.Now()
+	pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv"}}
+	va := &storage.VolumeAttachment{
+		Spec:   storage.VolumeAttachmentSpec{NodeName: "node-1"},
+		Status: storage.VolumeAttachmentStatus{Attached: true},
+	}
+	detaching := va.DeepCopy()
+	detaching.DeletionTimestamp = &now
+	attached := va.DeepCopy()
+	attached.Spec.NodeName = "node-2"
+
+	// storage is moved from node-1 to node-2
+	steps := []struct {
+		vas  []*storage.VolumeAttachment
+		step ddp.MigrationStep
+	}{
+		{vas: []*storage.VolumeAttachment{va}, step: ddp.MigrationNodeUpdated},
+		{vas: []*storage.VolumeAttachment{detaching}, step: ddp.MigrationDetaching},
+		{vas: nil, step: ddp.MigrationAttaching},
+		{vas: []*storage.VolumeAttachment{attached}},
+	}
+
+	status := &ddp.StorageStatus{}
+	for i, mock := range steps {
+		b := &storageStatusBuilder{
+			status:    status,
+			pvc:       newTestPVC(v1.ClaimBound),
+			pv:        pv,
+			vas:       mock.vas,
+			nodeNames: []string{"node-2"},
+			nodes:     map[string]*v1.Node{"node-2": newTestNode("node-2", v1.ConditionTrue)},
+
+			attacherResolved: attacherResolved,
+			attacherName:     "csi.example.com",
+			attachRequired:   true,
+		}
+		b.build()
+
+		if mock.step == "" {
+			if status.Migration != nil {
+				t.Fatalf("%d: Expected migration to complete got %+v", i, status.Migration)
+			}
+			continue
+		}
+		if status.Migration == nil {
+			t.Fatalf("%d: Expected migration step %s got none", i, mock.step)
+		}
+		if status.Migration.Step != mock.step {
+			t.Fatalf("%d: Expected step %s got %s", i, mock.step, status.Migration.Step)
+		}
+		if status.Migration.SourceNode != "node-1" || status.Migration.TargetNode != "node-2" {
+			t.Fatalf("%d: Expected node-1 to node-2 got %+v", i, status.Migration)
+		}
+	}
+}
+
+func TestStorageStatusBuilderSuggestsCompatibleNode(t *testing.T) {
+	pv := newCSIPV("pv", "csi.example.com")
+	pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+		Required: newZoneSelector("zone-a"),
+	}
+	node := newZonalNode("node-1", "zone-b")
+
+	b := &storageStatusBuilder{
+		status:    &ddp.StorageStatus{},
+		pvc:       newTestPVC(v1.ClaimBound),
+		pv:        pv,
+		nodeNames: []string{"node-1"},
+		nodes:     map[string]*v1.Node{"node-1": node},
+		allNodes:  []*v1.Node{node, newZonalNode("node-2", "zone-a")},
+
+		attacherResolved: attacherResolved,
+		attacherName:     "csi.example.com",
+		attachRequired:   true,
+	}
+	b.build()
+
+	cond := getStorageCondition(b.status, ddp.NodeAvailable)
+	expected := "Node node-1 does not match the node affinity of PV pv: Node node-2 is compatible"
+	if cond.Message != expected {
+		t.Fatalf("Expected message %q got %q", expected, cond.Message)
+	}
+}
+
+func TestStorageStatusBuilderVolumeResize(t *testing.T) {
+	pending := newBoundPVC("8Gi", "4Gi")
+	pending.Status.Conditions = []v1.PersistentVolumeClaimCondition{
+		{
+			Type:   v1.PersistentVolumeClaimFileSystemResizePending,
+			Status: v1.ConditionTrue,
+		},
+	}
+	resizing := newBoundPVC("8Gi", "4Gi")
+	resizing.Status.Conditions = []v1.PersistentVolumeClaimCondition{
+		{
+			Type:    v1.PersistentVolumeClaimResizing,
+			Status:  v1.ConditionTrue,
+			Message: "waiting for the external resizer",
+		},
+	}
+
+	tests := map[string]struct {
+		builder  *storageStatusBuilder
+		status   ddp.ConditionStatus
+		reason   string
+		message  string
+		capacity string
+	}{
+		"pvc not bound": {
+			builder: &storageStatusBuilder{pvc: newTestPVC(v1.ClaimPending)},
+			status:  ddp.ConditionFalse,
+			reason:  "NotBound",
+			message: "Storage can not be resized till its PVC is bound",
+		},
+		"no resize": {
+			builder:  &storageStatusBuilder{pvc: newBoundPVC("4Gi", "4Gi")},
+			status:   ddp.ConditionFalse,
+			reason:   "NoResizeInProgress",
+			message:  "Capacity is 4Gi",
+			capacity: "4Gi",
+		},
+		"resizing": {
+			builder:  &storageStatusBuilder{pvc: resizing},
+			status:   ddp.ConditionTrue,
+			reason:   "Resizing",
+			message:  "Resizing from 4Gi to 8Gi: waiting for the external resizer",
+			capacity: "4Gi",
+		},
+		"file system resize pending": {
+			builder:  &storageStatusBuilder{pvc: pending},
+			status:   ddp.ConditionTrue,
+			reason:   "FileSystemResizePending",
+			message:  "Volume is resized to 8Gi: Waiting for the file system to get resized on the node",
+			capacity: "4Gi",
+		},
+		"resize rejected": {
+			builder: &storageStatusBuilder{
+				pvc: newBoundPVC("4Gi", "4Gi"),
+				resizeRejected: newStorageCondition(
+					ddp.VolumeResize, ddp.ConditionFalse, "ShrinkNotSupported",
+					"Storage can not be shrunk",
+				),
+			},
+			status:   ddp.ConditionFalse,
+			reason:   "ShrinkNotSupported",
+			message:  "Storage can not be shrunk",
+			capacity: "4Gi",
+		},
+	}
+	for name, mock := range tests {
+		mock.builder.status = &ddp.StorageStatus{}
+		mock.builder.setVolumeResize()
+
+		cond := getStorageCondition(mock.builder.status, ddp.VolumeResize)
+		if cond == nil {
+			t.Fatalf("%s: Expected condition %s got none", name, ddp.VolumeResize)
+		}
+		if cond.Status != mock.status || cond.Reason != mock.reason {
+			t.Fatalf(
+				"%s: Expected %s/%s got %s/%s",
+				name, mock.status, mock.reason, cond.Status, cond.Reason,
+			)
+		}
+		if cond.Message != mock.message {
+			t.Fatalf("%s: Expected message %q got %q", name, mock.message, cond.Message)
+		}
+		capacity := mock.builder.status.Capacity
+		if mock.capacity == "" {
+			if capacity != nil {
+				t.Fatalf("%s: Expected no capacity got %s", name, capacity.String())
+			}
+			continue
+		}
+		if capacity == nil || capacity.Cmp(resource.MustParse(mock.capacity)) != 0 {
+			t.Fatalf("%s: Expected capacity %s got %v", name, mock.capacity, capacity)
+		}
+	}
+}
@@ -18,27 +18,63 @@ package storage
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	"k8s.io/client-go/tools/record"
 	ref "k8s.io/client-go/tools/reference"
 	"k8s.io/klog"
 
+	ddpclientset "github.com/mayadata-io/storage-provisioner/client/generated/clientset/versioned"
+	ddplisters "github.com/mayadata-io/storage-provisioner/client/generated/lister/dao/v1alpha1"
 	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
 )
 
-// Reconciler manages reconciling storage API
+// StorageReconciler manages reconciling storage API
 // in kubernetes cluster
-type Reconciler struct {
+type StorageReconciler struct {
 	// instances to invoke various Kubernetes APIs
-	Clientset kubernetes.Interface
-	PVCLister corelisters.PersistentVolumeClaimLister
+	Clientset    kubernetes.Interface
+	DDPClientset ddpclientset.Interface
+	PVCLister    corelisters.PersistentVolumeClaimLister
+	PVLister     corelisters.PersistentVolumeLister
+	NodeLister   corelisters.NodeLister
+	VALister     storagelisters.VolumeAttachmentLister
+
+	// listers used to resolve the attacher
+	StorageClassLister storagev1listers.StorageClassLister
+	CSIDriverLister    storagelisters.CSIDriverLister
+
+	// lister used to find the attach limits of nodes
+	CSINodeLister storagelisters.CSINodeLister
+
+	// instances used to resolve the data source i.e. volume snapshot
+	// or another storage
+	DynamicClient dynamic.Interface
+	StorageLister ddplisters.StorageLister
+
+	// Recorder emits events against the storage & its PVC
+	Recorder record.EventRecorder
+}
+
+// storageSync holds the state of reconciling a single storage. This
+// is not kept in the reconciler since the same reconciler is invoked
+// by concurrent workers.
+type storageSync struct {
+	*StorageReconciler
 
 	// storage that will get reconciled
 	storage *ddp.Storage
@@ -53,16 +89,37 @@ type Reconciler struct {
 	// name of the storage attacher
 	attacherName string
 
-	// name of the node where the storage gets attached to
-	nodeName string
+	// outcome of resolving the above attacher
+	attacherResolved ddp.StorageCondition
+
+	// true if above attacher requires a VolumeAttachment
+	attachRequired bool
+
+	// true if the storageclass delays binding till a node is selected
+	waitForFirstConsumer bool
+
+	// names of the nodes where the storage gets attached to
+	nodeNames []string
+
+	// outcome of selecting the node based on node selector & node
+	// affinity; this is not set if the nodes are set explicitly
+	nodeSelected ddp.StorageCondition
+
+	// data source to populate the PVC with
+	dataSource *v1.TypedLocalObjectReference
+
+	// reason why the above data source can not be used yet; PVC
+	// creation is held till then
+	sourceResolved ddp.StorageCondition
+
+	// reason why the PVC can not be resized to the capacity of this
+	// storage
+	resizeRejected ddp.StorageCondition
 }
 
-func (r *Reconciler) String() string {
-	if r.storage == nil {
-		return "StorageReconciler"
-	}
+func (s *storageSync) String() string {
 	return fmt.Sprintf(
-		"StorageReconciler %s/%s", r.storage.Namespace, r.storage.Name,
+		"StorageReconciler %s/%s", s.storage.Namespace, s.storage.Name,
 	)
 }
 
@@ -71,174 +128,577 @@ func (r *Reconciler) String() string {
 //
 // NOTE:
 //	Reconcile logic needs to be idempotent
-func (r *Reconciler) Reconcile(stor *ddp.Storage) error {
-	r.storage = stor
+func (r *StorageReconciler) Reconcile(stor *ddp.Storage) (result Result, err error) {
+	s := &storageSync{
+		StorageReconciler: r,
+		storage:           stor,
+	}
 
-	var (
-		found bool
-		err   error
-	)
 	defer func() {
 		if err != nil {
-			errors.Wrapf(err, "%s: Reconcile failed", r)
+			err = errors.Wrapf(err, "%s: Reconcile failed", s)
 		}
 	}()
 
-	r.storageRef, err = ref.GetReference(scheme.Scheme, r.storage)
+	s.storageRef, err = ref.GetReference(scheme.Scheme, s.storage)
 	if err != nil {
-		return err
+		return Result{}, err
 	}
 
-	if r.providerName, found = findProviderFromStorage(stor); !found {
-		return errors.Errorf(
-			"Missing annotation %q", storageclassProviderKey,
-		)
+	if stor.DeletionTimestamp != nil {
+		// storage is being deleted
+		return s.teardown()
+	}
+
+	// finalizer ensures owned resources are torn down in order
+	err = s.addTeardownFinalizer()
+	if err != nil {
+		return Result{}, err
 	}
 
-	if r.attacherName, found = findAttacherFromStorage(stor); !found {
-		return errors.Errorf(
-			"Missing annotation %q", storageCSIAttacherKey,
+	// storages created without the defaulting webhook get the same
+	// defaults here
+	err = s.applyDefaults()
+	if err != nil {
+		return Result{}, err
+	}
+
+	if errs := validateStorage(s.storage); len(errs) != 0 {
+		// storage can not be reconciled till its spec is fixed
+		message := errs.ToAggregate().Error()
+		s.Recorder.Event(
+			s.storage, v1.EventTypeWarning, EventInvalidSpec, message,
 		)
+		klog.Errorf("%s: Invalid spec: %s", s, message)
+		return Result{}, s.setFailedStatus(EventInvalidSpec, message)
+	}
+
+	// storages created by older versions have these set as annotations
+	err = s.migrateAnnotationsToSpec()
+	if err != nil {
+		return Result{}, err
 	}
 
+	s.providerName, _ = findProviderFromStorage(s.storage)
+
 	// find if PVC is created in previous reconcile attempt
-	pvc, err := r.findPVC()
+	pvc, err := s.findPVC()
 	if err != nil {
-		return err
+		return Result{}, err
+	}
+
+	pv, err := s.getBoundPV(pvc)
+	if err != nil {
+		return Result{}, err
+	}
+
+	s.attacherName, s.attacherResolved, err = s.resolveAttacher(pv)
+	if err != nil {
+		return Result{}, err
+	}
+
+	s.attachRequired = true
+	if s.attacherName != "" {
+		s.attachRequired, err = isAttachRequired(s.CSIDriverLister, s.attacherName)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	s.waitForFirstConsumer, err = s.isWaitForFirstConsumer()
+	if err != nil {
+		return Result{}, err
 	}
 
-	// create PVC if not found
+	s.nodeNames = s.getNodeNames()
+	s.nodeSelected = ddp.StorageCondition{}
+	if isNodeSelectionRequired(s.storage) {
+		var nodeName string
+		nodeName, s.nodeSelected, err = s.selectNode(pv)
+		if err != nil {
+			return Result{}, err
+		}
+		if nodeName != "" {
+			s.nodeNames = []string{nodeName}
+		}
+		if nodeName != "" && nodeName != s.storage.Status.SelectedNode {
+			s.Recorder.Eventf(
+				s.storage, v1.EventTypeNormal, EventNodeSelected,
+				"Selected node %s to attach the storage", nodeName,
+			)
+		}
+	}
+
+	s.dataSource, s.sourceResolved = nil, ddp.StorageCondition{}
+	s.resizeRejected = ddp.StorageCondition{}
 	if pvc == nil {
-		return r.createPVC()
+		s.dataSource, s.sourceResolved, err = s.resolveSource()
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	if pvc == nil && s.sourceResolved.Type != "" {
+		// PVC is created once its data source can be used
+		klog.V(3).Infof(
+			"%s: PVC creation is held: %s", s, s.sourceResolved.Message,
+		)
+	} else if pvc == nil {
+		// create PVC if not found
+		pvc, err = s.createPVC()
+		if err != nil {
+			return Result{}, err
+		}
+	} else if pvc.DeletionTimestamp != nil {
+		// PVC deletion is held by storage protection finalizer
+		// till this storage is deleted
+		klog.V(3).Infof("%s: PVC %s deletion is held", s, pvc.Name)
+	} else {
+		// PVCs created by older versions may not have the finalizer
+		err = addPVCProtection(s.Clientset, pvc)
+		if err != nil {
+			return Result{}, err
+		}
+
+		// update PVC if desired state was changed
+		var update bool
+		pvc, update, err = s.updatePVC(pvc)
+		if err != nil {
+			return Result{}, err
+		}
+		if !update {
+			klog.V(3).Infof("%s: No change to desired state", s)
+		}
+
+		pvc, s.resizeRejected, err = s.resizePVC(pvc)
+		if err != nil {
+			return Result{}, err
+		}
+		if s.resizeRejected.Type != "" && !isStorageConditionSet(
+			&s.storage.Status, s.resizeRejected,
+		) {
+			s.Recorder.Event(
+				s.storage, v1.EventTypeWarning, EventResizeRejected,
+				s.resizeRejected.Message,
+			)
+		}
+	}
+
+	// reflect the observed state of owned resources into storage status
+	err = s.updateStatus(pvc, pv)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if s.storage.Status.Phase == ddp.StoragePending {
+		// poll till the storage gets attached
+		return waitResult(), nil
+	}
+	return Result{}, nil
+}
+
+// applyDefaults sets the defaults of the storage & reports the
+// defaults applied here or by the defaulting webhook as an event
+func (s *storageSync) applyDefaults() (err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Apply defaults failed", s)
+		}
+	}()
+
+	copy := s.storage.DeepCopy()
+	defaults, err := DefaultStorage(copy, s.StorageClassLister)
+	if err != nil {
+		return err
+	}
+
+	// defaults applied by the webhook are reported once
+	if applied, found := findValueFromDict(copy.Annotations, defaultsAppliedKey); found {
+		defaults = append([]string{applied}, defaults...)
+		delete(copy.Annotations, defaultsAppliedKey)
+	}
+
+	if apiequality.Semantic.DeepEqual(s.storage, copy) {
+		// nothing to default
+		return nil
+	}
+
+	updated, err :=
+		s.DDPClientset.DaoV1alpha1().Storages(copy.Namespace).Update(copy)
+	if err != nil {
+		s.Recorder.Eventf(
+			s.storage, v1.EventTypeWarning, EventUpdateFailed,
+			"Failed to apply defaults: %v", err,
+		)
+		return err
+	}
+	if len(defaults) != 0 {
+		s.Recorder.Event(
+			s.storage, v1.EventTypeNormal, EventDefaulted,
+			strings.Join(defaults, "; "),
+		)
+	}
+	s.storage = updated
+	return nil
+}
+
+// migrateAnnotationsToSpec moves the storageclass & attacher names
+// from the annotations of the storage to its spec. Annotations are
+// removed once they are moved.
+//
+// NOTE:
+//	Storage should have been validated before invoking this
+func (s *storageSync) migrateAnnotationsToSpec() (err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Migrate annotations failed", s)
+		}
+	}()
+
+	anns := s.storage.GetAnnotations()
+	provider, providerFound := findValueFromDict(anns, storageclassProviderKey)
+	attacher, attacherFound := findValueFromDict(anns, storageCSIAttacherKey)
+	if !providerFound && !attacherFound {
+		// nothing to migrate
+		return nil
 	}
 
-	// update PVC if desired state was changed
-	update, err := r.updatePVC(pvc)
-	if !update {
-		klog.V(3).Infof("%s: No change to desired state", r)
+	copy := s.storage.DeepCopy()
+	if providerFound {
+		copy.Spec.StorageClassName = strPtr(provider)
+		delete(copy.Annotations, storageclassProviderKey)
+	}
+	if attacherFound {
+		copy.Spec.Attacher = strPtr(attacher)
+		delete(copy.Annotations, storageCSIAttacherKey)
 	}
-	return err
+
+	updated, err :=
+		s.DDPClientset.DaoV1alpha1().Storages(copy.Namespace).Update(copy)
+	if err != nil {
+		s.Recorder.Eventf(
+			s.storage, v1.EventTypeWarning, EventUpdateFailed,
+			"Failed to move annotations to spec: %v", err,
+		)
+		return err
+	}
+	s.Recorder.Eventf(
+		s.storage, v1.EventTypeNormal, EventSpecMigrated,
+		"Moved annotations %q & %q to spec",
+		storageclassProviderKey, storageCSIAttacherKey,
+	)
+	s.storage = updated
+	return nil
 }
 
 // findPVC will list & find the correct PVC if available
-func (r *Reconciler) findPVC() (*v1.PersistentVolumeClaim, error) {
+func (s *storageSync) findPVC() (*v1.PersistentVolumeClaim, error) {
+	return s.findPVCOf(s.storageRef)
+}
+
+// findPVCOf will list & find the PVC of the given storage if available
+func (s *storageSync) findPVCOf(
+	storRef *v1.ObjectReference,
+) (*v1.PersistentVolumeClaim, error) {
+
 	var err error
 
 	defer func() {
 		if err != nil {
-			err = errors.Wrapf(err, "%s: Find PVC failed", r)
+			err = errors.Wrapf(err, "%s: Find PVC of storage %s failed", s, storRef.Name)
 		}
 	}()
 
 	// PVC & storage must have same namespace
 	list, err :=
-		r.PVCLister.PersistentVolumeClaims(r.storage.Namespace).List(labels.Everything())
+		s.PVCLister.PersistentVolumeClaims(storRef.Namespace).List(labels.Everything())
 	if err != nil {
 		return nil, err
 	}
 
 	for _, pvc := range list {
-		isowner := isObjectReferenceAnOwner(pvc.OwnerReferences, r.storageRef)
+		isowner := isObjectReferenceAnOwner(pvc.OwnerReferences, storRef)
 		if isowner {
 			return pvc, nil
 		}
 	}
+
+	// owner reference may have been removed from the PVC
+	for _, pvc := range list {
+		uid, found := findValueFromDict(pvc.GetAnnotations(), storageUIDKey)
+		if found && uid == string(storRef.UID) {
+			return pvc, nil
+		}
+	}
 	return nil, nil
 }
 
-// updatePVC updates the PVC if there are any changes to desired state
-func (r *Reconciler) updatePVC(pvc *v1.PersistentVolumeClaim) (bool, error) {
+// getBoundPV returns the PV bound to the given PVC. It returns nil
+// if the PVC is not bound.
+func (s *storageSync) getBoundPV(
+	pvc *v1.PersistentVolumeClaim,
+) (*v1.PersistentVolume, error) {
+
+	if pvc == nil || pvc.Spec.VolumeName == "" {
+		return nil, nil
+	}
+
+	pv, err := s.PVLister.Get(pvc.Spec.VolumeName)
+	if apierrs.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: Get PV %s failed", s, pvc.Spec.VolumeName)
+	}
+	return pv, nil
+}
+
+// updatePVC updates the PVC if there are any changes to desired state.
+// Following changes are propagated to the PVC:
+//
+//	1/ node names of the storage which get picked up by the PVC
+//		reconciler to attach the storage to these nodes
+//	2/ resolved attacher of the storage
+//	3/ labels & annotations of the PVC template
+//	4/ node to provision the volume if the PVC is not yet bound
+//
+// NOTE:
+//	Capacity of the storage is propagated separately via resizePVC
+func (s *storageSync) updatePVC(
+	pvc *v1.PersistentVolumeClaim,
+) (*v1.PersistentVolumeClaim, bool, error) {
 
 	var err error
 	defer func() {
 		if err != nil {
-			err = errors.Wrapf(err, "%s: Update PVC failed", r)
+			err = errors.Wrapf(err, "%s: Update PVC failed", s)
 		}
 	}()
 
-	if pvc.Spec.Resources.Requests[v1.ResourceStorage] == r.storage.Spec.Capacity {
+	currentNodeNames := joinNodeNames(findNodeNamesFromPVC(pvc))
+	move := currentNodeNames != joinNodeNames(s.nodeNames)
+
+	currentAttacherName, _ := findAttacherFromPVC(pvc)
+	reattach := currentAttacherName != s.attacherName
+
+	selectedNodeName := s.getSelectedNodeName(pvc)
+	currentSelectedNodeName, _ := findValueFromDict(pvc.GetAnnotations(), selectedNodeKey)
+	reselect := selectedNodeName != "" && selectedNodeName != currentSelectedNodeName
+
+	// labels & annotations added to the template are synced to
+	// the PVC
+	copy := pvc.DeepCopy()
+	tmpl := getPVCTemplate(s.storage)
+	var relabel, reannotate bool
+	copy.Labels, relabel = mergeDict(copy.Labels, tmpl.Metadata.Labels)
+	copy.Annotations, reannotate = mergeDict(copy.Annotations, tmpl.Metadata.Annotations)
+
+	if !move && !reattach && !relabel && !reannotate && !reselect {
 		// no changes
-		return false, nil
+		return pvc, false, nil
 	}
 
-	copy := pvc.DeepCopy()
-	copy.Spec.Resources.Requests[v1.ResourceStorage] = r.storage.Spec.Capacity
+	if move {
+		if copy.Annotations == nil {
+			copy.Annotations = map[string]string{}
+		}
+		copy.Annotations[nodeNameKey] = joinNodeNames(s.nodeNames)
+	}
+	if reattach {
+		if copy.Annotations == nil {
+			copy.Annotations = map[string]string{}
+		}
+		copy.Annotations[storageCSIAttacherKey] = s.attacherName
+	}
+	if reselect {
+		if copy.Annotations == nil {
+			copy.Annotations = map[string]string{}
+		}
+		copy.Annotations[selectedNodeKey] = selectedNodeName
+	}
 
 	// PVC & storage must have same namespace
-	_, err =
-		r.Clientset.CoreV1().PersistentVolumeClaims(r.storage.Namespace).Update(copy)
-	return true, err
-}
+	updated, err :=
+		s.Clientset.CoreV1().PersistentVolumeClaims(s.storage.Namespace).Update(copy)
+	if err != nil {
+		s.Recorder.Eventf(
+			s.storage, v1.EventTypeWarning, EventUpdateFailed,
+			"Failed to update PVC %s: %v", pvc.Name, err,
+		)
+		return nil, true, err
+	}
 
-func (r *Reconciler) createPVC() error {
-	var err error
+	if move {
+		s.Recorder.Eventf(
+			s.storage, v1.EventTypeNormal, EventNodeChanged,
+			"Changed nodes of PVC %s from %q to %q",
+			pvc.Name, currentNodeNames, joinNodeNames(s.nodeNames),
+		)
+	}
+	if relabel || reannotate {
+		klog.V(3).Infof(
+			"%s: Synced labels & annotations of PVC %s with template", s, pvc.Name,
+		)
+	}
+	if reselect {
+		s.Recorder.Eventf(
+			s.storage, v1.EventTypeNormal, EventNodeChanged,
+			"Set node %s to provision the volume of PVC %s",
+			selectedNodeName, pvc.Name,
+		)
+	}
+	if reattach {
+		klog.V(3).Infof(
+			"%s: Changed attacher of PVC %s from %q to %q",
+			s, pvc.Name, currentAttacherName, s.attacherName,
+		)
+	}
+	return updated, true, nil
+}
 
+func (s *storageSync) createPVC() (pvc *v1.PersistentVolumeClaim, err error) {
 	defer func() {
 		if err != nil {
-			err = errors.Wrapf(err, "%s: Create PVC failed", r)
+			err = errors.Wrapf(err, "%s: Create PVC failed", s)
 		}
 	}()
 
-	r.nodeName = r.getNodeName()
-
 	// build a new instance of PVC object
-	pvc := r.newPVC()
+	pvc = s.newPVC()
 
 	// PVC & storage must have same namespace
-	_, err =
-		r.Clientset.CoreV1().PersistentVolumeClaims(r.storage.Namespace).Create(pvc)
-	return err
+	pvc, err =
+		s.Clientset.CoreV1().PersistentVolumeClaims(s.storage.Namespace).Create(pvc)
+	if err != nil {
+		s.Recorder.Eventf(
+			s.storage, v1.EventTypeWarning, EventCreateFailed,
+			"Failed to create PVC: %v", err,
+		)
+		return nil, err
+	}
+
+	if src := pvc.Spec.DataSource; src != nil {
+		s.Recorder.Eventf(
+			s.storage, v1.EventTypeNormal, EventPVCCreated,
+			"Created PVC %s with capacity %s from %s %s",
+			pvc.Name, s.storage.Spec.Capacity.String(), src.Kind, src.Name,
+		)
+	} else {
+		s.Recorder.Eventf(
+			s.storage, v1.EventTypeNormal, EventPVCCreated,
+			"Created PVC %s with capacity %s",
+			pvc.Name, s.storage.Spec.Capacity.String(),
+		)
+	}
+	s.Recorder.Eventf(
+		pvc, v1.EventTypeNormal, EventPVCCreated,
+		"Created for storage %s", s.storage.Name,
+	)
+	return pvc, nil
+}
+
+// isWaitForFirstConsumer returns true if the storageclass of this
+// storage delays the volume binding till a node is selected
+func (s *storageSync) isWaitForFirstConsumer() (bool, error) {
+	sc, err := s.StorageClassLister.Get(s.providerName)
+	if apierrs.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "%s: Get storageclass %s failed", s, s.providerName)
+	}
+	return sc.VolumeBindingMode != nil &&
+		*sc.VolumeBindingMode == storagev1.VolumeBindingWaitForFirstConsumer, nil
+}
+
+// getSelectedNodeName returns the node that should provision the
+// volume of the given PVC. This is applicable only for PVCs that
+// are not yet bound & belong to a WaitForFirstConsumer storageclass.
+// First node is used when the storage gets attached to more than one
+// node.
+func (s *storageSync) getSelectedNodeName(pvc *v1.PersistentVolumeClaim) string {
+	if !s.waitForFirstConsumer || len(s.nodeNames) == 0 {
+		return ""
+	}
+	if pvc != nil && pvc.Spec.VolumeName != "" {
+		// volume is already provisioned
+		return ""
+	}
+	return s.nodeNames[0]
 }
 
-// getNodeName returns the node name that will be used to attach
-// the storage
+// getNodeNames returns the names of the nodes that will be used to
+// attach the storage
 //
 // TODO (@amitkumardas):
-// 		Validate if this nodeName is allowed in storageclass (provider)
+// 		Validate if these nodes are allowed in storageclass (provider)
 // allowed topologies
-func (r *Reconciler) getNodeName() string {
-	if r.storage.Spec.NodeName != nil {
-		return *r.storage.Spec.NodeName
+func (s *storageSync) getNodeNames() []string {
+	return GetNodeNames(s.storage)
+}
+
+// GetNodeNames returns the names of the nodes that are set in the
+// given storage to attach the storage. Nodes selected by the
+// controller are not considered.
+func GetNodeNames(stor *ddp.Storage) []string {
+	if len(stor.Spec.NodeNames) != 0 {
+		return stor.Spec.NodeNames
 	}
-	return ""
+	if stor.Spec.NodeName != nil && *stor.Spec.NodeName != "" {
+		return []string{*stor.Spec.NodeName}
+	}
+	return nil
 }
 
-// newPVC returns a new instance of PVC API.
+// newPVC returns a new instance of PVC API. Fields owned by the
+// controller are set over the PVC template of the storage.
 //
 // NOTE:
 //	This should be used only for PVC create case
-func (r *Reconciler) newPVC() *v1.PersistentVolumeClaim {
+func (s *storageSync) newPVC() *v1.PersistentVolumeClaim {
+	tmpl := getPVCTemplate(s.storage)
+
+	annotations, _ := mergeDict(tmpl.Metadata.Annotations, map[string]string{
+		nodeNameKey:           joinNodeNames(s.nodeNames),
+		storageCSIAttacherKey: s.attacherName,
+		storageUIDKey:         string(s.storageRef.UID),
+	})
+	if selectedNodeName := s.getSelectedNodeName(nil); selectedNodeName != "" {
+		annotations[selectedNodeKey] = selectedNodeName
+	}
 
-	return &v1.PersistentVolumeClaim{
+	pvc := &v1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      r.storageRef.Name,
-			Namespace: r.storageRef.Namespace,
-			Annotations: map[string]string{
-				nodeNameKey:           r.nodeName,
-				storageCSIAttacherKey: r.attacherName,
-				storageUIDKey:         string(r.storageRef.UID),
+			Name:        s.storageRef.Name,
+			Namespace:   s.storageRef.Namespace,
+			Labels:      tmpl.Metadata.Labels,
+			Annotations: annotations,
+			Finalizers: []string{
+				storageProtectionFinalizer,
 			},
 			OwnerReferences: []metav1.OwnerReference{
 				metav1.OwnerReference{
-					APIVersion:         r.storageRef.APIVersion,
-					Kind:               r.storageRef.Kind,
-					Name:               r.storageRef.Name,
-					UID:                r.storageRef.UID,
+					APIVersion:         s.storageRef.APIVersion,
+					Kind:               s.storageRef.Kind,
+					Name:               s.storageRef.Name,
+					UID:                s.storageRef.UID,
 					Controller:         boolPtr(true),
 					BlockOwnerDeletion: boolPtr(true),
 				},
 			},
 		},
-		Spec: v1.PersistentVolumeClaimSpec{
-			Resources: v1.ResourceRequirements{
-				Requests: map[v1.ResourceName]resource.Quantity{
-					v1.ResourceStorage: r.storage.Spec.Capacity,
-				},
-			},
-			StorageClassName: strPtr(r.providerName),
-			AccessModes: []v1.PersistentVolumeAccessMode{
-				v1.ReadWriteOnce,
-			},
+	}
+
+	applyPVCTemplateSpec(&pvc.Spec, tmpl.Spec)
+	if s.dataSource != nil {
+		pvc.Spec.DataSource = s.dataSource
+	}
+	pvc.Spec.Resources = v1.ResourceRequirements{
+		Requests: map[v1.ResourceName]resource.Quantity{
+			v1.ResourceStorage: s.storage.Spec.Capacity,
 		},
 	}
+	pvc.Spec.StorageClassName = strPtr(s.providerName)
+	pvc.Spec.AccessModes = getAccessModes(s.storage)
+	return pvc
 }
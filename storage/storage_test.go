@@ -0,0 +1,927 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	ddpclientset "github.com/mayadata-io/storage-provisioner/client/generated/clientset/versioned"
+	ddpscheme "github.com/mayadata-io/storage-provisioner/client/generated/clientset/versioned/scheme"
+	daov1alpha1 "github.com/mayadata-io/storage-provisioner/client/generated/clientset/versioned/typed/dao/v1alpha1"
+	ddplisters "github.com/mayadata-io/storage-provisioner/client/generated/lister/dao/v1alpha1"
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// workers is the number of concurrent workers invoking the same
+// reconciler in tests
+const workers = 25
+
+func init() {
+	// storage references are built from this scheme
+	utilruntime.Must(ddpscheme.AddToScheme(scheme.Scheme))
+}
+
+func newIndexer(t *testing.T, objs ...interface{}) cache.Indexer {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+	})
+	for _, obj := range objs {
+		if err := indexer.Add(obj); err != nil {
+			t.Fatalf("Add %v to indexer failed: %v", obj, err)
+		}
+	}
+	return indexer
+}
+
+// fakeDDPClientset serves the storage & storage set updates made by
+// the reconcilers. Other APIs are not implemented.
+type fakeDDPClientset struct {
+	ddpclientset.Interface
+
+	storages    *fakeStorages
+	storageSets *fakeStorageSets
+}
+
+func (c *fakeDDPClientset) DaoV1alpha1() daov1alpha1.DaoV1alpha1Interface {
+	return &fakeDaoV1alpha1{storages: c.storages, storageSets: c.storageSets}
+}
+
+type fakeDaoV1alpha1 struct {
+	daov1alpha1.DaoV1alpha1Interface
+
+	storages    *fakeStorages
+	storageSets *fakeStorageSets
+}
+
+func (c *fakeDaoV1alpha1) Storages(namespace string) daov1alpha1.StorageInterface {
+	return c.storages
+}
+
+// fakeStorages records the last update of each storage along with
+// the storages that are created & deleted
+type fakeStorages struct {
+	daov1alpha1.StorageInterface
+
+	mutex   sync.Mutex
+	updated map[string]*ddp.Storage
+	created []*ddp.Storage
+	deleted []string
+}
+
+func (c *fakeStorages) Update(stor *ddp.Storage) (*ddp.Storage, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.updated[stor.Namespace+"/"+stor.Name] = stor.DeepCopy()
+	return stor, nil
+}
+
+func (c *fakeStorages) UpdateStatus(stor *ddp.Storage) (*ddp.Storage, error) {
+	return c.Update(stor)
+}
+
+func newTestStorage(name, nodeName string) *ddp.Storage {
+	return &ddp.Storage{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			UID:       types.UID("uid-" + name),
+		},
+		Spec: ddp.StorageSpec{
+			Capacity:         resource.MustParse("4Gi"),
+			NodeName:         strPtr(nodeName),
+			StorageClassName: strPtr("csi-sc"),
+			Attacher:         strPtr("csi.example.com"),
+		},
+	}
+}
+
+// newTestStorageClassLister returns a lister that serves the
+// storageclass of the test storages
+func newTestStorageClassLister(t *testing.T) storagev1listers.StorageClassLister {
+	return storagev1listers.NewStorageClassLister(newIndexer(t,
+		&storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: "csi-sc"},
+			Provisioner: "csi.example.com",
+		},
+	))
+}
+
+func TestStorageReconcilerReconcile(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+
+	clientset := fake.NewSimpleClientset()
+	ddpStorages := &fakeStorages{updated: map[string]*ddp.Storage{}}
+	recorder := record.NewFakeRecorder(10)
+	r := &StorageReconciler{
+		Clientset:    clientset,
+		DDPClientset: &fakeDDPClientset{storages: ddpStorages},
+		PVCLister:    corelisters.NewPersistentVolumeClaimLister(newIndexer(t)),
+		PVLister:     corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister: corelisters.NewNodeLister(newIndexer(t,
+			newTestNode("node-1", v1.ConditionTrue),
+		)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:           recorder,
+	}
+
+	result, err := r.Reconcile(stor)
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if result.RequeueAfter != waitInterval {
+		t.Fatalf("Expected requeue after %s got %+v", waitInterval, result)
+	}
+
+	pvc, err := clientset.CoreV1().PersistentVolumeClaims(stor.Namespace).
+		Get(stor.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected PVC got %v", err)
+	}
+	if nodeName := pvc.Annotations[nodeNameKey]; nodeName != "node-1" {
+		t.Fatalf("Expected node node-1 got %s", nodeName)
+	}
+	if attacher := pvc.Annotations[storageCSIAttacherKey]; attacher != "csi.example.com" {
+		t.Fatalf("Expected attacher csi.example.com got %s", attacher)
+	}
+	if !hasFinalizer(pvc, storageProtectionFinalizer) {
+		t.Fatalf("Expected finalizer %s got %v", storageProtectionFinalizer, pvc.Finalizers)
+	}
+	if owner := pvc.OwnerReferences[0]; owner.UID != stor.UID {
+		t.Fatalf("Expected owner %s got %s", stor.UID, owner.UID)
+	}
+	capacity := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	if capacity.Cmp(stor.Spec.Capacity) != 0 {
+		t.Fatalf("Expected capacity %s got %s", stor.Spec.Capacity.String(), capacity.String())
+	}
+
+	expectEvents(t, recorder, "Normal "+EventPVCCreated)
+
+	updated := ddpStorages.updated[stor.Namespace+"/"+stor.Name]
+	if updated == nil {
+		t.Fatalf("Expected status update got none")
+	}
+	if !hasFinalizer(updated, storageTeardownFinalizer) {
+		t.Fatalf("Expected finalizer %s got %v", storageTeardownFinalizer, updated.Finalizers)
+	}
+	if updated.Status.Phase != ddp.StoragePending {
+		t.Fatalf("Expected phase %s got %s", ddp.StoragePending, updated.Status.Phase)
+	}
+	if updated.Status.Reason != "WaitingForBinding" {
+		t.Fatalf("Expected reason WaitingForBinding got %s", updated.Status.Reason)
+	}
+}
+
+func TestStorageReconcilerFindPVCWithoutOwner(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+
+	// owner reference may get removed from the PVC
+	pvc := newOwnedPVC(stor)
+	pvc.OwnerReferences = nil
+	pvc.Annotations = map[string]string{storageUIDKey: string(stor.UID)}
+
+	clientset := fake.NewSimpleClientset(pvc)
+	r := &StorageReconciler{
+		Clientset: clientset,
+		DDPClientset: &fakeDDPClientset{
+			storages: &fakeStorages{updated: map[string]*ddp.Storage{}},
+		},
+		PVCLister:          corelisters.NewPersistentVolumeClaimLister(newIndexer(t, pvc)),
+		PVLister:           corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister:         corelisters.NewNodeLister(newIndexer(t)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:           record.NewFakeRecorder(10),
+	}
+
+	if _, err := r.Reconcile(stor); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	for _, action := range clientset.Actions() {
+		if action.Matches("create", "persistentvolumeclaims") {
+			t.Fatalf("Expected existing PVC to be used got %v", action)
+		}
+	}
+}
+
+func TestStorageReconcilerNodeChange(t *testing.T) {
+	stor := newTestStorage("stor", "node-2")
+	pvc := newOwnedPVC(stor)
+	pvc.Annotations = map[string]string{nodeNameKey: "node-1"}
+
+	clientset := fake.NewSimpleClientset(pvc)
+	recorder := record.NewFakeRecorder(10)
+	r := &StorageReconciler{
+		Clientset: clientset,
+		DDPClientset: &fakeDDPClientset{
+			storages: &fakeStorages{updated: map[string]*ddp.Storage{}},
+		},
+		PVCLister:          corelisters.NewPersistentVolumeClaimLister(newIndexer(t, pvc)),
+		PVLister:           corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister:         corelisters.NewNodeLister(newIndexer(t)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:           recorder,
+	}
+
+	if _, err := r.Reconcile(stor); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	// PVC reconciler picks the new node from the PVC
+	got, err := clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace).
+		Get(pvc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected PVC got %v", err)
+	}
+	if nodeName := got.Annotations[nodeNameKey]; nodeName != "node-2" {
+		t.Fatalf("Expected node node-2 got %s", nodeName)
+	}
+	expectEvents(t, recorder, "Normal "+EventNodeChanged)
+}
+
+func TestStorageReconcilerMigrateAnnotationsToSpec(t *testing.T) {
+	// storage created by an older version
+	stor := newTestStorage("stor", "node-1")
+	stor.Spec.StorageClassName = nil
+	stor.Spec.Attacher = nil
+	stor.Annotations = map[string]string{
+		storageclassProviderKey: "csi-sc",
+		storageCSIAttacherKey:   "csi.example.com",
+	}
+
+	clientset := fake.NewSimpleClientset()
+	ddpStorages := &fakeStorages{updated: map[string]*ddp.Storage{}}
+	recorder := record.NewFakeRecorder(10)
+	r := &StorageReconciler{
+		Clientset:          clientset,
+		DDPClientset:       &fakeDDPClientset{storages: ddpStorages},
+		PVCLister:          corelisters.NewPersistentVolumeClaimLister(newIndexer(t)),
+		PVLister:           corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister:         corelisters.NewNodeLister(newIndexer(t)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:           recorder,
+	}
+
+	if _, err := r.Reconcile(stor); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	expectEvents(t, recorder, "Normal "+EventSpecMigrated)
+
+	updated := ddpStorages.updated[stor.Namespace+"/"+stor.Name]
+	if len(updated.Annotations) != 0 {
+		t.Fatalf("Expected annotations to be removed got %v", updated.Annotations)
+	}
+	if name := updated.Spec.StorageClassName; name == nil || *name != "csi-sc" {
+		t.Fatalf("Expected storageclass csi-sc got %v", name)
+	}
+	if attacher := updated.Spec.Attacher; attacher == nil || *attacher != "csi.example.com" {
+		t.Fatalf("Expected attacher csi.example.com got %v", attacher)
+	}
+
+	pvc, err := clientset.CoreV1().PersistentVolumeClaims(stor.Namespace).
+		Get(stor.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected PVC got %v", err)
+	}
+	if sc := pvc.Spec.StorageClassName; sc == nil || *sc != "csi-sc" {
+		t.Fatalf("Expected PVC storageclass csi-sc got %v", sc)
+	}
+}
+
+func TestStorageReconcilerConcurrentReconcile(t *testing.T) {
+	var stors []*ddp.Storage
+	for i := 0; i < workers; i++ {
+		stors = append(stors, newTestStorage(
+			fmt.Sprintf("stor-%d", i), fmt.Sprintf("node-%d", i),
+		))
+	}
+
+	clientset := fake.NewSimpleClientset()
+	ddpStorages := &fakeStorages{updated: map[string]*ddp.Storage{}}
+	r := &StorageReconciler{
+		Clientset:          clientset,
+		DDPClientset:       &fakeDDPClientset{storages: ddpStorages},
+		PVCLister:          corelisters.NewPersistentVolumeClaimLister(newIndexer(t)),
+		PVLister:           corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister:         corelisters.NewNodeLister(newIndexer(t)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:           record.NewFakeRecorder(10 * workers),
+	}
+
+	// same reconciler is invoked by concurrent workers
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, len(stors))
+	for i, stor := range stors {
+		wg.Add(1)
+		go func(i int, stor *ddp.Storage) {
+			defer wg.Done()
+			<-start
+			_, errs[i] = r.Reconcile(stor)
+		}(i, stor)
+	}
+	close(start)
+	wg.Wait()
+
+	for i, stor := range stors {
+		if errs[i] != nil {
+			t.Fatalf("%s: Expected no error got %v", stor.Name, errs[i])
+		}
+
+		pvc, err := clientset.CoreV1().PersistentVolumeClaims(stor.Namespace).
+			Get(stor.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: Expected PVC got %v", stor.Name, err)
+		}
+		if uid := pvc.Annotations[storageUIDKey]; uid != string(stor.UID) {
+			t.Fatalf("%s: Expected PVC of storage %s got %s", stor.Name, stor.UID, uid)
+		}
+		if nodeName := pvc.Annotations[nodeNameKey]; nodeName != *stor.Spec.NodeName {
+			t.Fatalf("%s: Expected node %s got %s", stor.Name, *stor.Spec.NodeName, nodeName)
+		}
+
+		updated := ddpStorages.updated[stor.Namespace+"/"+stor.Name]
+		if updated == nil {
+			t.Fatalf("%s: Expected status update got none", stor.Name)
+		}
+		if updated.UID != stor.UID {
+			t.Fatalf("%s: Expected status of storage %s got %s", stor.Name, stor.UID, updated.UID)
+		}
+	}
+}
+
+func TestStorageReconcilerSharedNodes(t *testing.T) {
+	stor := newTestStorage("stor", "")
+	stor.Spec.NodeName = nil
+	stor.Spec.NodeNames = []string{"node-1", "node-2"}
+	stor.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteMany}
+
+	clientset := fake.NewSimpleClientset()
+	r := &StorageReconciler{
+		Clientset: clientset,
+		DDPClientset: &fakeDDPClientset{
+			storages: &fakeStorages{updated: map[string]*ddp.Storage{}},
+		},
+		PVCLister: corelisters.NewPersistentVolumeClaimLister(newIndexer(t)),
+		PVLister:  corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister: corelisters.NewNodeLister(newIndexer(t,
+			newTestNode("node-1", v1.ConditionTrue),
+			newTestNode("node-2", v1.ConditionTrue),
+		)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:           record.NewFakeRecorder(10),
+	}
+
+	if _, err := r.Reconcile(stor); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	pvc, err := clientset.CoreV1().PersistentVolumeClaims(stor.Namespace).
+		Get(stor.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected PVC got %v", err)
+	}
+	if nodeNames := pvc.Annotations[nodeNameKey]; nodeNames != "node-1,node-2" {
+		t.Fatalf("Expected nodes node-1,node-2 got %s", nodeNames)
+	}
+	if !reflect.DeepEqual(pvc.Spec.AccessModes, stor.Spec.AccessModes) {
+		t.Fatalf("Expected access modes %v got %v", stor.Spec.AccessModes, pvc.Spec.AccessModes)
+	}
+}
+
+func TestStorageReconcilerReadOnlyPV(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+	stor.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany}
+	pvc := newOwnedPVC(stor)
+	pvc.Annotations = map[string]string{
+		nodeNameKey:           "node-1",
+		storageCSIAttacherKey: "csi.example.com",
+	}
+	pvc.Spec.AccessModes = stor.Spec.AccessModes
+	pvc.Status.Phase = v1.ClaimBound
+	pv := newCSIPV(pvc.Spec.VolumeName, "csi.example.com")
+	pv.Spec.AccessModes = stor.Spec.AccessModes
+
+	clientset := fake.NewSimpleClientset(pvc, pv)
+	// source of a PV is immutable
+	clientset.PrependReactor(
+		"update", "persistentvolumes",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, apierrs.NewInvalid(
+				schema.GroupKind{Kind: "PersistentVolume"}, pv.Name, nil,
+			)
+		},
+	)
+	recorder := record.NewFakeRecorder(10)
+	r := &StorageReconciler{
+		Clientset: clientset,
+		DDPClientset: &fakeDDPClientset{
+			storages: &fakeStorages{updated: map[string]*ddp.Storage{}},
+		},
+		PVCLister: corelisters.NewPersistentVolumeClaimLister(newIndexer(t, pvc)),
+		PVLister:  corelisters.NewPersistentVolumeLister(newIndexer(t, pv)),
+		NodeLister: corelisters.NewNodeLister(newIndexer(t,
+			newTestNode("node-1", v1.ConditionTrue),
+		)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:           recorder,
+	}
+
+	if _, err := r.Reconcile(stor); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	for _, action := range clientset.Actions() {
+		if action.Matches("update", "persistentvolumes") {
+			t.Fatalf("Expected no update of PV got %v", action)
+		}
+	}
+}
+
+func TestStorageReconcilerPVCTemplate(t *testing.T) {
+	block := v1.PersistentVolumeBlock
+	stor := newTestStorage("stor", "node-1")
+	stor.Spec.PVCTemplate = &ddp.PVCTemplate{
+		Metadata: ddp.PVCTemplateMeta{
+			Labels:      map[string]string{"app": "db"},
+			Annotations: map[string]string{"example.com/owner": "team-1"},
+		},
+		Spec: ddp.PVCTemplateSpec{VolumeMode: &block},
+	}
+
+	clientset := fake.NewSimpleClientset()
+	r := &StorageReconciler{
+		Clientset: clientset,
+		DDPClientset: &fakeDDPClientset{
+			storages: &fakeStorages{updated: map[string]*ddp.Storage{}},
+		},
+		PVCLister:          corelisters.NewPersistentVolumeClaimLister(newIndexer(t)),
+		PVLister:           corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister:         corelisters.NewNodeLister(newIndexer(t)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:           record.NewFakeRecorder(10),
+	}
+
+	if _, err := r.Reconcile(stor); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	pvc, err := clientset.CoreV1().PersistentVolumeClaims(stor.Namespace).
+		Get(stor.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected PVC got %v", err)
+	}
+	if pvc.Labels["app"] != "db" {
+		t.Fatalf("Expected label app=db got %v", pvc.Labels)
+	}
+	if pvc.Annotations["example.com/owner"] != "team-1" {
+		t.Fatalf("Expected annotation example.com/owner=team-1 got %v", pvc.Annotations)
+	}
+	if pvc.Annotations[nodeNameKey] != "node-1" {
+		t.Fatalf("Expected node node-1 got %v", pvc.Annotations)
+	}
+	if pvc.Spec.VolumeMode == nil || *pvc.Spec.VolumeMode != block {
+		t.Fatalf("Expected volume mode %s got %v", block, pvc.Spec.VolumeMode)
+	}
+	if sc := pvc.Spec.StorageClassName; sc == nil || *sc != "csi-sc" {
+		t.Fatalf("Expected storageclass csi-sc got %v", sc)
+	}
+}
+
+func TestStorageReconcilerSyncPVCTemplateMeta(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+	stor.Spec.PVCTemplate = &ddp.PVCTemplate{
+		Metadata: ddp.PVCTemplateMeta{
+			Labels: map[string]string{"app": "db"},
+		},
+	}
+	pvc := newOwnedPVC(stor)
+	pvc.Labels = map[string]string{"tier": "data"}
+	pvc.Annotations = map[string]string{
+		nodeNameKey:           "node-1",
+		storageCSIAttacherKey: "csi.example.com",
+	}
+
+	clientset := fake.NewSimpleClientset(pvc)
+	r := &StorageReconciler{
+		Clientset: clientset,
+		DDPClientset: &fakeDDPClientset{
+			storages: &fakeStorages{updated: map[string]*ddp.Storage{}},
+		},
+		PVCLister:          corelisters.NewPersistentVolumeClaimLister(newIndexer(t, pvc)),
+		PVLister:           corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister:         corelisters.NewNodeLister(newIndexer(t)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:           record.NewFakeRecorder(10),
+	}
+
+	if _, err := r.Reconcile(stor); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	// labels added to the template are synced while the ones set by
+	// others are retained
+	got, err := clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace).
+		Get(pvc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected PVC got %v", err)
+	}
+	expected := map[string]string{"app": "db", "tier": "data"}
+	if !reflect.DeepEqual(got.Labels, expected) {
+		t.Fatalf("Expected labels %v got %v", expected, got.Labels)
+	}
+}
+
+func TestStorageReconcilerSelectNode(t *testing.T) {
+	stor := newTestStorage("stor", "")
+	stor.Spec.NodeName = nil
+	stor.Spec.NodeSelector = map[string]string{"zone": "zone-a"}
+
+	clientset := fake.NewSimpleClientset()
+	ddpStorages := &fakeStorages{updated: map[string]*ddp.Storage{}}
+	recorder := record.NewFakeRecorder(10)
+	r := &StorageReconciler{
+		Clientset:    clientset,
+		DDPClientset: &fakeDDPClientset{storages: ddpStorages},
+		PVCLister:    corelisters.NewPersistentVolumeClaimLister(newIndexer(t)),
+		PVLister:     corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister: corelisters.NewNodeLister(newIndexer(t,
+			newZonalNode("node-1", "zone-b"),
+			newZonalNode("node-2", "zone-a"),
+		)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:           recorder,
+	}
+
+	if _, err := r.Reconcile(stor); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	pvc, err := clientset.CoreV1().PersistentVolumeClaims(stor.Namespace).
+		Get(stor.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected PVC got %v", err)
+	}
+	if nodeName := pvc.Annotations[nodeNameKey]; nodeName != "node-2" {
+		t.Fatalf("Expected node node-2 got %s", nodeName)
+	}
+	expectEvents(t, recorder, "Normal "+EventNodeSelected)
+
+	updated := ddpStorages.updated[stor.Namespace+"/"+stor.Name]
+	if updated == nil {
+		t.Fatalf("Expected status update got none")
+	}
+	if updated.Status.SelectedNode != "node-2" {
+		t.Fatalf("Expected selected node node-2 got %s", updated.Status.SelectedNode)
+	}
+	cond := getStorageCondition(&updated.Status, ddp.NodeSelected)
+	if cond.Status != ddp.ConditionTrue || cond.Reason != "NodeSelected" {
+		t.Fatalf("Expected node to be selected got %+v", cond)
+	}
+}
+
+func TestStorageReconcilerWaitForFirstConsumer(t *testing.T) {
+	stor := newTestStorage("stor", "node-2")
+	wffc := storagev1.VolumeBindingWaitForFirstConsumer
+
+	unbound := newOwnedPVC(stor)
+	unbound.Spec.VolumeName = ""
+	unbound.Annotations = map[string]string{
+		nodeNameKey:           "node-2",
+		storageCSIAttacherKey: "csi.example.com",
+		selectedNodeKey:       "node-1",
+	}
+	bound := newOwnedPVC(stor)
+	bound.Annotations = map[string]string{
+		nodeNameKey:           "node-2",
+		storageCSIAttacherKey: "csi.example.com",
+		selectedNodeKey:       "node-1",
+	}
+
+	tests := map[string]struct {
+		pvc          *v1.PersistentVolumeClaim
+		bindingMode  *storagev1.VolumeBindingMode
+		selectedNode string
+	}{
+		"new pvc": {
+			bindingMode:  &wffc,
+			selectedNode: "node-2",
+		},
+		"new pvc of immediate binding": {},
+		"pvc not bound": {
+			pvc:          unbound,
+			bindingMode:  &wffc,
+			selectedNode: "node-2",
+		},
+		"pvc already bound": {
+			pvc:          bound,
+			bindingMode:  &wffc,
+			selectedNode: "node-1",
+		},
+	}
+	for name, mock := range tests {
+		clientset := fake.NewSimpleClientset()
+		var pvcs []interface{}
+		if mock.pvc != nil {
+			clientset = fake.NewSimpleClientset(mock.pvc)
+			pvcs = append(pvcs, mock.pvc)
+		}
+
+		r := &StorageReconciler{
+			Clientset: clientset,
+			DDPClientset: &fakeDDPClientset{
+				storages: &fakeStorages{updated: map[string]*ddp.Storage{}},
+			},
+			PVCLister: corelisters.NewPersistentVolumeClaimLister(newIndexer(t, pvcs...)),
+			PVLister:  corelisters.NewPersistentVolumeLister(newIndexer(t)),
+			NodeLister: corelisters.NewNodeLister(newIndexer(t,
+				newTestNode("node-2", v1.ConditionTrue),
+			)),
+			VALister: storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+			StorageClassLister: storagev1listers.NewStorageClassLister(newIndexer(t,
+				&storagev1.StorageClass{
+					ObjectMeta:        metav1.ObjectMeta{Name: "csi-sc"},
+					Provisioner:       "csi.example.com",
+					VolumeBindingMode: mock.bindingMode,
+				},
+			)),
+			CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+			CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+			Recorder:        record.NewFakeRecorder(10),
+		}
+
+		if _, err := r.Reconcile(stor); err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+
+		pvc, err := clientset.CoreV1().PersistentVolumeClaims(stor.Namespace).
+			Get(stor.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: Expected PVC got %v", name, err)
+		}
+		if got := pvc.Annotations[selectedNodeKey]; got != mock.selectedNode {
+			t.Fatalf("%s: Expected selected node %q got %q", name, mock.selectedNode, got)
+		}
+	}
+}
+
+func TestStorageReconcilerRestoreFromSnapshot(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+	stor.Spec.Source = &ddp.StorageSource{
+		VolumeSnapshot: &v1.LocalObjectReference{Name: "snap"},
+	}
+	snap := newTestSnapshot("snap", map[string]interface{}{"readyToUse": false})
+
+	clientset := fake.NewSimpleClientset()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), snap)
+	ddpStorages := &fakeStorages{updated: map[string]*ddp.Storage{}}
+	r := &StorageReconciler{
+		Clientset:    clientset,
+		DDPClientset: &fakeDDPClientset{storages: ddpStorages},
+		PVCLister:    corelisters.NewPersistentVolumeClaimLister(newIndexer(t)),
+		PVLister:     corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister: corelisters.NewNodeLister(newIndexer(t,
+			newTestNode("node-1", v1.ConditionTrue),
+		)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		DynamicClient:      dynamicClient,
+		StorageLister:      ddplisters.NewStorageLister(newIndexer(t, stor)),
+		Recorder:           record.NewFakeRecorder(10),
+	}
+
+	// PVC creation is held till the snapshot is ready
+	if _, err := r.Reconcile(stor); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	for _, action := range clientset.Actions() {
+		if action.Matches("create", "persistentvolumeclaims") {
+			t.Fatalf("Expected PVC creation to be held got %v", action)
+		}
+	}
+	updated := ddpStorages.updated[stor.Namespace+"/"+stor.Name]
+	if updated == nil || updated.Status.Reason != "SourceNotReady" {
+		t.Fatalf("Expected reason SourceNotReady got %+v", updated)
+	}
+
+	ready := newTestSnapshot("snap", map[string]interface{}{"readyToUse": true})
+	_, err := dynamicClient.Resource(volumeSnapshotGVR).Namespace(stor.Namespace).
+		Update(ready, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("Update snapshot failed: %v", err)
+	}
+
+	if _, err := r.Reconcile(stor); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	pvc, err := clientset.CoreV1().PersistentVolumeClaims(stor.Namespace).
+		Get(stor.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected PVC got %v", err)
+	}
+	if src := pvc.Spec.DataSource; src == nil || src.Kind != snapshotKind || src.Name != "snap" {
+		t.Fatalf("Expected data source snapshot snap got %+v", src)
+	}
+}
+
+func TestStorageReconcilerResizeRejected(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+	stor.Spec.Capacity = resource.MustParse("2Gi")
+	pvc := newOwnedPVC(stor)
+	pvc.Spec.Resources.Requests = v1.ResourceList{
+		v1.ResourceStorage: resource.MustParse("4Gi"),
+	}
+	pvc.Status = v1.PersistentVolumeClaimStatus{
+		Phase: v1.ClaimBound,
+		Capacity: v1.ResourceList{
+			v1.ResourceStorage: resource.MustParse("4Gi"),
+		},
+	}
+
+	ddpStorages := &fakeStorages{updated: map[string]*ddp.Storage{}}
+	recorder := record.NewFakeRecorder(10)
+	r := &StorageReconciler{
+		Clientset:          fake.NewSimpleClientset(pvc),
+		DDPClientset:       &fakeDDPClientset{storages: ddpStorages},
+		PVCLister:          corelisters.NewPersistentVolumeClaimLister(newIndexer(t, pvc)),
+		PVLister:           corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister:         corelisters.NewNodeLister(newIndexer(t)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:           recorder,
+	}
+
+	countRejected := func() int {
+		count := 0
+		for {
+			select {
+			case event := <-recorder.Events:
+				if strings.HasPrefix(event, v1.EventTypeWarning+" "+EventResizeRejected) {
+					count++
+				}
+			default:
+				return count
+			}
+		}
+	}
+
+	if _, err := r.Reconcile(stor); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if count := countRejected(); count != 1 {
+		t.Fatalf("Expected 1 %s event got %d", EventResizeRejected, count)
+	}
+	updated := ddpStorages.updated[stor.Namespace+"/"+stor.Name]
+	if updated == nil {
+		t.Fatalf("Expected status update got none")
+	}
+	cond := getStorageCondition(&updated.Status, ddp.VolumeResize)
+	if cond == nil || cond.Reason != "ShrinkNotSupported" {
+		t.Fatalf("Expected reason ShrinkNotSupported got %+v", cond)
+	}
+
+	// rejection that is already reported is not repeated as an event
+	if _, err := r.Reconcile(updated); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if count := countRejected(); count != 0 {
+		t.Fatalf("Expected no %s event got %d", EventResizeRejected, count)
+	}
+}
+
+func TestStorageReconcilerApplyDefaults(t *testing.T) {
+	stor := newTestStorage("stor", "node-1")
+	stor.Spec.StorageClassName = nil
+	stor.Spec.Attacher = nil
+	stor.Annotations = map[string]string{
+		defaultsAppliedKey: "spec.accessModes is set by the webhook",
+	}
+
+	ddpStorages := &fakeStorages{updated: map[string]*ddp.Storage{}}
+	recorder := record.NewFakeRecorder(10)
+	r := &StorageReconciler{
+		Clientset:    fake.NewSimpleClientset(),
+		DDPClientset: &fakeDDPClientset{storages: ddpStorages},
+		PVCLister:    corelisters.NewPersistentVolumeClaimLister(newIndexer(t)),
+		PVLister:     corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister: corelisters.NewNodeLister(newIndexer(t,
+			newTestNode("node-1", v1.ConditionTrue),
+		)),
+		VALister: storagelisters.NewVolumeAttachmentLister(newIndexer(t)),
+		StorageClassLister: storagev1listers.NewStorageClassLister(newIndexer(t,
+			&storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "csi-sc",
+					Annotations: map[string]string{isDefaultStorageClassKey: "true"},
+				},
+				Provisioner: "csi.example.com",
+			},
+		)),
+		CSIDriverLister: storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:   storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:        recorder,
+	}
+
+	if _, err := r.Reconcile(stor); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	updated := ddpStorages.updated[stor.Namespace+"/"+stor.Name]
+	if updated == nil {
+		t.Fatalf("Expected storage update got none")
+	}
+	if sc := updated.Spec.StorageClassName; sc == nil || *sc != "csi-sc" {
+		t.Fatalf("Expected storageclass csi-sc got %v", sc)
+	}
+	if attacher := updated.Spec.Attacher; attacher == nil || *attacher != "csi.example.com" {
+		t.Fatalf("Expected attacher csi.example.com got %v", attacher)
+	}
+	if _, found := updated.Annotations[defaultsAppliedKey]; found {
+		t.Fatalf("Expected annotation %s to be removed", defaultsAppliedKey)
+	}
+
+	// defaults applied by the webhook & controller are reported
+	// together
+	expected := v1.EventTypeNormal + " " + EventDefaulted + " " +
+		"spec.accessModes is set by the webhook; " +
+		"spec.storageClassName is set to default storageclass csi-sc; " +
+		"spec.attacher is set to provisioner csi.example.com of storageclass csi-sc"
+	select {
+	case event := <-recorder.Events:
+		if event != expected {
+			t.Fatalf("Expected event %q got %q", expected, event)
+		}
+	default:
+		t.Fatalf("Expected event %s got none", EventDefaulted)
+	}
+}
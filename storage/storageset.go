@@ -0,0 +1,485 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ref "k8s.io/client-go/tools/reference"
+	"k8s.io/klog"
+
+	ddpclientset "github.com/mayadata-io/storage-provisioner/client/generated/clientset/versioned"
+	ddplisters "github.com/mayadata-io/storage-provisioner/client/generated/lister/dao/v1alpha1"
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// StorageSetReconciler manages reconciling storage set API in
+// kubernetes cluster. It creates a storage per ordinal of the set
+// & removes the storages whose ordinal is beyond its replicas.
+type StorageSetReconciler struct {
+	// instances to invoke various Kubernetes APIs
+	DDPClientset  ddpclientset.Interface
+	StorageLister ddplisters.StorageLister
+
+	// Recorder emits events against the storage set
+	Recorder record.EventRecorder
+}
+
+// storageSetSync holds the state of reconciling a single storage set.
+// This is not kept in the reconciler since the same reconciler is
+// invoked by concurrent workers.
+type storageSetSync struct {
+	*StorageSetReconciler
+
+	// storage set that will get reconciled
+	set *ddp.StorageSet
+
+	// reference to above storage set which has extra information
+	// like APIVersion & Kind
+	setRef *v1.ObjectReference
+
+	// storages owned by the set mapped to their ordinals
+	storages map[int]*ddp.Storage
+
+	// storages owned by the set that do not have a valid ordinal or
+	// whose ordinal is beyond the replicas of the set
+	condemned []*ddp.Storage
+
+	// ordinals whose names are taken by storages not owned by the set
+	conflicts []int
+}
+
+func (s *storageSetSync) String() string {
+	return fmt.Sprintf(
+		"StorageSetReconciler %s/%s", s.set.Namespace, s.set.Name,
+	)
+}
+
+// Reconcile accepts storage set as the desired state and starts
+// executing the reconcile logic based on this desired state
+//
+// NOTE:
+//	Reconcile logic needs to be idempotent
+func (r *StorageSetReconciler) Reconcile(set *ddp.StorageSet) (result Result, err error) {
+	s := &storageSetSync{
+		StorageSetReconciler: r,
+		set:                  set,
+		storages:             map[int]*ddp.Storage{},
+	}
+
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Reconcile failed", s)
+		}
+	}()
+
+	if set.DeletionTimestamp != nil {
+		// owned storages are deleted by the garbage collector
+		klog.V(3).Infof("%s: Reconcile ignored: Set is being deleted", s)
+		return Result{}, nil
+	}
+
+	s.setRef, err = ref.GetReference(scheme.Scheme, set)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if errs := validateStorageSet(set); len(errs) != 0 {
+		// set can not be reconciled till its spec is fixed
+		message := errs.ToAggregate().Error()
+		s.Recorder.Event(set, v1.EventTypeWarning, EventInvalidSpec, message)
+		klog.Errorf("%s: Invalid spec: %s", s, message)
+		status := set.Status.DeepCopy()
+		status.Reason = EventInvalidSpec
+		status.Message = message
+		return Result{}, s.writeStatus(status)
+	}
+
+	err = s.findStorages()
+	if err != nil {
+		return Result{}, err
+	}
+
+	// scale up is done in the order of ordinals
+	for ordinal := 0; ordinal < getStorageSetReplicas(set); ordinal++ {
+		if _, found := s.storages[ordinal]; found {
+			continue
+		}
+		err = s.createOrAdoptStorage(ordinal)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	// scale down is done in the reverse order of ordinals
+	for _, stor := range s.condemned {
+		err = s.releaseStorage(stor)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	return Result{}, s.updateStatus()
+}
+
+// findStorages finds the storages owned by the storage set & groups
+// them by their ordinals
+func (s *storageSetSync) findStorages() (err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Find storages failed", s)
+		}
+	}()
+
+	// storage set & its storages must have same namespace
+	stors, err := s.StorageLister.Storages(s.set.Namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	replicas := getStorageSetReplicas(s.set)
+	for _, stor := range stors {
+		owner := metav1.GetControllerOf(stor)
+		if owner == nil || owner.UID != s.set.UID {
+			continue
+		}
+		ordinal, found := getStorageSetOrdinal(s.set, stor.Name)
+		if found && ordinal < replicas {
+			s.storages[ordinal] = stor
+			continue
+		}
+		s.condemned = append(s.condemned, stor)
+	}
+
+	sort.Slice(s.condemned, func(i, j int) bool {
+		ordinalI, _ := getStorageSetOrdinal(s.set, s.condemned[i].Name)
+		ordinalJ, _ := getStorageSetOrdinal(s.set, s.condemned[j].Name)
+		return ordinalI > ordinalJ
+	})
+	return nil
+}
+
+// createOrAdoptStorage creates the storage of the given ordinal. A
+// storage of this ordinal that was retained by this set on an earlier
+// scale down is adopted instead. Any other storage of the same name is
+// reported as a conflict.
+func (s *storageSetSync) createOrAdoptStorage(ordinal int) (err error) {
+	name := getStorageSetStorageName(s.set, ordinal)
+
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Create storage %s failed", s, name)
+		}
+	}()
+
+	existing, err := s.StorageLister.Storages(s.set.Namespace).Get(name)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if metav1.GetControllerOf(existing) != nil ||
+			existing.Labels[storageSetKey] != s.set.Name ||
+			existing.Annotations[retainedByKey] != string(s.set.UID) ||
+			existing.DeletionTimestamp != nil {
+			// storage was not retained by this set
+			s.conflicts = append(s.conflicts, ordinal)
+			return nil
+		}
+		return s.adoptStorage(existing)
+	}
+
+	stor, err :=
+		s.DDPClientset.DaoV1alpha1().Storages(s.set.Namespace).Create(s.newStorage(ordinal))
+	if err != nil {
+		s.Recorder.Eventf(
+			s.set, v1.EventTypeWarning, EventCreateFailed,
+			"Failed to create storage %s: %v", name, err,
+		)
+		return err
+	}
+
+	s.Recorder.Eventf(
+		s.set, v1.EventTypeNormal, EventStorageCreated,
+		"Created storage %s with capacity %s",
+		stor.Name, stor.Spec.Capacity.String(),
+	)
+	s.storages[ordinal] = stor
+	return nil
+}
+
+// adoptStorage sets the storage set as the controller of the given
+// storage that was retained by the set
+func (s *storageSetSync) adoptStorage(stor *ddp.Storage) error {
+	copy := stor.DeepCopy()
+	copy.OwnerReferences = append(copy.OwnerReferences, s.newOwnerReference())
+	delete(copy.Annotations, retainedByKey)
+
+	updated, err :=
+		s.DDPClientset.DaoV1alpha1().Storages(copy.Namespace).Update(copy)
+	if err != nil {
+		s.Recorder.Eventf(
+			s.set, v1.EventTypeWarning, EventUpdateFailed,
+			"Failed to adopt storage %s: %v", stor.Name, err,
+		)
+		return err
+	}
+
+	s.Recorder.Eventf(
+		s.set, v1.EventTypeNormal, EventStorageAdopted,
+		"Adopted retained storage %s", stor.Name,
+	)
+	ordinal, _ := getStorageSetOrdinal(s.set, stor.Name)
+	s.storages[ordinal] = updated
+	return nil
+}
+
+// releaseStorage removes the given storage from the storage set as
+// per the retention policy of the set. Storage is either deleted or
+// is retained without the set as its controller.
+func (s *storageSetSync) releaseStorage(stor *ddp.Storage) (err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Release storage %s failed", s, stor.Name)
+		}
+	}()
+
+	if stor.DeletionTimestamp != nil {
+		// storage is being torn down
+		return nil
+	}
+
+	if getStorageSetRetentionPolicy(s.set) == ddp.StorageSetRetentionRetain {
+		copy := stor.DeepCopy()
+		var owners []metav1.OwnerReference
+		for _, owner := range copy.OwnerReferences {
+			if owner.UID != s.set.UID {
+				owners = append(owners, owner)
+			}
+		}
+		copy.OwnerReferences = owners
+		copy.Annotations, _ = mergeDict(copy.Annotations, map[string]string{
+			retainedByKey: string(s.set.UID),
+		})
+
+		_, err = s.DDPClientset.DaoV1alpha1().Storages(copy.Namespace).Update(copy)
+		if err != nil {
+			s.Recorder.Eventf(
+				s.set, v1.EventTypeWarning, EventUpdateFailed,
+				"Failed to retain storage %s: %v", stor.Name, err,
+			)
+			return err
+		}
+		s.Recorder.Eventf(
+			s.set, v1.EventTypeNormal, EventStorageRetained,
+			"Retained storage %s on scale down", stor.Name,
+		)
+		return nil
+	}
+
+	err = s.DDPClientset.DaoV1alpha1().Storages(stor.Namespace).Delete(
+		stor.Name, &metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &stor.UID},
+		},
+	)
+	if err != nil && !apierrs.IsNotFound(err) {
+		s.Recorder.Eventf(
+			s.set, v1.EventTypeWarning, EventDeleteFailed,
+			"Failed to delete storage %s: %v", stor.Name, err,
+		)
+		return err
+	}
+	s.Recorder.Eventf(
+		s.set, v1.EventTypeNormal, EventStorageDeleted,
+		"Deleted storage %s on scale down", stor.Name,
+	)
+	return nil
+}
+
+// updateStatus counts the storages of the storage set by their phase.
+// Every storage counted in replicas is counted in exactly one of the
+// phase buckets. A storage that is being deleted is counted as
+// terminating irrespective of its phase.
+func (s *storageSetSync) updateStatus() error {
+	status := &ddp.StorageSetStatus{
+		ObservedGeneration: s.set.Generation,
+		Replicas:           int32(len(s.storages)),
+	}
+	for _, stor := range s.storages {
+		if stor.DeletionTimestamp != nil {
+			status.TerminatingReplicas++
+			continue
+		}
+		switch stor.Status.Phase {
+		case ddp.StorageAttached:
+			status.AttachedReplicas++
+		case ddp.StorageDetached:
+			status.DetachedReplicas++
+		case ddp.StorageFailed:
+			status.FailedReplicas++
+		case ddp.StorageTerminating:
+			status.TerminatingReplicas++
+		default:
+			// storage without a phase is yet to be reconciled
+			status.PendingReplicas++
+		}
+	}
+
+	if len(s.conflicts) != 0 {
+		var names []string
+		for _, ordinal := range s.conflicts {
+			names = append(names, getStorageSetStorageName(s.set, ordinal))
+		}
+		message := fmt.Sprintf(
+			"Storages %s exist & are not part of the set",
+			strings.Join(names, ", "),
+		)
+		if s.set.Status.Reason != EventNameConflict || s.set.Status.Message != message {
+			s.Recorder.Event(s.set, v1.EventTypeWarning, EventNameConflict, message)
+		}
+		status.Reason = EventNameConflict
+		status.Message = message
+	}
+
+	return s.writeStatus(status)
+}
+
+// writeStatus updates the storage set with the given status via
+// status sub resource. Update is skipped if there is no change in
+// status.
+func (s *storageSetSync) writeStatus(status *ddp.StorageSetStatus) (err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Update status failed", s)
+		}
+	}()
+
+	if apiequality.Semantic.DeepEqual(&s.set.Status, status) {
+		klog.V(4).Infof("%s: No change to status", s)
+		return nil
+	}
+
+	copy := s.set.DeepCopy()
+	copy.Status = *status
+
+	updated, err :=
+		s.DDPClientset.DaoV1alpha1().StorageSets(copy.Namespace).UpdateStatus(copy)
+	if err != nil {
+		return err
+	}
+	klog.V(3).Infof(
+		"%s: Status updated: Replicas %d: Attached %d",
+		s, status.Replicas, status.AttachedReplicas,
+	)
+	s.set = updated
+	return nil
+}
+
+// newStorage returns a new instance of storage API for the given
+// ordinal. Storage is built from the template of the storage set.
+func (s *storageSetSync) newStorage(ordinal int) *ddp.Storage {
+	tmpl := s.set.Spec.Template.DeepCopy()
+
+	storageLabels, _ := mergeDict(tmpl.Metadata.Labels, map[string]string{
+		storageSetKey: s.set.Name,
+	})
+	return &ddp.Storage{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        getStorageSetStorageName(s.set, ordinal),
+			Namespace:   s.set.Namespace,
+			Labels:      storageLabels,
+			Annotations: tmpl.Metadata.Annotations,
+			OwnerReferences: []metav1.OwnerReference{
+				s.newOwnerReference(),
+			},
+		},
+		Spec: tmpl.Spec,
+	}
+}
+
+// newOwnerReference returns the owner reference that sets the storage
+// set as the controller of its storages
+func (s *storageSetSync) newOwnerReference() metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion:         s.setRef.APIVersion,
+		Kind:               s.setRef.Kind,
+		Name:               s.setRef.Name,
+		UID:                s.setRef.UID,
+		Controller:         boolPtr(true),
+		BlockOwnerDeletion: boolPtr(true),
+	}
+}
+
+// getStorageSetReplicas returns the desired number of storages of the
+// given storage set
+func getStorageSetReplicas(set *ddp.StorageSet) int {
+	if set.Spec.Replicas == nil {
+		return 1
+	}
+	return int(*set.Spec.Replicas)
+}
+
+// getStorageSetRetentionPolicy returns the retention policy of the
+// given storage set
+func getStorageSetRetentionPolicy(set *ddp.StorageSet) ddp.StorageSetRetentionPolicy {
+	if set.Spec.RetentionPolicy == "" {
+		return ddp.StorageSetRetentionDelete
+	}
+	return set.Spec.RetentionPolicy
+}
+
+// getStorageSetNamePrefix returns the prefix of the names of the
+// storages of the given storage set
+func getStorageSetNamePrefix(set *ddp.StorageSet) string {
+	if set.Spec.NamePrefix == "" {
+		return set.Name
+	}
+	return set.Spec.NamePrefix
+}
+
+// getStorageSetStorageName returns the name of the storage of the
+// given ordinal
+func getStorageSetStorageName(set *ddp.StorageSet, ordinal int) string {
+	return getStorageSetNamePrefix(set) + "-" + strconv.Itoa(ordinal)
+}
+
+// getStorageSetOrdinal returns the ordinal of the storage having the
+// given name. It returns false if the name does not follow the naming
+// of the given storage set.
+func getStorageSetOrdinal(set *ddp.StorageSet, name string) (int, bool) {
+	prefix := getStorageSetNamePrefix(set) + "-"
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false
+	}
+	suffix := strings.TrimPrefix(name, prefix)
+	ordinal, err := strconv.Atoi(suffix)
+	if err != nil || ordinal < 0 || strconv.Itoa(ordinal) != suffix {
+		// e.g. leading zeros are not part of the naming
+		return 0, false
+	}
+	return ordinal, true
+}
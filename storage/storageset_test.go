@@ -0,0 +1,372 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	daov1alpha1 "github.com/mayadata-io/storage-provisioner/client/generated/clientset/versioned/typed/dao/v1alpha1"
+	ddplisters "github.com/mayadata-io/storage-provisioner/client/generated/lister/dao/v1alpha1"
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+func (c *fakeDaoV1alpha1) StorageSets(namespace string) daov1alpha1.StorageSetInterface {
+	return c.storageSets
+}
+
+// fakeStorageSets records the last status update of each storage set
+type fakeStorageSets struct {
+	daov1alpha1.StorageSetInterface
+
+	updated map[string]*ddp.StorageSet
+}
+
+func (c *fakeStorageSets) UpdateStatus(set *ddp.StorageSet) (*ddp.StorageSet, error) {
+	c.updated[set.Namespace+"/"+set.Name] = set.DeepCopy()
+	return set, nil
+}
+
+func (c *fakeStorages) Create(stor *ddp.Storage) (*ddp.Storage, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.created = append(c.created, stor.DeepCopy())
+	return stor, nil
+}
+
+func (c *fakeStorages) Delete(name string, options *metav1.DeleteOptions) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.deleted = append(c.deleted, name)
+	return nil
+}
+
+func newTestStorageSet(replicas int32, policy ddp.StorageSetRetentionPolicy) *ddp.StorageSet {
+	return &ddp.StorageSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "set",
+			Namespace: "default",
+			UID:       types.UID("uid-set"),
+		},
+		Spec: ddp.StorageSetSpec{
+			Replicas: &replicas,
+			Template: ddp.StorageTemplate{
+				Metadata: ddp.StorageTemplateMeta{
+					Labels: map[string]string{"app": "db"},
+				},
+				Spec: ddp.StorageSpec{
+					Capacity:         resource.MustParse("4Gi"),
+					StorageClassName: strPtr("csi-sc"),
+				},
+			},
+			RetentionPolicy: policy,
+		},
+	}
+}
+
+// newSetStorage returns the storage of the given ordinal that is
+// owned by the given storage set
+func newSetStorage(set *ddp.StorageSet, ordinal int, phase ddp.StoragePhase) *ddp.Storage {
+	stor := newTestStorage(getStorageSetStorageName(set, ordinal), "")
+	stor.Labels = map[string]string{storageSetKey: set.Name}
+	stor.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: StorageSetGVK.GroupVersion().String(),
+		Kind:       StorageSetGVK.Kind,
+		Name:       set.Name,
+		UID:        set.UID,
+		Controller: boolPtr(true),
+	}}
+	stor.Status.Phase = phase
+	return stor
+}
+
+func newTestStorageSetReconciler(
+	t *testing.T, stors ...interface{},
+) (*StorageSetReconciler, *fakeStorages, *fakeStorageSets, *record.FakeRecorder) {
+
+	storages := &fakeStorages{updated: map[string]*ddp.Storage{}}
+	storageSets := &fakeStorageSets{updated: map[string]*ddp.StorageSet{}}
+	recorder := record.NewFakeRecorder(10)
+	r := &StorageSetReconciler{
+		DDPClientset: &fakeDDPClientset{
+			storages:    storages,
+			storageSets: storageSets,
+		},
+		StorageLister: ddplisters.NewStorageLister(newIndexer(t, stors...)),
+		Recorder:      recorder,
+	}
+	return r, storages, storageSets, recorder
+}
+
+func TestGetStorageSetOrdinal(t *testing.T) {
+	set := newTestStorageSet(1, "")
+	set.Spec.NamePrefix = "data"
+
+	tests := map[string]struct {
+		name    string
+		ordinal int
+		isFound bool
+	}{
+		"first ordinal": {
+			name:    "data-0",
+			isFound: true,
+		},
+		"large ordinal": {
+			name:    "data-12",
+			ordinal: 12,
+			isFound: true,
+		},
+		"name of set": {
+			name: "set-0",
+		},
+		"leading zero": {
+			name: "data-01",
+		},
+		"negative ordinal": {
+			name: "data--1",
+		},
+		"no ordinal": {
+			name: "data-",
+		},
+	}
+	for name, mock := range tests {
+		ordinal, found := getStorageSetOrdinal(set, mock.name)
+		if found != mock.isFound || ordinal != mock.ordinal {
+			t.Fatalf(
+				"%s: Expected ordinal %d found %t got %d found %t",
+				name, mock.ordinal, mock.isFound, ordinal, found,
+			)
+		}
+	}
+}
+
+func TestStorageSetReconcilerScaleUp(t *testing.T) {
+	set := newTestStorageSet(3, "")
+	r, storages, storageSets, _ := newTestStorageSetReconciler(t,
+		newSetStorage(set, 0, ddp.StorageAttached),
+	)
+
+	if _, err := r.Reconcile(set); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	var names []string
+	for _, stor := range storages.created {
+		names = append(names, stor.Name)
+
+		expectedLabels := map[string]string{"app": "db", storageSetKey: "set"}
+		if !reflect.DeepEqual(stor.Labels, expectedLabels) {
+			t.Fatalf("%s: Expected labels %v got %v", stor.Name, expectedLabels, stor.Labels)
+		}
+		owner := metav1.GetControllerOf(stor)
+		if owner == nil || owner.UID != set.UID || owner.Kind != StorageSetGVK.Kind {
+			t.Fatalf("%s: Expected set to be the controller got %+v", stor.Name, owner)
+		}
+		if stor.Spec.Capacity.Cmp(set.Spec.Template.Spec.Capacity) != 0 {
+			t.Fatalf("%s: Expected capacity 4Gi got %s", stor.Name, stor.Spec.Capacity.String())
+		}
+	}
+	if expected := []string{"set-1", "set-2"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected storages %v to be created got %v", expected, names)
+	}
+
+	updated := storageSets.updated["default/set"]
+	if updated == nil {
+		t.Fatalf("Expected status update got none")
+	}
+	expected := ddp.StorageSetStatus{
+		Replicas:         3,
+		AttachedReplicas: 1,
+		PendingReplicas:  2,
+	}
+	if !reflect.DeepEqual(updated.Status, expected) {
+		t.Fatalf("Expected status %+v got %+v", expected, updated.Status)
+	}
+}
+
+func TestStorageSetReconcilerScaleDown(t *testing.T) {
+	tests := map[string]struct {
+		policy   ddp.StorageSetRetentionPolicy
+		deleted  []string
+		retained []string
+	}{
+		"delete": {
+			deleted: []string{"set-2", "set-1"},
+		},
+		"retain": {
+			policy:   ddp.StorageSetRetentionRetain,
+			retained: []string{"set-1", "set-2"},
+		},
+	}
+	for name, mock := range tests {
+		set := newTestStorageSet(1, mock.policy)
+		r, storages, storageSets, _ := newTestStorageSetReconciler(t,
+			newSetStorage(set, 0, ddp.StorageAttached),
+			newSetStorage(set, 1, ddp.StorageAttached),
+			newSetStorage(set, 2, ddp.StorageFailed),
+		)
+
+		if _, err := r.Reconcile(set); err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+
+		if !reflect.DeepEqual(storages.deleted, mock.deleted) {
+			t.Fatalf("%s: Expected %v to be deleted got %v", name, mock.deleted, storages.deleted)
+		}
+		if len(storages.updated) != len(mock.retained) {
+			t.Fatalf("%s: Expected %v to be retained got %v", name, mock.retained, storages.updated)
+		}
+		for _, storName := range mock.retained {
+			stor := storages.updated["default/"+storName]
+			if stor == nil || metav1.GetControllerOf(stor) != nil {
+				t.Fatalf("%s: Expected %s to be retained without controller got %+v", name, storName, stor)
+			}
+			if stor.Labels[storageSetKey] != set.Name {
+				t.Fatalf("%s: Expected %s to keep label %s", name, storName, storageSetKey)
+			}
+			if stor.Annotations[retainedByKey] != string(set.UID) {
+				t.Fatalf(
+					"%s: Expected %s to be retained by %s got %q",
+					name, storName, set.UID, stor.Annotations[retainedByKey],
+				)
+			}
+		}
+
+		updated := storageSets.updated["default/set"]
+		if updated == nil || updated.Status.Replicas != 1 || updated.Status.AttachedReplicas != 1 {
+			t.Fatalf("%s: Expected 1 attached replica got %+v", name, updated)
+		}
+	}
+}
+
+func TestStorageSetReconcilerAdoptRetainedStorage(t *testing.T) {
+	set := newTestStorageSet(2, ddp.StorageSetRetentionRetain)
+	retained := newSetStorage(set, 1, ddp.StorageDetached)
+	retained.OwnerReferences = nil
+	retained.Annotations = map[string]string{retainedByKey: string(set.UID)}
+
+	r, storages, _, recorder := newTestStorageSetReconciler(t,
+		newSetStorage(set, 0, ddp.StorageAttached), retained,
+	)
+
+	if _, err := r.Reconcile(set); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	if len(storages.created) != 0 {
+		t.Fatalf("Expected no storage to be created got %d", len(storages.created))
+	}
+	adopted := storages.updated["default/set-1"]
+	if adopted == nil {
+		t.Fatalf("Expected set-1 to be adopted got none")
+	}
+	if owner := metav1.GetControllerOf(adopted); owner == nil || owner.UID != set.UID {
+		t.Fatalf("Expected set to be the controller got %+v", owner)
+	}
+	if _, found := adopted.Annotations[retainedByKey]; found {
+		t.Fatalf("Expected annotation %s to be removed got %v", retainedByKey, adopted.Annotations)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, EventStorageAdopted) {
+		t.Fatalf("Expected event %s got %q", EventStorageAdopted, event)
+	}
+}
+
+func TestStorageSetReconcilerNameConflict(t *testing.T) {
+	set := newTestStorageSet(2, "")
+	// storage that is not created by the set
+	other := newTestStorage("set-1", "node-1")
+
+	r, storages, storageSets, recorder := newTestStorageSetReconciler(t,
+		newSetStorage(set, 0, ddp.StorageAttached), other,
+	)
+
+	if _, err := r.Reconcile(set); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	if len(storages.created) != 0 || len(storages.updated) != 0 {
+		t.Fatalf("Expected set-1 to be left as is got %+v", storages)
+	}
+	updated := storageSets.updated["default/set"]
+	if updated == nil || updated.Status.Reason != EventNameConflict {
+		t.Fatalf("Expected reason %s got %+v", EventNameConflict, updated)
+	}
+	if updated.Status.Replicas != 1 {
+		t.Fatalf("Expected 1 replica got %d", updated.Status.Replicas)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, EventNameConflict) {
+		t.Fatalf("Expected event %s got %q", EventNameConflict, event)
+	}
+
+	// conflict that is already reported is not repeated as an event
+	if _, err := r.Reconcile(updated); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	select {
+	case event := <-recorder.Events:
+		t.Fatalf("Expected no event got %q", event)
+	default:
+	}
+}
+
+func TestStorageSetReconcilerRetainedByOtherSet(t *testing.T) {
+	set := newTestStorageSet(2, ddp.StorageSetRetentionRetain)
+	// storage retained by an earlier set of the same name
+	retained := newSetStorage(set, 1, ddp.StorageDetached)
+	retained.OwnerReferences = nil
+	retained.Annotations = map[string]string{retainedByKey: "uid-deleted-set"}
+
+	r, storages, storageSets, _ := newTestStorageSetReconciler(t,
+		newSetStorage(set, 0, ddp.StorageAttached), retained,
+	)
+
+	if _, err := r.Reconcile(set); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+
+	if len(storages.created) != 0 || len(storages.updated) != 0 {
+		t.Fatalf("Expected set-1 to be left as is got %+v", storages)
+	}
+	updated := storageSets.updated["default/set"]
+	if updated == nil || updated.Status.Reason != EventNameConflict {
+		t.Fatalf("Expected reason %s got %+v", EventNameConflict, updated)
+	}
+}
+
+func TestStorageSetReconcilerInvalidSpec(t *testing.T) {
+	set := newTestStorageSet(-1, "")
+	r, storages, storageSets, _ := newTestStorageSetReconciler(t)
+
+	if _, err := r.Reconcile(set); err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if len(storages.created) != 0 {
+		t.Fatalf("Expected no storage to be created got %d", len(storages.created))
+	}
+	updated := storageSets.updated["default/set"]
+	if updated == nil || updated.Status.Reason != EventInvalidSpec {
+		t.Fatalf("Expected reason %s got %+v", EventInvalidSpec, updated)
+	}
+}
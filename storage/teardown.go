@@ -0,0 +1,183 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// addTeardownFinalizer sets the teardown finalizer against the
+// storage if not set previously
+func (s *storageSync) addTeardownFinalizer() (err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Add finalizer failed", s)
+		}
+	}()
+
+	if hasFinalizer(s.storage, storageTeardownFinalizer) {
+		return nil
+	}
+
+	copy := s.storage.DeepCopy()
+	copy.Finalizers = append(copy.Finalizers, storageTeardownFinalizer)
+
+	updated, err :=
+		s.DDPClientset.DaoV1alpha1().Storages(copy.Namespace).Update(copy)
+	if err != nil {
+		return err
+	}
+	s.storage = updated
+	return nil
+}
+
+// removeTeardownFinalizer removes the teardown finalizer from the
+// storage. This lets the storage get deleted.
+func (s *storageSync) removeTeardownFinalizer() (err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Remove finalizer failed", s)
+		}
+	}()
+
+	copy := s.storage.DeepCopy()
+	copy.Finalizers = removeFinalizer(copy.Finalizers, storageTeardownFinalizer)
+
+	_, err =
+		s.DDPClientset.DaoV1alpha1().Storages(copy.Namespace).Update(copy)
+	return err
+}
+
+// teardown deletes the resources owned by this storage in the
+// following order:
+//
+//	1/ VolumeAttachments
+//	2/ PVC once the VolumeAttachments are gone i.e. attacher has
+//		confirmed the detach
+//
+// The teardown finalizer is removed once all the owned resources
+// are deleted.
+//
+// NOTE:
+//	Each invocation moves the teardown by at most one step. Progress
+// is reflected in storage status.
+func (s *storageSync) teardown() (result Result, err error) {
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: Teardown failed", s)
+		}
+	}()
+
+	if !hasFinalizer(s.storage, storageTeardownFinalizer) {
+		// nothing to do
+		return Result{}, nil
+	}
+
+	pvc, err := s.findPVC()
+	if err != nil {
+		return Result{}, err
+	}
+
+	if pvc == nil {
+		klog.V(3).Infof("%s: Teardown completed", s)
+		return Result{}, s.removeTeardownFinalizer()
+	}
+
+	vas, err := listVAsForPVC(s.VALister, pvc)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var messages []string
+	for _, va := range vas {
+		if va.DeletionTimestamp == nil || hasFinalizer(va, pvcProtectionFinalizer) {
+			klog.V(3).Infof("%s: Deleting VA %s", s, va.Name)
+			err = deleteVA(s.Clientset, va)
+			if err != nil {
+				s.Recorder.Eventf(
+					s.storage, v1.EventTypeWarning, EventDeleteFailed,
+					"Failed to delete VolumeAttachment %s: %v", va.Name, err,
+				)
+				return Result{}, err
+			}
+			s.Recorder.Eventf(
+				s.storage, v1.EventTypeNormal, EventVolumeAttachmentDeleted,
+				"Deleted VolumeAttachment %s to detach from node %s",
+				va.Name, va.Spec.NodeName,
+			)
+		}
+
+		message := fmt.Sprintf(
+			"Waiting for VolumeAttachment %s to detach from node %s",
+			va.Name, va.Spec.NodeName,
+		)
+		if va.Status.DetachError != nil {
+			message = fmt.Sprintf(
+				"%s: Detach error: %s", message, va.Status.DetachError.Message,
+			)
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) != 0 {
+		return waitResult(), s.setTeardownStatus(
+			"WaitingForDetach", strings.Join(messages, "; "),
+		)
+	}
+
+	if pvc.DeletionTimestamp == nil || hasFinalizer(pvc, storageProtectionFinalizer) {
+		klog.V(3).Infof("%s: Deleting PVC %s", s, pvc.Name)
+		err = deletePVC(s.Clientset, pvc)
+		if err != nil {
+			s.Recorder.Eventf(
+				s.storage, v1.EventTypeWarning, EventDeleteFailed,
+				"Failed to delete PVC %s: %v", pvc.Name, err,
+			)
+			return Result{}, err
+		}
+		s.Recorder.Eventf(
+			s.storage, v1.EventTypeNormal, EventPVCDeleted,
+			"Deleted PVC %s", pvc.Name,
+		)
+	}
+
+	return waitResult(), s.setTeardownStatus(
+		"WaitingForPVCDeletion",
+		fmt.Sprintf("Waiting for PVC %s to be deleted", pvc.Name),
+	)
+}
+
+// setTeardownStatus reflects the current teardown step in the
+// storage status
+func (s *storageSync) setTeardownStatus(reason, message string) error {
+	status := s.storage.Status.DeepCopy()
+
+	status.Phase = ddp.StorageTerminating
+	status.Reason = reason
+	status.Message = message
+	setStorageCondition(status, newStorageCondition(
+		ddp.Ready, ddp.ConditionFalse, reason, message,
+	))
+
+	return s.writeStatus(status)
+}
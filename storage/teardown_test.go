@@ -0,0 +1,152 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	"k8s.io/client-go/tools/record"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// newOwnedPVC returns a PVC that is owned by the given storage
+func newOwnedPVC(stor *ddp.Storage) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      stor.Name,
+			Namespace: stor.Namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: ddp.SchemeGroupVersion.String(),
+					Kind:       "Storage",
+					Name:       stor.Name,
+					UID:        stor.UID,
+					Controller: boolPtr(true),
+				},
+			},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			VolumeName: "pv-" + stor.Name,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: stor.Spec.Capacity,
+				},
+			},
+		},
+	}
+}
+
+func TestStorageReconcilerTeardown(t *testing.T) {
+	now := metav1.Now()
+	stor := newTestStorage("stor", "node-1")
+	stor.DeletionTimestamp = &now
+	stor.Finalizers = []string{storageTeardownFinalizer}
+
+	pvc := newOwnedPVC(stor)
+	va := newTestVA(pvc, "node-1")
+	va.Finalizers = nil
+
+	clientset := fake.NewSimpleClientset(pvc, va)
+	ddpStorages := &fakeStorages{updated: map[string]*ddp.Storage{}}
+	pvcIndexer := newIndexer(t, pvc)
+	vaIndexer := newIndexer(t, va)
+	recorder := record.NewFakeRecorder(10)
+	r := &StorageReconciler{
+		Clientset:          clientset,
+		DDPClientset:       &fakeDDPClientset{storages: ddpStorages},
+		PVCLister:          corelisters.NewPersistentVolumeClaimLister(pvcIndexer),
+		PVLister:           corelisters.NewPersistentVolumeLister(newIndexer(t)),
+		NodeLister:         corelisters.NewNodeLister(newIndexer(t)),
+		VALister:           storagelisters.NewVolumeAttachmentLister(vaIndexer),
+		StorageClassLister: newTestStorageClassLister(t),
+		CSIDriverLister:    storagelisters.NewCSIDriverLister(newIndexer(t)),
+		CSINodeLister:      storagelisters.NewCSINodeLister(newIndexer(t)),
+		Recorder:           recorder,
+	}
+
+	// VolumeAttachment is deleted first while PVC is retained
+	result, err := r.Reconcile(stor)
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if result.RequeueAfter != waitInterval {
+		t.Fatalf("Expected requeue after %s got %+v", waitInterval, result)
+	}
+	_, err = clientset.StorageV1beta1().VolumeAttachments().Get(va.Name, metav1.GetOptions{})
+	if !apierrs.IsNotFound(err) {
+		t.Fatalf("Expected VA to be deleted got %v", err)
+	}
+	_, err = clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(pvc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected PVC to be retained till detach got %v", err)
+	}
+	expectEvents(t, recorder, "Normal "+EventVolumeAttachmentDeleted)
+	updated := ddpStorages.updated[stor.Namespace+"/"+stor.Name]
+	if updated.Status.Phase != ddp.StorageTerminating || updated.Status.Reason != "WaitingForDetach" {
+		t.Fatalf(
+			"Expected Terminating: WaitingForDetach got %s: %s",
+			updated.Status.Phase, updated.Status.Reason,
+		)
+	}
+
+	// PVC is deleted once the attacher has confirmed the detach
+	if err := vaIndexer.Delete(va); err != nil {
+		t.Fatalf("Delete VA from indexer failed: %v", err)
+	}
+	result, err = r.Reconcile(stor)
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if result.RequeueAfter != waitInterval {
+		t.Fatalf("Expected requeue after %s got %+v", waitInterval, result)
+	}
+	_, err = clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(pvc.Name, metav1.GetOptions{})
+	if !apierrs.IsNotFound(err) {
+		t.Fatalf("Expected PVC to be deleted got %v", err)
+	}
+	expectEvents(t, recorder, "Normal "+EventPVCDeleted)
+	updated = ddpStorages.updated[stor.Namespace+"/"+stor.Name]
+	if updated.Status.Reason != "WaitingForPVCDeletion" {
+		t.Fatalf("Expected reason WaitingForPVCDeletion got %s", updated.Status.Reason)
+	}
+	if !hasFinalizer(updated, storageTeardownFinalizer) {
+		t.Fatalf("Expected finalizer to be retained till PVC is gone")
+	}
+
+	// finalizer is removed once all the owned resources are gone
+	if err := pvcIndexer.Delete(pvc); err != nil {
+		t.Fatalf("Delete PVC from indexer failed: %v", err)
+	}
+	result, err = r.Reconcile(stor)
+	if err != nil {
+		t.Fatalf("Expected no error got %v", err)
+	}
+	if result != (Result{}) {
+		t.Fatalf("Expected no requeue got %+v", result)
+	}
+	updated = ddpStorages.updated[stor.Namespace+"/"+stor.Name]
+	if hasFinalizer(updated, storageTeardownFinalizer) {
+		t.Fatalf("Expected finalizer to be removed got %v", updated.Finalizers)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// getPVCTemplate returns the PVC template of the given storage. An
+// empty template is returned if the storage does not have one.
+func getPVCTemplate(stor *ddp.Storage) ddp.PVCTemplate {
+	if stor.Spec.PVCTemplate == nil {
+		return ddp.PVCTemplate{}
+	}
+	return *stor.Spec.PVCTemplate.DeepCopy()
+}
+
+// applyPVCTemplateSpec sets the fields of the given template spec
+// against the given PVC spec. Fields owned by the controller are not
+// part of the template & hence are left as is.
+func applyPVCTemplateSpec(spec *v1.PersistentVolumeClaimSpec, tmpl ddp.PVCTemplateSpec) {
+	spec.Selector = tmpl.Selector
+	spec.VolumeMode = tmpl.VolumeMode
+	spec.DataSource = tmpl.DataSource
+}
+
+// mergeDict adds the given entries to the given dict. Existing entries
+// with the same keys are overwritten. It returns the resulting dict &
+// true if the dict was changed.
+//
+// NOTE:
+//	Entries are never removed since PVC labels & annotations are
+// set by other controllers as well.
+func mergeDict(dict, entries map[string]string) (map[string]string, bool) {
+	var changed bool
+	for key, value := range entries {
+		if existing, found := dict[key]; found && existing == value {
+			continue
+		}
+		if dict == nil {
+			dict = map[string]string{}
+		}
+		dict[key] = value
+		changed = true
+	}
+	return dict, changed
+}
+
+// isControllerOwnedKey returns true if the given label or annotation
+// key is owned by the storage controller
+func isControllerOwnedKey(key string) bool {
+	return strings.HasPrefix(key, StorageProvisionerAnnotationNamespace+"/")
+}
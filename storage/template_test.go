@@ -0,0 +1,70 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeDict(t *testing.T) {
+	tests := map[string]struct {
+		dict      map[string]string
+		entries   map[string]string
+		expected  map[string]string
+		isChanged bool
+	}{
+		"nil dict": {
+			entries:   map[string]string{"app": "db"},
+			expected:  map[string]string{"app": "db"},
+			isChanged: true,
+		},
+		"no entries": {
+			dict:     map[string]string{"app": "db"},
+			expected: map[string]string{"app": "db"},
+		},
+		"same entries": {
+			dict:     map[string]string{"app": "db"},
+			entries:  map[string]string{"app": "db"},
+			expected: map[string]string{"app": "db"},
+		},
+		"changed entry": {
+			dict:      map[string]string{"app": "db", "tier": "data"},
+			entries:   map[string]string{"app": "cache"},
+			expected:  map[string]string{"app": "cache", "tier": "data"},
+			isChanged: true,
+		},
+	}
+	for name, mock := range tests {
+		got, changed := mergeDict(mock.dict, mock.entries)
+		if changed != mock.isChanged {
+			t.Fatalf("%s: Expected changed %t got %t", name, mock.isChanged, changed)
+		}
+		if !reflect.DeepEqual(got, mock.expected) {
+			t.Fatalf("%s: Expected %v got %v", name, mock.expected, got)
+		}
+	}
+}
+
+func TestIsControllerOwnedKey(t *testing.T) {
+	if !isControllerOwnedKey(nodeNameKey) {
+		t.Fatalf("Expected %s to be owned by the controller", nodeNameKey)
+	}
+	if isControllerOwnedKey("app") {
+		t.Fatalf("Expected app to not be owned by the controller")
+	}
+}
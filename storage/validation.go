@@ -0,0 +1,406 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+// ValidateStorage returns the errors found in the given storage. This
+// is the same validation that is done by the storage controller before
+// reconciling a storage.
+func ValidateStorage(stor *ddp.Storage) field.ErrorList {
+	return validateStorage(stor)
+}
+
+// ValidateStorageUpdate returns the errors found in the given storage
+// along with the errors due to the changes from its old version
+func ValidateStorageUpdate(stor, old *ddp.Storage) field.ErrorList {
+	allErrs := validateStorage(stor)
+	return append(allErrs, validateStorageUpdate(stor, old)...)
+}
+
+// validateStorage returns the errors found in the given storage
+func validateStorage(stor *ddp.Storage) field.ErrorList {
+	var allErrs field.ErrorList
+
+	specPath := field.NewPath("spec")
+	if stor.Spec.Capacity.Sign() <= 0 {
+		allErrs = append(allErrs, field.Invalid(
+			specPath.Child("capacity"), stor.Spec.Capacity.String(),
+			"must be greater than zero",
+		))
+	}
+	allErrs = append(allErrs, validateSpecWithAnnotation(
+		stor, specPath.Child("storageClassName"),
+		stor.Spec.StorageClassName, storageclassProviderKey, true,
+	)...)
+	allErrs = append(allErrs, validateSpecWithAnnotation(
+		stor, specPath.Child("attacher"),
+		stor.Spec.Attacher, storageCSIAttacherKey, false,
+	)...)
+	allErrs = append(allErrs, validateNodeNames(stor.Spec, specPath)...)
+	allErrs = append(allErrs, validateNodeSelection(stor.Spec, specPath)...)
+	if stor.Spec.PVCTemplate != nil {
+		allErrs = append(allErrs, validatePVCTemplate(
+			stor.Spec.PVCTemplate, specPath.Child("pvcTemplate"),
+		)...)
+	}
+	if stor.Spec.Source != nil {
+		allErrs = append(allErrs, validateSource(stor, specPath.Child("source"))...)
+	}
+	return allErrs
+}
+
+// validateSource verifies the data source of the given storage.
+// Exactly one source must be set & it can not be set along with the
+// data source of PVC template.
+func validateSource(stor *ddp.Storage, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	src := stor.Spec.Source
+	if tmpl := stor.Spec.PVCTemplate; tmpl != nil && tmpl.Spec.DataSource != nil {
+		allErrs = append(allErrs, field.Forbidden(
+			fldPath, "may not be set along with spec.pvcTemplate.spec.dataSource",
+		))
+	}
+
+	switch {
+	case src.VolumeSnapshot == nil && src.Storage == nil:
+		allErrs = append(allErrs, field.Required(
+			fldPath, "must set one of volumeSnapshot or storage",
+		))
+	case src.VolumeSnapshot != nil && src.Storage != nil:
+		allErrs = append(allErrs, field.Forbidden(
+			fldPath.Child("storage"), "may not be set along with volumeSnapshot",
+		))
+	case src.VolumeSnapshot != nil:
+		allErrs = append(allErrs, validateObjectName(
+			src.VolumeSnapshot.Name, fldPath.Child("volumeSnapshot", "name"),
+		)...)
+	default:
+		namePath := fldPath.Child("storage", "name")
+		allErrs = append(allErrs, validateObjectName(src.Storage.Name, namePath)...)
+		if src.Storage.Name == stor.Name {
+			allErrs = append(allErrs, field.Invalid(
+				namePath, src.Storage.Name, "may not refer to the storage itself",
+			))
+		}
+	}
+	return allErrs
+}
+
+// validateObjectName verifies the given name of a referred object
+func validateObjectName(name string, fldPath *field.Path) field.ErrorList {
+	if name == "" {
+		return field.ErrorList{field.Required(fldPath, "")}
+	}
+
+	var allErrs field.ErrorList
+	for _, msg := range apivalidation.NameIsDNSSubdomain(name, false) {
+		allErrs = append(allErrs, field.Invalid(fldPath, name, msg))
+	}
+	return allErrs
+}
+
+// validateStorageSet returns the errors found in the given storage
+// set. Storage template is not validated here since the storages get
+// defaulted & validated on their own.
+func validateStorageSet(set *ddp.StorageSet) field.ErrorList {
+	var allErrs field.ErrorList
+
+	specPath := field.NewPath("spec")
+	replicas := getStorageSetReplicas(set)
+	if replicas < 0 {
+		allErrs = append(allErrs, field.Invalid(
+			specPath.Child("replicas"), replicas, "must be greater than or equal to zero",
+		))
+		replicas = 0
+	}
+
+	// name of the storage having the highest ordinal is the longest
+	lastOrdinal := replicas - 1
+	if lastOrdinal < 0 {
+		lastOrdinal = 0
+	}
+	name := getStorageSetStorageName(set, lastOrdinal)
+	for _, msg := range apivalidation.NameIsDNSSubdomain(name, false) {
+		allErrs = append(allErrs, field.Invalid(
+			specPath.Child("namePrefix"), getStorageSetNamePrefix(set),
+			fmt.Sprintf("storage name %s is not valid: %s", name, msg),
+		))
+	}
+
+	switch policy := set.Spec.RetentionPolicy; policy {
+	case "", ddp.StorageSetRetentionDelete, ddp.StorageSetRetentionRetain:
+	default:
+		allErrs = append(allErrs, field.NotSupported(
+			specPath.Child("retentionPolicy"), policy, []string{
+				string(ddp.StorageSetRetentionDelete),
+				string(ddp.StorageSetRetentionRetain),
+			},
+		))
+	}
+	return allErrs
+}
+
+// validateStorageUpdate verifies the changes made to the given storage
+// against its old version. Fields that are used only when the PVC gets
+// created can not be changed & the storage can not be shrunk.
+func validateStorageUpdate(stor, old *ddp.Storage) field.ErrorList {
+	var allErrs field.ErrorList
+
+	specPath := field.NewPath("spec")
+	if stor.Spec.Capacity.Cmp(old.Spec.Capacity) < 0 {
+		allErrs = append(allErrs, field.Forbidden(
+			specPath.Child("capacity"),
+			fmt.Sprintf(
+				"may not be less than the current capacity %s: storage can not be shrunk",
+				old.Spec.Capacity.String(),
+			),
+		))
+	}
+
+	// storageclass can be set once if it was missing e.g. when the
+	// default storageclass is applied
+	provider, _ := findProviderFromStorage(stor)
+	oldProvider, _ := findProviderFromStorage(old)
+	if oldProvider != "" {
+		allErrs = append(allErrs, apivalidation.ValidateImmutableField(
+			provider, oldProvider, specPath.Child("storageClassName"),
+		)...)
+	}
+	allErrs = append(allErrs, apivalidation.ValidateImmutableField(
+		getAccessModes(stor), getAccessModes(old), specPath.Child("accessModes"),
+	)...)
+	allErrs = append(allErrs, apivalidation.ValidateImmutableField(
+		stor.Spec.Source, old.Spec.Source, specPath.Child("source"),
+	)...)
+	allErrs = append(allErrs, apivalidation.ValidateImmutableField(
+		getPVCTemplate(stor).Spec, getPVCTemplate(old).Spec,
+		specPath.Child("pvcTemplate", "spec"),
+	)...)
+	return allErrs
+}
+
+// validateNodeSelection verifies the node selector & node affinity
+// used to select the node of the storage
+func validateNodeSelection(spec ddp.StorageSpec, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if len(spec.NodeSelector) == 0 && spec.NodeAffinity == nil {
+		return nil
+	}
+
+	if spec.NodeName != nil || len(spec.NodeNames) != 0 {
+		allErrs = append(allErrs, field.Forbidden(
+			fldPath.Child("nodeSelector"),
+			"may not be set along with spec.nodeName or spec.nodeNames",
+		))
+	}
+
+	allErrs = append(allErrs, metav1validation.ValidateLabels(
+		spec.NodeSelector, fldPath.Child("nodeSelector"),
+	)...)
+
+	if spec.NodeAffinity == nil {
+		return allErrs
+	}
+
+	termsPath := fldPath.Child("nodeAffinity", "nodeSelectorTerms")
+	if len(spec.NodeAffinity.NodeSelectorTerms) == 0 {
+		allErrs = append(allErrs, field.Required(termsPath, "must have at least one term"))
+	}
+	for i, term := range spec.NodeAffinity.NodeSelectorTerms {
+		for j, expr := range term.MatchExpressions {
+			if _, err := newNodeSelectorRequirement(expr); err != nil {
+				allErrs = append(allErrs, field.Invalid(
+					termsPath.Index(i).Child("matchExpressions").Index(j),
+					expr, err.Error(),
+				))
+			}
+		}
+		for j, expr := range term.MatchFields {
+			fldPath := termsPath.Index(i).Child("matchFields").Index(j)
+			if expr.Key != nodeNameField {
+				allErrs = append(allErrs, field.NotSupported(
+					fldPath.Child("key"), expr.Key, []string{nodeNameField},
+				))
+				continue
+			}
+			if _, err := newNodeSelectorRequirement(expr); err != nil {
+				allErrs = append(allErrs, field.Invalid(fldPath, expr, err.Error()))
+			}
+		}
+	}
+	return allErrs
+}
+
+// validatePVCTemplate verifies the given PVC template. Labels &
+// annotations owned by the controller can not be set in the template.
+func validatePVCTemplate(tmpl *ddp.PVCTemplate, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	metaPath := fldPath.Child("metadata")
+	allErrs = append(allErrs, metav1validation.ValidateLabels(
+		tmpl.Metadata.Labels, metaPath.Child("labels"),
+	)...)
+	allErrs = append(allErrs, apivalidation.ValidateAnnotations(
+		tmpl.Metadata.Annotations, metaPath.Child("annotations"),
+	)...)
+	for key := range tmpl.Metadata.Labels {
+		if isControllerOwnedKey(key) {
+			allErrs = append(allErrs, field.Forbidden(
+				metaPath.Child("labels").Key(key), "owned by the controller",
+			))
+		}
+	}
+	for key := range tmpl.Metadata.Annotations {
+		if isControllerOwnedKey(key) {
+			allErrs = append(allErrs, field.Forbidden(
+				metaPath.Child("annotations").Key(key), "owned by the controller",
+			))
+		}
+	}
+
+	specPath := fldPath.Child("spec")
+	allErrs = append(allErrs, metav1validation.ValidateLabelSelector(
+		tmpl.Spec.Selector, specPath.Child("selector"),
+	)...)
+	if mode := tmpl.Spec.VolumeMode; mode != nil &&
+		*mode != v1.PersistentVolumeBlock && *mode != v1.PersistentVolumeFilesystem {
+		allErrs = append(allErrs, field.NotSupported(
+			specPath.Child("volumeMode"), *mode, []string{
+				string(v1.PersistentVolumeBlock), string(v1.PersistentVolumeFilesystem),
+			},
+		))
+	}
+	if src := tmpl.Spec.DataSource; src != nil {
+		if src.Kind == "" {
+			allErrs = append(allErrs, field.Required(
+				specPath.Child("dataSource", "kind"), "",
+			))
+		}
+		if src.Name == "" {
+			allErrs = append(allErrs, field.Required(
+				specPath.Child("dataSource", "name"), "",
+			))
+		}
+	}
+	return allErrs
+}
+
+// supportedAccessModes are the access modes that can be set
+// against a storage
+var supportedAccessModes = []string{
+	string(v1.ReadWriteOnce),
+	string(v1.ReadOnlyMany),
+	string(v1.ReadWriteMany),
+}
+
+// validateNodeNames verifies the nodes to attach the storage against
+// the access modes of the storage
+func validateNodeNames(spec ddp.StorageSpec, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	for i, mode := range spec.AccessModes {
+		if !ContainsString(supportedAccessModes, string(mode)) {
+			allErrs = append(allErrs, field.NotSupported(
+				fldPath.Child("accessModes").Index(i), mode, supportedAccessModes,
+			))
+		}
+	}
+
+	nodeNamesPath := fldPath.Child("nodeNames")
+	if spec.NodeName != nil && len(spec.NodeNames) != 0 {
+		allErrs = append(allErrs, field.Forbidden(
+			nodeNamesPath, "may not be set along with spec.nodeName",
+		))
+	}
+
+	seen := map[string]bool{}
+	for i, nodeName := range spec.NodeNames {
+		if nodeName == "" {
+			allErrs = append(allErrs, field.Required(
+				nodeNamesPath.Index(i), "must not be empty",
+			))
+		} else if seen[nodeName] {
+			allErrs = append(allErrs, field.Duplicate(
+				nodeNamesPath.Index(i), nodeName,
+			))
+		}
+		seen[nodeName] = true
+	}
+
+	if len(spec.NodeNames) > 1 && !isMultiNodeAccess(spec.AccessModes) {
+		allErrs = append(allErrs, field.Invalid(
+			nodeNamesPath, spec.NodeNames,
+			fmt.Sprintf(
+				"more than one node requires access mode %s or %s",
+				v1.ReadWriteMany, v1.ReadOnlyMany,
+			),
+		))
+	}
+	return allErrs
+}
+
+// validateSpecWithAnnotation verifies the given spec field against
+// the annotation that was used before this field was introduced.
+// One of them must be set if required. They must not disagree if
+// both are set.
+func validateSpecWithAnnotation(
+	stor *ddp.Storage,
+	fldPath *field.Path,
+	value *string,
+	annKey string,
+	required bool,
+) field.ErrorList {
+
+	annValue, found := findValueFromDict(stor.GetAnnotations(), annKey)
+
+	switch {
+	case value == nil && !found && !required:
+		return nil
+	case value == nil && !found:
+		return field.ErrorList{field.Required(
+			fldPath, fmt.Sprintf("must be set either here or via annotation %q", annKey),
+		)}
+	case value != nil && *value == "":
+		return field.ErrorList{field.Required(fldPath, "must not be empty")}
+	case value == nil && annValue == "":
+		return field.ErrorList{field.Required(
+			fldPath, fmt.Sprintf("annotation %q must not be empty", annKey),
+		)}
+	case value != nil && found && *value != annValue:
+		return field.ErrorList{field.Invalid(
+			fldPath, *value,
+			fmt.Sprintf("does not match annotation %q value %q", annKey, annValue),
+		)}
+	case value != nil:
+		return validateObjectName(*value, fldPath)
+	}
+	return validateObjectName(
+		annValue, field.NewPath("metadata", "annotations").Key(annKey),
+	)
+}
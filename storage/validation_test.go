@@ -0,0 +1,495 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+func TestValidateStorage(t *testing.T) {
+	tests := map[string]struct {
+		storageClassName *string
+		annotations      map[string]string
+		capacity         string
+		isErr            bool
+	}{
+		"spec only": {
+			storageClassName: strPtr("csi-sc"),
+		},
+		"annotation only": {
+			annotations: map[string]string{storageclassProviderKey: "csi-sc"},
+		},
+		"spec matches annotation": {
+			storageClassName: strPtr("csi-sc"),
+			annotations:      map[string]string{storageclassProviderKey: "csi-sc"},
+		},
+		"neither spec nor annotation": {
+			isErr: true,
+		},
+		"empty spec": {
+			storageClassName: strPtr(""),
+			isErr:            true,
+		},
+		"empty annotation": {
+			annotations: map[string]string{storageclassProviderKey: ""},
+			isErr:       true,
+		},
+		"spec does not match annotation": {
+			storageClassName: strPtr("csi-sc"),
+			annotations:      map[string]string{storageclassProviderKey: "other-sc"},
+			isErr:            true,
+		},
+		"zero capacity": {
+			storageClassName: strPtr("csi-sc"),
+			capacity:         "0",
+			isErr:            true,
+		},
+	}
+	for name, mock := range tests {
+		stor := newTestStorage("stor", "node-1")
+		stor.Spec.StorageClassName = mock.storageClassName
+		stor.Annotations = mock.annotations
+		if mock.capacity != "" {
+			stor.Spec.Capacity = resource.MustParse(mock.capacity)
+		}
+
+		errs := validateStorage(stor)
+		if mock.isErr && len(errs) == 0 {
+			t.Fatalf("%s: Expected error got none", name)
+		}
+		if !mock.isErr && len(errs) != 0 {
+			t.Fatalf("%s: Expected no error got %v", name, errs)
+		}
+	}
+}
+
+func TestValidateStorageAttacher(t *testing.T) {
+	// attacher is resolved by the controller if not set
+	stor := &ddp.Storage{
+		Spec: ddp.StorageSpec{
+			Capacity:         resource.MustParse("1Gi"),
+			StorageClassName: strPtr("csi-sc"),
+		},
+	}
+	if errs := validateStorage(stor); len(errs) != 0 {
+		t.Fatalf("Expected no error got %v", errs)
+	}
+
+	stor.Spec.Attacher = strPtr("")
+	errs := validateStorage(stor)
+	if len(errs) != 1 || errs[0].Field != "spec.attacher" {
+		t.Fatalf("Expected spec.attacher to be invalid got %v", errs)
+	}
+}
+
+func TestValidateNodeNames(t *testing.T) {
+	tests := map[string]struct {
+		spec  ddp.StorageSpec
+		isErr bool
+	}{
+		"single node": {
+			spec: ddp.StorageSpec{NodeNames: []string{"node-1"}},
+		},
+		"multiple nodes with shared access": {
+			spec: ddp.StorageSpec{
+				NodeNames:   []string{"node-1", "node-2"},
+				AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			},
+		},
+		"multiple nodes without shared access": {
+			spec: ddp.StorageSpec{
+				NodeNames: []string{"node-1", "node-2"},
+			},
+			isErr: true,
+		},
+		"along with nodeName": {
+			spec: ddp.StorageSpec{
+				NodeName:  strPtr("node-1"),
+				NodeNames: []string{"node-1"},
+			},
+			isErr: true,
+		},
+		"empty node": {
+			spec:  ddp.StorageSpec{NodeNames: []string{""}},
+			isErr: true,
+		},
+		"duplicate nodes": {
+			spec: ddp.StorageSpec{
+				NodeNames:   []string{"node-1", "node-1"},
+				AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany},
+			},
+			isErr: true,
+		},
+		"unsupported access mode": {
+			spec: ddp.StorageSpec{
+				AccessModes: []v1.PersistentVolumeAccessMode{"ReadWriteSometimes"},
+			},
+			isErr: true,
+		},
+	}
+	for name, mock := range tests {
+		errs := validateNodeNames(mock.spec, field.NewPath("spec"))
+		if mock.isErr && len(errs) == 0 {
+			t.Fatalf("%s: Expected error got none", name)
+		}
+		if !mock.isErr && len(errs) != 0 {
+			t.Fatalf("%s: Expected no error got %v", name, errs)
+		}
+	}
+}
+
+func TestValidatePVCTemplate(t *testing.T) {
+	block := v1.PersistentVolumeBlock
+	unknown := v1.PersistentVolumeMode("Tape")
+
+	tests := map[string]struct {
+		tmpl  ddp.PVCTemplate
+		isErr bool
+	}{
+		"empty template": {},
+		"labels & annotations": {
+			tmpl: ddp.PVCTemplate{
+				Metadata: ddp.PVCTemplateMeta{
+					Labels:      map[string]string{"app": "db"},
+					Annotations: map[string]string{"example.com/owner": "team-1"},
+				},
+			},
+		},
+		"invalid label": {
+			tmpl: ddp.PVCTemplate{
+				Metadata: ddp.PVCTemplateMeta{
+					Labels: map[string]string{"app": "not a value"},
+				},
+			},
+			isErr: true,
+		},
+		"controller owned annotation": {
+			tmpl: ddp.PVCTemplate{
+				Metadata: ddp.PVCTemplateMeta{
+					Annotations: map[string]string{nodeNameKey: "node-1"},
+				},
+			},
+			isErr: true,
+		},
+		"controller owned label": {
+			tmpl: ddp.PVCTemplate{
+				Metadata: ddp.PVCTemplateMeta{
+					Labels: map[string]string{storageUIDKey: "uid"},
+				},
+			},
+			isErr: true,
+		},
+		"block volume mode": {
+			tmpl: ddp.PVCTemplate{
+				Spec: ddp.PVCTemplateSpec{VolumeMode: &block},
+			},
+		},
+		"unsupported volume mode": {
+			tmpl: ddp.PVCTemplate{
+				Spec: ddp.PVCTemplateSpec{VolumeMode: &unknown},
+			},
+			isErr: true,
+		},
+		"data source without name": {
+			tmpl: ddp.PVCTemplate{
+				Spec: ddp.PVCTemplateSpec{
+					DataSource: &v1.TypedLocalObjectReference{Kind: "VolumeSnapshot"},
+				},
+			},
+			isErr: true,
+		},
+	}
+	for name, mock := range tests {
+		errs := validatePVCTemplate(&mock.tmpl, field.NewPath("spec", "pvcTemplate"))
+		if mock.isErr && len(errs) == 0 {
+			t.Fatalf("%s: Expected error got none", name)
+		}
+		if !mock.isErr && len(errs) != 0 {
+			t.Fatalf("%s: Expected no error got %v", name, errs)
+		}
+	}
+}
+
+func TestValidateNodeSelection(t *testing.T) {
+	tests := map[string]struct {
+		spec  ddp.StorageSpec
+		isErr bool
+	}{
+		"no selection": {},
+		"node selector": {
+			spec: ddp.StorageSpec{NodeSelector: map[string]string{"zone": "zone-a"}},
+		},
+		"along with nodeName": {
+			spec: ddp.StorageSpec{
+				NodeName:     strPtr("node-1"),
+				NodeSelector: map[string]string{"zone": "zone-a"},
+			},
+			isErr: true,
+		},
+		"invalid node selector": {
+			spec:  ddp.StorageSpec{NodeSelector: map[string]string{"zone": "zone a"}},
+			isErr: true,
+		},
+		"node affinity without terms": {
+			spec:  ddp.StorageSpec{NodeAffinity: &v1.NodeSelector{}},
+			isErr: true,
+		},
+		"node affinity with unsupported operator": {
+			spec: ddp.StorageSpec{
+				NodeAffinity: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{Key: "zone", Operator: "Near"},
+							},
+						},
+					},
+				},
+			},
+			isErr: true,
+		},
+		"node affinity with unsupported field": {
+			spec: ddp.StorageSpec{
+				NodeAffinity: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchFields: []v1.NodeSelectorRequirement{
+								{Key: "spec.podCIDR", Operator: v1.NodeSelectorOpExists},
+							},
+						},
+					},
+				},
+			},
+			isErr: true,
+		},
+		"node affinity by node name": {
+			spec: ddp.StorageSpec{
+				NodeAffinity: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchFields: []v1.NodeSelectorRequirement{
+								{
+									Key:      nodeNameField,
+									Operator: v1.NodeSelectorOpIn,
+									Values:   []string{"node-1"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	for name, mock := range tests {
+		errs := validateNodeSelection(mock.spec, field.NewPath("spec"))
+		if mock.isErr && len(errs) == 0 {
+			t.Fatalf("%s: Expected error got none", name)
+		}
+		if !mock.isErr && len(errs) != 0 {
+			t.Fatalf("%s: Expected no error got %v", name, errs)
+		}
+	}
+}
+
+func TestValidateSource(t *testing.T) {
+	tests := map[string]struct {
+		source      *ddp.StorageSource
+		pvcTemplate *ddp.PVCTemplate
+		isErr       bool
+	}{
+		"volume snapshot": {
+			source: &ddp.StorageSource{
+				VolumeSnapshot: &v1.LocalObjectReference{Name: "snap"},
+			},
+		},
+		"storage": {
+			source: &ddp.StorageSource{
+				Storage: &v1.LocalObjectReference{Name: "other"},
+			},
+		},
+		"no source": {
+			source: &ddp.StorageSource{},
+			isErr:  true,
+		},
+		"both sources": {
+			source: &ddp.StorageSource{
+				VolumeSnapshot: &v1.LocalObjectReference{Name: "snap"},
+				Storage:        &v1.LocalObjectReference{Name: "other"},
+			},
+			isErr: true,
+		},
+		"invalid name": {
+			source: &ddp.StorageSource{
+				VolumeSnapshot: &v1.LocalObjectReference{Name: "Snap_1"},
+			},
+			isErr: true,
+		},
+		"storage itself": {
+			source: &ddp.StorageSource{
+				Storage: &v1.LocalObjectReference{Name: "stor"},
+			},
+			isErr: true,
+		},
+		"along with template data source": {
+			source: &ddp.StorageSource{
+				VolumeSnapshot: &v1.LocalObjectReference{Name: "snap"},
+			},
+			pvcTemplate: &ddp.PVCTemplate{
+				Spec: ddp.PVCTemplateSpec{
+					DataSource: &v1.TypedLocalObjectReference{Kind: pvcKind, Name: "pvc"},
+				},
+			},
+			isErr: true,
+		},
+	}
+	for name, mock := range tests {
+		stor := newTestStorage("stor", "node-1")
+		stor.Spec.Source = mock.source
+		stor.Spec.PVCTemplate = mock.pvcTemplate
+
+		errs := validateSource(stor, field.NewPath("spec", "source"))
+		if mock.isErr && len(errs) == 0 {
+			t.Fatalf("%s: Expected error got none", name)
+		}
+		if !mock.isErr && len(errs) != 0 {
+			t.Fatalf("%s: Expected no error got %v", name, errs)
+		}
+	}
+}
+
+func TestValidateStorageUpdate(t *testing.T) {
+	tests := map[string]struct {
+		old    func(*ddp.Storage)
+		update func(*ddp.Storage)
+		field  string
+	}{
+		"no change": {
+			update: func(*ddp.Storage) {},
+		},
+		"expand": {
+			update: func(stor *ddp.Storage) {
+				stor.Spec.Capacity = resource.MustParse("8Gi")
+			},
+		},
+		"change node": {
+			update: func(stor *ddp.Storage) {
+				stor.Spec.NodeName = strPtr("node-2")
+			},
+		},
+		"shrink": {
+			update: func(stor *ddp.Storage) {
+				stor.Spec.Capacity = resource.MustParse("2Gi")
+			},
+			field: "spec.capacity",
+		},
+		"set missing storageclass": {
+			old: func(stor *ddp.Storage) {
+				stor.Spec.StorageClassName = nil
+			},
+			update: func(*ddp.Storage) {},
+		},
+		"change storageclass": {
+			update: func(stor *ddp.Storage) {
+				stor.Spec.StorageClassName = strPtr("other-sc")
+			},
+			field: "spec.storageClassName",
+		},
+		"change access modes": {
+			update: func(stor *ddp.Storage) {
+				stor.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteMany}
+			},
+			field: "spec.accessModes",
+		},
+		"change source": {
+			update: func(stor *ddp.Storage) {
+				stor.Spec.Source = &ddp.StorageSource{
+					VolumeSnapshot: &v1.LocalObjectReference{Name: "snap"},
+				}
+			},
+			field: "spec.source",
+		},
+	}
+	for name, mock := range tests {
+		old := newTestStorage("stor", "node-1")
+		if mock.old != nil {
+			mock.old(old)
+		}
+		stor := newTestStorage("stor", "node-1")
+		mock.update(stor)
+
+		errs := ValidateStorageUpdate(stor, old)
+		if mock.field == "" {
+			if len(errs) != 0 {
+				t.Fatalf("%s: Expected no error got %v", name, errs)
+			}
+			continue
+		}
+		if len(errs) != 1 || errs[0].Field != mock.field {
+			t.Fatalf("%s: Expected %s to be invalid got %v", name, mock.field, errs)
+		}
+	}
+}
+
+func TestValidateStorageSet(t *testing.T) {
+	tests := map[string]struct {
+		replicas   int32
+		namePrefix string
+		policy     ddp.StorageSetRetentionPolicy
+		field      string
+	}{
+		"valid": {
+			replicas: 3,
+			policy:   ddp.StorageSetRetentionRetain,
+		},
+		"no replicas": {},
+		"negative replicas": {
+			replicas: -1,
+			field:    "spec.replicas",
+		},
+		"invalid name prefix": {
+			replicas:   1,
+			namePrefix: "Data",
+			field:      "spec.namePrefix",
+		},
+		"unsupported retention policy": {
+			replicas: 1,
+			policy:   "Archive",
+			field:    "spec.retentionPolicy",
+		},
+	}
+	for name, mock := range tests {
+		set := newTestStorageSet(mock.replicas, mock.policy)
+		set.Spec.NamePrefix = mock.namePrefix
+
+		errs := validateStorageSet(set)
+		if mock.field == "" {
+			if len(errs) != 0 {
+				t.Fatalf("%s: Expected no error got %v", name, errs)
+			}
+			continue
+		}
+		if len(errs) != 1 || errs[0].Field != mock.field {
+			t.Fatalf("%s: Expected %s to be invalid got %v", name, mock.field, errs)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+
+	"github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+	"github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1beta1"
+)
+
+// conversionReview is the request & response of a CRD conversion
+// webhook. This mirrors ConversionReview of apiextensions.k8s.io/v1beta1
+// which is not vendored by this repo.
+type conversionReview struct {
+	metav1.TypeMeta `json:",inline"`
+
+	Request  *conversionRequest  `json:"request,omitempty"`
+	Response *conversionResponse `json:"response,omitempty"`
+}
+
+// conversionRequest has the objects to be converted to the desired
+// API version
+type conversionRequest struct {
+	UID               types.UID              `json:"uid"`
+	DesiredAPIVersion string                 `json:"desiredAPIVersion"`
+	Objects           []runtime.RawExtension `json:"objects"`
+}
+
+// conversionResponse has the converted objects in the same order as
+// the request. Result tells if all the objects got converted.
+type conversionResponse struct {
+	UID              types.UID              `json:"uid"`
+	ConvertedObjects []runtime.RawExtension `json:"convertedObjects"`
+	Result           metav1.Status          `json:"result"`
+}
+
+// StorageConverter converts a storage between the served versions
+// of storage API i.e. v1alpha1 & v1beta1
+type StorageConverter struct{}
+
+// ServeHTTP implements http.Handler interface. It decodes the
+// conversion review from the request & responds with the review
+// that has the converted storages.
+func (c *StorageConverter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, ok := readReviewBody(w, req)
+	if !ok {
+		return
+	}
+
+	review := &conversionReview{}
+	if err := json.Unmarshal(body, review); err != nil {
+		http.Error(
+			w, fmt.Sprintf("Decode conversion review failed: %v", err),
+			http.StatusBadRequest,
+		)
+		return
+	}
+	if review.Request == nil {
+		http.Error(w, "Conversion review has no request", http.StatusBadRequest)
+		return
+	}
+
+	response := &conversionResponse{
+		UID:    review.Request.UID,
+		Result: metav1.Status{Status: metav1.StatusSuccess},
+	}
+	converted, err := c.Convert(review.Request.Objects, review.Request.DesiredAPIVersion)
+	if err != nil {
+		klog.Errorf("%v", err)
+		response.Result = metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: err.Error(),
+		}
+	} else {
+		response.ConvertedObjects = converted
+	}
+	review.Request = nil
+	review.Response = response
+
+	writeReview(w, review)
+}
+
+// Convert returns the given storages converted to the given API
+// version. Storages that are already at this version are returned
+// as is.
+func (c *StorageConverter) Convert(
+	objects []runtime.RawExtension, desiredAPIVersion string,
+) (converted []runtime.RawExtension, err error) {
+
+	defer func() {
+		if err != nil {
+			err = errors.Wrapf(err, "Convert storages to %s failed", desiredAPIVersion)
+		}
+	}()
+
+	switch desiredAPIVersion {
+	case v1alpha1.SchemeGroupVersion.String(), v1beta1.SchemeGroupVersion.String():
+	default:
+		return nil, errors.Errorf("Unsupported API version")
+	}
+
+	for _, obj := range objects {
+		typeMeta := &metav1.TypeMeta{}
+		if err := json.Unmarshal(obj.Raw, typeMeta); err != nil {
+			return nil, errors.Wrapf(err, "Decode object failed")
+		}
+		if typeMeta.APIVersion == desiredAPIVersion {
+			converted = append(converted, obj)
+			continue
+		}
+
+		var out interface{}
+		switch typeMeta.APIVersion {
+		case v1alpha1.SchemeGroupVersion.String():
+			stor := &v1alpha1.Storage{}
+			if err := json.Unmarshal(obj.Raw, stor); err != nil {
+				return nil, errors.Wrapf(err, "Decode storage failed")
+			}
+			out, err = v1beta1.ConvertFromV1alpha1(stor)
+		case v1beta1.SchemeGroupVersion.String():
+			stor := &v1beta1.Storage{}
+			if err := json.Unmarshal(obj.Raw, stor); err != nil {
+				return nil, errors.Wrapf(err, "Decode storage failed")
+			}
+			out, err = v1beta1.ConvertToV1alpha1(stor)
+		default:
+			return nil, errors.Errorf("Unsupported API version %q", typeMeta.APIVersion)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		raw, err := json.Marshal(out)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Encode storage failed")
+		}
+		converted = append(converted, runtime.RawExtension{Raw: raw})
+	}
+	return converted, nil
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+	"github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1beta1"
+)
+
+// postConversionReview posts a conversion review of the given objects
+// to the given server & returns the response of the review
+func postConversionReview(
+	t *testing.T, url string, client *http.Client,
+	desiredAPIVersion string, objs ...interface{},
+) *conversionResponse {
+
+	req := &conversionRequest{
+		UID:               types.UID("uid-convert"),
+		DesiredAPIVersion: desiredAPIVersion,
+	}
+	for _, obj := range objs {
+		raw, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatalf("Encode object failed: %v", err)
+		}
+		req.Objects = append(req.Objects, runtime.RawExtension{Raw: raw})
+	}
+	body, err := json.Marshal(&conversionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "apiextensions.k8s.io/v1beta1",
+			Kind:       "ConversionReview",
+		},
+		Request: req,
+	})
+	if err != nil {
+		t.Fatalf("Encode conversion review failed: %v", err)
+	}
+
+	resp, err := client.Post(url+ConvertStoragePath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Post conversion review failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	review := &conversionReview{}
+	if err := json.NewDecoder(resp.Body).Decode(review); err != nil {
+		t.Fatalf("Decode conversion review failed: %v", err)
+	}
+	if review.Request != nil {
+		t.Fatalf("Expected no request in review got %v", review.Request)
+	}
+	if review.Response == nil {
+		t.Fatalf("Expected response in review got none")
+	}
+	if review.Response.UID != req.UID {
+		t.Fatalf("Expected response uid %q got %q", req.UID, review.Response.UID)
+	}
+	return review.Response
+}
+
+func TestConvertStorageRoundTrip(t *testing.T) {
+	srv := newTestServer(t, nil, nil)
+	defer srv.Close()
+
+	stor := newStorage("4Gi", v1alpha1.StorageSpec{
+		StorageClassName: strPtr("csi-sc"),
+		NodeName:         strPtr("node-1"),
+	})
+
+	resp := postConversionReview(
+		t, srv.URL, srv.Client(), v1beta1.SchemeGroupVersion.String(), stor,
+	)
+	if resp.Result.Status != metav1.StatusSuccess {
+		t.Fatalf("Expected success got %+v", resp.Result)
+	}
+	if len(resp.ConvertedObjects) != 1 {
+		t.Fatalf("Expected 1 converted object got %d", len(resp.ConvertedObjects))
+	}
+	beta := &v1beta1.Storage{}
+	if err := json.Unmarshal(resp.ConvertedObjects[0].Raw, beta); err != nil {
+		t.Fatalf("Decode v1beta1 storage failed: %v", err)
+	}
+	if beta.APIVersion != v1beta1.SchemeGroupVersion.String() {
+		t.Fatalf(
+			"Expected api version %s got %s",
+			v1beta1.SchemeGroupVersion.String(), beta.APIVersion,
+		)
+	}
+
+	resp = postConversionReview(
+		t, srv.URL, srv.Client(), v1alpha1.SchemeGroupVersion.String(), beta,
+	)
+	if resp.Result.Status != metav1.StatusSuccess {
+		t.Fatalf("Expected success got %+v", resp.Result)
+	}
+	if len(resp.ConvertedObjects) != 1 {
+		t.Fatalf("Expected 1 converted object got %d", len(resp.ConvertedObjects))
+	}
+	alpha := &v1alpha1.Storage{}
+	if err := json.Unmarshal(resp.ConvertedObjects[0].Raw, alpha); err != nil {
+		t.Fatalf("Decode v1alpha1 storage failed: %v", err)
+	}
+	if !reflect.DeepEqual(alpha.Spec, stor.Spec) {
+		t.Fatalf("Expected spec %+v got %+v", stor.Spec, alpha.Spec)
+	}
+}
+
+func TestConvertStorage(t *testing.T) {
+	stor := newStorage("4Gi", v1alpha1.StorageSpec{
+		StorageClassName: strPtr("csi-sc"),
+	})
+
+	var tests = map[string]struct {
+		desiredAPIVersion string
+		obj               interface{}
+		isErr             bool
+	}{
+		"same version": {
+			desiredAPIVersion: v1alpha1.SchemeGroupVersion.String(),
+			obj:               stor,
+		},
+		"unsupported desired version": {
+			desiredAPIVersion: "dao.mayadata.io/v2",
+			obj:               stor,
+			isErr:             true,
+		},
+		"unsupported object version": {
+			desiredAPIVersion: v1beta1.SchemeGroupVersion.String(),
+			obj: &metav1.PartialObjectMetadata{
+				TypeMeta: metav1.TypeMeta{APIVersion: "dao.mayadata.io/v2", Kind: "Storage"},
+			},
+			isErr: true,
+		},
+	}
+	for name, mock := range tests {
+		raw, err := json.Marshal(mock.obj)
+		if err != nil {
+			t.Fatalf("%s: Encode object failed: %v", name, err)
+		}
+		objs := []runtime.RawExtension{{Raw: raw}}
+
+		converted, err := (&StorageConverter{}).Convert(objs, mock.desiredAPIVersion)
+		if mock.isErr {
+			if err == nil {
+				t.Fatalf("%s: Expected error got none", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: Expected no error got %v", name, err)
+		}
+		if !reflect.DeepEqual(converted, objs) {
+			t.Fatalf("%s: Expected objects as is got %s", name, converted[0].Raw)
+		}
+	}
+}
+
+func TestConvertStorageFailure(t *testing.T) {
+	srv := newTestServer(t, nil, nil)
+	defer srv.Close()
+
+	resp := postConversionReview(
+		t, srv.URL, srv.Client(), "dao.mayadata.io/v2", newStorage("4Gi", v1alpha1.StorageSpec{}),
+	)
+	if resp.Result.Status != metav1.StatusFailure {
+		t.Fatalf("Expected failure got %+v", resp.Result)
+	}
+	if len(resp.ConvertedObjects) != 0 {
+		t.Fatalf("Expected no converted objects got %d", len(resp.ConvertedObjects))
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	admission "k8s.io/api/admission/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/klog"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+	"github.com/mayadata-io/storage-provisioner/storage"
+)
+
+const (
+	// defaultsAuditKey is the audit annotation that describes the
+	// defaults applied to a storage
+	defaultsAuditKey = "defaults"
+)
+
+// StorageDefaulter applies defaults to a new storage. Defaults are
+// the same as applied by the storage controller.
+//
+// NOTE:
+//	Admission response of this API version can not carry warnings.
+// Hence the applied defaults are recorded as an annotation that gets
+// reported as an event by the storage controller.
+type StorageDefaulter struct {
+	StorageClassLister storagev1listers.StorageClassLister
+}
+
+// ServeHTTP implements http.Handler interface. It decodes the
+// admission review from the request & responds with the review
+// that has the patch to default the storage.
+func (d *StorageDefaulter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	serveAdmissionReview(w, req, d.Default)
+}
+
+// Default returns the admission response to the given request
+func (d *StorageDefaulter) Default(
+	req *admission.AdmissionRequest,
+) *admission.AdmissionResponse {
+
+	if req.Operation != admission.Create {
+		// only new storages are defaulted
+		return &admission.AdmissionResponse{Allowed: true}
+	}
+
+	stor := &ddp.Storage{}
+	if err := json.Unmarshal(req.Object.Raw, stor); err != nil {
+		return toErrorResponse(
+			apierrs.NewBadRequest(errors.Wrapf(err, "Decode storage failed").Error()),
+		)
+	}
+	stor.Namespace = req.Namespace
+
+	defaulted := stor.DeepCopy()
+	defaults, err := storage.DefaultStorage(defaulted, d.StorageClassLister)
+	if err != nil {
+		return toErrorResponse(apierrs.NewInternalError(err))
+	}
+	storage.SetDefaultsApplied(defaulted, defaults)
+
+	response := &admission.AdmissionResponse{Allowed: true}
+	if ops := newStoragePatch(stor, defaulted); len(ops) != 0 {
+		patch, err := json.Marshal(ops)
+		if err != nil {
+			return toErrorResponse(apierrs.NewInternalError(err))
+		}
+		patchType := admission.PatchTypeJSONPatch
+		response.Patch = patch
+		response.PatchType = &patchType
+	}
+	if len(defaults) != 0 {
+		klog.V(3).Infof(
+			"Defaulted storage %s/%s: %s",
+			req.Namespace, req.Name, strings.Join(defaults, "; "),
+		)
+		response.AuditAnnotations = map[string]string{
+			defaultsAuditKey: strings.Join(defaults, "; "),
+		}
+	}
+	return response
+}
+
+// patchOperation is an operation of a JSON patch
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// newStoragePatch returns the JSON patch that changes the given
+// storage to its defaulted version. Only the fields that are defaulted
+// are considered.
+func newStoragePatch(stor, defaulted *ddp.Storage) []patchOperation {
+	var patch []patchOperation
+
+	patch = append(patch, newDictPatch(
+		"/metadata/labels", stor.Labels, defaulted.Labels,
+	)...)
+	patch = append(patch, newDictPatch(
+		"/metadata/annotations", stor.Annotations, defaulted.Annotations,
+	)...)
+	if stor.Spec.StorageClassName == nil && defaulted.Spec.StorageClassName != nil {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/storageClassName",
+			Value: *defaulted.Spec.StorageClassName,
+		})
+	}
+	if stor.Spec.Attacher == nil && defaulted.Spec.Attacher != nil {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/attacher",
+			Value: *defaulted.Spec.Attacher,
+		})
+	}
+	return patch
+}
+
+// newDictPatch returns the JSON patch that adds the entries of the
+// given defaulted dict that are missing or differ in the given dict
+func newDictPatch(path string, dict, defaulted map[string]string) []patchOperation {
+	if len(dict) == 0 && len(defaulted) != 0 {
+		return []patchOperation{{Op: "add", Path: path, Value: defaulted}}
+	}
+
+	// keys are sorted to have the same patch for the same change
+	var keys []string
+	for key := range defaulted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var patch []patchOperation
+	for _, key := range keys {
+		if current, found := dict[key]; found && current == defaulted[key] {
+			continue
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path + "/" + escapePatchPath(key),
+			Value: defaulted[key],
+		})
+	}
+	return patch
+}
+
+// escapePatchPath escapes the given key to be used as a segment of
+// JSON patch path
+func escapePatchPath(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	admission "k8s.io/api/admission/v1beta1"
+	storagev1 "k8s.io/api/storage/v1"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+	"github.com/mayadata-io/storage-provisioner/storage"
+)
+
+const (
+	managedByLabel    = "app.kubernetes.io/managed-by"
+	storageclassLabel = storage.StorageProvisionerAnnotationNamespace + "/storageclass"
+	defaultsApplied   = storage.StorageProvisionerAnnotationNamespace + "/defaults-applied"
+)
+
+func TestDefaultStorage(t *testing.T) {
+	var tests = map[string]struct {
+		scs    []*storagev1.StorageClass
+		op     admission.Operation
+		stor   *ddp.Storage
+		patch  []patchOperation
+		audits map[string]string
+	}{
+		"default storageclass & attacher": {
+			scs: []*storagev1.StorageClass{
+				newStorageClass("csi-gce-pd", "pd.csi.storage.gke.io", true),
+			},
+			op:   admission.Create,
+			stor: newStorage("4Gi", ddp.StorageSpec{}),
+			patch: []patchOperation{{
+				Op:   "add",
+				Path: "/metadata/labels",
+				Value: map[string]interface{}{
+					managedByLabel:    "storage-provisioner",
+					storageclassLabel: "csi-gce-pd",
+				},
+			}, {
+				Op:   "add",
+				Path: "/metadata/annotations",
+				Value: map[string]interface{}{
+					defaultsApplied: "spec.storageClassName is set to default storageclass csi-gce-pd; " +
+						"spec.attacher is set to provisioner pd.csi.storage.gke.io of storageclass csi-gce-pd",
+				},
+			}, {
+				Op:    "add",
+				Path:  "/spec/storageClassName",
+				Value: "csi-gce-pd",
+			}, {
+				Op:    "add",
+				Path:  "/spec/attacher",
+				Value: "pd.csi.storage.gke.io",
+			}},
+			audits: map[string]string{
+				defaultsAuditKey: "spec.storageClassName is set to default storageclass csi-gce-pd; " +
+					"spec.attacher is set to provisioner pd.csi.storage.gke.io of storageclass csi-gce-pd",
+			},
+		},
+		"default attacher of given storageclass": {
+			scs: []*storagev1.StorageClass{
+				newStorageClass("csi-gce-pd", "pd.csi.storage.gke.io", false),
+			},
+			op: admission.Create,
+			stor: func() *ddp.Storage {
+				stor := newStorage("4Gi", ddp.StorageSpec{
+					StorageClassName: strPtr("csi-gce-pd"),
+				})
+				stor.Labels = map[string]string{"app": "db"}
+				stor.Annotations = map[string]string{"owner": "team"}
+				return stor
+			}(),
+			patch: []patchOperation{{
+				Op:    "add",
+				Path:  "/metadata/labels/app.kubernetes.io~1managed-by",
+				Value: "storage-provisioner",
+			}, {
+				Op:    "add",
+				Path:  "/metadata/labels/storageprovisioner.dao.mayadata.io~1storageclass",
+				Value: "csi-gce-pd",
+			}, {
+				Op:    "add",
+				Path:  "/metadata/annotations/storageprovisioner.dao.mayadata.io~1defaults-applied",
+				Value: "spec.attacher is set to provisioner pd.csi.storage.gke.io of storageclass csi-gce-pd",
+			}, {
+				Op:    "add",
+				Path:  "/spec/attacher",
+				Value: "pd.csi.storage.gke.io",
+			}},
+			audits: map[string]string{
+				defaultsAuditKey: "spec.attacher is set to provisioner pd.csi.storage.gke.io of storageclass csi-gce-pd",
+			},
+		},
+		"in-tree storageclass": {
+			scs: []*storagev1.StorageClass{
+				newStorageClass("standard", "kubernetes.io/gce-pd", false),
+			},
+			op: admission.Create,
+			stor: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("standard"),
+			}),
+			patch: []patchOperation{{
+				Op:   "add",
+				Path: "/metadata/labels",
+				Value: map[string]interface{}{
+					managedByLabel:    "storage-provisioner",
+					storageclassLabel: "standard",
+				},
+			}},
+		},
+		"nothing to default": {
+			scs: []*storagev1.StorageClass{
+				newStorageClass("csi-gce-pd", "pd.csi.storage.gke.io", true),
+			},
+			op: admission.Create,
+			stor: func() *ddp.Storage {
+				stor := newStorage("4Gi", ddp.StorageSpec{
+					StorageClassName: strPtr("csi-gce-pd"),
+					Attacher:         strPtr("pd.csi.storage.gke.io"),
+				})
+				stor.Labels = map[string]string{
+					managedByLabel:    "storage-provisioner",
+					storageclassLabel: "csi-gce-pd",
+				}
+				return stor
+			}(),
+		},
+		"ambiguous default storageclass": {
+			scs: []*storagev1.StorageClass{
+				newStorageClass("csi-gce-pd", "pd.csi.storage.gke.io", true),
+				newStorageClass("standard", "kubernetes.io/gce-pd", true),
+			},
+			op:   admission.Create,
+			stor: newStorage("4Gi", ddp.StorageSpec{}),
+			patch: []patchOperation{{
+				Op:   "add",
+				Path: "/metadata/labels",
+				Value: map[string]interface{}{
+					managedByLabel: "storage-provisioner",
+				},
+			}},
+		},
+		"update": {
+			scs: []*storagev1.StorageClass{
+				newStorageClass("csi-gce-pd", "pd.csi.storage.gke.io", true),
+			},
+			op:   admission.Update,
+			stor: newStorage("4Gi", ddp.StorageSpec{}),
+		},
+	}
+	for name, mock := range tests {
+		name, mock := name, mock
+		t.Run(name, func(t *testing.T) {
+			srv := newTestServer(t, mock.scs, nil)
+			defer srv.Close()
+
+			old := mock.stor
+			if mock.op != admission.Update {
+				old = nil
+			}
+			resp := postReview(
+				t, srv, DefaultStoragePath, newAdmissionRequest(t, mock.op, mock.stor, old),
+			)
+			if !resp.Allowed {
+				t.Fatalf("Expected allowed got rejected: %v", resp.Result)
+			}
+			if !reflect.DeepEqual(resp.AuditAnnotations, mock.audits) {
+				t.Fatalf("Expected audit annotations %v got %v", mock.audits, resp.AuditAnnotations)
+			}
+
+			if len(mock.patch) == 0 {
+				if len(resp.Patch) != 0 || resp.PatchType != nil {
+					t.Fatalf("Expected no patch got %s", resp.Patch)
+				}
+				return
+			}
+			if resp.PatchType == nil || *resp.PatchType != admission.PatchTypeJSONPatch {
+				t.Fatalf("Expected patch type %s got %v", admission.PatchTypeJSONPatch, resp.PatchType)
+			}
+			var patch []patchOperation
+			if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+				t.Fatalf("Decode patch failed: %v", err)
+			}
+			if !reflect.DeepEqual(patch, mock.patch) {
+				t.Fatalf("Expected patch %+v got %+v", mock.patch, patch)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+	admission "k8s.io/api/admission/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog"
+)
+
+const (
+	// ValidateStoragePath is the URL path that serves the validating
+	// webhook of storage
+	ValidateStoragePath = "/validate-storage"
+
+	// DefaultStoragePath is the URL path that serves the defaulting
+	// webhook of storage
+	DefaultStoragePath = "/default-storage"
+
+	// ConvertStoragePath is the URL path that serves the conversion
+	// webhook of storage
+	ConvertStoragePath = "/convert"
+)
+
+// Server serves the admission & conversion webhooks of storage API
+// over TLS
+type Server struct {
+	// Address to listen on e.g. ":9443"
+	Addr string
+
+	// Files having the TLS certificate & its private key. Certificate
+	// must be signed by the CA bundle of the webhook configuration.
+	CertFile string
+	KeyFile  string
+
+	// Validator of storage
+	Validator *StorageValidator
+
+	// Defaulter of storage
+	//
+	// This is optional
+	Defaulter *StorageDefaulter
+
+	// Converter of storage between its API versions
+	//
+	// This is optional
+	Converter *StorageConverter
+}
+
+// String implements Stringer interface
+func (s *Server) String() string {
+	return fmt.Sprintf("Webhook server %s", s.Addr)
+}
+
+// Handler returns the handler that routes the admission & conversion
+// requests to the respective webhooks. This can be served by any TLS
+// server.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(ValidateStoragePath, s.Validator)
+	if s.Defaulter != nil {
+		mux.Handle(DefaultStoragePath, s.Defaulter)
+	}
+	if s.Converter != nil {
+		mux.Handle(ConvertStoragePath, s.Converter)
+	}
+	return mux
+}
+
+// Run serves the webhooks till the given channel is closed
+func (s *Server) Run(stopCh <-chan struct{}) error {
+	if s.Validator == nil {
+		return errors.Errorf("%s: Run failed: Nil validator", s)
+	}
+
+	srv := &http.Server{Addr: s.Addr, Handler: s.Handler()}
+	go func() {
+		<-stopCh
+		if err := srv.Shutdown(context.Background()); err != nil {
+			klog.Errorf("%s: Shutdown failed: %v", s, err)
+		}
+	}()
+
+	klog.Infof("Starting %s", s)
+	err := srv.ListenAndServeTLS(s.CertFile, s.KeyFile)
+	if err != nil && err != http.ErrServerClosed {
+		return errors.Wrapf(err, "%s: Run failed", s)
+	}
+	klog.Infof("Shutting down %s", s)
+	return nil
+}
+
+// admitFunc returns the admission response to the given request
+type admitFunc func(*admission.AdmissionRequest) *admission.AdmissionResponse
+
+// serveAdmissionReview decodes the admission review from the given
+// request, admits it via the given func & writes back the review with
+// the response
+func serveAdmissionReview(w http.ResponseWriter, req *http.Request, admit admitFunc) {
+	body, ok := readReviewBody(w, req)
+	if !ok {
+		return
+	}
+
+	review := &admission.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil {
+		http.Error(
+			w, fmt.Sprintf("Decode admission review failed: %v", err),
+			http.StatusBadRequest,
+		)
+		return
+	}
+	if review.Request == nil {
+		http.Error(w, "Admission review has no request", http.StatusBadRequest)
+		return
+	}
+
+	response := admit(review.Request)
+	response.UID = review.Request.UID
+	review.Request = nil
+	review.Response = response
+
+	writeReview(w, review)
+}
+
+// readReviewBody returns the body of the given review request. It
+// responds with an error & returns false if the request is invalid.
+func readReviewBody(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if contentType := req.Header.Get("Content-Type"); contentType != "application/json" {
+		http.Error(
+			w, fmt.Sprintf("Unsupported content type %q", contentType),
+			http.StatusUnsupportedMediaType,
+		)
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Read body failed: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+// writeReview writes the given review as the response
+func writeReview(w http.ResponseWriter, review interface{}) {
+	out, err := json.Marshal(review)
+	if err != nil {
+		http.Error(
+			w, fmt.Sprintf("Encode review failed: %v", err),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(out); err != nil {
+		klog.Errorf("Write review failed: %v", err)
+	}
+}
+
+// toErrorResponse returns an admission response that rejects the
+// request with the given error
+func toErrorResponse(err apierrs.APIStatus) *admission.AdmissionResponse {
+	status := err.Status()
+	return &admission.AdmissionResponse{
+		Allowed: false,
+		Result:  &status,
+	}
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	admission "k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func newIndexer(t *testing.T, objs ...interface{}) cache.Indexer {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+	})
+	for _, obj := range objs {
+		if err := indexer.Add(obj); err != nil {
+			t.Fatalf("Add %v to indexer failed: %v", obj, err)
+		}
+	}
+	return indexer
+}
+
+func newStorageClass(name, provisioner string, isDefault bool) *storagev1.StorageClass {
+	sc := &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: name},
+		Provisioner: provisioner,
+	}
+	if isDefault {
+		sc.Annotations = map[string]string{
+			"storageclass.kubernetes.io/is-default-class": "true",
+		}
+	}
+	return sc
+}
+
+func newNode(name string) *v1.Node {
+	return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+func newStorage(capacity string, spec ddp.StorageSpec) *ddp.Storage {
+	spec.Capacity = resource.MustParse(capacity)
+	return &ddp.Storage{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: ddp.SchemeGroupVersion.String(),
+			Kind:       "Storage",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: "stor", Namespace: "default"},
+		Spec:       spec,
+	}
+}
+
+// newTestServer returns a TLS server that serves the webhooks with
+// listers having the given storageclasses & nodes
+func newTestServer(
+	t *testing.T, scs []*storagev1.StorageClass, nodes []*v1.Node,
+) *httptest.Server {
+
+	var scObjs, nodeObjs []interface{}
+	for _, sc := range scs {
+		scObjs = append(scObjs, sc)
+	}
+	for _, node := range nodes {
+		nodeObjs = append(nodeObjs, node)
+	}
+	scLister := storagev1listers.NewStorageClassLister(newIndexer(t, scObjs...))
+	nodeLister := corelisters.NewNodeLister(newIndexer(t, nodeObjs...))
+
+	server := &Server{
+		Validator: &StorageValidator{
+			StorageClassLister: scLister,
+			NodeLister:         nodeLister,
+		},
+		Defaulter: &StorageDefaulter{StorageClassLister: scLister},
+		Converter: &StorageConverter{},
+	}
+	return httptest.NewTLSServer(server.Handler())
+}
+
+func newAdmissionRequest(
+	t *testing.T, op admission.Operation, stor, old *ddp.Storage,
+) *admission.AdmissionRequest {
+
+	req := &admission.AdmissionRequest{
+		UID:       types.UID("uid-" + strings.ToLower(string(op))),
+		Kind:      metav1.GroupVersionKind(ddp.SchemeGroupVersion.WithKind("Storage")),
+		Name:      stor.Name,
+		Namespace: stor.Namespace,
+		Operation: op,
+	}
+	raw, err := json.Marshal(stor)
+	if err != nil {
+		t.Fatalf("Encode storage failed: %v", err)
+	}
+	req.Object = runtime.RawExtension{Raw: raw}
+	if old != nil {
+		raw, err := json.Marshal(old)
+		if err != nil {
+			t.Fatalf("Encode old storage failed: %v", err)
+		}
+		req.OldObject = runtime.RawExtension{Raw: raw}
+	}
+	return req
+}
+
+// postReview posts the given admission request to the given path of
+// the given server & returns the response of the review
+func postReview(
+	t *testing.T, srv *httptest.Server, path string, req *admission.AdmissionRequest,
+) *admission.AdmissionResponse {
+
+	body, err := json.Marshal(&admission.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admission.SchemeGroupVersion.String(),
+			Kind:       "AdmissionReview",
+		},
+		Request: req,
+	})
+	if err != nil {
+		t.Fatalf("Encode admission review failed: %v", err)
+	}
+
+	resp, err := srv.Client().Post(srv.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Post admission review failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	review := &admission.AdmissionReview{}
+	if err := json.NewDecoder(resp.Body).Decode(review); err != nil {
+		t.Fatalf("Decode admission review failed: %v", err)
+	}
+	if review.Request != nil {
+		t.Fatalf("Expected no request in review got %v", review.Request)
+	}
+	if review.Response == nil {
+		t.Fatalf("Expected response in review got none")
+	}
+	if review.Response.UID != req.UID {
+		t.Fatalf("Expected response uid %q got %q", req.UID, review.Response.UID)
+	}
+	return review.Response
+}
+
+func TestServerRejectsInvalidReviewRequest(t *testing.T) {
+	srv := newTestServer(t, nil, nil)
+	defer srv.Close()
+
+	var tests = map[string]struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+	}{
+		"get": {
+			method:      http.MethodGet,
+			path:        ValidateStoragePath,
+			contentType: "application/json",
+			status:      http.StatusMethodNotAllowed,
+		},
+		"unsupported content type": {
+			method:      http.MethodPost,
+			path:        ValidateStoragePath,
+			contentType: "text/plain",
+			body:        "{}",
+			status:      http.StatusUnsupportedMediaType,
+		},
+		"invalid body": {
+			method:      http.MethodPost,
+			path:        DefaultStoragePath,
+			contentType: "application/json",
+			body:        "{",
+			status:      http.StatusBadRequest,
+		},
+		"admission review without request": {
+			method:      http.MethodPost,
+			path:        ValidateStoragePath,
+			contentType: "application/json",
+			body:        `{"kind":"AdmissionReview"}`,
+			status:      http.StatusBadRequest,
+		},
+		"conversion review without request": {
+			method:      http.MethodPost,
+			path:        ConvertStoragePath,
+			contentType: "application/json",
+			body:        `{"kind":"ConversionReview"}`,
+			status:      http.StatusBadRequest,
+		},
+		"unknown path": {
+			method:      http.MethodPost,
+			path:        "/unknown",
+			contentType: "application/json",
+			body:        "{}",
+			status:      http.StatusNotFound,
+		},
+	}
+	for name, mock := range tests {
+		name, mock := name, mock
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(mock.method, srv.URL+mock.path, strings.NewReader(mock.body))
+			if err != nil {
+				t.Fatalf("Expected no error got %v", err)
+			}
+			req.Header.Set("Content-Type", mock.contentType)
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatalf("Expected no error got %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != mock.status {
+				t.Fatalf("Expected status %d got %d", mock.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestServerWithoutOptionalWebhooks(t *testing.T) {
+	server := &Server{Validator: &StorageValidator{}}
+	srv := httptest.NewTLSServer(server.Handler())
+	defer srv.Close()
+
+	for _, path := range []string{DefaultStoragePath, ConvertStoragePath} {
+		resp, err := srv.Client().Post(srv.URL+path, "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("Expected no error got %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: Expected status %d got %d", path, http.StatusNotFound, resp.StatusCode)
+		}
+	}
+}
+
+func TestServerRunWithoutValidator(t *testing.T) {
+	server := &Server{Addr: ":0"}
+	if err := server.Run(make(chan struct{})); err == nil {
+		t.Fatalf("Expected error got none")
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	admission "k8s.io/api/admission/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/klog"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+	"github.com/mayadata-io/storage-provisioner/storage"
+)
+
+// StorageValidator admits a storage only if it can be reconciled by
+// the storage controller. Besides the validation done by the storage
+// controller, it verifies if the referred storageclass & nodes exist.
+type StorageValidator struct {
+	StorageClassLister storagev1listers.StorageClassLister
+	NodeLister         corelisters.NodeLister
+}
+
+// ServeHTTP implements http.Handler interface. It decodes the
+// admission review from the request & responds with the review
+// that has the outcome of validation.
+func (v *StorageValidator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	serveAdmissionReview(w, req, v.Validate)
+}
+
+// Validate returns the admission response to the given request
+func (v *StorageValidator) Validate(
+	req *admission.AdmissionRequest,
+) *admission.AdmissionResponse {
+
+	stor := &ddp.Storage{}
+	if err := json.Unmarshal(req.Object.Raw, stor); err != nil {
+		return toErrorResponse(
+			apierrs.NewBadRequest(errors.Wrapf(err, "Decode storage failed").Error()),
+		)
+	}
+	stor.Namespace = req.Namespace
+
+	var allErrs field.ErrorList
+	switch req.Operation {
+	case admission.Create:
+		allErrs = storage.ValidateStorage(stor)
+		allErrs = append(allErrs, v.validateReferences(stor, nil)...)
+	case admission.Update:
+		if stor.DeletionTimestamp != nil {
+			// finalizers must be removable even if the storage has
+			// become invalid
+			return &admission.AdmissionResponse{Allowed: true}
+		}
+		old := &ddp.Storage{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return toErrorResponse(
+				apierrs.NewBadRequest(errors.Wrapf(err, "Decode old storage failed").Error()),
+			)
+		}
+		allErrs = storage.ValidateStorageUpdate(stor, old)
+		allErrs = append(allErrs, v.validateReferences(stor, old)...)
+	default:
+		return &admission.AdmissionResponse{Allowed: true}
+	}
+
+	if len(allErrs) != 0 {
+		klog.V(3).Infof(
+			"Rejected %s of storage %s/%s: %v",
+			req.Operation, req.Namespace, req.Name, allErrs.ToAggregate(),
+		)
+		return toErrorResponse(apierrs.NewInvalid(
+			ddp.SchemeGroupVersion.WithKind("Storage").GroupKind(), req.Name, allErrs,
+		))
+	}
+	return &admission.AdmissionResponse{Allowed: true}
+}
+
+// validateReferences verifies if the storageclass & the nodes referred
+// by the given storage exist. Only the references that were changed
+// from the old storage are verified during an update. This lets a
+// storage get updated even after its node is removed.
+func (v *StorageValidator) validateReferences(stor, old *ddp.Storage) field.ErrorList {
+	var allErrs field.ErrorList
+
+	specPath := field.NewPath("spec")
+	provider := storage.FindProviderFromStorage(stor)
+	if old == nil && provider != "" {
+		_, err := v.StorageClassLister.Get(provider)
+		if apierrs.IsNotFound(err) {
+			allErrs = append(allErrs, field.Invalid(
+				specPath.Child("storageClassName"), provider,
+				"storageclass does not exist",
+			))
+		} else if err != nil {
+			allErrs = append(allErrs, field.InternalError(
+				specPath.Child("storageClassName"), err,
+			))
+		}
+	}
+
+	var oldNodeNames []string
+	if old != nil {
+		oldNodeNames = storage.GetNodeNames(old)
+	}
+	nodePath := specPath.Child("nodeName")
+	if len(stor.Spec.NodeNames) != 0 {
+		nodePath = specPath.Child("nodeNames")
+	}
+	for _, nodeName := range storage.GetNodeNames(stor) {
+		if nodeName == "" || storage.ContainsString(oldNodeNames, nodeName) {
+			continue
+		}
+		_, err := v.NodeLister.Get(nodeName)
+		if apierrs.IsNotFound(err) {
+			allErrs = append(allErrs, field.Invalid(
+				nodePath, nodeName, "node does not exist",
+			))
+		} else if err != nil {
+			allErrs = append(allErrs, field.InternalError(nodePath, err))
+		}
+	}
+	return allErrs
+}
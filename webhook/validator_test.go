@@ -0,0 +1,245 @@
+/*
+Copyright 2019 The MayaData Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"net/http"
+	"testing"
+
+	admission "k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ddp "github.com/mayadata-io/storage-provisioner/pkg/apis/dao/v1alpha1"
+)
+
+func TestValidateStorage(t *testing.T) {
+	srv := newTestServer(t, []*storagev1.StorageClass{
+		newStorageClass("csi-gce-pd", "pd.csi.storage.gke.io", false),
+		newStorageClass("standard", "kubernetes.io/gce-pd", true),
+	}, []*v1.Node{
+		newNode("n1"),
+		newNode("n2"),
+	})
+	defer srv.Close()
+
+	var tests = map[string]struct {
+		op    admission.Operation
+		stor  *ddp.Storage
+		old   *ddp.Storage
+		field string // field of the rejected request
+	}{
+		"create": {
+			op: admission.Create,
+			stor: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+				NodeName:         strPtr("n1"),
+			}),
+		},
+		"create with node names": {
+			op: admission.Create,
+			stor: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+				NodeNames:        []string{"n1", "n2"},
+				AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			}),
+		},
+		"create without storageclass": {
+			op:    admission.Create,
+			stor:  newStorage("4Gi", ddp.StorageSpec{}),
+			field: "spec.storageClassName",
+		},
+		"create with unknown storageclass": {
+			op: admission.Create,
+			stor: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("unknown"),
+			}),
+			field: "spec.storageClassName",
+		},
+		"create with unknown node": {
+			op: admission.Create,
+			stor: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+				NodeName:         strPtr("unknown"),
+			}),
+			field: "spec.nodeName",
+		},
+		"create with unknown node in node names": {
+			op: admission.Create,
+			stor: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+				NodeNames:        []string{"n1", "unknown"},
+				AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			}),
+			field: "spec.nodeNames",
+		},
+		"create with zero capacity": {
+			op: admission.Create,
+			stor: newStorage("0", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+			}),
+			field: "spec.capacity",
+		},
+		"create with negative capacity": {
+			op: admission.Create,
+			stor: newStorage("-1Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+			}),
+			field: "spec.capacity",
+		},
+		"update to expand": {
+			op: admission.Update,
+			stor: newStorage("8Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+			}),
+			old: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+			}),
+		},
+		"update with removed node": {
+			op: admission.Update,
+			stor: newStorage("8Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+				NodeName:         strPtr("removed"),
+			}),
+			old: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+				NodeName:         strPtr("removed"),
+			}),
+		},
+		"update with unknown node": {
+			op: admission.Update,
+			stor: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+				NodeName:         strPtr("unknown"),
+			}),
+			old: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+				NodeName:         strPtr("n1"),
+			}),
+			field: "spec.nodeName",
+		},
+		"update to shrink": {
+			op: admission.Update,
+			stor: newStorage("2Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+			}),
+			old: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+			}),
+			field: "spec.capacity",
+		},
+		"update storageclass": {
+			op: admission.Update,
+			stor: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("standard"),
+			}),
+			old: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+			}),
+			field: "spec.storageClassName",
+		},
+		"update access modes": {
+			op: admission.Update,
+			stor: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+				AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			}),
+			old: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+			}),
+			field: "spec.accessModes",
+		},
+		"update source": {
+			op: admission.Update,
+			stor: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+				Source: &ddp.StorageSource{
+					Storage: &v1.LocalObjectReference{Name: "src"},
+				},
+			}),
+			old: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+			}),
+			field: "spec.source",
+		},
+		"update storage being deleted": {
+			op: admission.Update,
+			stor: func() *ddp.Storage {
+				stor := newStorage("0", ddp.StorageSpec{})
+				now := metav1.Now()
+				stor.DeletionTimestamp = &now
+				return stor
+			}(),
+			old: newStorage("4Gi", ddp.StorageSpec{
+				StorageClassName: strPtr("csi-gce-pd"),
+			}),
+		},
+		"delete": {
+			op:   admission.Delete,
+			stor: newStorage("0", ddp.StorageSpec{}),
+		},
+	}
+	for name, mock := range tests {
+		name, mock := name, mock
+		t.Run(name, func(t *testing.T) {
+			resp := postReview(
+				t, srv, ValidateStoragePath, newAdmissionRequest(t, mock.op, mock.stor, mock.old),
+			)
+			if mock.field == "" {
+				if !resp.Allowed {
+					t.Fatalf("Expected allowed got rejected: %v", resp.Result)
+				}
+				return
+			}
+			if resp.Allowed {
+				t.Fatalf("Expected rejected got allowed")
+			}
+			if resp.Result == nil || resp.Result.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("Expected invalid result got %v", resp.Result)
+			}
+			if resp.Result.Details == nil {
+				t.Fatalf("Expected details of result got none")
+			}
+			var fields []string
+			for _, cause := range resp.Result.Details.Causes {
+				if cause.Field == mock.field {
+					return
+				}
+				fields = append(fields, cause.Field)
+			}
+			t.Fatalf("Expected cause %s got %v", mock.field, fields)
+		})
+	}
+}
+
+func TestValidateStorageWithInvalidObject(t *testing.T) {
+	srv := newTestServer(t, nil, nil)
+	defer srv.Close()
+
+	req := newAdmissionRequest(t, admission.Create, newStorage("4Gi", ddp.StorageSpec{}), nil)
+	req.Object.Raw = []byte(`{"spec":{"capacity":"invalid"}}`)
+
+	resp := postReview(t, srv, ValidateStoragePath, req)
+	if resp.Allowed {
+		t.Fatalf("Expected rejected got allowed")
+	}
+	if resp.Result == nil || resp.Result.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request result got %v", resp.Result)
+	}
+}